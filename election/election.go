@@ -0,0 +1,293 @@
+// Package election elects a leader among processes whose stores share a persister. The leader holds
+// a key with a TTL and renews it with heartbeats; if it stops, the key expires and another candidate
+// takes it. Candidates hold a lock shared by every process, such as a persistence.FileLock in the
+// shared data folder, while they campaign, reloading the key from the persister and flushing their
+// claim before releasing it, so two processes cannot both take the key.
+package election
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Locker is a lock shared by every candidate of an election, across processes. persistence.FileLock
+// implements it with an flock on a file.
+type Locker interface {
+	Lock() error
+	Unlock() error
+}
+
+// Election campaigns for leadership on behalf of one candidate until it is closed.
+type Election struct {
+	store     *kvstore.Store
+	locker    Locker
+	key       string
+	ttl       time.Duration
+	heartbeat time.Duration
+	id        string
+	onElected func()
+	onDemoted func()
+
+	lock   sync.Mutex
+	leader bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Option is a type for functions that configure an Election.
+type Option func(e *Election)
+
+// WithIDOption returns an Option that sets the candidate's identity, which is stored as the value of the
+// election key while it leads. By default a unique ID is generated from the host name and process ID.
+//
+// Example:
+//
+//	election.New(store, lock, "leader:billing", 10*time.Second, WithIDOption("billing-1"))
+func WithIDOption(id string) Option {
+	return func(e *Election) {
+		e.id = id
+	}
+}
+
+// WithOnElectedOption returns an Option that calls fn when the candidate becomes the leader.
+// Callbacks run on the election's goroutine, so heartbeats wait until they return.
+//
+// Example:
+//
+//	election.New(store, lock, "leader:billing", 10*time.Second, WithOnElectedOption(startJobs))
+func WithOnElectedOption(fn func()) Option {
+	return func(e *Election) {
+		e.onElected = fn
+	}
+}
+
+// WithOnDemotedOption returns an Option that calls fn when the candidate stops being the leader,
+// either because it could not renew the key in time or because the election was closed.
+//
+// Example:
+//
+//	election.New(store, lock, "leader:billing", 10*time.Second, WithOnDemotedOption(stopJobs))
+func WithOnDemotedOption(fn func()) Option {
+	return func(e *Election) {
+		e.onDemoted = fn
+	}
+}
+
+// WithHeartbeatOption returns an Option that sets how often the leader renews the election key and
+// other candidates check whether it has expired. It defaults to a third of the TTL.
+//
+// Example:
+//
+//	election.New(store, lock, "leader:billing", 10*time.Second, WithHeartbeatOption(2*time.Second))
+func WithHeartbeatOption(interval time.Duration) Option {
+	return func(e *Election) {
+		e.heartbeat = interval
+	}
+}
+
+// New starts campaigning for leadership of key. The leader's claim lasts for ttl, which is rounded up
+// to whole seconds, and is renewed on every heartbeat. locker must be shared by every candidate,
+// in this process and others, such as a persistence.FileLock on the same file.
+//
+// Example:
+//
+//	lock := persistence.NewFileLock(path.Join("./data", ".election.lock"))
+//	e, err := election.New(store, lock, "leader:billing", 10*time.Second)
+func New(store *kvstore.Store, locker Locker, key string, ttl time.Duration, options ...Option) (*Election, error) {
+	if !kvstore.KeyValid(key) {
+		return nil, kvstore.ErrKeyInvalid
+	}
+	if ttl < time.Second {
+		return nil, errors.New("election.New ttl must be at least one second")
+	}
+
+	e := &Election{
+		store:     store,
+		locker:    locker,
+		key:       key,
+		ttl:       ttl,
+		heartbeat: ttl / 3,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(e)
+	}
+	if e.heartbeat <= 0 || e.heartbeat >= ttl {
+		return nil, errors.New("election.New heartbeat must be positive and shorter than the ttl")
+	}
+	if e.id == "" {
+		id, err := defaultID()
+		if err != nil {
+			return nil, errors.Wrap(err, "election.New")
+		}
+		e.id = id
+	}
+
+	go e.run()
+	return e, nil
+}
+
+// defaultID returns a candidate ID that is unique across hosts, processes and elections.
+func defaultID() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(suffix)), nil
+}
+
+// ID returns the candidate's identity.
+func (e *Election) ID() string {
+	return e.id
+}
+
+// IsLeader reports whether the candidate currently leads.
+func (e *Election) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leader
+}
+
+// Leader returns the ID of the current leader, or kvstore.ErrNotFound if there is none.
+func (e *Election) Leader() (string, error) {
+	if err := e.store.Reload(e.key); err != nil {
+		return "", errors.Wrap(err, "Election.Leader")
+	}
+	value, err := e.store.Get(e.key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// Close stops campaigning. If the candidate leads it gives up the key, so another candidate can
+// take over without waiting for the TTL to expire.
+func (e *Election) Close() error {
+	close(e.stop)
+	<-e.done
+
+	if !e.IsLeader() {
+		return nil
+	}
+	defer e.setLeader(false)
+	if err := e.locker.Lock(); err != nil {
+		return errors.Wrap(err, "Election.Close")
+	}
+	defer e.unlock()
+	if held, err := e.held(); err != nil || !held {
+		return errors.Wrap(err, "Election.Close")
+	}
+	if err := e.store.Delete(e.key); err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+		return errors.Wrap(err, "Election.Close")
+	}
+	return errors.Wrap(e.store.Flush(), "Election.Close")
+}
+
+// run campaigns on every heartbeat until the election is closed.
+func (e *Election) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.heartbeat)
+	defer ticker.Stop()
+	for {
+		e.campaign()
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// campaign takes the key if it is free, or renews it if the candidate already holds it.
+func (e *Election) campaign() {
+	leader, err := e.claim()
+	if err != nil {
+		log.Error().Msgf("[kvstore election] %s error: %s", e.key, err.Error())
+	}
+	e.setLeader(leader)
+}
+
+// claim takes or renews the key under the election lock, reporting whether the candidate holds it.
+// The key is reloaded from the persister first, to see claims made by other processes, and the
+// claim is flushed to it before the lock is released.
+func (e *Election) claim() (bool, error) {
+	if err := e.locker.Lock(); err != nil {
+		return false, errors.Wrap(err, "Election lock")
+	}
+	defer e.unlock()
+	if err := e.store.Reload(e.key); err != nil {
+		return false, errors.Wrap(err, "Election reload")
+	}
+
+	ok, err := e.store.SetNX(e.key, []byte(e.id), kvstore.WithTTLSetOption(e.ttl))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		info, err := e.store.GetMetadata(e.key)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if held, err := e.held(); err != nil || !held {
+			return false, err
+		}
+		err = e.store.SetIfMatch(e.key, []byte(e.id), info.ETag, kvstore.WithTTLSetOption(e.ttl))
+		if errors.Is(err, kvstore.ErrETagMismatch) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if err := e.store.Flush(); err != nil {
+		return false, errors.Wrap(err, "Election flush")
+	}
+	return true, nil
+}
+
+// held reports whether the key holds the candidate's ID. The caller must hold the election lock.
+func (e *Election) held() (bool, error) {
+	value, err := e.store.Get(e.key)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(value) == e.id, nil
+}
+
+func (e *Election) unlock() {
+	if err := e.locker.Unlock(); err != nil {
+		log.Error().Msgf("[kvstore election] %s error releasing lock: %s", e.key, err.Error())
+	}
+}
+
+// setLeader records whether the candidate leads and calls the callback for a change.
+func (e *Election) setLeader(leader bool) {
+	e.lock.Lock()
+	changed := e.leader != leader
+	e.leader = leader
+	e.lock.Unlock()
+	if !changed {
+		return
+	}
+	if leader && e.onElected != nil {
+		e.onElected()
+	} else if !leader && e.onDemoted != nil {
+		e.onDemoted()
+	}
+}
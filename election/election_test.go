@@ -0,0 +1,76 @@
+package election_test
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/election"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElection(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0))
+	require.NoError(t, err)
+	defer s.Close()
+	lock := filepath.Join(t.TempDir(), "election.lock")
+
+	var elected, demoted atomic.Int32
+	first, err := election.New(s, persistence.NewFileLock(lock), "leader:jobs", time.Second,
+		election.WithIDOption("first"),
+		election.WithOnElectedOption(func() { elected.Add(1) }),
+		election.WithOnDemotedOption(func() { demoted.Add(1) }),
+	)
+	require.NoError(t, err)
+	require.Eventually(t, first.IsLeader, time.Second, 10*time.Millisecond)
+
+	second, err := election.New(s, persistence.NewFileLock(lock), "leader:jobs", time.Second, election.WithIDOption("second"))
+	require.NoError(t, err)
+	defer second.Close()
+	time.Sleep(1500 * time.Millisecond)
+	require.True(t, first.IsLeader())
+	require.False(t, second.IsLeader())
+	leader, err := second.Leader()
+	require.NoError(t, err)
+	require.Equal(t, "first", leader)
+
+	require.NoError(t, first.Close())
+	require.False(t, first.IsLeader())
+	require.Equal(t, int32(1), elected.Load())
+	require.Equal(t, int32(1), demoted.Load())
+	require.Eventually(t, second.IsLeader, time.Second, 10*time.Millisecond)
+
+	_, err = election.New(s, persistence.NewFileLock(lock), "leader:jobs", 100*time.Millisecond)
+	require.Error(t, err)
+}
+
+func TestElectionAcrossStores(t *testing.T) {
+	folder := t.TempDir()
+	lock := filepath.Join(t.TempDir(), "election.lock")
+	candidates := make([]*election.Election, 2)
+	for i, id := range []string{"first", "second"} {
+		s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+		require.NoError(t, err)
+		defer s.Close()
+		candidates[i], err = election.New(s, persistence.NewFileLock(lock), "leader:jobs", time.Second,
+			election.WithIDOption(id), election.WithHeartbeatOption(20*time.Millisecond))
+		require.NoError(t, err)
+	}
+	first, second := candidates[0], candidates[1]
+
+	require.Eventually(t, func() bool { return first.IsLeader() || second.IsLeader() }, time.Second, 10*time.Millisecond)
+	for i := 0; i < 50; i++ {
+		require.False(t, first.IsLeader() && second.IsLeader())
+		time.Sleep(10 * time.Millisecond)
+	}
+	leader, follower := first, second
+	if second.IsLeader() {
+		leader, follower = second, first
+	}
+	defer follower.Close()
+	require.NoError(t, leader.Close())
+	require.Eventually(t, follower.IsLeader, time.Second, 10*time.Millisecond)
+}
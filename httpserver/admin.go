@@ -0,0 +1,191 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+)
+
+const (
+	adminPath        = "/admin"
+	adminStatsPath   = adminPath + "/stats"
+	adminKeysPath    = adminPath + "/keys"
+	adminTTLPath     = adminPath + "/ttl/"
+	adminFlushPath   = adminPath + "/flush"
+	adminCompactPath = adminPath + "/compact"
+)
+
+// Page sizes of the admin key listing.
+const (
+	defaultPageSize = 100
+	maximumPageSize = 1000
+)
+
+// WithAdminTokenOption returns a ServerOption that enables the /admin endpoints, accessible only with token
+// sent as "Authorization: Bearer <token>". Admin requests act on the whole store and bypass its ACL.
+// The endpoints are:
+//
+//	GET  /admin/stats              store statistics
+//	GET  /admin/keys?after=&limit= keys with their metadata, in pages ordered by key
+//	PUT  /admin/ttl/{key}?ttl=     set a key's time-to-live in seconds
+//	POST /admin/flush              flush the persisters
+//	POST /admin/compact            compact the persisters
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithAdminTokenOption(os.Getenv("KVSTORE_ADMIN_TOKEN")))
+func WithAdminTokenOption(token string) ServerOption {
+	return func(s *Server) {
+		hash := sha256.Sum256([]byte(token))
+		s.adminToken = &hash
+	}
+}
+
+// keyInfo is the JSON representation of a key and its metadata in the admin key listing.
+type keyInfo struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	ETag        string            `json:"etag"`
+	Timestamp   time.Time         `json:"timestamp"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	AccessedAt  time.Time         `json:"accessedAt"`
+	TTL         kvstore.TTLType   `json:"ttl"`
+	Loaded      bool              `json:"loaded"`
+}
+
+// keyPage is a page of the admin key listing. Next is the value of the after parameter for the
+// following page, and is empty on the last page.
+type keyPage struct {
+	Keys []keyInfo `json:"keys"`
+	Next string    `json:"next,omitempty"`
+}
+
+// registerAdmin mounts the admin endpoints if an admin token is configured.
+func (s *Server) registerAdmin() {
+	if s.adminToken == nil {
+		return
+	}
+	s.mux.Handle(adminStatsPath, s.admin(http.MethodGet, s.handleStats))
+	s.mux.Handle(adminKeysPath, s.admin(http.MethodGet, s.handleKeyBrowser))
+	s.mux.Handle(adminTTLPath, s.admin(http.MethodPut, s.handleTTL))
+	s.mux.Handle(adminFlushPath, s.admin(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		s.runMaintenance(w, s.store.Flush)
+	}))
+	s.mux.Handle(adminCompactPath, s.admin(http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+		s.runMaintenance(w, s.store.Compact)
+	}))
+	if s.dashboard {
+		s.registerDashboard()
+	}
+}
+
+// admin checks the method and admin token of a request before passing it to next.
+func (s *Server) admin(method string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		hash := sha256.Sum256([]byte(token))
+		if subtle.ConstantTimeCompare(hash[:], s.adminToken[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kvstore admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleStats writes the store's statistics.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.store.Stats())
+}
+
+// handleKeyBrowser writes a page of keys with their metadata.
+func (s *Server) handleKeyBrowser(w http.ResponseWriter, r *http.Request) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maximumPageSize)
+	}
+	after := r.URL.Query().Get("after")
+
+	keys, err := s.store.Keys()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, after)
+	if start < len(keys) && keys[start] == after {
+		start++
+	}
+
+	page := keyPage{Keys: make([]keyInfo, 0, limit)}
+	for _, k := range keys[start:] {
+		if len(page.Keys) == limit {
+			page.Next = page.Keys[len(page.Keys)-1].Key
+			break
+		}
+		info, err := s.store.GetMetadata(k)
+		if err != nil {
+			continue
+		}
+		page.Keys = append(page.Keys, keyInfo{
+			Key:         k,
+			ContentType: info.ContentType,
+			Meta:        info.Meta,
+			ETag:        info.ETag,
+			Timestamp:   info.UpdatedAt,
+			CreatedAt:   info.CreatedAt,
+			AccessedAt:  info.AccessedAt,
+			TTL:         s.store.TTL(k),
+			Loaded:      info.Loaded,
+		})
+	}
+	writeJSON(w, page)
+}
+
+// handleTTL sets the time-to-live of a key.
+func (s *Server) handleTTL(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, adminTTLPath)
+	ttl, err := strconv.ParseInt(r.URL.Query().Get("ttl"), 10, 64)
+	if err != nil {
+		http.Error(w, "ttl must be a number of seconds", http.StatusBadRequest)
+		return
+	}
+	if err := s.store.SetTTL(key, ttl); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runMaintenance runs a maintenance operation and reports its outcome.
+func (s *Server) runMaintenance(w http.ResponseWriter, operation func() error) {
+	if err := operation(); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
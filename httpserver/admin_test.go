@@ -0,0 +1,81 @@
+package httpserver_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/httpserver"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminEndpoints(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, store.Set(k, []byte(k)))
+	}
+	srv := httptest.NewServer(httpserver.New(store,
+		httpserver.WithTokenOption("user", "user"),
+		httpserver.WithAdminTokenOption("admin"),
+	))
+	defer srv.Close()
+
+	require.Equal(t, http.StatusUnauthorized, request(t, srv, http.MethodGet, "/admin/stats", "user", "").StatusCode)
+
+	resp := request(t, srv, http.MethodGet, "/admin/stats", "admin", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats kvstore.Stats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.Equal(t, 3, stats.Keys)
+
+	var page struct {
+		Keys []struct {
+			Key string `json:"key"`
+			TTL int64  `json:"ttl"`
+		} `json:"keys"`
+		Next string `json:"next"`
+	}
+	resp = request(t, srv, http.MethodGet, "/admin/keys?limit=2", "admin", "")
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	require.Len(t, page.Keys, 2)
+	require.Equal(t, "b", page.Next)
+	resp = request(t, srv, http.MethodGet, "/admin/keys?limit=2&after=b", "admin", "")
+	page.Next = ""
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	require.Len(t, page.Keys, 1)
+	require.Equal(t, "c", page.Keys[0].Key)
+	require.Empty(t, page.Next)
+
+	require.Equal(t, http.StatusNoContent, request(t, srv, http.MethodPut, "/admin/ttl/c?ttl=60", "admin", "").StatusCode)
+	require.Equal(t, kvstore.TTLType(60), store.TTL("c"))
+	require.Equal(t, http.StatusNoContent, request(t, srv, http.MethodPost, "/admin/flush", "admin", "").StatusCode)
+	require.Equal(t, http.StatusNoContent, request(t, srv, http.MethodPost, "/admin/compact", "admin", "").StatusCode)
+}
+
+func TestDashboard(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, store.Set("big", []byte("0123456789")))
+	_, err = store.Get("big")
+	require.NoError(t, err)
+	srv := httptest.NewServer(httpserver.New(store, httpserver.WithAdminTokenOption("admin"), httpserver.WithDashboardOption()))
+	defer srv.Close()
+
+	resp := request(t, srv, http.MethodGet, "/admin/dashboard/", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+
+	require.Equal(t, http.StatusUnauthorized, request(t, srv, http.MethodGet, "/admin/insights", "", "").StatusCode)
+	resp = request(t, srv, http.MethodGet, "/admin/insights", "admin", "")
+	var insights struct {
+		HottestKeys []kvstore.KeyStats `json:"hottestKeys"`
+		LargestKeys []kvstore.KeySize  `json:"largestKeys"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&insights))
+	require.Equal(t, []kvstore.KeySize{{Key: "big", Size: 10}}, insights.LargestKeys)
+	require.Len(t, insights.HottestKeys, 1)
+	require.Equal(t, uint64(1), insights.HottestKeys[0].Hits)
+}
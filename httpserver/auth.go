@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+)
+
+// WithTokenOption returns a ServerOption that accepts an API token, sent as "Authorization: Bearer <token>",
+// and serves its requests as identity. Scope the identity to namespaces by granting it permissions on the
+// store's ACL. Once any authentication is configured, requests without valid credentials are rejected.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithTokenOption(os.Getenv("BILLING_TOKEN"), "billing-service"))
+func WithTokenOption(token, identity string) ServerOption {
+	return func(s *Server) {
+		s.tokens[sha256.Sum256([]byte(token))] = identity
+	}
+}
+
+// WithClientCertAuthOption returns a ServerOption that accepts verified TLS client certificates,
+// serving their requests as the certificate's subject common name. The server must be configured
+// to request and verify client certificates for mutual TLS.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithClientCertAuthOption())
+func WithClientCertAuthOption() ServerOption {
+	return func(s *Server) {
+		s.clientCertAuth = true
+	}
+}
+
+// scopedHandler handles a request on behalf of an authenticated caller.
+type scopedHandler func(w http.ResponseWriter, r *http.Request, caller *kvstore.ScopedStore)
+
+// authenticated identifies the caller of each request and applies its rate limit before passing it to next.
+func (s *Server) authenticated(next scopedHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := s.identify(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kvstore"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		if !s.allow(w, r, identity) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next(w, r, s.store.As(identity))
+	})
+}
+
+// identify returns the identity of the caller. Requests are anonymous when no authentication is configured.
+func (s *Server) identify(r *http.Request) (string, bool) {
+	if len(s.tokens) == 0 && !s.clientCertAuth {
+		return "", true
+	}
+
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		identity, ok := s.tokens[sha256.Sum256([]byte(token))]
+		return identity, ok
+	}
+
+	if s.clientCertAuth && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", false
+}
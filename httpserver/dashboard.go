@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	_ "embed"
+	"net/http"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+)
+
+const (
+	adminDashboardPath = adminPath + "/dashboard/"
+	adminInsightsPath  = adminPath + "/insights"
+)
+
+// insightsLimit is the number of keys listed in each section of the insights.
+const insightsLimit = 20
+
+// expiringWithin is how soon a key must expire to be listed as expiring soon.
+const expiringWithin = time.Hour
+
+//go:embed dashboard/index.html
+var dashboardPage []byte
+
+// WithDashboardOption returns a ServerOption that serves a web dashboard at /admin/dashboard/, showing the
+// store's hit rate, memory usage, most read and largest keys and keys expiring soon. The page itself holds no data: it asks
+// for the admin token and reads the admin endpoints, so the dashboard requires WithAdminTokenOption.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithAdminTokenOption(token), httpserver.WithDashboardOption())
+func WithDashboardOption() ServerOption {
+	return func(s *Server) {
+		s.dashboard = true
+	}
+}
+
+// insights is the JSON served to the dashboard alongside the store statistics.
+type insights struct {
+	HottestKeys  []kvstore.KeyStats  `json:"hottestKeys"`
+	LargestKeys  []kvstore.KeySize   `json:"largestKeys"`
+	ExpiringKeys []kvstore.KeyExpiry `json:"expiringKeys"`
+}
+
+// registerDashboard mounts the dashboard page and the insights endpoint.
+func (s *Server) registerDashboard() {
+	s.mux.HandleFunc(adminDashboardPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		_, _ = w.Write(dashboardPage)
+	})
+	s.mux.Handle(adminInsightsPath, s.admin(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, insights{
+			HottestKeys:  s.store.TopKeys(insightsLimit, kvstore.ByHits),
+			LargestKeys:  s.store.LargestKeys(insightsLimit),
+			ExpiringKeys: s.store.ExpiringKeys(insightsLimit, expiringWithin),
+		})
+	}))
+}
@@ -0,0 +1,59 @@
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/limits"
+	"github.com/rs/zerolog/log"
+)
+
+// WithRateLimitOption returns a ServerOption that allows each client at most limit requests per window,
+// rejecting further requests with 429 Too Many Requests. Requests are counted once authenticated, so
+// requests with invalid credentials never use a client's quota. Clients are identified by their caller
+// identity, or by IP address when no authentication is configured. Requests are counted with window
+// counters in counters, which is typically a memory-only store so that counting requests does not write
+// to the persisters. The eviction frequency of counters is set to window, so the counters of clients
+// that stop sending requests are deleted once their window ends.
+//
+// Example:
+//
+//	counters, _ := kvstore.New()
+//	httpserver.New(store, httpserver.WithRateLimitOption(counters, 100, time.Second))
+func WithRateLimitOption(counters *kvstore.Store, limit int64, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.rateLimiter = limits.NewRateLimiter(counters, limit, window)
+	}
+}
+
+// WithMaxConnectionsOption returns a ServerOption that limits the number of simultaneous connections
+// accepted by ListenAndServe. Further connections wait until an existing one is closed, or until the
+// server is shut down.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithMaxConnectionsOption(1000))
+func WithMaxConnectionsOption(n int) ServerOption {
+	return func(s *Server) {
+		s.maxConnections = n
+	}
+}
+
+// allow counts a request from a client and reports whether it is within the rate limit.
+// When the limit is exceeded the Retry-After header is set to the end of the current window.
+func (s *Server) allow(w http.ResponseWriter, r *http.Request, identity string) bool {
+	client := identity
+	if client == "" {
+		client = limits.RemoteIP(r.RemoteAddr)
+	}
+	allowed, retryAfter, err := s.rateLimiter.Allow(client)
+	if err != nil {
+		log.Error().Msgf("[kvstore httpserver] error counting requests for %s error: %s", client, err.Error())
+	}
+	if !allowed && retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+	return allowed
+}
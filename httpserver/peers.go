@@ -0,0 +1,157 @@
+package httpserver
+
+import (
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// defaultReplicas is the number of points each peer has on the hash ring, which evens out the share of keys each owns.
+const defaultReplicas = 50
+
+// defaultPeerTimeout bounds a fill request, after which the store falls back to its persister.
+const defaultPeerTimeout = 2 * time.Second
+
+// PeerPool assigns each key to one of a set of store instances by consistent hashing, and fetches
+// values from the owning instance's REST API. It implements kvstore.PeerFiller, so a store created
+// with kvstore.WithPeerFillOption asks the owner of a key for its value before reading the persister.
+// Adding or removing a peer only moves the keys of the peers next to it on the ring.
+type PeerPool struct {
+	self     string
+	token    string
+	client   *http.Client
+	replicas int
+	lock     sync.RWMutex
+	ring     []uint32
+	owners   map[uint32]string
+}
+
+// PeerPoolOption is a type for functions that configure a PeerPool.
+type PeerPoolOption func(p *PeerPool)
+
+// WithPeerTokenOption returns a PeerPoolOption that sends token as a bearer token with fill requests.
+// The token's identity needs read permission on the keys in the owning server's ACL.
+//
+// Example:
+//
+//	NewPeerPool("http://10.0.0.1:8080", WithPeerTokenOption(os.Getenv("PEER_TOKEN")))
+func WithPeerTokenOption(token string) PeerPoolOption {
+	return func(p *PeerPool) {
+		p.token = token
+	}
+}
+
+// WithPeerClientOption returns a PeerPoolOption that makes fill requests with client, such as to
+// configure TLS or change the default two second timeout.
+//
+// Example:
+//
+//	NewPeerPool("https://10.0.0.1:8443", WithPeerClientOption(&http.Client{Transport: mtlsTransport}))
+func WithPeerClientOption(client *http.Client) PeerPoolOption {
+	return func(p *PeerPool) {
+		p.client = client
+	}
+}
+
+// WithPeerReplicasOption returns a PeerPoolOption that sets how many points each peer has on the hash ring.
+//
+// Example:
+//
+//	NewPeerPool("http://10.0.0.1:8080", WithPeerReplicasOption(200))
+func WithPeerReplicasOption(n int) PeerPoolOption {
+	return func(p *PeerPool) {
+		if n > 0 {
+			p.replicas = n
+		}
+	}
+}
+
+// NewPeerPool creates a pool for the instance whose API is served at the base URL self.
+// Until Set is called the instance owns every key.
+func NewPeerPool(self string, options ...PeerPoolOption) *PeerPool {
+	p := &PeerPool{
+		self:     strings.TrimSuffix(self, "/"),
+		client:   &http.Client{Timeout: defaultPeerTimeout},
+		replicas: defaultReplicas,
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	p.Set()
+	return p
+}
+
+// Set replaces the peers in the pool with the instances at the given base URLs. The pool's own
+// instance is always included.
+func (p *PeerPool) Set(peers ...string) {
+	ring := make([]uint32, 0, (len(peers)+1)*p.replicas)
+	owners := make(map[uint32]string, cap(ring))
+	for _, peer := range append([]string{p.self}, peers...) {
+		peer = strings.TrimSuffix(peer, "/")
+		for i := 0; i < p.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + peer))
+			if _, ok := owners[h]; !ok {
+				ring = append(ring, h)
+			}
+			owners[h] = peer
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i] < ring[j] })
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ring = ring
+	p.owners = owners
+}
+
+// Owner returns the base URL of the instance that owns key.
+func (p *PeerPool) Owner(key string) string {
+	h := crc32.ChecksumIEEE([]byte(key))
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.owners[p.ring[i]]
+}
+
+// Fill fetches the value of key from the instance that owns it. It returns false if this instance
+// owns the key, or if the owner does not have it or cannot be reached.
+func (p *PeerPool) Fill(key string) ([]byte, bool) {
+	owner := p.Owner(key)
+	if owner == p.self {
+		return nil, false
+	}
+
+	req, err := http.NewRequest(http.MethodGet, owner+keysPath+"/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, false
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Error().Msgf("[kvstore peerfill] %s key %s error: %s", owner, key, err.Error())
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxValueSize))
+	if err != nil {
+		log.Error().Msgf("[kvstore peerfill] %s key %s error: %s", owner, key, err.Error())
+		return nil, false
+	}
+	return data, true
+}
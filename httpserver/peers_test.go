@@ -0,0 +1,67 @@
+package httpserver_test
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/httpserver"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+type readCountingPersister struct {
+	*persistence.Filesystem
+	reads int
+}
+
+func (p *readCountingPersister) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	if readValue {
+		p.reads++
+	}
+	return p.Filesystem.Read(key, readValue)
+}
+
+func TestPeerFill(t *testing.T) {
+	const folder = "TestPeerFill"
+	defer os.RemoveAll(folder)
+
+	owner, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer owner.Close()
+	srv := httptest.NewServer(httpserver.New(owner))
+	defer srv.Close()
+
+	pool := httpserver.NewPeerPool("http://sibling.invalid")
+	pool.Set(srv.URL)
+	var owned, local string
+	for i := 0; owned == "" || local == ""; i++ {
+		key := fmt.Sprintf("doc:%d", i)
+		if pool.Owner(key) == srv.URL {
+			owned = key
+		} else {
+			local = key
+		}
+	}
+	require.NoError(t, owner.Set(owned, []byte("remote")))
+	require.NoError(t, owner.Set(local, []byte("local")))
+
+	p := &readCountingPersister{Filesystem: persistence.NewFsPersistence(folder)}
+	sibling, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithPeerFillOption(pool))
+	require.NoError(t, err)
+	defer sibling.Close()
+	require.False(t, sibling.InMemory(owned))
+
+	value, err := sibling.Get(owned)
+	require.NoError(t, err)
+	require.Equal(t, "remote", string(value))
+	require.Equal(t, 0, p.reads)
+	require.True(t, sibling.InMemory(owned))
+
+	value, err = sibling.Get(local)
+	require.NoError(t, err)
+	require.Equal(t, "local", string(value))
+	require.Equal(t, 1, p.reads)
+}
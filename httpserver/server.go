@@ -0,0 +1,232 @@
+// Package httpserver exposes a kvstore.Store over a REST API.
+//
+// Values are read, written and deleted with GET, PUT and DELETE requests to /keys/{key},
+// and GET /keys lists the keys the caller may read. Callers are identified by the
+// authenticators configured on the Server and their requests are checked against the store's ACL.
+package httpserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/limits"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const keysPath = "/keys"
+
+// maxValueSize is the largest request body accepted by PUT.
+const maxValueSize = 32 << 20
+
+// Server serves the REST API for a store.
+type Server struct {
+	store          *kvstore.Store
+	tokens         map[[32]byte]string
+	clientCertAuth bool
+	certFile       string
+	keyFile        string
+	clientCAFile   string
+	rateLimiter    *limits.RateLimiter
+	maxConnections int
+	adminToken     *[32]byte
+	dashboard      bool
+	mux            *http.ServeMux
+	httpServer     *http.Server
+}
+
+// ServerOption is a type for functions that configure a Server.
+type ServerOption func(s *Server)
+
+// New creates a Server for store.
+func New(store *kvstore.Store, options ...ServerOption) *Server {
+	s := &Server{
+		store:  store,
+		tokens: make(map[[32]byte]string),
+		mux:    http.NewServeMux(),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+
+	s.mux.Handle(keysPath, s.authenticated(s.handleKeys))
+	s.mux.Handle(keysPath+"/", s.authenticated(s.handleKey))
+	s.registerAdmin()
+	return s
+}
+
+// ServeHTTP implements http.Handler, so the Server can be mounted in an existing HTTP server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe listens on addr and serves the API until Shutdown is called, using HTTPS if TLS is configured.
+func (s *Server) ListenAndServe(addr string) error {
+	tlsConfig, err := s.TLSConfig()
+	if err != nil {
+		return err
+	}
+	s.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Server.ListenAndServe Listen")
+	}
+	if s.maxConnections > 0 {
+		ln = limits.NewListener(ln, s.maxConnections)
+	}
+
+	if tlsConfig != nil {
+		err = s.httpServer.ServeTLS(ln, "", "")
+	} else {
+		err = s.httpServer.Serve(ln)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown gracefully stops a server started with ListenAndServe.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+	return s.httpServer.Shutdown(ctx)
+}
+
+// handleKeys lists the keys the caller may read, one per line.
+func (s *Server) handleKeys(w http.ResponseWriter, r *http.Request, caller *kvstore.ScopedStore) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	keys, err := caller.Keys()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, k := range keys {
+		_, _ = io.WriteString(w, k+"\n")
+	}
+}
+
+// handleKey reads, writes or deletes a single key.
+func (s *Server) handleKey(w http.ResponseWriter, r *http.Request, caller *kvstore.ScopedStore) {
+	key := strings.TrimPrefix(r.URL.Path, keysPath+"/")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.getKey(w, r, caller, key)
+	case http.MethodPut:
+		s.putKey(w, r, caller, key)
+	case http.MethodDelete:
+		if err := caller.Delete(key); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// getKey writes a value with its content type and ETag.
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request, caller *kvstore.ScopedStore, key string) {
+	value, info, err := caller.GetWithMetadata(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if info.ContentType != "" {
+		w.Header().Set("Content-Type", info.ContentType)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	w.Header().Set("ETag", strconv.Quote(info.ETag))
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(value)
+}
+
+// putKey stores the request body. An If-Match header makes the write conditional on the current
+// ETag, and a ttl query parameter sets the key's time-to-live in seconds.
+func (s *Server) putKey(w http.ResponseWriter, r *http.Request, caller *kvstore.ScopedStore, key string) {
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxValueSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var ttl int64
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		if ttl, err = strconv.ParseInt(v, 10, 64); err != nil || ttl <= 0 {
+			http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var options []kvstore.SetOption
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		options = append(options, kvstore.WithContentTypeSetOption(ct))
+	}
+	if ttl > 0 {
+		options = append(options, kvstore.WithTTLSetOption(time.Duration(ttl)*time.Second))
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		err = caller.SetIfMatch(key, value, unquoteETag(etag), options...)
+	} else {
+		err = caller.Set(key, value, options...)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unquoteETag strips the quotes from an ETag header value.
+func unquoteETag(etag string) string {
+	if unquoted, err := strconv.Unquote(etag); err == nil {
+		return unquoted
+	}
+	return etag
+}
+
+// writeError maps store errors to HTTP status codes.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, kvstore.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, kvstore.ErrKeyInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, kvstore.ErrPermissionDenied), errors.Is(err, kvstore.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, kvstore.ErrETagMismatch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, kvstore.ErrWrongType), errors.Is(err, kvstore.ErrCounterMaxReached), errors.Is(err, kvstore.ErrCounterMinReached):
+		status = http.StatusConflict
+	case errors.Is(err, kvstore.ErrBufferFull), errors.Is(err, kvstore.ErrPersisterUnavailable):
+		status = http.StatusServiceUnavailable
+	default:
+		log.Error().Msgf("[kvstore httpserver] error: %s", err.Error())
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,157 @@
+package httpserver_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/httpserver"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/stretchr/testify/require"
+)
+
+func request(t *testing.T, srv *httptest.Server, method, path, token, body string, headers ...string) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	acl := kvstore.NewACL()
+	acl.Grant("tenant1-app", "tenant1", kvstore.PermWrite)
+	store, err := kvstore.New(kvstore.WithACLOption(acl))
+	require.NoError(t, err)
+	srv := httptest.NewServer(httpserver.New(store, httpserver.WithTokenOption("secret1", "tenant1-app")))
+	defer srv.Close()
+
+	resp := request(t, srv, http.MethodPut, "/keys/tenant1:doc", "", "value")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = request(t, srv, http.MethodPut, "/keys/tenant1:doc", "wrong", "value")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = request(t, srv, http.MethodPut, "/keys/tenant1:doc", "secret1", "value", "Content-Type", "text/plain")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = request(t, srv, http.MethodPut, "/keys/tenant2:doc", "secret1", "value")
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp = request(t, srv, http.MethodGet, "/keys/tenant1:doc", "secret1", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(body))
+
+	resp = request(t, srv, http.MethodPut, "/keys/tenant1:doc", "secret1", "new", "If-Match", `"0"`)
+	require.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+
+	resp = request(t, srv, http.MethodDelete, "/keys/tenant1:doc", "secret1", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = request(t, srv, http.MethodGet, "/keys/tenant1:doc", "secret1", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPutTTL(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	srv := httptest.NewServer(httpserver.New(store))
+	defer srv.Close()
+
+	resp := request(t, srv, http.MethodPut, "/keys/doc?ttl=60", "", "value")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, kvstore.TTLType(60), store.TTL("doc"))
+	resp = request(t, srv, http.MethodPut, "/keys/doc?ttl=0", "", "value")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = request(t, srv, http.MethodGet, "/keys/doc", "", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	info, err := store.GetMetadata("doc")
+	require.NoError(t, err)
+	require.Equal(t, `"`+info.ETag+`"`, resp.Header.Get("ETag"))
+}
+
+func TestRateLimit(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	counters, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	srv := httptest.NewServer(httpserver.New(store,
+		httpserver.WithTokenOption("a", "client-a"),
+		httpserver.WithTokenOption("b", "client-b"),
+		httpserver.WithRateLimitOption(counters, 2, time.Minute),
+	))
+	defer srv.Close()
+
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "a", "").StatusCode)
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "a", "").StatusCode)
+	resp := request(t, srv, http.MethodGet, "/keys", "a", "")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "b", "").StatusCode)
+
+	now = now.Add(time.Minute)
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "a", "").StatusCode)
+
+	// Requests with invalid credentials are rejected before they are counted.
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusUnauthorized, request(t, srv, http.MethodGet, "/keys", "wrong", "").StatusCode)
+	}
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "b", "").StatusCode)
+}
+
+func TestRateLimitExpiresIdleClients(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	counters, err := kvstore.New()
+	require.NoError(t, err)
+	defer counters.Close()
+	srv := httptest.NewServer(httpserver.New(store, httpserver.WithRateLimitOption(counters, 10, 50*time.Millisecond)))
+	defer srv.Close()
+
+	require.Equal(t, http.StatusOK, request(t, srv, http.MethodGet, "/keys", "", "").StatusCode)
+	require.Equal(t, 1, counters.Stats().Keys)
+	require.Eventually(t, func() bool {
+		return counters.Stats().Keys == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestShutdownWithConnectionsAtLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	srv := httpserver.New(store, httpserver.WithMaxConnectionsOption(1))
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe(addr) }()
+
+	// A kept-alive connection holds the only slot, so the server waits for another.
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		resp, err = http.Get("http://" + addr + "/keys")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Shutdown(ctx))
+	require.NoError(t, <-served)
+}
@@ -0,0 +1,109 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// WithTLSOption returns a ServerOption that serves HTTPS using a certificate and key in PEM files.
+// The files are reloaded when they change, so certificates can be renewed without a restart.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithTLSOption("/etc/kvstore/tls.crt", "/etc/kvstore/tls.key"))
+func WithTLSOption(certFile, keyFile string) ServerOption {
+	return func(s *Server) {
+		s.certFile = certFile
+		s.keyFile = keyFile
+	}
+}
+
+// WithClientCAOption returns a ServerOption that requires clients to present a certificate signed by
+// one of the CAs in a PEM file, for mutual TLS. Combine it with WithClientCertAuthOption to use the
+// certificate's common name as the caller identity.
+//
+// Example:
+//
+//	httpserver.New(store, httpserver.WithTLSOption(cert, key), httpserver.WithClientCAOption("/etc/kvstore/clients.pem"))
+func WithClientCAOption(caFile string) ServerOption {
+	return func(s *Server) {
+		s.clientCAFile = caFile
+	}
+}
+
+// TLSConfig returns the TLS configuration for the server, or nil if TLS is not configured.
+// It is used by ListenAndServe, and can be used when mounting the Server in another HTTP server.
+func (s *Server) TLSConfig() (*tls.Config, error) {
+	if s.certFile == "" {
+		return nil, nil
+	}
+
+	certs := &certReloader{certFile: s.certFile, keyFile: s.keyFile}
+	if _, err := certs.getCertificate(nil); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+
+	if s.clientCAFile != "" {
+		pem, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Server.TLSConfig ReadFile client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("Server.TLSConfig: no certificates found in %s", s.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certReloader serves a certificate from files, reloading it when either file's modification time changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certMod  time.Time
+	keyMod   time.Time
+}
+
+// getCertificate implements tls.Config.GetCertificate. If a changed certificate cannot be loaded,
+// for example because only one of the files has been replaced so far, the previous one is served.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	certInfo, certErr := os.Stat(c.certFile)
+	keyInfo, keyErr := os.Stat(c.keyFile)
+	if certErr == nil && keyErr == nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Error().Msgf("[kvstore httpserver] error reloading certificate %s error: %s", c.certFile, err.Error())
+			return c.cert, nil
+		}
+		return nil, errors.Wrap(err, "certReloader LoadX509KeyPair")
+	}
+	if c.cert != nil {
+		log.Info().Msgf("[kvstore httpserver] reloaded certificate %s", c.certFile)
+	}
+	c.cert = &cert
+	if certErr == nil && keyErr == nil {
+		c.certMod, c.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,240 @@
+// Package kafka provides a write-only DataPersister that publishes the store's changes to a Kafka
+// topic, so downstream stream processors can follow every Set and Delete. It does not make data
+// durable on its own and is configured alongside a persister that does:
+//
+//	feed := kafka.New([]string{"localhost:9092"}, "kvstore-changes")
+//	store, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence("./data"), feed))
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	kafkago "github.com/segmentio/kafka-go"
+)
+
+// Event operations.
+const (
+	OpSet    = "set"    // The key's value was written.
+	OpMeta   = "meta"   // Only the key's metadata was written, such as its TTL.
+	OpDelete = "delete" // The key was deleted.
+)
+
+// DefaultTimeout is how long a write waits for Kafka to accept its events by default.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultBatchTimeout is how long the writer created by New waits for more events to batch with
+// those it holds by default. Writes are synchronous and the store persists under its lock, so it is
+// kept short; kafka-go's own default of a second would stall every write for that long.
+const DefaultBatchTimeout = 10 * time.Millisecond
+
+// ErrWriteOnly returned when reading from a Publisher, which only publishes changes.
+var ErrWriteOnly error = errors.New("kafka publisher is write-only")
+
+// Event is the JSON value of each message published. The message key is the store key, so all the
+// events of one key land on the same partition, in order.
+type Event struct {
+	Op    string             `json:"op"`
+	Key   string             `json:"key"`
+	Value []byte             `json:"value,omitempty"`
+	Item  *kvstore.ValueItem `json:"item,omitempty"`
+	Ts    time.Time          `json:"ts"`
+}
+
+// MessageWriter writes messages to Kafka. It is implemented by *kafkago.Writer.
+type MessageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+}
+
+// Publisher is a write-only DataPersister that publishes an Event for every write and delete.
+// It must not be the store's first persister, which is the one values are read back from.
+type Publisher struct {
+	writer       MessageWriter
+	timeout      time.Duration
+	batchTimeout time.Duration
+	async        bool
+	nowFunc      func() time.Time
+}
+
+// Option configures a Publisher.
+type Option func(*Publisher)
+
+// WithWriterOption returns an Option that publishes through writer instead of a writer created for
+// the brokers and topic passed to New. The writer should partition messages by key.
+//
+// Example:
+//
+//	kafka.New(nil, "", kafka.WithWriterOption(&kafkago.Writer{Addr: kafkago.TCP("localhost:9092"), Topic: "changes", Balancer: &kafkago.Hash{}}))
+func WithWriterOption(writer MessageWriter) Option {
+	return func(p *Publisher) {
+		p.writer = writer
+	}
+}
+
+// WithTimeoutOption returns an Option that sets how long a write waits for Kafka to accept its events.
+//
+// Example:
+//
+//	kafka.New(brokers, "changes", kafka.WithTimeoutOption(2*time.Second))
+func WithTimeoutOption(timeout time.Duration) Option {
+	return func(p *Publisher) {
+		p.timeout = timeout
+	}
+}
+
+// WithBatchTimeoutOption returns an Option that sets how long the writer created by New waits for
+// more events to batch with those it holds. It has no effect with WithWriterOption.
+//
+// Example:
+//
+//	kafka.New(brokers, "changes", kafka.WithBatchTimeoutOption(time.Millisecond))
+func WithBatchTimeoutOption(timeout time.Duration) Option {
+	return func(p *Publisher) {
+		p.batchTimeout = timeout
+	}
+}
+
+// WithAsyncOption returns an Option that makes the writer created by New return from writes without
+// waiting for Kafka, so a slow or unreachable broker never holds up the store. Events that cannot be
+// delivered are logged and dropped, not reported to the store. It has no effect with WithWriterOption;
+// wrapping the Publisher in a persistence.Buffer is the alternative that keeps retrying.
+//
+// Example:
+//
+//	kafka.New(brokers, "changes", kafka.WithAsyncOption())
+func WithAsyncOption() Option {
+	return func(p *Publisher) {
+		p.async = true
+	}
+}
+
+// WithNowFuncOption returns an Option that sets the function used to timestamp events.
+//
+// Example:
+//
+//	kafka.New(brokers, "changes", kafka.WithNowFuncOption(clock.Now))
+func WithNowFuncOption(nowFunc func() time.Time) Option {
+	return func(p *Publisher) {
+		p.nowFunc = nowFunc
+	}
+}
+
+// New creates a Publisher for topic on the given brokers. Messages are partitioned by a hash of the
+// store key, so the events of each key are delivered in order.
+func New(brokers []string, topic string, options ...Option) *Publisher {
+	p := &Publisher{
+		timeout:      DefaultTimeout,
+		batchTimeout: DefaultBatchTimeout,
+		nowFunc:      time.Now,
+	}
+	for _, opt := range options {
+		opt(p)
+	}
+	if p.writer == nil {
+		w := &kafkago.Writer{
+			Addr:         kafkago.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafkago.Hash{},
+			RequiredAcks: kafkago.RequireAll,
+			BatchTimeout: p.batchTimeout,
+			Async:        p.async,
+		}
+		if p.async {
+			w.Completion = completion
+		}
+		p.writer = w
+	}
+	return p
+}
+
+// completion logs events the writer failed to deliver, which is the only report of failures with
+// WithAsyncOption.
+func completion(msgs []kafkago.Message, err error) {
+	if err != nil {
+		log.Error().Msgf("[kvstore kafka] error publishing %d events error: %s", len(msgs), err.Error())
+	}
+}
+
+// Write publishes a set event, or a meta event for a metadata-only write.
+func (p *Publisher) Write(key string, data *kvstore.ValueItem) error {
+	msg, err := p.message(key, data)
+	if err != nil {
+		return errors.Wrap(err, "Publisher.Write")
+	}
+	return p.publish("Publisher.Write", msg)
+}
+
+// WriteMulti publishes a set event for every item in a single request.
+func (p *Publisher) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	msgs := make([]kafkago.Message, 0, len(items))
+	for k, item := range items {
+		msg, err := p.message(k, item)
+		if err != nil {
+			return errors.Wrap(err, "Publisher.WriteMulti")
+		}
+		msgs = append(msgs, msg)
+	}
+	return p.publish("Publisher.WriteMulti", msgs...)
+}
+
+// Delete publishes a delete event.
+func (p *Publisher) Delete(key string) error {
+	msg, err := p.encode(Event{Op: OpDelete, Key: key, Ts: p.nowFunc()})
+	if err != nil {
+		return errors.Wrap(err, "Publisher.Delete")
+	}
+	return p.publish("Publisher.Delete", msg)
+}
+
+// Read returns ErrWriteOnly, as published events cannot be read back.
+func (p *Publisher) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	return nil, errors.Wrapf(ErrWriteOnly, "Publisher.Read key %s", key)
+}
+
+// Keys returns no keys, as published events cannot be read back.
+func (p *Publisher) Keys() ([]string, error) {
+	return nil, nil
+}
+
+// Close closes the writer if it holds resources.
+func (p *Publisher) Close() {
+	if c, ok := p.writer.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+// message returns the message describing a write of item.
+func (p *Publisher) message(key string, item *kvstore.ValueItem) (kafkago.Message, error) {
+	event := Event{Op: OpSet, Key: key, Value: item.Data, Item: item, Ts: p.nowFunc()}
+	if item.Data == nil {
+		event.Op = OpMeta
+	}
+	return p.encode(event)
+}
+
+// encode returns a message keyed by the event's key holding the event as JSON.
+func (p *Publisher) encode(event Event) (kafkago.Message, error) {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return kafkago.Message{}, errors.Wrap(err, "Marshal")
+	}
+	return kafkago.Message{Key: []byte(event.Key), Value: value, Time: event.Ts}, nil
+}
+
+// publish writes messages to Kafka, waiting at most the configured timeout.
+func (p *Publisher) publish(op string, msgs ...kafkago.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+	if err := p.writer.WriteMessages(ctx, msgs...); err != nil {
+		return errors.Wrapf(kvstore.ErrPersisterUnavailable, "%s: %s", op, err.Error())
+	}
+	return nil
+}
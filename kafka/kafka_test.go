@@ -0,0 +1,91 @@
+package kafka_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kafka"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/pkg/errors"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingWriter records the messages written to it.
+type recordingWriter struct {
+	lock sync.Mutex
+	msgs []kafkago.Message
+	err  error
+}
+
+func (w *recordingWriter) WriteMessages(_ context.Context, msgs ...kafkago.Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *recordingWriter) events(t *testing.T) []kafka.Event {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	events := make([]kafka.Event, 0, len(w.msgs))
+	for _, msg := range w.msgs {
+		var e kafka.Event
+		require.NoError(t, json.Unmarshal(msg.Value, &e))
+		require.Equal(t, e.Key, string(msg.Key))
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestPublisher(t *testing.T) {
+	folder := "./TestKafkaPublisher"
+	defer os.RemoveAll(folder)
+
+	w := &recordingWriter{}
+	publisher := kafka.New(nil, "changes", kafka.WithWriterOption(w))
+	store, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder), publisher))
+	require.NoError(t, err)
+	defer store.Close()
+
+	require.NoError(t, store.Set("a", []byte("one")))
+	require.NoError(t, store.Set("b", []byte("two")))
+	require.NoError(t, store.Delete("a"))
+
+	events := w.events(t)
+	require.Len(t, events, 3)
+	require.Equal(t, kafka.OpSet, events[0].Op)
+	require.Equal(t, "a", events[0].Key)
+	require.NotEmpty(t, events[0].Value)
+	require.NotNil(t, events[0].Item)
+	require.Equal(t, kafka.OpSet, events[1].Op)
+	require.Equal(t, "b", events[1].Key)
+	require.Equal(t, kafka.OpDelete, events[2].Op)
+	require.Equal(t, "a", events[2].Key)
+
+	// Values are read back from the filesystem, not the publisher.
+	v, err := store.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, []byte("two"), v)
+
+	_, err = publisher.Read("b", true)
+	require.True(t, errors.Is(err, kafka.ErrWriteOnly))
+}
+
+func TestPublisherUnavailable(t *testing.T) {
+	w := &recordingWriter{err: errors.New("broker down")}
+	publisher := kafka.New(nil, "changes", kafka.WithWriterOption(w))
+
+	err := publisher.Write("a", &kvstore.ValueItem{Data: []byte(`"one"`)})
+	require.True(t, errors.Is(err, kvstore.ErrPersisterUnavailable))
+
+	err = publisher.WriteMulti(map[string]*kvstore.ValueItem{"a": {Data: []byte(`"one"`)}})
+	require.True(t, errors.Is(err, kvstore.ErrPersisterUnavailable))
+}
@@ -0,0 +1,272 @@
+package kvstore
+
+import (
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPermissionDenied returned when a caller does not have the permission an operation requires.
+var ErrPermissionDenied error = errors.New("permission denied")
+
+// Permission is the level of access a caller has to a namespace. Each level includes the ones below it.
+type Permission int
+
+// Permissions that can be granted on a namespace.
+const (
+	PermNone  Permission = iota // No access.
+	PermRead                    // Read values and metadata.
+	PermWrite                   // Read, write and delete values.
+	PermAdmin                   // Read and write values, and grant or revoke access to the namespace.
+)
+
+// AllNamespaces can be granted to give an identity access to every namespace.
+const AllNamespaces = "*"
+
+// ACL holds the permissions granted to caller identities on namespaces, as returned by Namespace.
+// It is safe for concurrent use, so grants can change while the store is serving requests.
+type ACL struct {
+	lock   sync.RWMutex
+	grants map[string]map[string]Permission
+}
+
+// NewACL creates an ACL with no grants.
+func NewACL() *ACL {
+	return &ACL{grants: make(map[string]map[string]Permission)}
+}
+
+// Grant sets the permission an identity has on a namespace, which may be AllNamespaces.
+func (a *ACL) Grant(identity, namespace string, p Permission) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.grants[identity]; !ok {
+		a.grants[identity] = make(map[string]Permission)
+	}
+	a.grants[identity][namespace] = p
+}
+
+// Revoke removes the permission an identity was granted on a namespace.
+func (a *ACL) Revoke(identity, namespace string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.grants[identity], namespace)
+	if len(a.grants[identity]) == 0 {
+		delete(a.grants, identity)
+	}
+}
+
+// Permission returns the permission an identity has on a namespace, taking the higher of its
+// grant on the namespace and its grant on AllNamespaces.
+func (a *ACL) Permission(identity, namespace string) Permission {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	grants := a.grants[identity]
+	p := grants[namespace]
+	if all := grants[AllNamespaces]; all > p {
+		p = all
+	}
+	return p
+}
+
+// Allowed reports whether an identity has at least permission p on the namespace of key.
+func (a *ACL) Allowed(identity, key string, p Permission) bool {
+	return a.Permission(identity, Namespace(key)) >= p
+}
+
+// ScopedStore performs store operations on behalf of a caller identity, checking each operation
+// against the store's ACL. Operations the caller is not permitted to perform return ErrPermissionDenied.
+// Only the operations of ScopedStore are checked: the Store's other methods, such as SetTTLWhere,
+// SetNamespaceTTL and the maintenance operations, act with full access, so servers exposing a store
+// to callers must only reach it through a ScopedStore.
+type ScopedStore struct {
+	store    *Store
+	identity string
+}
+
+// As returns a view of the store that acts as the given caller identity.
+// If the store has no ACL every operation is permitted.
+func (kv *Store) As(identity string) *ScopedStore {
+	return &ScopedStore{store: kv, identity: identity}
+}
+
+// Identity returns the caller identity the ScopedStore acts as.
+func (s *ScopedStore) Identity() string {
+	return s.identity
+}
+
+// Allowed reports whether the caller has at least permission p on the namespace of key.
+// Keys are normalized first if the store uses WithKeyNormalizationOption, so grants should name canonical namespaces.
+func (s *ScopedStore) Allowed(key string, p Permission) bool {
+	return s.store.acl == nil || s.store.acl.Allowed(s.identity, s.store.canonicalKey(key), p)
+}
+
+// check returns ErrPermissionDenied if the caller lacks permission p on the namespace of key.
+func (s *ScopedStore) check(key string, p Permission) error {
+	if !s.Allowed(key, p) {
+		return errors.Wrapf(ErrPermissionDenied, "%s on %s", s.identity, key)
+	}
+	return nil
+}
+
+// Get retrieves a value, requiring PermRead.
+func (s *ScopedStore) Get(key string) ([]byte, error) {
+	if err := s.check(key, PermRead); err != nil {
+		return nil, err
+	}
+	return s.store.Get(key)
+}
+
+// GetMetadata retrieves a key's metadata, requiring PermRead.
+func (s *ScopedStore) GetMetadata(key string) (ItemInfo, error) {
+	if err := s.check(key, PermRead); err != nil {
+		return ItemInfo{}, err
+	}
+	return s.store.GetMetadata(key)
+}
+
+// GetWithMetadata retrieves a value with its metadata, requiring PermRead.
+func (s *ScopedStore) GetWithMetadata(key string) ([]byte, ItemInfo, error) {
+	if err := s.check(key, PermRead); err != nil {
+		return nil, ItemInfo{}, err
+	}
+	return s.store.GetWithMetadata(key)
+}
+
+// TTL returns the time-to-live of a key, requiring PermRead.
+func (s *ScopedStore) TTL(key string) (TTLType, error) {
+	if err := s.check(key, PermRead); err != nil {
+		return TTLKeyNotExist, err
+	}
+	return s.store.TTL(key), nil
+}
+
+// Keys returns the keys the caller is permitted to read.
+func (s *ScopedStore) Keys() ([]string, error) {
+	keys, err := s.store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	permitted := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if s.Allowed(k, PermRead) {
+			permitted = append(permitted, k)
+		}
+	}
+	return permitted, nil
+}
+
+// Set stores a value, requiring PermWrite.
+func (s *ScopedStore) Set(key string, value []byte, options ...SetOption) error {
+	if err := s.check(key, PermWrite); err != nil {
+		return err
+	}
+	return s.store.Set(key, value, options...)
+}
+
+// SetIfMatch conditionally stores a value, requiring PermWrite.
+func (s *ScopedStore) SetIfMatch(key string, value []byte, etag string, options ...SetOption) error {
+	if err := s.check(key, PermWrite); err != nil {
+		return err
+	}
+	return s.store.SetIfMatch(key, value, etag, options...)
+}
+
+// Delete removes a key, requiring PermWrite.
+func (s *ScopedStore) Delete(key string) error {
+	if err := s.check(key, PermWrite); err != nil {
+		return err
+	}
+	return s.store.Delete(key)
+}
+
+// SetTTL sets the time-to-live of a key, requiring PermWrite.
+func (s *ScopedStore) SetTTL(key string, ttl int64) error {
+	if err := s.check(key, PermWrite); err != nil {
+		return err
+	}
+	return s.store.SetTTL(key, ttl)
+}
+
+// Counter adjusts a counter, requiring PermWrite.
+func (s *ScopedStore) Counter(key string, delta int64) (int64, error) {
+	if err := s.check(key, PermWrite); err != nil {
+		return 0, err
+	}
+	return s.store.Counter(key, delta)
+}
+
+// Patch overwrites part of a value, requiring PermWrite.
+func (s *ScopedStore) Patch(key string, offset int, data []byte) error {
+	if err := s.check(key, PermWrite); err != nil {
+		return err
+	}
+	return s.store.Patch(key, offset, data)
+}
+
+// DeleteWhere deletes the matching keys as Store.DeleteWhere does, skipping keys the caller does
+// not have PermWrite on.
+func (s *ScopedStore) DeleteWhere(pred func(key string, meta ItemInfo) bool, options ...RangeOption) (int, error) {
+	return s.store.DeleteWhere(func(key string, meta ItemInfo) bool {
+		return s.Allowed(key, PermWrite) && (pred == nil || pred(key, meta))
+	}, options...)
+}
+
+// Watch starts a transaction as Store.Watch does. Exec requires PermRead on every watched key and
+// PermWrite on every key the queued commands change, and applies nothing if any is missing.
+func (s *ScopedStore) Watch(keys ...string) *Tx {
+	tx := s.store.Watch(keys...)
+	tx.check = s.check
+	return tx
+}
+
+// Import imports records as Store.Import does, requiring PermWrite on the key of every record.
+// Nothing is imported if any is missing.
+func (s *ScopedStore) Import(r io.Reader, policy ConflictPolicy) error {
+	return s.store.importFrom(r, policy, func(key string) error {
+		return s.check(key, PermWrite)
+	})
+}
+
+// Merge imports the keys of another persister as Store.Merge does. As it may write to any
+// namespace, it requires PermAdmin on AllNamespaces.
+func (s *ScopedStore) Merge(other DataPersister, policy MergePolicy) (MergeReport, error) {
+	if err := s.checkAdmin(AllNamespaces); err != nil {
+		return MergeReport{}, err
+	}
+	return s.store.Merge(other, policy)
+}
+
+// SetCounterLimits sets the bounds of a counter, requiring PermAdmin.
+func (s *ScopedStore) SetCounterLimits(key string, min, max int64) error {
+	if err := s.check(key, PermAdmin); err != nil {
+		return err
+	}
+	return s.store.SetCounterLimits(key, min, max)
+}
+
+// Grant gives another identity a permission on a namespace, requiring PermAdmin on the namespace.
+func (s *ScopedStore) Grant(identity, namespace string, p Permission) error {
+	if err := s.checkAdmin(namespace); err != nil {
+		return err
+	}
+	s.store.acl.Grant(identity, namespace, p)
+	return nil
+}
+
+// Revoke removes another identity's permission on a namespace, requiring PermAdmin on the namespace.
+func (s *ScopedStore) Revoke(identity, namespace string) error {
+	if err := s.checkAdmin(namespace); err != nil {
+		return err
+	}
+	s.store.acl.Revoke(identity, namespace)
+	return nil
+}
+
+// checkAdmin returns ErrPermissionDenied unless the store has an ACL on which the caller is an admin of namespace.
+func (s *ScopedStore) checkAdmin(namespace string) error {
+	if s.store.acl == nil || s.store.acl.Permission(s.identity, namespace) < PermAdmin {
+		return errors.Wrapf(ErrPermissionDenied, "%s is not an admin of namespace %q", s.identity, namespace)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package kvstore
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	// DefaultArenaSlabSize is the size of the slabs allocated by WithArenaOption when none is given.
+	DefaultArenaSlabSize = 4 << 20
+
+	// minArenaRegion is the smallest region handed out by an arena.
+	minArenaRegion = 64
+)
+
+// arena hands out byte regions carved from large slabs, so a cache of many values is held in a
+// few large allocations that the garbage collector does not need to scan, instead of one heap
+// object per value. Regions are rounded up to a power of two and are recycled through a free list
+// per size when released. Values larger than an eighth of a slab are not held in the arena.
+//
+// A region that is dropped without being released is not lost: it keeps its slab reachable until
+// nothing refers to it, and the slab is then collected.
+type arena struct {
+	lock     sync.Mutex
+	slabSize int
+	slab     []byte     // The unused remainder of the current slab.
+	free     [][][]byte // Released regions, indexed by size class.
+	reserved int64      // Bytes allocated for slabs.
+}
+
+func newArena(slabSize int) *arena {
+	if slabSize <= 0 {
+		slabSize = DefaultArenaSlabSize
+	}
+	return &arena{slabSize: max(slabSize, 8*minArenaRegion)}
+}
+
+// class returns the size class and region size that hold n bytes, reporting false if n is too
+// large for the arena.
+func (a *arena) class(n int) (int, int, bool) {
+	size := minArenaRegion
+	if n > size {
+		size = 1 << bits.Len(uint(n-1))
+	}
+	if size > a.slabSize/8 {
+		return 0, 0, false
+	}
+	return bits.TrailingZeros(uint(size / minArenaRegion)), size, true
+}
+
+// alloc returns a region of length n, reporting false if n is too large for the arena.
+func (a *arena) alloc(n int) ([]byte, bool) {
+	class, size, ok := a.class(n)
+	if !ok {
+		return nil, false
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if class < len(a.free) {
+		if free := a.free[class]; len(free) > 0 {
+			region := free[len(free)-1]
+			a.free[class] = free[:len(free)-1]
+			return region[:n], true
+		}
+	}
+	if len(a.slab) < size {
+		a.slab = make([]byte, a.slabSize)
+		a.reserved += int64(a.slabSize)
+	}
+	region := a.slab[:n:size]
+	a.slab = a.slab[size:]
+	return region, true
+}
+
+// release returns a region handed out by alloc for reuse. The region must not be used afterwards.
+func (a *arena) release(region []byte) {
+	if region == nil {
+		return
+	}
+	class, size, ok := a.class(cap(region))
+	if !ok || size != cap(region) {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for len(a.free) <= class {
+		a.free = append(a.free, nil)
+	}
+	a.free[class] = append(a.free[class], region[:0])
+}
+
+// size returns the bytes allocated for slabs.
+func (a *arena) size() int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.reserved
+}
+
+// internValue moves an item's loaded value into the arena. The caller must hold the write lock.
+func (kv *Store) internValue(mv *ValueItem) {
+	if kv.arena == nil || !mv.dataLoaded || mv.inArena {
+		return
+	}
+	if region, ok := kv.arena.alloc(len(mv.Data)); ok {
+		copy(region, mv.Data)
+		mv.Data = region
+		mv.inArena = true
+	}
+}
+
+// releaseValue unloads an item's value, returning its region to the arena if it holds one.
+// The caller must hold the write lock.
+func (kv *Store) releaseValue(mv *ValueItem) {
+	if mv.inArena {
+		kv.releaseRegion(mv.Data)
+		mv.inArena = false
+	}
+	mv.dataLoaded = false
+	mv.Data = nil
+}
+
+// replaceItem stores an item under a key, moving its value into the arena and releasing the value
+// of the item it replaces. The caller must hold the write lock.
+func (kv *Store) replaceItem(key string, mv *ValueItem) {
+	if old, ok := kv.data[key]; ok && old != mv {
+		if old.Version != mv.Version {
+			kv.preserveForSnapshots(key)
+		}
+		if old.inArena {
+			kv.releaseValue(old)
+		}
+		mv.inheritAccessStats(old)
+	}
+	kv.internValue(mv)
+	kv.putItem(key, mv)
+}
+
+// valueOf returns an item's loaded value. Values held in the arena are copied, as their region may
+// be reused once the lock is released; others are returned as stored. The caller must hold the read
+// or write lock.
+func (kv *Store) valueOf(mv *ValueItem) []byte {
+	if mv.inArena {
+		return append([]byte(nil), mv.Data...)
+	}
+	return mv.Data
+}
+
+// persisted returns a copy of an item to hand to the persisters, which may write it after the lock
+// is released, as the async Buffer does. Values held in the arena are copied, as their region is
+// reused once the key is unloaded, overwritten or deleted. The caller must hold the write lock.
+func (kv *Store) persisted(mv *ValueItem) *ValueItem {
+	item := mv.Clone()
+	item.Data = kv.valueOf(mv)
+	return item
+}
+
+// loadedValue returns the loaded value of a key, reporting false if it is not loaded.
+func (kv *Store) loadedValue(key string) ([]byte, bool) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	mv, ok := kv.data[key]
+	if !ok || !mv.dataLoaded {
+		return nil, false
+	}
+	return kv.valueOf(mv), true
+}
@@ -0,0 +1,184 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Defaults used when BFAdd creates a bloom filter that has not been reserved.
+const (
+	DefaultBloomCapacity  = 100
+	DefaultBloomErrorRate = 0.01
+)
+
+var (
+	// ErrCorruptBloomFilter returned when the stored encoding of a bloom filter cannot be decoded.
+	ErrCorruptBloomFilter error = errors.Wrap(ErrCorrupted, "bloom filter encoding")
+
+	// ErrKeyExists returned when reserving a bloom filter under a key that already exists.
+	ErrKeyExists error = errors.New("key already exists")
+)
+
+// bloomFilter is a bit set of m bits probed by k hash functions.
+type bloomFilter struct {
+	m    uint64
+	k    uint64
+	bits []byte
+}
+
+// BFReserve creates an empty bloom filter under key sized for capacity items at the given
+// false-positive rate. It returns ErrKeyExists if the key already exists.
+func (kv *Store) BFReserve(key string, capacity uint, errorRate float64) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	if capacity == 0 || errorRate <= 0 || errorRate >= 1 {
+		return errors.New("Store.BFReserve capacity must be positive and error rate between 0 and 1")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	if mv, ok := kv.data[key]; ok && !kv.expired(key, mv, kv.nowFunc()) {
+		return ErrKeyExists
+	}
+	bf := newBloomFilter(capacity, errorRate)
+	if err := kv.setTypedData(key, bf.encode(), BloomValue); err != nil {
+		return errors.Wrap(err, "Store.BFReserve kv.setTypedData")
+	}
+	return nil
+}
+
+// BFAdd adds an item to the bloom filter stored under key, creating a filter with the default
+// capacity and error rate if the key does not exist. It returns false if the item was
+// (probably) already present.
+func (kv *Store) BFAdd(key string, item []byte) (bool, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return false, err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	bf, err := kv.bloomFilter(key)
+	if errors.Is(err, ErrNotFound) {
+		bf = newBloomFilter(DefaultBloomCapacity, DefaultBloomErrorRate)
+	} else if err != nil {
+		return false, err
+	}
+
+	if !bf.add(item) {
+		return false, nil
+	}
+	if err := kv.setTypedData(key, bf.encode(), BloomValue); err != nil {
+		return false, errors.Wrap(err, "Store.BFAdd kv.setTypedData")
+	}
+	return true, nil
+}
+
+// BFExists reports whether an item may have been added to the bloom filter stored under key.
+// A false result means the item has definitely not been added.
+func (kv *Store) BFExists(key string, item []byte) (bool, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return false, err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	bf, err := kv.bloomFilter(key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return bf.test(item), nil
+}
+
+// bloomFilter returns the decoded bloom filter stored under key. The caller must hold the write lock.
+func (kv *Store) bloomFilter(key string) (*bloomFilter, error) {
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return nil, err
+	}
+	if mv.Type != BloomValue {
+		return nil, ErrWrongType
+	}
+	return decodeBloomFilter(mv.Data)
+}
+
+// newBloomFilter sizes a bloom filter for n items at false-positive rate p.
+func newBloomFilter(n uint, p float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{m: m, k: k, bits: make([]byte, (m+7)/8)}
+}
+
+// add sets the item's bits and returns true if any bit was previously unset.
+func (bf *bloomFilter) add(item []byte) bool {
+	added := false
+	bf.probe(item, func(i uint64) bool {
+		if bf.bits[i/8]&(1<<(i%8)) == 0 {
+			bf.bits[i/8] |= 1 << (i % 8)
+			added = true
+		}
+		return true
+	})
+	return added
+}
+
+// test returns true if all of the item's bits are set.
+func (bf *bloomFilter) test(item []byte) bool {
+	present := true
+	bf.probe(item, func(i uint64) bool {
+		present = bf.bits[i/8]&(1<<(i%8)) != 0
+		return present
+	})
+	return present
+}
+
+// probe calls f with each of the item's k bit positions, using double hashing, until f returns false.
+func (bf *bloomFilter) probe(item []byte, f func(i uint64) bool) {
+	h1 := fnv.New64a()
+	_, _ = h1.Write(item)
+	h2 := fnv.New64()
+	_, _ = h2.Write(item)
+	a, b := h1.Sum64(), h2.Sum64()|1
+	for i := uint64(0); i < bf.k; i++ {
+		if !f((a + i*b) % bf.m) {
+			return
+		}
+	}
+}
+
+// encode serialises the filter as m and k followed by the bit set.
+func (bf *bloomFilter) encode() []byte {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(bf.bits))
+	buf = binary.AppendUvarint(buf, bf.m)
+	buf = binary.AppendUvarint(buf, bf.k)
+	return append(buf, bf.bits...)
+}
+
+// decodeBloomFilter reverses bloomFilter.encode.
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	m, n := binary.Uvarint(data)
+	if n <= 0 || m == 0 {
+		return nil, ErrCorruptBloomFilter
+	}
+	data = data[n:]
+	k, n := binary.Uvarint(data)
+	if n <= 0 || k == 0 {
+		return nil, ErrCorruptBloomFilter
+	}
+	data = data[n:]
+	if uint64(len(data)) != (m+7)/8 {
+		return nil, ErrCorruptBloomFilter
+	}
+	return &bloomFilter{m: m, k: k, bits: append([]byte(nil), data...)}, nil
+}
@@ -0,0 +1,92 @@
+package kvstore
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Broadcaster tells other store instances sharing the same persister which keys have changed,
+// so they can discard stale in-memory copies. The peer package provides a gossip implementation.
+type Broadcaster interface {
+	// Broadcast announces that a key was written or deleted. It is called while the store is
+	// locked, so it must not block or call back into the store.
+	Broadcast(key string)
+
+	// Subscribe registers the function called for each key another instance announces.
+	Subscribe(invalidate func(key string))
+}
+
+// broadcast announces a changed key, if the store has a Broadcaster.
+func (kv *Store) broadcast(key string) {
+	if kv.broadcaster != nil {
+		kv.broadcaster.Broadcast(key)
+	}
+}
+
+// Invalidate discards the in-memory copy of a key that another instance has changed in the shared
+// persister. The key's metadata is read again and its value is reloaded when it is next read; if the
+// key is no longer persisted it is removed. Keys with local writes that have not been persisted are kept,
+// as are keys whose metadata cannot be read for another reason, such as a transient I/O error.
+func (kv *Store) Invalidate(key string) {
+	if err := kv.Reload(key); err != nil {
+		log.Warn().Msgf("[kvstore invalidate] error reloading key %s, keeping the in-memory copy: %s", key, err.Error())
+	}
+}
+
+// Reload reads a key's metadata again from the first persister, as Invalidate does, returning the
+// error if it cannot be read. A key that is no longer persisted is removed from memory and nil is
+// returned; after any other error the in-memory copy is kept.
+func (kv *Store) Reload(key string) error {
+	_, err := kv.reload(kv.canonicalKey(key))
+	return err
+}
+
+// reload reads a canonical key's metadata again for Reload and Refresh, reporting whether the
+// in-memory copy was replaced or removed. A key whose persisted version and timestamp have not
+// changed keeps its loaded value.
+func (kv *Store) reload(key string) (bool, error) {
+	if len(kv.persistence) == 0 {
+		return false, nil
+	}
+	mv, err := kv.persistence[0].Read(key, false)
+	if err != nil && !notPersisted(err) {
+		return false, errors.Wrap(err, "Store.Reload Read")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	old, ok := kv.data[key]
+	if ok && old.dirty {
+		return false, nil
+	}
+	kv.misses.forget(key)
+
+	if err != nil {
+		if !ok {
+			return false, nil
+		}
+		kv.forget(key)
+		return true, nil
+	}
+	var oldDeps []string
+	if ok {
+		if old.Version == mv.Version && old.Ts.Equal(mv.Ts) {
+			return false, nil
+		}
+		oldDeps = old.DependsOn
+	}
+	if mv.Version > kv.version {
+		kv.version = mv.Version
+	}
+	kv.replaceItem(key, mv)
+	kv.trackDependencies(key, oldDeps, mv.DependsOn)
+	return true, nil
+}
+
+// notPersisted reports whether a persister error means the key is not stored, either ErrNotFound or
+// a missing file, as the filesystem persisters report it.
+func notPersisted(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, os.ErrNotExist)
+}
@@ -0,0 +1,186 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bulkBatchSize is the number of keys DeleteWhere and SetTTLWhere change under each hold of the write lock.
+const bulkBatchSize = 500
+
+// DeleteWhere deletes every live key that passes the filters and for which pred returns true,
+// returning the number of keys deleted. It suits enforcing retention policies over large stores:
+// the keys are changed in batches, releasing the write lock between them so other operations are
+// not held up, and each batch is deleted from the persisters in one operation where they implement
+// BatchDeleter. A nil pred matches every key that passes the filters.
+//
+// pred is called while the store's lock is held, so it must not call the Store's methods. It is
+// called again for each key just before the key is deleted, so a key changed after it was first
+// matched is only deleted if it still matches.
+func (kv *Store) DeleteWhere(pred func(key string, meta ItemInfo) bool, options ...RangeOption) (int, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	f := kv.newRangeFilter(options)
+	keys := kv.matchingKeys(pred, f)
+
+	deleted := 0
+	for start := 0; start < len(keys); start += bulkBatchSize {
+		n, err := kv.deleteBatch(keys[start:min(start+bulkBatchSize, len(keys))], pred, f)
+		deleted += n
+		if err != nil {
+			return deleted, errors.Wrap(err, "Store.DeleteWhere")
+		}
+	}
+	return deleted, nil
+}
+
+// SetTTLWhere sets the TTL, in seconds, of every live key that passes the filters and for which
+// pred returns true, returning the number of keys changed. Keys are changed in batches as with
+// DeleteWhere, and each batch is written to the persisters in one operation where they implement
+// BatchWriter. A nil pred matches every key that passes the filters.
+//
+// pred is called while the store's lock is held, so it must not call the Store's methods.
+func (kv *Store) SetTTLWhere(pred func(key string, meta ItemInfo) bool, ttl int64, options ...RangeOption) (int, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	f := kv.newRangeFilter(options)
+	keys := kv.matchingKeys(pred, f)
+
+	changed := 0
+	for start := 0; start < len(keys); start += bulkBatchSize {
+		n, err := kv.setTTLBatch(keys[start:min(start+bulkBatchSize, len(keys))], pred, f, TTLType(ttl))
+		changed += n
+		if err != nil {
+			return changed, errors.Wrap(err, "Store.SetTTLWhere")
+		}
+	}
+	return changed, nil
+}
+
+// matchingKeys returns the canonical keys of the live items that pass the filters and pred.
+func (kv *Store) matchingKeys(pred func(key string, meta ItemInfo) bool, f rangeFilter) []string {
+	kv.resolveAll()
+
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	keys := make([]string, 0)
+	for k, v := range kv.data {
+		if kv.matchesWhere(k, v, f, pred, now) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// stillMatches returns the item of a key if it is live and still passes the filters and pred.
+// The caller must hold the write lock.
+func (kv *Store) stillMatches(key string, pred func(key string, meta ItemInfo) bool, f rangeFilter) (*ValueItem, bool) {
+	mv, ok := kv.data[key]
+	if !ok || !kv.matchesWhere(key, mv, f, pred, kv.nowFunc()) {
+		return nil, false
+	}
+	return mv, true
+}
+
+// matchesWhere reports whether a live item passes the filters and pred.
+func (kv *Store) matchesWhere(key string, mv *ValueItem, f rangeFilter, pred func(key string, meta ItemInfo) bool, now time.Time) bool {
+	if kv.expired(key, mv, now) || !f.matches(key, mv) {
+		return false
+	}
+	return pred == nil || pred(mv.displayKey(key), mv.info())
+}
+
+// deleteBatch deletes the keys that still match, removing them from the persisters as one batch.
+func (kv *Store) deleteBatch(keys []string, pred func(key string, meta ItemInfo) bool, f rangeFilter) (int, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	deleted := make([]string, 0, len(keys))
+	persisted := make([]string, 0, len(keys))
+	events := make(map[string]RemovalEvent)
+	for _, k := range keys {
+		mv, ok := kv.stillMatches(k, pred, f)
+		if !ok {
+			continue
+		}
+		if event, notify := kv.removalEvent(k, mv, RemovalDeleted); notify {
+			events[k] = event
+		}
+		kv.unindexItem(k, mv)
+		deleted = append(deleted, k)
+		if !kv.ephemeral(k) {
+			persisted = append(persisted, k)
+		}
+	}
+
+	var returnError error
+	if len(persisted) > 0 {
+		for _, p := range kv.persistence {
+			if err := deleteMulti(p, persisted); err != nil {
+				returnError = errors.Wrap(err, "p.DeleteMulti")
+			}
+		}
+	}
+	for _, k := range deleted {
+		if event, ok := events[k]; ok && (returnError == nil || kv.ephemeral(k)) {
+			kv.queueRemoval(event)
+		}
+	}
+	for _, k := range persisted {
+		kv.broadcast(k)
+	}
+	for _, k := range deleted {
+		kv.invalidateDependents(k)
+	}
+	return len(deleted), returnError
+}
+
+// setTTLBatch sets the TTL of the keys that still match, writing them to the persisters as one batch.
+func (kv *Store) setTTLBatch(keys []string, pred func(key string, meta ItemInfo) bool, f rangeFilter, ttl TTLType) (int, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	now := kv.nowFunc()
+	changed := make([]string, 0, len(keys))
+	for _, k := range keys {
+		mv, ok := kv.stillMatches(k, pred, f)
+		if !ok {
+			continue
+		}
+		mv.TTL = ttl
+		kv.applyExpiry(mv, now)
+		changed = append(changed, k)
+	}
+	return len(changed), kv.persistBatch(changed)
+}
+
+// deleteMulti deletes the keys from p as a single batch if it supports it, otherwise one at a time.
+func deleteMulti(p DataPersister, keys []string) error {
+	if bd, ok := p.(BatchDeleter); ok {
+		return bd.DeleteMulti(keys)
+	}
+	for _, k := range keys {
+		if err := p.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMulti writes the items to p as a single batch if it supports it, otherwise one at a time.
+func writeMulti(p DataPersister, items map[string]*ValueItem) error {
+	if bw, ok := p.(BatchWriter); ok {
+		return bw.WriteMulti(items)
+	}
+	for k, mv := range items {
+		if err := p.Write(k, mv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
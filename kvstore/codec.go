@@ -0,0 +1,26 @@
+package kvstore
+
+import "encoding/json"
+
+// Codec converts between Go values and the bytes held in the store.
+type Codec interface {
+
+	// Marshal encodes v into bytes.
+	Marshal(v any) ([]byte, error)
+
+	// Unmarshal decodes data into the value pointed to by v.
+	Unmarshal(data []byte, v any) error
+}
+
+// JSONCodec is a Codec that encodes values as JSON.
+type JSONCodec struct{}
+
+// Marshal encodes v as JSON.
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes JSON data into v.
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,124 @@
+package kvstore
+
+import (
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// configPollInterval is how often a watched configuration file is checked for changes.
+const configPollInterval = time.Second
+
+// Config holds the store settings that can be changed while the store is running.
+// Fields left nil are not changed when the Config is applied.
+// It can be loaded from YAML or JSON, with durations written as strings such as "90s".
+type Config struct {
+	EvictionFrequency *time.Duration `yaml:"evictionFrequency" json:"evictionFrequency"`
+	UnloadAfter       *time.Duration `yaml:"unloadAfter" json:"unloadAfter"`
+	MemoryLimit       *int64         `yaml:"memoryLimit" json:"memoryLimit"`
+	DefaultTTL        *time.Duration `yaml:"defaultTTL" json:"defaultTTL"`
+}
+
+// LoadConfigFile reads a YAML or JSON configuration file.
+func LoadConfigFile(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, errors.Wrap(err, "LoadConfigFile ReadFile")
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return cfg, errors.Wrap(err, "LoadConfigFile Unmarshal")
+	}
+	return cfg, nil
+}
+
+// ApplyConfig applies the non-nil settings of cfg to the running store.
+func (kv *Store) ApplyConfig(cfg Config) {
+	kv.lock.Lock()
+	if cfg.EvictionFrequency != nil {
+		kv.evictionFreq = *cfg.EvictionFrequency
+	}
+	if cfg.UnloadAfter != nil {
+		kv.unloadAfterTime = *cfg.UnloadAfter
+	}
+	if cfg.MemoryLimit != nil {
+		kv.memoryLimit = *cfg.MemoryLimit
+	}
+	if cfg.DefaultTTL != nil {
+		kv.defaultTTL = *cfg.DefaultTTL
+	}
+	kv.lock.Unlock()
+	kv.signalReconfigure()
+}
+
+// defaultTTLSeconds returns the TTL applied to a new key, which is the default of its namespace if
+// it sets one. The caller must hold the store lock.
+func (kv *Store) defaultTTLSeconds(key string) TTLType {
+	ttl := kv.defaultTTL
+	if ns := kv.namespaceOf(key); ns != nil && ns.defaultTTL > 0 {
+		ttl = ns.defaultTTL
+	}
+	if ttl <= 0 {
+		return TTLNoExpirySet
+	}
+	return TTLType(math.Ceil(ttl.Seconds()))
+}
+
+// applyExpiry starts an item's TTL at now, moving the deadline by a random amount of up to the
+// fraction set with WithTTLJitterOption either way. The caller must hold the write lock.
+func (kv *Store) applyExpiry(mv *ValueItem, now time.Time) {
+	mv.setExpiry(now)
+	if kv.ttlJitter <= 0 || mv.ExpiresAt.IsZero() {
+		return
+	}
+	ttl := float64(time.Duration(mv.TTL) * time.Second)
+	mv.ExpiresAt = mv.ExpiresAt.Add(time.Duration((rand.Float64()*2 - 1) * kv.ttlJitter * ttl))
+}
+
+// loadConfigFile applies the configuration file and starts watching it for changes.
+func (kv *Store) loadConfigFile() error {
+	if kv.configPath == "" {
+		return nil
+	}
+	info, err := os.Stat(kv.configPath)
+	if err != nil {
+		return errors.Wrap(err, "Store.loadConfigFile Stat")
+	}
+	cfg, err := LoadConfigFile(kv.configPath)
+	if err != nil {
+		return err
+	}
+	kv.ApplyConfig(cfg)
+	go kv.watchConfigFile(info.ModTime())
+	return nil
+}
+
+// watchConfigFile polls the configuration file and applies it whenever it is modified.
+func (kv *Store) watchConfigFile(lastMod time.Time) {
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(kv.configPath)
+			if err != nil || info.ModTime().Equal(lastMod) {
+				continue
+			}
+			cfg, err := LoadConfigFile(kv.configPath)
+			if err != nil {
+				log.Error().Msgf("[kvstore config] error reloading %s error: %s", kv.configPath, err.Error())
+				continue
+			}
+			lastMod = info.ModTime()
+			kv.ApplyConfig(cfg)
+			log.Info().Msgf("[kvstore config] reloaded %s", kv.configPath)
+		case <-kv.ctx.Done():
+			return
+		}
+	}
+}
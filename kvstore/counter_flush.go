@@ -0,0 +1,83 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// deferCounters reports whether counter updates are persisted in checkpoints rather than on every increment.
+func (kv *Store) deferCounters() bool {
+	return kv.counterFlushFreq > 0 || kv.counterFlushDelta > 0
+}
+
+// persistCounter persists a counter after it changed by delta. With WithCounterFlushOption the write is
+// deferred, leaving the counter dirty until its unpersisted change reaches the delta threshold or the
+// next checkpoint. The caller must hold the write lock.
+func (kv *Store) persistCounter(key string, delta int64) error {
+	if !kv.deferCounters() {
+		return kv.persistData(key)
+	}
+	if !kv.pendCounter(key, delta) {
+		return nil
+	}
+	return kv.persistData(key)
+}
+
+// pendCounter records an unpersisted change of delta to a counter, reporting whether it should now be persisted.
+// The caller must hold the write lock.
+func (kv *Store) pendCounter(key string, delta int64) bool {
+	if len(kv.persistence) == 0 || kv.ephemeral(key) {
+		return false
+	}
+	mv := kv.data[key]
+	if delta < 0 {
+		delta = -delta
+	}
+	mv.pendingDelta += delta
+	kv.markDirty(key, mv)
+	return kv.counterFlushDelta > 0 && mv.pendingDelta >= kv.counterFlushDelta
+}
+
+// CheckpointCounters persists every counter with deferred updates. It is called periodically when
+// WithCounterFlushOption sets an interval, and when the store is closed.
+func (kv *Store) CheckpointCounters() error {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.checkpointCounters()
+}
+
+// checkpointCounters persists every counter with deferred updates. The caller must hold the write lock.
+func (kv *Store) checkpointCounters() error {
+	keys := make([]string, 0)
+	for k, mv := range kv.data {
+		if mv.dirty && mv.pendingDelta > 0 {
+			keys = append(keys, k)
+		}
+	}
+	if err := kv.persistBatch(keys); err != nil {
+		return errors.Wrap(err, "Store.CheckpointCounters")
+	}
+	return nil
+}
+
+// counterFlushController checkpoints deferred counter updates periodically until the store is closed.
+func (kv *Store) counterFlushController() {
+	if kv.counterFlushFreq <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(kv.counterFlushFreq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := kv.CheckpointCounters(); err != nil {
+				log.Error().Msgf("[kvstore counters] checkpoint error: %s", err.Error())
+			}
+		case <-kv.ctx.Done():
+			return
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package kvstore
 
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 // DataPersister defines the methods that must be implemented for data persistence in a key-value store.
 // Multiple DataPersisters can be associated with a single store to allow for various persistence strategies.
 //
@@ -26,3 +33,145 @@ type DataPersister interface {
 	// Keys returns a slice containing all keys stored in the persistence layer.
 	Keys() ([]string, error)
 }
+
+// BatchWriter is an optional interface a DataPersister can implement to persist
+// several ValueItems in a single operation, such as one transaction or request.
+type BatchWriter interface {
+
+	// WriteMulti persists all the given ValueItems, keyed by their keys.
+	WriteMulti(items map[string]*ValueItem) error
+}
+
+// BatchDeleter is an optional interface a DataPersister can implement to delete several keys in one operation.
+type BatchDeleter interface {
+
+	// DeleteMulti removes the given keys. Keys that do not exist are ignored.
+	DeleteMulti(keys []string) error
+}
+
+// Flusher is an optional interface for DataPersisters that queue writes,
+// allowing the store to wait for queued writes to complete on shutdown.
+type Flusher interface {
+
+	// Flush blocks until all queued operations have been applied.
+	Flush() error
+}
+
+// Compactor is an optional interface for DataPersisters that can reclaim space,
+// such as by removing expired values that were never deleted.
+type Compactor interface {
+
+	// Compact reclaims space held by the persister.
+	Compact() error
+}
+
+// Patcher is an optional interface for DataPersisters that can overwrite part of a stored value
+// without rewriting all of it.
+type Patcher interface {
+
+	// Patch writes data at offset within the stored value of key, and the metadata of item,
+	// which holds the complete value after the patch.
+	Patch(key string, offset int64, data []byte, item *ValueItem) error
+}
+
+// Migrator is an optional interface for DataPersisters whose storage layout is versioned, letting the
+// store upgrade data written in older layouts before loading it.
+type Migrator interface {
+
+	// Migrate rewrites data stored in older layouts in the current layout.
+	Migrate() error
+}
+
+// BatchReader is an optional interface a DataPersister can implement to read several keys in
+// a single round trip, for backends where each call is expensive.
+type BatchReader interface {
+
+	// ReadMulti retrieves the ValueItems of the given keys, keyed by key. Keys that cannot be read
+	// are omitted; an error is only returned if the batch as a whole fails.
+	ReadMulti(keys []string, readValue bool) (map[string]*ValueItem, error)
+}
+
+// ChangeLister is an optional interface for DataPersisters that can list the keys written since a
+// time without reading them, so a follower's Refresh only reads the metadata of keys that changed.
+type ChangeLister interface {
+
+	// ChangedSince returns the keys written at or after since.
+	ChangedSince(since time.Time) ([]string, error)
+}
+
+// Usage is the space a DataPersister's backend holds.
+type Usage struct {
+	Bytes int64
+	Keys  int
+}
+
+// UsageReporter is an optional interface for DataPersisters that can report how much space their
+// backend uses, so quota and capacity alerts can be driven from Store.Stats. Wrapping persisters
+// return ErrUsageNotSupported when the persister they wrap cannot report usage.
+type UsageReporter interface {
+
+	// Usage returns the total bytes and number of keys held by the backend.
+	Usage() (Usage, error)
+}
+
+// ErrUsageNotSupported returned by UsageReporters that wrap a persister which cannot report usage.
+var ErrUsageNotSupported error = errors.New("persister does not report usage")
+
+// UsageOf returns the usage reported by p, or ErrUsageNotSupported if it does not implement UsageReporter.
+func UsageOf(p DataPersister) (Usage, error) {
+	if ur, ok := p.(UsageReporter); ok {
+		return ur.Usage()
+	}
+	return Usage{}, ErrUsageNotSupported
+}
+
+// readMulti reads several keys from p, as a single batch if p implements BatchReader.
+func readMulti(p DataPersister, keys []string, readValue bool) (map[string]*ValueItem, error) {
+	if br, ok := p.(BatchReader); ok {
+		return br.ReadMulti(keys, readValue)
+	}
+
+	items := make(map[string]*ValueItem, len(keys))
+	for _, k := range keys {
+		if mv, err := p.Read(k, readValue); err == nil {
+			items[k] = mv
+		}
+	}
+	return items, nil
+}
+
+// readMultiConcurrently reads several keys from p, splitting them into up to parallelism batches
+// that are read at the same time. Each batch is read with readMulti.
+func readMultiConcurrently(p DataPersister, keys []string, readValue bool, parallelism int) (map[string]*ValueItem, error) {
+	if parallelism <= 1 || len(keys) < 2 {
+		return readMulti(p, keys, readValue)
+	}
+
+	batchSize := (len(keys) + parallelism - 1) / parallelism
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var returnError error
+	items := make(map[string]*ValueItem, len(keys))
+	for start := 0; start < len(keys); start += batchSize {
+		batch := keys[start:min(start+batchSize, len(keys))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read, err := readMulti(p, batch, readValue)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				returnError = err
+				return
+			}
+			for k, mv := range read {
+				items[k] = mv
+			}
+		}()
+	}
+	wg.Wait()
+	if returnError != nil {
+		return nil, returnError
+	}
+	return items, nil
+}
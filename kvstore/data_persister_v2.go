@@ -0,0 +1,374 @@
+package kvstore
+
+import (
+	"context"
+	"time"
+)
+
+// DataPersisterV2 is a context-aware version of DataPersister, so that timeouts and cancellation
+// propagate into network-backed backends. Use AdaptV2 to give a DataPersisterV2 to a Store, and
+// AdaptV1 to use an existing DataPersister where a DataPersisterV2 is expected.
+//
+// The optional interfaces of DataPersister have context-aware versions below. The adapters forward
+// each of them, so batching, flushing and the other optional operations keep working across them.
+type DataPersisterV2 interface {
+
+	// Write persists the ValueItem associated with the given key.
+	Write(ctx context.Context, key string, data *ValueItem) error
+
+	// Read retrieves the ValueItem associated with the given key.
+	// The 'readValue' parameter controls whether to fetch the actual data value or just metadata.
+	Read(ctx context.Context, key string, readValue bool) (*ValueItem, error)
+
+	// Delete removes the key-value pair associated with the given key.
+	Delete(ctx context.Context, key string) error
+
+	// Keys returns a slice containing all keys stored in the persistence layer.
+	Keys(ctx context.Context) ([]string, error)
+}
+
+// BatchWriterV2 is the context-aware version of BatchWriter.
+type BatchWriterV2 interface {
+	WriteMulti(ctx context.Context, items map[string]*ValueItem) error
+}
+
+// BatchReaderV2 is the context-aware version of BatchReader.
+type BatchReaderV2 interface {
+	ReadMulti(ctx context.Context, keys []string, readValue bool) (map[string]*ValueItem, error)
+}
+
+// BatchDeleterV2 is the context-aware version of BatchDeleter.
+type BatchDeleterV2 interface {
+	DeleteMulti(ctx context.Context, keys []string) error
+}
+
+// FlusherV2 is the context-aware version of Flusher.
+type FlusherV2 interface {
+	Flush(ctx context.Context) error
+}
+
+// CompactorV2 is the context-aware version of Compactor.
+type CompactorV2 interface {
+	Compact(ctx context.Context) error
+}
+
+// PatcherV2 is the context-aware version of Patcher.
+type PatcherV2 interface {
+	Patch(ctx context.Context, key string, offset int64, data []byte, item *ValueItem) error
+}
+
+// MigratorV2 is the context-aware version of Migrator.
+type MigratorV2 interface {
+	Migrate(ctx context.Context) error
+}
+
+// UsageReporterV2 is the context-aware version of UsageReporter.
+type UsageReporterV2 interface {
+	Usage(ctx context.Context) (Usage, error)
+}
+
+// ChangeListerV2 is the context-aware version of ChangeLister.
+type ChangeListerV2 interface {
+	ChangedSince(ctx context.Context, since time.Time) ([]string, error)
+}
+
+// AdaptV1 returns a DataPersisterV2 that calls p. DataPersisters cannot be interrupted, so the
+// context is only checked before each call is made.
+func AdaptV1(p DataPersister) DataPersisterV2 {
+	if a, ok := p.(*v2Adapter); ok && a.parent == context.Background() {
+		return a.persister
+	}
+	return &v1Adapter{persister: p}
+}
+
+// AdaptV2 returns a DataPersister that calls p, giving each call a context that times out after
+// timeout. A timeout of zero leaves calls without a deadline.
+func AdaptV2(p DataPersisterV2, timeout time.Duration) DataPersister {
+	return AdaptV2Context(context.Background(), p, timeout)
+}
+
+// AdaptV2Context is AdaptV2 with the context of each call derived from ctx, so cancelling ctx, such
+// as when the application shuts down, cancels the calls in progress and fails those made afterwards.
+//
+// Example:
+//
+//	kvstore.New(kvstore.WithPersistenceOption(kvstore.AdaptV2Context(appCtx, remote, 5*time.Second)))
+func AdaptV2Context(ctx context.Context, p DataPersisterV2, timeout time.Duration) DataPersister {
+	if a, ok := p.(*v1Adapter); ok && ctx == context.Background() {
+		return a.persister
+	}
+	return &v2Adapter{persister: p, parent: ctx, timeout: timeout}
+}
+
+// v1Adapter adapts a DataPersister to DataPersisterV2.
+type v1Adapter struct {
+	persister DataPersister
+}
+
+func (a *v1Adapter) Write(ctx context.Context, key string, data *ValueItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.persister.Write(key, data)
+}
+
+func (a *v1Adapter) Read(ctx context.Context, key string, readValue bool) (*ValueItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.persister.Read(key, readValue)
+}
+
+func (a *v1Adapter) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return a.persister.Delete(key)
+}
+
+func (a *v1Adapter) Keys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return a.persister.Keys()
+}
+
+func (a *v1Adapter) WriteMulti(ctx context.Context, items map[string]*ValueItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return writeMulti(a.persister, items)
+}
+
+func (a *v1Adapter) ReadMulti(ctx context.Context, keys []string, readValue bool) (map[string]*ValueItem, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return readMulti(a.persister, keys, readValue)
+}
+
+func (a *v1Adapter) DeleteMulti(ctx context.Context, keys []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return deleteMulti(a.persister, keys)
+}
+
+func (a *v1Adapter) Flush(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f, ok := a.persister.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+func (a *v1Adapter) Compact(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c, ok := a.persister.(Compactor); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+func (a *v1Adapter) Patch(ctx context.Context, key string, offset int64, data []byte, item *ValueItem) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if p, ok := a.persister.(Patcher); ok {
+		return p.Patch(key, offset, data, item)
+	}
+	return a.persister.Write(key, item)
+}
+
+func (a *v1Adapter) Migrate(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if m, ok := a.persister.(Migrator); ok {
+		return m.Migrate()
+	}
+	return nil
+}
+
+func (a *v1Adapter) Usage(ctx context.Context) (Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return Usage{}, err
+	}
+	return UsageOf(a.persister)
+}
+
+func (a *v1Adapter) ChangedSince(ctx context.Context, since time.Time) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cl, ok := a.persister.(ChangeLister); ok {
+		return cl.ChangedSince(since)
+	}
+	return a.persister.Keys()
+}
+
+// Close forwards to the adapted persister if it holds resources.
+func (a *v1Adapter) Close() {
+	if c, ok := a.persister.(closer); ok {
+		c.Close()
+	}
+}
+
+// v2Adapter adapts a DataPersisterV2 to DataPersister.
+type v2Adapter struct {
+	persister DataPersisterV2
+	parent    context.Context
+	timeout   time.Duration
+}
+
+// context returns the context for a single call.
+func (a *v2Adapter) context() (context.Context, context.CancelFunc) {
+	if a.timeout <= 0 {
+		return context.WithCancel(a.parent)
+	}
+	return context.WithTimeout(a.parent, a.timeout)
+}
+
+func (a *v2Adapter) Write(key string, data *ValueItem) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	return a.persister.Write(ctx, key, data)
+}
+
+func (a *v2Adapter) Read(key string, readValue bool) (*ValueItem, error) {
+	ctx, cancel := a.context()
+	defer cancel()
+	return a.persister.Read(ctx, key, readValue)
+}
+
+func (a *v2Adapter) Delete(key string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	return a.persister.Delete(ctx, key)
+}
+
+func (a *v2Adapter) Keys() ([]string, error) {
+	ctx, cancel := a.context()
+	defer cancel()
+	return a.persister.Keys(ctx)
+}
+
+// WriteMulti writes the items as one batch if the adapted persister supports it, otherwise one at a time.
+func (a *v2Adapter) WriteMulti(items map[string]*ValueItem) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	if bw, ok := a.persister.(BatchWriterV2); ok {
+		return bw.WriteMulti(ctx, items)
+	}
+	for k, mv := range items {
+		if err := a.persister.Write(ctx, k, mv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMulti reads the keys as one batch if the adapted persister supports it, otherwise one at a time.
+func (a *v2Adapter) ReadMulti(keys []string, readValue bool) (map[string]*ValueItem, error) {
+	ctx, cancel := a.context()
+	defer cancel()
+	if br, ok := a.persister.(BatchReaderV2); ok {
+		return br.ReadMulti(ctx, keys, readValue)
+	}
+	items := make(map[string]*ValueItem, len(keys))
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if mv, err := a.persister.Read(ctx, k, readValue); err == nil {
+			items[k] = mv
+		}
+	}
+	return items, nil
+}
+
+// DeleteMulti deletes the keys as one batch if the adapted persister supports it, otherwise one at a time.
+func (a *v2Adapter) DeleteMulti(keys []string) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	if bd, ok := a.persister.(BatchDeleterV2); ok {
+		return bd.DeleteMulti(ctx, keys)
+	}
+	for _, k := range keys {
+		if err := a.persister.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush forwards to the adapted persister if it queues writes.
+func (a *v2Adapter) Flush() error {
+	if f, ok := a.persister.(FlusherV2); ok {
+		ctx, cancel := a.context()
+		defer cancel()
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+// Compact forwards to the adapted persister if it can reclaim space.
+func (a *v2Adapter) Compact() error {
+	if c, ok := a.persister.(CompactorV2); ok {
+		ctx, cancel := a.context()
+		defer cancel()
+		return c.Compact(ctx)
+	}
+	return nil
+}
+
+// Patch forwards to the adapted persister if it can patch values, otherwise writes the whole value.
+func (a *v2Adapter) Patch(key string, offset int64, data []byte, item *ValueItem) error {
+	ctx, cancel := a.context()
+	defer cancel()
+	if p, ok := a.persister.(PatcherV2); ok {
+		return p.Patch(ctx, key, offset, data, item)
+	}
+	return a.persister.Write(ctx, key, item)
+}
+
+// Migrate forwards to the adapted persister if its layout is versioned.
+func (a *v2Adapter) Migrate() error {
+	if m, ok := a.persister.(MigratorV2); ok {
+		ctx, cancel := a.context()
+		defer cancel()
+		return m.Migrate(ctx)
+	}
+	return nil
+}
+
+// Usage forwards to the adapted persister if it reports usage.
+func (a *v2Adapter) Usage() (Usage, error) {
+	if ur, ok := a.persister.(UsageReporterV2); ok {
+		ctx, cancel := a.context()
+		defer cancel()
+		return ur.Usage(ctx)
+	}
+	return Usage{}, ErrUsageNotSupported
+}
+
+// ChangedSince forwards to the adapted persister if it lists changed keys, otherwise lists every key.
+func (a *v2Adapter) ChangedSince(since time.Time) ([]string, error) {
+	ctx, cancel := a.context()
+	defer cancel()
+	if cl, ok := a.persister.(ChangeListerV2); ok {
+		return cl.ChangedSince(ctx, since)
+	}
+	return a.persister.Keys(ctx)
+}
+
+// Close forwards to the adapted persister if it holds resources.
+func (a *v2Adapter) Close() {
+	if c, ok := a.persister.(closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,84 @@
+package kvstore
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// checkDependencyCycle returns ErrDependencyCycle if setting a key with options would make it depend,
+// directly or transitively, on itself, which would delete the key as it is set. The options are
+// applied to a copy of the key's item, so nothing is changed. The caller must hold the write lock.
+func (kv *Store) checkDependencyCycle(key string, options []SetOption) error {
+	if len(options) == 0 {
+		return nil
+	}
+	probe := &ValueItem{}
+	if mv, ok := kv.data[key]; ok {
+		probe = mv.Clone()
+	}
+	for _, opt := range options {
+		opt(probe)
+	}
+	deps := make(map[string]struct{}, len(probe.DependsOn))
+	for _, d := range kv.canonicalKeys(probe.DependsOn) {
+		if d != key {
+			deps[d] = struct{}{}
+		}
+	}
+	if len(deps) == 0 {
+		return nil
+	}
+
+	// A cycle forms if any of the new dependencies already depends on key.
+	seen := map[string]struct{}{key: {}}
+	queue := []string{key}
+	for len(queue) > 0 {
+		k := queue[0]
+		queue = queue[1:]
+		for d := range kv.dependents[k] {
+			if _, ok := deps[d]; ok {
+				return errors.Wrapf(ErrDependencyCycle, "Store.Set key %s depends on %s", key, d)
+			}
+			if _, ok := seen[d]; !ok {
+				seen[d] = struct{}{}
+				queue = append(queue, d)
+			}
+		}
+	}
+	return nil
+}
+
+// trackDependencies updates the reverse dependency index when a key's dependencies change.
+// The caller must hold the write lock.
+func (kv *Store) trackDependencies(key string, oldDeps, newDeps []string) {
+	for _, d := range oldDeps {
+		if dependents, ok := kv.dependents[d]; ok {
+			delete(dependents, key)
+			if len(dependents) == 0 {
+				delete(kv.dependents, d)
+			}
+		}
+	}
+	for _, d := range newDeps {
+		if d == key {
+			continue
+		}
+		if _, ok := kv.dependents[d]; !ok {
+			kv.dependents[d] = make(map[string]struct{})
+		}
+		kv.dependents[d][key] = struct{}{}
+	}
+}
+
+// invalidateDependents deletes every key that depends, directly or transitively, on key.
+// The caller must hold the write lock.
+func (kv *Store) invalidateDependents(key string) {
+	for d := range kv.dependents[key] {
+		if _, ok := kv.data[d]; !ok {
+			continue
+		}
+		if err := kv.delete(d, RemovalDeleted); err != nil {
+			log.Error().Msgf("[kvstore dependencies] error invalidating key %s error: %s", d, err.Error())
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package kvstore
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// earlyExpired reports whether a read should treat an item as expired ahead of its expiry, using
+// XFetch: the item is expired early when now - cost * beta * ln(rand) reaches its expiry, so the
+// chance grows as the expiry nears and is larger for values that take longer to recompute.
+// Items without a TTL or a recompute cost are never expired early.
+func (kv *Store) earlyExpired(mv *ValueItem, now time.Time) bool {
+	if kv.earlyExpiryBeta <= 0 || mv.RecomputeCost <= 0 {
+		return false
+	}
+	expiresAt, ok := mv.expiry()
+	if !ok {
+		return false
+	}
+
+	r := rand.Float64()
+	if r == 0 {
+		return true
+	}
+	gap := float64(mv.RecomputeCost) * kv.earlyExpiryBeta * -math.Log(r)
+	return gap >= float64(expiresAt.Sub(now))
+}
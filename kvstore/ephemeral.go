@@ -0,0 +1,15 @@
+package kvstore
+
+import "strings"
+
+// ephemeral reports whether a key is held only in memory because it matches a prefix set with
+// WithEphemeralPrefixOption. Ephemeral keys are never written to, read from or deleted from the
+// persisters, and are never unloaded, as there would be nothing to reload them from.
+func (kv *Store) ephemeral(key string) bool {
+	for _, prefix := range kv.ephemeralPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
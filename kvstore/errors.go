@@ -0,0 +1,52 @@
+package kvstore
+
+import "github.com/pkg/errors"
+
+// Errors describing why an operation failed, for callers to test with errors.Is. They are wrapped
+// with context by the Store and the persisters, so they are never returned unwrapped.
+// See also ErrNotFound, ErrKeyInvalid, ErrWrongType and the other errors of individual operations.
+var (
+	// ErrCounterMaxReached returned when a counter update would exceed the counter's maximum.
+	ErrCounterMaxReached error = errors.New("counter maximum value reached")
+
+	// ErrCounterMinReached returned when a counter update would go below the counter's minimum.
+	ErrCounterMinReached error = errors.New("counter minimum value reached")
+
+	// ErrBufferFull returned by a persistence buffer that rejects commands when its queue is full.
+	ErrBufferFull error = errors.New("persistence buffer full")
+
+	// ErrPersisterUnavailable returned when a persister cannot accept operations, such as after it is closed.
+	ErrPersisterUnavailable error = errors.New("persister unavailable")
+
+	// ErrCorrupted returned when stored data fails validation or cannot be decoded.
+	ErrCorrupted error = errors.New("stored data corrupted")
+
+	// ErrReadOnly returned when writing to a store created with WithReadOnlyOption.
+	ErrReadOnly error = errors.New("store is read-only")
+
+	// ErrKeyTooLong returned when a key is longer than the limit set with WithMaxKeyLengthOption.
+	// It is a kind of ErrKeyInvalid, so errors.Is(err, ErrKeyInvalid) also reports it.
+	ErrKeyTooLong error = keyTooLongError{}
+
+	// ErrDependencyCycle returned when a key is set to depend, directly or transitively, on itself.
+	ErrDependencyCycle error = errors.New("dependency cycle")
+)
+
+// keyTooLongError is the type of ErrKeyTooLong, which matches ErrKeyInvalid with errors.Is.
+type keyTooLongError struct{}
+
+func (keyTooLongError) Error() string {
+	return "key too long"
+}
+
+func (keyTooLongError) Is(target error) bool {
+	return target == ErrKeyInvalid
+}
+
+// checkWritable returns ErrReadOnly if the store does not accept writes.
+func (kv *Store) checkWritable() error {
+	if kv.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package kvstore
+
+import (
+	"time"
+	"unsafe"
+)
+
+// itemOverheadBytes approximates the memory held for each key besides its value: the ValueItem
+// and its entry in the store's map.
+const itemOverheadBytes = int64(unsafe.Sizeof(ValueItem{})) + 64
+
+// SizeEstimate forecasts the memory used by the store's keys. It is intended for sizing instances
+// before enabling preloading or raising the memory limit.
+//
+// ProjectedBytes is the memory the keys would hold if every value were loaded, including the keys
+// themselves and an allowance for per-key overhead. The growth rates count the keys created within
+// the window and the size of their values; keys deleted within the window are not subtracted.
+type SizeEstimate struct {
+	Keys             int
+	LoadedBytes      int64
+	TotalBytes       int64
+	ProjectedBytes   int64
+	AverageValueSize int64
+	Window           time.Duration
+	NewKeys          int
+	NewBytes         int64
+	KeysPerSecond    float64
+	BytesPerSecond   float64
+}
+
+// Estimate returns a forecast of the store's memory use, with growth rates measured over the
+// given window up to now.
+func (kv *Store) Estimate(window time.Duration) SizeEstimate {
+	kv.resolveAll()
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	since := now.Add(-window)
+	estimate := SizeEstimate{Window: window}
+	for k, v := range kv.data {
+		if kv.expired(k, v, now) {
+			continue
+		}
+		estimate.Keys++
+		estimate.TotalBytes += v.Size
+		estimate.ProjectedBytes += v.Size + int64(len(k)) + itemOverheadBytes
+		if v.dataLoaded {
+			estimate.LoadedBytes += int64(len(v.Data))
+		}
+		if window > 0 && v.created().After(since) {
+			estimate.NewKeys++
+			estimate.NewBytes += v.Size
+		}
+	}
+
+	if estimate.Keys > 0 {
+		estimate.AverageValueSize = estimate.TotalBytes / int64(estimate.Keys)
+	}
+	if window > 0 {
+		estimate.KeysPerSecond = float64(estimate.NewKeys) / window.Seconds()
+		estimate.BytesPerSecond = float64(estimate.NewBytes) / window.Seconds()
+	}
+	return estimate
+}
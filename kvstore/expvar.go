@@ -0,0 +1,54 @@
+package kvstore
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// expvarStores holds the open store published under each expvar name. A name is published once per
+// process, as expvar cannot remove variables; once its store is closed the variable reports null until
+// another store is created with the name.
+var expvarStores = struct {
+	lock      sync.Mutex
+	published map[string]bool
+	stores    map[string]*Store
+}{published: make(map[string]bool), stores: make(map[string]*Store)}
+
+// publishExpvar publishes the store's statistics under name, which must not be used by another open
+// store or published by the program.
+func (kv *Store) publishExpvar(name string) error {
+	expvarStores.lock.Lock()
+	defer expvarStores.lock.Unlock()
+
+	if _, ok := expvarStores.stores[name]; ok {
+		return errors.Errorf("expvar name %q is used by another open store", name)
+	}
+	if !expvarStores.published[name] {
+		if expvar.Get(name) != nil {
+			return errors.Errorf("expvar name %q is already published", name)
+		}
+		expvar.Publish(name, expvar.Func(func() any {
+			expvarStores.lock.Lock()
+			store := expvarStores.stores[name]
+			expvarStores.lock.Unlock()
+			if store == nil {
+				return nil
+			}
+			return store.Stats()
+		}))
+		expvarStores.published[name] = true
+	}
+	expvarStores.stores[name] = kv
+	return nil
+}
+
+// unpublishExpvar stops publishing the store's statistics.
+func (kv *Store) unpublishExpvar() {
+	expvarStores.lock.Lock()
+	defer expvarStores.lock.Unlock()
+	if expvarStores.stores[kv.expvarName] == kv {
+		delete(expvarStores.stores, kv.expvarName)
+	}
+}
@@ -0,0 +1,131 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// RefreshReport describes the changes a follower picked up from its first persister.
+type RefreshReport struct {
+	Added   []string // Keys written by another process that were not in memory.
+	Updated []string // Keys whose persisted version or timestamp changed; their values are reloaded when next read.
+	Removed []string // Keys no longer persisted, which were dropped from memory.
+}
+
+// refreshOverlap is how far before the previous Refresh began that changes are listed from, so writes
+// recorded with coarse file timestamps, or racing with the previous listing, are not missed.
+const refreshOverlap = time.Second
+
+// Refresh brings the in-memory key index up to date with the first persister, for stores following
+// a folder written by another process. The persisted keys are compared with the key map: new keys have
+// their metadata loaded and keys deleted from the persister are dropped. Keys the persister lists as
+// written since the previous refresh, where it implements ChangeLister, or otherwise every key, are
+// reloaded as Reload does, so their values are read again when next read. Nothing is written back;
+// keys that depend on a changed key are invalidated by the writer and picked up on a later refresh.
+func (kv *Store) Refresh() (RefreshReport, error) {
+	var report RefreshReport
+	if len(kv.persistence) == 0 {
+		return report, nil
+	}
+
+	started := time.Now()
+	persisted, unindexed, err := kv.persistedIndex()
+	if err != nil {
+		return report, errors.Wrap(err, "Store.Refresh")
+	}
+	changed, err := kv.changedKeys(persisted, unindexed)
+	if err != nil {
+		return report, errors.Wrap(err, "Store.Refresh")
+	}
+
+	kv.lock.Lock()
+	for k, mv := range kv.data {
+		if _, ok := persisted[k]; ok || mv.dirty || kv.ephemeral(k) {
+			continue
+		}
+		kv.forget(k)
+		report.Removed = append(report.Removed, k)
+	}
+	report.Added = kv.indexUnindexed(unindexed)
+	kv.lock.Unlock()
+
+	for _, k := range changed {
+		updated, err := kv.reload(k)
+		if err != nil {
+			// The next refresh lists changes from the same time, so the key is read again.
+			return report, errors.Wrapf(err, "Store.Refresh key %s", k)
+		}
+		if updated {
+			report.Updated = append(report.Updated, k)
+		}
+	}
+
+	kv.lock.Lock()
+	kv.refreshedAt = started
+	kv.lock.Unlock()
+	return report, nil
+}
+
+// changedKeys returns the persisted keys already in the key map that may have changed since the
+// previous refresh: those the first persister lists as written since then, if it implements
+// ChangeLister, or otherwise all of them.
+func (kv *Store) changedKeys(persisted map[string]struct{}, unindexed map[string]*ValueItem) ([]string, error) {
+	kv.lock.RLock()
+	since := kv.refreshedAt
+	kv.lock.RUnlock()
+
+	p := kv.persistence[0]
+	if ip, ok := p.(*instrumentedPersister); ok {
+		p = ip.DataPersister
+	}
+	var candidates []string
+	if cl, ok := p.(ChangeLister); ok && !since.IsZero() {
+		listed, err := cl.ChangedSince(since.Add(-refreshOverlap))
+		if err != nil {
+			return nil, errors.Wrap(err, "ChangedSince")
+		}
+		candidates = listed
+	} else {
+		candidates = make([]string, 0, len(persisted))
+		for k := range persisted {
+			candidates = append(candidates, k)
+		}
+	}
+
+	changed := candidates[:0]
+	for _, k := range candidates {
+		_, ok := persisted[k]
+		if _, added := unindexed[k]; ok && !added {
+			changed = append(changed, k)
+		}
+	}
+	return changed, nil
+}
+
+// followController runs Refresh periodically until the store is closed.
+func (kv *Store) followController() {
+	if kv.followFreq <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(kv.followFreq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := kv.Refresh()
+			if err != nil {
+				log.Error().Msgf("[kvstore follow] error: %s", err.Error())
+				continue
+			}
+			if len(report.Added)+len(report.Updated)+len(report.Removed) > 0 {
+				log.Debug().Msgf("[kvstore follow] added: %d updated: %d removed: %d",
+					len(report.Added), len(report.Updated), len(report.Removed))
+			}
+		case <-kv.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Geohash limits, matching the ranges used by Redis so that hashes stay comparable.
+const (
+	geoStepBits     = 26
+	geoLatitudeMin  = -85.05112878
+	geoLatitudeMax  = 85.05112878
+	geoLongitudeMin = -180.0
+	geoLongitudeMax = 180.0
+	earthRadiusM    = 6372797.560856
+)
+
+// ErrCorruptGeoSet returned when the stored encoding of a geo set cannot be decoded.
+var ErrCorruptGeoSet error = errors.Wrap(ErrCorrupted, "geo set encoding")
+
+// ErrInvalidCoordinates returned when a latitude or longitude is outside the supported range.
+var ErrInvalidCoordinates error = errors.New("invalid coordinates")
+
+// GeoMember is a named location in a geo set.
+type GeoMember struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+// GeoResult is a member returned by GeoSearch along with its distance from the search centre in metres.
+type GeoResult struct {
+	GeoMember
+	Distance float64
+}
+
+// GeoAdd adds or updates members of the geo set stored under key, creating the set if it does not exist.
+// It returns the number of members that were newly added.
+func (kv *Store) GeoAdd(key string, members ...GeoMember) (int, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return 0, err
+	}
+	for _, m := range members {
+		if !validCoordinates(m.Latitude, m.Longitude) {
+			return 0, errors.Wrapf(ErrInvalidCoordinates, "Store.GeoAdd member %q", m.Name)
+		}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	set, err := kv.geoSet(key)
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, m := range members {
+		if _, ok := set[m.Name]; !ok {
+			added++
+		}
+		set[m.Name] = geohashEncode(m.Latitude, m.Longitude)
+	}
+
+	if err := kv.setTypedData(key, encodeGeoSet(set), GeoValue); err != nil {
+		return 0, errors.Wrap(err, "Store.GeoAdd kv.setTypedData")
+	}
+	return added, nil
+}
+
+// GeoSearch returns the members of the geo set stored under key that lie within radius metres
+// of the given point, nearest first. A limit greater than zero caps the number of results.
+func (kv *Store) GeoSearch(key string, latitude, longitude, radius float64, limit int) ([]GeoResult, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return nil, err
+	}
+	if !validCoordinates(latitude, longitude) {
+		return nil, ErrInvalidCoordinates
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return nil, err
+	}
+	if mv.Type != GeoValue {
+		return nil, ErrWrongType
+	}
+	set, err := decodeGeoSet(mv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]GeoResult, 0)
+	for name, hash := range set {
+		lat, lon := geohashDecode(hash)
+		d := geoDistance(latitude, longitude, lat, lon)
+		if d <= radius {
+			results = append(results, GeoResult{GeoMember: GeoMember{Name: name, Latitude: lat, Longitude: lon}, Distance: d})
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance == results[j].Distance {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Distance < results[j].Distance
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// geoSet returns the decoded members stored under key, or an empty set if the key does not exist.
+// The caller must hold the write lock.
+func (kv *Store) geoSet(key string) (map[string]uint64, error) {
+	mv, err := kv.loadedItem(key)
+	if errors.Is(err, ErrNotFound) {
+		return make(map[string]uint64), nil
+	} else if err != nil {
+		return nil, err
+	}
+	if mv.Type != GeoValue {
+		return nil, ErrWrongType
+	}
+	return decodeGeoSet(mv.Data)
+}
+
+func validCoordinates(latitude, longitude float64) bool {
+	return latitude >= geoLatitudeMin && latitude <= geoLatitudeMax &&
+		longitude >= geoLongitudeMin && longitude <= geoLongitudeMax
+}
+
+// geohashEncode interleaves the quantised longitude and latitude into a 52 bit geohash.
+func geohashEncode(latitude, longitude float64) uint64 {
+	latBits := uint64((latitude - geoLatitudeMin) / (geoLatitudeMax - geoLatitudeMin) * (1 << geoStepBits))
+	lonBits := uint64((longitude - geoLongitudeMin) / (geoLongitudeMax - geoLongitudeMin) * (1 << geoStepBits))
+	latBits = min(latBits, 1<<geoStepBits-1)
+	lonBits = min(lonBits, 1<<geoStepBits-1)
+
+	var hash uint64
+	for i := geoStepBits - 1; i >= 0; i-- {
+		hash = hash<<1 | (lonBits>>uint(i))&1
+		hash = hash<<1 | (latBits>>uint(i))&1
+	}
+	return hash
+}
+
+// geohashDecode returns the centre of the cell described by a 52 bit geohash.
+func geohashDecode(hash uint64) (latitude, longitude float64) {
+	var latBits, lonBits uint64
+	for i := geoStepBits - 1; i >= 0; i-- {
+		lonBits = lonBits<<1 | (hash>>uint(2*i+1))&1
+		latBits = latBits<<1 | (hash>>uint(2*i))&1
+	}
+	cell := float64(uint64(1) << geoStepBits)
+	latitude = geoLatitudeMin + (float64(latBits)+0.5)/cell*(geoLatitudeMax-geoLatitudeMin)
+	longitude = geoLongitudeMin + (float64(lonBits)+0.5)/cell*(geoLongitudeMax-geoLongitudeMin)
+	return latitude, longitude
+}
+
+// geoDistance returns the great-circle distance in metres between two points using the haversine formula.
+func geoDistance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// encodeGeoSet serialises members as a count followed by length-prefixed names and their geohashes.
+func encodeGeoSet(set map[string]uint64) []byte {
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := binary.AppendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf, set[name])
+	}
+	return buf
+}
+
+// decodeGeoSet reverses encodeGeoSet.
+func decodeGeoSet(data []byte) (map[string]uint64, error) {
+	set := make(map[string]uint64)
+	if len(data) == 0 {
+		return set, nil
+	}
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrCorruptGeoSet
+	}
+	data = data[n:]
+
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return nil, ErrCorruptGeoSet
+		}
+		name := string(data[n : n+int(l)])
+		data = data[n+int(l):]
+
+		hash, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrCorruptGeoSet
+		}
+		data = data[n:]
+		set[name] = hash
+	}
+	return set, nil
+}
@@ -0,0 +1,192 @@
+package kvstore
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrStoreName returned by StoreGroup when a store name is empty or cannot be used as a folder name.
+	ErrStoreName error = errors.New("invalid store name")
+
+	// ErrGroupClosed returned when opening a store in a StoreGroup that has been closed.
+	ErrGroupClosed error = errors.New("store group closed")
+)
+
+// PersisterFactory creates the DataPersister of a named store in a StoreGroup, such as a filesystem
+// persister in a subfolder named after the store.
+type PersisterFactory func(name string) (DataPersister, error)
+
+// GroupOption is a type for functions that configure a StoreGroup.
+type GroupOption func(g *StoreGroup)
+
+// WithStoreOptionsGroupOption returns a GroupOption that applies options to every store the group
+// opens, before the options passed to Open.
+//
+// Example:
+//
+//	NewStoreGroup(WithStoreOptionsGroupOption(WithDefaultTTLOption(time.Hour)))
+func WithStoreOptionsGroupOption(options ...StoreOption) GroupOption {
+	return func(g *StoreGroup) {
+		g.options = append(g.options, options...)
+	}
+}
+
+// WithPersisterGroupOption returns a GroupOption that gives every store the group opens a persister
+// created by factory for the store's name.
+//
+// Example:
+//
+//	NewStoreGroup(WithPersisterGroupOption(persistence.FsPersisterFactory("./tenants")))
+func WithPersisterGroupOption(factory PersisterFactory) GroupOption {
+	return func(g *StoreGroup) {
+		g.persisters = factory
+	}
+}
+
+// StoreGroup creates and owns named Stores, such as one per tenant, each with its own persister
+// and options. Its Stats aggregate the stores' statistics and Close shuts them all down.
+type StoreGroup struct {
+	lock       sync.Mutex
+	options    []StoreOption
+	persisters PersisterFactory
+	stores     map[string]*Store
+	closed     bool
+}
+
+// GroupStats is a snapshot of the statistics of a StoreGroup's stores and their totals.
+// The totals do not include persister statistics.
+type GroupStats struct {
+	Total  Stats
+	Stores map[string]Stats
+}
+
+// NewStoreGroup creates an empty StoreGroup.
+func NewStoreGroup(options ...GroupOption) *StoreGroup {
+	g := &StoreGroup{stores: make(map[string]*Store)}
+	for _, opt := range options {
+		opt(g)
+	}
+	return g
+}
+
+// Open returns the store with the given name, creating it if the group does not hold one.
+// A new store is created with the group's options followed by options, and the persister created
+// for its name; options are ignored if the store already exists.
+func (g *StoreGroup) Open(name string, options ...StoreOption) (*Store, error) {
+	if err := checkStoreName(name); err != nil {
+		return nil, err
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.closed {
+		return nil, ErrGroupClosed
+	}
+	if store, ok := g.stores[name]; ok {
+		return store, nil
+	}
+
+	storeOptions := append(append([]StoreOption(nil), g.options...), options...)
+	if g.persisters != nil {
+		p, err := g.persisters(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "StoreGroup.Open %s persister", name)
+		}
+		storeOptions = append(storeOptions, WithPersistenceOption(p))
+	}
+	store, err := New(storeOptions...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "StoreGroup.Open %s", name)
+	}
+	g.stores[name] = store
+	return store, nil
+}
+
+// Store returns the store with the given name, reporting false if the group does not hold one.
+func (g *StoreGroup) Store(name string) (*Store, bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	store, ok := g.stores[name]
+	return store, ok
+}
+
+// Names returns the names of the group's stores in order.
+func (g *StoreGroup) Names() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	names := make([]string, 0, len(g.stores))
+	for name := range g.stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove shuts down the store with the given name and removes it from the group. Its persisted data is kept.
+func (g *StoreGroup) Remove(name string) error {
+	g.lock.Lock()
+	store, ok := g.stores[name]
+	delete(g.stores, name)
+	g.lock.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+	if err := store.Shutdown(); err != nil {
+		return errors.Wrapf(err, "StoreGroup.Remove %s", name)
+	}
+	return nil
+}
+
+// Stats returns the statistics of each store and their totals.
+func (g *StoreGroup) Stats() GroupStats {
+	g.lock.Lock()
+	stores := make(map[string]*Store, len(g.stores))
+	for name, store := range g.stores {
+		stores[name] = store
+	}
+	g.lock.Unlock()
+
+	stats := GroupStats{Stores: make(map[string]Stats, len(stores))}
+	for name, store := range stores {
+		s := store.Stats()
+		stats.Stores[name] = s
+		stats.Total.Keys += s.Keys
+		stats.Total.LoadedKeys += s.LoadedKeys
+		stats.Total.LoadedBytes += s.LoadedBytes
+		stats.Total.TotalBytes += s.TotalBytes
+		stats.Total.ArenaBytes += s.ArenaBytes
+		stats.Total.Hits += s.Hits
+		stats.Total.Misses += s.Misses
+	}
+	return stats
+}
+
+// Close shuts down every store in the group, flushing and closing their persisters. The group
+// cannot open stores afterwards. The first error is returned once every store has been shut down.
+func (g *StoreGroup) Close() error {
+	g.lock.Lock()
+	stores := g.stores
+	g.stores = make(map[string]*Store)
+	g.closed = true
+	g.lock.Unlock()
+
+	var returnError error
+	for name, store := range stores {
+		if err := store.Shutdown(); err != nil && returnError == nil {
+			returnError = errors.Wrapf(err, "StoreGroup.Close %s", name)
+		}
+	}
+	return returnError
+}
+
+// checkStoreName returns ErrStoreName if a name cannot be used as a folder name.
+func checkStoreName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return errors.Wrapf(ErrStoreName, "%q", name)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package kvstore
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// debugReportLargestKeys is the number of largest keys listed by DebugReport.
+const debugReportLargestKeys = 20
+
+// KeySize is a key and the size of its value in bytes.
+type KeySize struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// KeyExpiry is a key and the time its TTL runs out.
+type KeyExpiry struct {
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// KeyRanking selects how TopKeys orders keys.
+type KeyRanking int
+
+// Rankings supported by TopKeys.
+const (
+	ByHits KeyRanking = iota // Most read first.
+	BySize                   // Largest value first.
+)
+
+// KeyStats describes how a key is being used.
+// Hits counts the reads of the key since it was loaded by this process; with WithHitSamplingOption
+// it is an estimate.
+type KeyStats struct {
+	Key        string    `json:"key"`
+	Hits       uint64    `json:"hits"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"lastAccess"`
+	Loaded     bool      `json:"loaded"`
+}
+
+// TopKeys returns up to n keys ranked by how often they are read or by the size of their value,
+// so operators can see what the cache is actually serving. Ties are ordered by key.
+func (kv *Store) TopKeys(n int, by KeyRanking) []KeyStats {
+	kv.resolveAll()
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	keys := make([]KeyStats, 0, len(kv.data))
+	for k, v := range kv.data {
+		if kv.expired(k, v, now) {
+			continue
+		}
+		keys = append(keys, KeyStats{
+			Key:        v.displayKey(k),
+			Hits:       atomic.LoadUint64(&v.hitCount),
+			Size:       v.Size,
+			LastAccess: v.accessedAt(),
+			Loaded:     v.dataLoaded,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		switch {
+		case by == ByHits && keys[i].Hits != keys[j].Hits:
+			return keys[i].Hits > keys[j].Hits
+		case by == BySize && keys[i].Size != keys[j].Size:
+			return keys[i].Size > keys[j].Size
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// recordHit counts a read of a key for Stats and TopKeys. It is safe to call while holding only
+// the read lock.
+func (kv *Store) recordHit(mv *ValueItem) {
+	atomic.AddUint64(&kv.hits, 1)
+	if kv.hitSampling <= 1 {
+		atomic.AddUint64(&mv.hitCount, 1)
+	} else if rand.Intn(kv.hitSampling) == 0 {
+		atomic.AddUint64(&mv.hitCount, uint64(kv.hitSampling))
+	}
+}
+
+// inheritAccessStats carries the hit count of the item a reloaded item replaces.
+func (item *ValueItem) inheritAccessStats(old *ValueItem) {
+	atomic.AddUint64(&item.hitCount, atomic.LoadUint64(&old.hitCount))
+}
+
+// LargestKeys returns up to n keys with the largest values, largest first.
+func (kv *Store) LargestKeys(n int) []KeySize {
+	kv.resolveAll()
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	keys := make([]KeySize, 0, len(kv.data))
+	for k, v := range kv.data {
+		if !kv.expired(k, v, now) {
+			keys = append(keys, KeySize{Key: k, Size: v.Size})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Size != keys[j].Size {
+			return keys[i].Size > keys[j].Size
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// ExpiringKeys returns up to n keys with a TTL that expire within the given duration, soonest first.
+func (kv *Store) ExpiringKeys(n int, within time.Duration) []KeyExpiry {
+	kv.resolveAll()
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	keys := make([]KeyExpiry, 0)
+	for k, v := range kv.data {
+		expiresAt, ok := v.expiry()
+		if !ok || kv.expired(k, v, now) {
+			continue
+		}
+		if expiresAt.Sub(now) <= within {
+			keys = append(keys, KeyExpiry{Key: k, ExpiresAt: expiresAt})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].ExpiresAt.Equal(keys[j].ExpiresAt) {
+			return keys[i].ExpiresAt.Before(keys[j].ExpiresAt)
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys[:min(n, len(keys))]
+}
+
+// prefixUsage summarises the keys in one namespace for DebugReport.
+type prefixUsage struct {
+	prefix      string
+	keys        int
+	loadedKeys  int
+	loadedBytes int64
+	totalBytes  int64
+}
+
+// DebugReport writes a human readable summary of the store's contents to w: the number of keys,
+// loaded bytes and total bytes per namespace, ordered by loaded bytes, followed by the largest keys.
+// It is intended for attributing heap growth to key families during incident response.
+func (kv *Store) DebugReport(w io.Writer) error {
+	kv.resolveAll()
+	kv.lock.RLock()
+	usage := make(map[string]*prefixUsage)
+	for k, v := range kv.data {
+		prefix := Namespace(k)
+		u, ok := usage[prefix]
+		if !ok {
+			u = &prefixUsage{prefix: prefix}
+			usage[prefix] = u
+		}
+		u.keys++
+		u.totalBytes += v.Size
+		if v.dataLoaded {
+			u.loadedKeys++
+			u.loadedBytes += int64(len(v.Data))
+		}
+	}
+	kv.lock.RUnlock()
+
+	prefixes := make([]*prefixUsage, 0, len(usage))
+	for _, u := range usage {
+		prefixes = append(prefixes, u)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].loadedBytes != prefixes[j].loadedBytes {
+			return prefixes[i].loadedBytes > prefixes[j].loadedBytes
+		}
+		return prefixes[i].prefix < prefixes[j].prefix
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tKEYS\tLOADED KEYS\tLOADED BYTES\tTOTAL BYTES")
+	for _, u := range prefixes {
+		prefix := u.prefix
+		if prefix == "" {
+			prefix = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", prefix, u.keys, u.loadedKeys, u.loadedBytes, u.totalBytes)
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "LARGEST KEYS\tBYTES")
+	for _, k := range kv.LargestKeys(debugReportLargestKeys) {
+		fmt.Fprintf(tw, "%s\t%d\n", k.Key, k.Size)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "Store.DebugReport Flush")
+	}
+	return nil
+}
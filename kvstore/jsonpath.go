@@ -0,0 +1,217 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidPath returned when a JSON path cannot be parsed.
+	ErrInvalidPath error = errors.New("invalid JSON path")
+
+	// ErrPathNotFound returned when a JSON path does not exist in a value.
+	ErrPathNotFound error = errors.New("JSON path not found")
+)
+
+// GetPath returns the JSON encoding of the part of a key's JSON value selected by path.
+// Paths start at the root "$" and select object fields with ".name" or `["name"]` and array
+// elements with "[index]", as in "$.users[0].name".
+func (kv *Store) GetPath(key, path string) ([]byte, error) {
+	key = kv.canonicalKey(key)
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	value, err := kv.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, seg := range segments {
+		if doc, err = seg.get(doc); err != nil {
+			return nil, errors.Wrapf(err, "Store.GetPath %s", path)
+		}
+	}
+	return json.Marshal(doc)
+}
+
+// SetPath replaces the part of a key's JSON value selected by path with value, which must be valid JSON.
+// Missing object fields along the path are created; array elements must already exist. The value is
+// re-encoded, so object fields are written in sorted order and insignificant whitespace is removed.
+func (kv *Store) SetPath(key, path string, value []byte) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	segments, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	replacement, err := decodeJSON(value)
+	if err != nil {
+		return errors.Wrap(err, "Store.SetPath value")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return err
+	}
+	doc, err := decodeJSON(mv.Data)
+	if err != nil {
+		return err
+	}
+	if doc, err = setPath(doc, segments, replacement); err != nil {
+		return errors.Wrapf(err, "Store.SetPath %s", path)
+	}
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return errors.Wrap(err, "Store.SetPath Marshal")
+	}
+	if err := kv.setData(key, encoded); err != nil {
+		return errors.Wrap(err, "Store.SetPath kv.setData")
+	}
+	return nil
+}
+
+// setPath returns doc with the value at segments replaced.
+func setPath(doc any, segments []pathSegment, value any) (any, error) {
+	if len(segments) == 0 {
+		return value, nil
+	}
+	seg := segments[0]
+	child, err := seg.get(doc)
+	if errors.Is(err, ErrPathNotFound) && seg.index < 0 && len(segments) > 1 {
+		child, err = map[string]any{}, nil
+	} else if errors.Is(err, ErrPathNotFound) && seg.index < 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if child, err = setPath(child, segments[1:], value); err != nil {
+		return nil, err
+	}
+	return doc, seg.set(doc, child)
+}
+
+// decodeJSON decodes a JSON document, keeping numbers exact.
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.Wrap(ErrWrongType, err.Error())
+	}
+	if dec.More() {
+		return nil, errors.Wrap(ErrWrongType, "trailing data after JSON value")
+	}
+	return doc, nil
+}
+
+// pathSegment selects an object field, or an array element when index is not negative.
+type pathSegment struct {
+	field string
+	index int
+}
+
+// get returns the child of doc selected by the segment.
+func (seg pathSegment) get(doc any) (any, error) {
+	if seg.index >= 0 {
+		arr, ok := doc.([]any)
+		if !ok || seg.index >= len(arr) {
+			return nil, errors.Wrapf(ErrPathNotFound, "[%d]", seg.index)
+		}
+		return arr[seg.index], nil
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return nil, errors.Wrapf(ErrPathNotFound, ".%s", seg.field)
+	}
+	child, ok := obj[seg.field]
+	if !ok {
+		return nil, errors.Wrapf(ErrPathNotFound, ".%s", seg.field)
+	}
+	return child, nil
+}
+
+// set replaces the child of doc selected by the segment.
+func (seg pathSegment) set(doc, value any) error {
+	if seg.index >= 0 {
+		arr, ok := doc.([]any)
+		if !ok || seg.index >= len(arr) {
+			return errors.Wrapf(ErrPathNotFound, "[%d]", seg.index)
+		}
+		arr[seg.index] = value
+		return nil
+	}
+	obj, ok := doc.(map[string]any)
+	if !ok {
+		return errors.Wrapf(ErrPathNotFound, ".%s is not in an object", seg.field)
+	}
+	obj[seg.field] = value
+	return nil
+}
+
+// parsePath splits a JSON path such as `$.users[0]["first name"]` into segments.
+func parsePath(path string) ([]pathSegment, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, errors.Wrapf(ErrInvalidPath, "%q must start with $", path)
+	}
+	rest := path[1:]
+	segments := make([]pathSegment, 0)
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			field := rest[1 : end+1]
+			if field == "" {
+				return nil, errors.Wrapf(ErrInvalidPath, "%q has an empty field name", path)
+			}
+			segments = append(segments, pathSegment{field: field, index: -1})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if strings.HasPrefix(rest, `["`) {
+				if end = strings.Index(rest[2:], `"]`); end >= 0 {
+					end += 3
+				}
+			}
+			if end < 0 {
+				return nil, errors.Wrapf(ErrInvalidPath, "%q has an unterminated [", path)
+			}
+			inner := rest[1:end]
+			if strings.HasPrefix(inner, `"`) {
+				field, err := strconv.Unquote(inner)
+				if err != nil {
+					return nil, errors.Wrapf(ErrInvalidPath, "%q has an invalid quoted field", path)
+				}
+				segments = append(segments, pathSegment{field: field, index: -1})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, errors.Wrapf(ErrInvalidPath, "%q has an invalid array index", path)
+				}
+				segments = append(segments, pathSegment{index: index})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, errors.Wrapf(ErrInvalidPath, "%q has an unexpected %q", path, rest[0])
+		}
+	}
+	return segments, nil
+}
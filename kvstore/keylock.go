@@ -0,0 +1,37 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyLockStripes is the number of mutexes shared between all keys by LockKey.
+const keyLockStripes = 256
+
+// keyLocks is a fixed set of striped mutexes used for per-key advisory locking.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// LockKey acquires an advisory lock for a key and returns the function that releases it.
+// It lets callers performing multi-step read-modify-write operations on a single key
+// serialize with each other without holding the store lock for the whole operation.
+// The lock is advisory: it does not block other Store methods on the key.
+// Locks are striped, so unrelated keys may occasionally share a mutex; callers must not
+// hold more than one key lock at a time.
+//
+// Example:
+//
+//	unlock := store.LockKey("profile:42")
+//	defer unlock()
+func (kv *Store) LockKey(key string) (unlock func()) {
+	key = kv.canonicalKey(key)
+	m := kv.keyLocks.stripe(key)
+	m.Lock()
+	return m.Unlock
+}
+
+// stripe returns the mutex responsible for a key.
+func (l *keyLocks) stripe(key string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &l[h.Sum32()%keyLockStripes]
+}
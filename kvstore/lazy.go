@@ -0,0 +1,91 @@
+package kvstore
+
+import (
+	"github.com/rs/zerolog/log"
+)
+
+// listKeys adds persisted keys to the key map without reading their metadata, for WithLazyMetadataOption.
+// The caller must hold the write lock.
+func (kv *Store) listKeys(keys []string) {
+	for _, k := range keys {
+		if !kv.loadable(k) {
+			continue
+		}
+		if kv.canonicalKey(k) != k {
+			log.Warn().Msgf("[kvstore init] persisted key %q is not in canonical form and cannot be looked up", k)
+		}
+		kv.putItem(k, &ValueItem{metaPending: true})
+	}
+}
+
+// useKey validates a key and, with WithLazyMetadataOption, reads its metadata if this is the key's
+// first use. Operations on a single key call it before taking the store lock.
+func (kv *Store) useKey(key string) error {
+	if err := kv.checkKey(key); err != nil {
+		return err
+	}
+	kv.resolveKeys(key)
+	return nil
+}
+
+// resolveAll reads the metadata of every key not used since startup, for operations that filter
+// or report on the metadata of all keys.
+func (kv *Store) resolveAll() {
+	if !kv.lazyMetadata {
+		return
+	}
+	kv.lock.RLock()
+	pending := make([]string, 0)
+	for k, mv := range kv.data {
+		if mv.metaPending {
+			pending = append(pending, k)
+		}
+	}
+	kv.lock.RUnlock()
+	kv.resolveKeys(pending...)
+}
+
+// resolveKeys reads the metadata of keys that were listed on startup but have not been used since,
+// as a single batch where the first persister supports it. Keys whose metadata cannot be read are
+// kept with a timestamp of now and no TTL, as on an eager startup.
+func (kv *Store) resolveKeys(keys ...string) {
+	if !kv.lazyMetadata {
+		return
+	}
+
+	kv.lock.RLock()
+	pending := make(map[string]*ValueItem)
+	for _, k := range keys {
+		if mv, ok := kv.data[k]; ok && mv.metaPending {
+			pending[k] = mv
+		}
+	}
+	kv.lock.RUnlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(pending))
+	for k := range pending {
+		names = append(names, k)
+	}
+	items, err := kv.readPersisted(names, false)
+	if err != nil {
+		log.Error().Msgf("[kvstore lazy] error reading metadata: %s", err.Error())
+		items = map[string]*ValueItem{}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for k, placeholder := range pending {
+		if current, ok := kv.data[k]; !ok || current != placeholder {
+			// The key was written, deleted or resolved by another caller while its metadata was read.
+			continue
+		}
+		mv, ok := items[k]
+		if !ok {
+			mv = &ValueItem{Ts: kv.nowFunc()}
+		}
+		kv.indexItem(k, mv)
+	}
+}
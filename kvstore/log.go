@@ -0,0 +1,130 @@
+package kvstore
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCorruptLog returned when the stored encoding of a log cannot be decoded.
+var ErrCorruptLog error = errors.Wrap(ErrCorrupted, "log encoding")
+
+// LogEntry is a record in a log, numbered by its position in the log starting at 1.
+type LogEntry struct {
+	Seq  uint64
+	Data []byte
+}
+
+// LogAppend appends an entry to the log stored under key, creating the log if it does not exist,
+// and returns the entry's sequence number.
+func (kv *Store) LogAppend(key string, entry []byte) (uint64, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return 0, err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	entries, err := kv.logEntries(key)
+	if err != nil {
+		return 0, err
+	}
+	seq := uint64(len(entries)) + 1
+	entries = append(entries, LogEntry{Seq: seq, Data: append([]byte(nil), entry...)})
+
+	if err := kv.setTypedData(key, encodeLog(entries), LogValue); err != nil {
+		return 0, errors.Wrap(err, "Store.LogAppend kv.setTypedData")
+	}
+	return seq, nil
+}
+
+// LogRange returns the entries of the log stored under key with sequence numbers between
+// fromSeq and toSeq inclusive, in order.
+func (kv *Store) LogRange(key string, fromSeq, toSeq uint64) ([]LogEntry, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return nil, err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return nil, err
+	}
+	if mv.Type != LogValue {
+		return nil, ErrWrongType
+	}
+	entries, err := decodeLog(mv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	fromSeq = max(fromSeq, 1)
+	toSeq = min(toSeq, uint64(len(entries)))
+	if fromSeq > toSeq {
+		return []LogEntry{}, nil
+	}
+	return entries[fromSeq-1 : toSeq], nil
+}
+
+// logEntries returns the decoded entries stored under key, or an empty log if the key does not exist.
+// The caller must hold the write lock.
+func (kv *Store) logEntries(key string) ([]LogEntry, error) {
+	mv, err := kv.loadedItem(key)
+	if errors.Is(err, ErrNotFound) {
+		return []LogEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if mv.Type != LogValue {
+		return nil, ErrWrongType
+	}
+	return decodeLog(mv.Data)
+}
+
+// encodeLog encodes entries as a count followed by length-prefixed records.
+func encodeLog(entries []LogEntry) []byte {
+	size := binary.MaxVarintLen64 * (1 + len(entries))
+	for _, e := range entries {
+		size += len(e.Data)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(len(e.Data)))
+		buf = append(buf, e.Data...)
+	}
+	return buf
+}
+
+// decodeLog reverses encodeLog.
+func decodeLog(data []byte) ([]LogEntry, error) {
+	if len(data) == 0 {
+		return []LogEntry{}, nil
+	}
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrCorruptLog
+	}
+	data = data[n:]
+	// Every entry takes at least one byte, so a larger count is corrupt and must not size the slice.
+	if count > uint64(len(data)) {
+		return nil, ErrCorruptLog
+	}
+
+	entries := make([]LogEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < size {
+			return nil, ErrCorruptLog
+		}
+		data = data[n:]
+		entries = append(entries, LogEntry{Seq: i + 1, Data: append([]byte(nil), data[:size]...)})
+		data = data[size:]
+	}
+	return entries, nil
+}
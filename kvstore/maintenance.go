@@ -0,0 +1,44 @@
+package kvstore
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Flush writes every key whose in-memory item differs from the persisters, such as after a failed
+// write or a deferred counter update, to the persisters again, then waits for persisters that queue
+// writes to apply them.
+func (kv *Store) Flush() error {
+	kv.lock.Lock()
+	var returnError error
+	for k, mv := range kv.data {
+		if !mv.dirty {
+			continue
+		}
+		if err := kv.persistData(k); err != nil && returnError == nil {
+			returnError = errors.Wrapf(err, "Store.Flush key %s", k)
+		}
+	}
+	kv.lock.Unlock()
+
+	for _, p := range kv.persistence {
+		if f, ok := p.(Flusher); ok {
+			if err := f.Flush(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Store.Flush Flush")
+			}
+		}
+	}
+	return returnError
+}
+
+// Compact asks each persister that implements Compactor to reclaim space.
+func (kv *Store) Compact() error {
+	var returnError error
+	for _, p := range kv.persistence {
+		if c, ok := p.(Compactor); ok {
+			if err := c.Compact(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Store.Compact")
+			}
+		}
+	}
+	return returnError
+}
@@ -0,0 +1,171 @@
+package kvstore
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Priority orders keys for unloading when the memory limit is exceeded.
+type Priority int
+
+// Priorities that can be set with WithPrioritySetOption and SetPriority.
+const (
+	PriorityLow    Priority = -1 // Unloaded before other values.
+	PriorityNormal Priority = 0  // The default.
+	PriorityHigh   Priority = 1  // Unloaded only once lower priority values have been.
+)
+
+// enforceMemoryLimit unloads values until the loaded bytes fit within the memory limit, and those
+// of each namespace fit within its share of the limit. Dirty values are written to the persisters
+// before being unloaded, and are kept in memory if that write fails, so nothing is lost.
+// The caller must hold the write lock.
+func (kv *Store) enforceMemoryLimit() {
+	if kv.memoryLimit <= 0 || len(kv.persistence) == 0 {
+		return
+	}
+	for _, ns := range kv.namespaces {
+		if ns.shareGroup == ns {
+			budget := int64(ns.memoryShare * float64(kv.memoryLimit))
+			kv.unloadUntil(budget, func(key string) bool {
+				owner := kv.namespaceOf(key)
+				return owner != nil && owner.shareGroup == ns
+			})
+		}
+	}
+	kv.unloadUntil(kv.memoryLimit, nil)
+}
+
+// unloadUntil unloads the values of the keys accepted by match, or of every key if match is nil,
+// until their loaded bytes fit within budget. Values of namespaces using EvictEarly go first, then
+// the others from the lowest priority up, each in least-recently-accessed order. The caller must
+// hold the write lock.
+func (kv *Store) unloadUntil(budget int64, match func(key string) bool) {
+	var loaded int64
+	candidates := make([]string, 0)
+	for k, v := range kv.data {
+		if !v.dataLoaded || (match != nil && !match(k)) {
+			continue
+		}
+		loaded += int64(len(v.Data))
+		if kv.unloadable(k) {
+			candidates = append(candidates, k)
+		}
+	}
+	if loaded <= budget {
+		return
+	}
+
+	early := func(key string) bool {
+		return kv.namespaceOf(key).evictionPolicy() == EvictEarly
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if ei, ej := early(candidates[i]), early(candidates[j]); ei != ej {
+			return ei
+		}
+		mi, mj := kv.data[candidates[i]], kv.data[candidates[j]]
+		if mi.Priority != mj.Priority {
+			return mi.Priority < mj.Priority
+		}
+		return mi.accessed() < mj.accessed()
+	})
+
+	for _, k := range candidates {
+		if loaded <= budget {
+			return
+		}
+		mv := kv.data[k]
+		if mv.dirty {
+			if err := kv.persistData(k); err != nil {
+				log.Error().Msgf("[kvstore memory] error spilling key %s error: %s", k, err.Error())
+				continue
+			}
+		}
+		loaded -= int64(len(mv.Data))
+		kv.unloadValue(k, mv)
+	}
+}
+
+// unloadable reports whether a key's value can be unloaded from memory: it is not ephemeral or
+// pinned, and its namespace does not use EvictNever.
+func (kv *Store) unloadable(key string) bool {
+	if mv, ok := kv.data[key]; ok && mv.Pinned {
+		return false
+	}
+	return !kv.ephemeral(key) && kv.namespaceOf(key).evictionPolicy() != EvictNever
+}
+
+// Pin loads a key's value into memory and keeps it there, so it is never unloaded by the eviction
+// controller or to stay within the memory limit. Pinned values still count towards the limit, and the
+// pin is recorded in the key's persisted metadata.
+func (kv *Store) Pin(key string) error {
+	return kv.setPinned(key, true)
+}
+
+// Unpin lets a value pinned with Pin or WithPinSetOption be unloaded again.
+func (kv *Store) Unpin(key string) error {
+	return kv.setPinned(key, false)
+}
+
+func (kv *Store) setPinned(key string, pinned bool) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return err
+	}
+	if mv.Pinned == pinned {
+		return nil
+	}
+	mv.Pinned = pinned
+	if err := kv.persistData(key); err != nil {
+		return errors.Wrap(err, "Store.setPinned kv.persist")
+	}
+	return nil
+}
+
+// SetPriority changes the priority of a key's value when the memory limit is exceeded. The priority
+// is recorded in the key's persisted metadata.
+func (kv *Store) SetPriority(key string, priority Priority) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return ErrNotFound
+	}
+	if mv.Priority == priority {
+		return nil
+	}
+	mv.Priority = priority
+	if err := kv.persistData(key); err != nil {
+		return errors.Wrap(err, "Store.SetPriority kv.persist")
+	}
+	return nil
+}
+
+// touchAccess records that the item was accessed at the given time in unix nanoseconds.
+// It is safe to call while holding only the read lock.
+func (item *ValueItem) touchAccess(nanos int64) {
+	atomic.StoreInt64(&item.lastAccess, nanos)
+}
+
+// accessed returns the time the item was last accessed in unix nanoseconds.
+func (item *ValueItem) accessed() int64 {
+	return atomic.LoadInt64(&item.lastAccess)
+}
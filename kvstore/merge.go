@@ -0,0 +1,173 @@
+package kvstore
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// mergeBatchSize is the number of keys Merge reads from the other persister under each hold of the write lock.
+const mergeBatchSize = 500
+
+// MergeRenameSuffix is appended to the key of an incoming value kept by MergeRename, followed by a
+// number from 2 if that key is also taken, as in "config#merged" and "config#merged2".
+const MergeRenameSuffix = "#merged"
+
+// MergePolicy decides what Merge does with a key that already exists in the store.
+type MergePolicy int
+
+// Merge policies supported by Merge.
+const (
+	MergeKeepNewest   MergePolicy = iota // Keep whichever value has the later timestamp.
+	MergeSkipExisting                    // Keep the existing value.
+	MergeRename                          // Keep the existing value and store the incoming one under a new key.
+)
+
+// MergeReport describes the keys imported by Merge.
+type MergeReport struct {
+	Added    int               // Keys that did not exist in the store.
+	Replaced int               // Existing keys replaced by a newer incoming value.
+	Skipped  int               // Incoming keys not imported, as the existing value was kept or the incoming value had expired.
+	Renamed  map[string]string // Incoming keys stored under a new key by MergeRename, mapped to the new key.
+}
+
+// Merge imports every live key held by other, such as the data folder of another node, into the
+// store, keeping each value's timestamp and metadata. Keys that already exist are resolved using
+// policy. Keys are read in batches, using WithLoadParallelismOption, and each value imported is
+// persisted under a new version as if it had been set. A failed merge leaves the keys imported
+// before the failure in place.
+//
+// Example:
+//
+//	report, err := kv.Merge(persistence.NewFsPersistence("./node2"), kvstore.MergeKeepNewest)
+func (kv *Store) Merge(other DataPersister, policy MergePolicy) (MergeReport, error) {
+	report := MergeReport{Renamed: make(map[string]string)}
+	if err := kv.checkWritable(); err != nil {
+		return report, err
+	}
+	keys, err := other.Keys()
+	if err != nil {
+		return report, errors.Wrap(err, "Store.Merge Keys")
+	}
+
+	for start := 0; start < len(keys); start += mergeBatchSize {
+		batch := keys[start:min(start+mergeBatchSize, len(keys))]
+		items, err := readMultiConcurrently(other, batch, true, kv.loadParallelism)
+		if err != nil {
+			return report, errors.Wrap(err, "Store.Merge ReadMulti")
+		}
+		if err := kv.mergeBatch(batch, items, policy, &report); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// mergeBatch imports a batch of items read from another persister.
+func (kv *Store) mergeBatch(keys []string, items map[string]*ValueItem, policy MergePolicy, report *MergeReport) error {
+	records := make([]ExportRecord, 0, len(items))
+	now := kv.nowFunc()
+	for _, k := range keys {
+		item, ok := items[k]
+		if !ok || item.Expired(now) {
+			report.Skipped++
+			continue
+		}
+		key := kv.canonicalKey(k)
+		if err := kv.checkKey(key); err != nil {
+			return errors.Wrapf(err, "Store.Merge key %q", k)
+		}
+		data := item.Data
+		item.Data = nil
+		records = append(records, ExportRecord{Key: key, Item: item, Data: data})
+	}
+	if kv.lazyMetadata {
+		resolve := make([]string, 0, len(records))
+		for _, record := range records {
+			resolve = append(resolve, record.Key)
+		}
+		kv.resolveKeys(resolve...)
+		if policy == MergeRename {
+			kv.resolveRenameCandidates(resolve)
+		}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	for _, record := range records {
+		from := record.Key
+		mv, exists := kv.data[record.Key]
+		exists = exists && !kv.expired(record.Key, mv, now)
+		switch {
+		case !exists:
+			report.Added++
+		case policy == MergeKeepNewest && record.Item.Ts.After(mv.Ts):
+			report.Replaced++
+		case policy == MergeRename:
+			renamed, err := kv.mergeRenameKey(record.Key, now)
+			if err != nil {
+				return errors.Wrapf(err, "Store.Merge key %s", record.Key)
+			}
+			if record.Item.Key != "" {
+				// Keep the spelling the incoming key was first set with, under its new name.
+				record.Item.Key += renamed[len(from):]
+			}
+			record.Key = renamed
+			report.Renamed[from] = renamed
+		default:
+			report.Skipped++
+			continue
+		}
+		if err := kv.importRecord(record); err != nil {
+			return errors.Wrapf(err, "Store.Merge key %s", from)
+		}
+	}
+	return nil
+}
+
+// mergeRenameKey returns the first key formed from key and MergeRenameSuffix that is not in use.
+// The caller must hold the write lock.
+func (kv *Store) mergeRenameKey(key string, now time.Time) (string, error) {
+	for n := 1; ; n++ {
+		renamed := mergeRenameCandidate(key, n)
+		if err := kv.checkKey(renamed); err != nil {
+			return "", err
+		}
+		if mv, ok := kv.data[renamed]; !ok || kv.expired(renamed, mv, now) {
+			return renamed, nil
+		}
+	}
+}
+
+// mergeRenameCandidate returns the nth key MergeRename tries for key.
+func mergeRenameCandidate(key string, n int) string {
+	if n == 1 {
+		return key + MergeRenameSuffix
+	}
+	return key + MergeRenameSuffix + strconv.Itoa(n)
+}
+
+// resolveRenameCandidates reads the metadata of the keys MergeRename may store incoming keys under,
+// for WithLazyMetadataOption, so mergeRenameKey judges whether each is live from its metadata rather
+// than from an unread placeholder. Candidates are resolved in turn until one is not in the store.
+func (kv *Store) resolveRenameCandidates(keys []string) {
+	for n := 1; len(keys) > 0; n++ {
+		candidates := make([]string, len(keys))
+		for i, k := range keys {
+			candidates[i] = mergeRenameCandidate(k, n)
+		}
+		kv.resolveKeys(candidates...)
+
+		taken := make([]string, 0, len(keys))
+		kv.lock.RLock()
+		for i, c := range candidates {
+			if _, ok := kv.data[c]; ok {
+				taken = append(taken, keys[i])
+			}
+		}
+		kv.lock.RUnlock()
+		keys = taken
+	}
+}
@@ -0,0 +1,190 @@
+package kvstore
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NamespaceSeparator separates a key's namespace from the rest of the key, as in "tenant1:orders".
+const NamespaceSeparator = ":"
+
+// Namespace returns the namespace of a key: the part before the first NamespaceSeparator,
+// or an empty string if the key has no namespace.
+func Namespace(key string) string {
+	ns, _, found := strings.Cut(key, NamespaceSeparator)
+	if !found {
+		return ""
+	}
+	return ns
+}
+
+// EvictionPolicy decides when the values of a namespace are unloaded from memory.
+type EvictionPolicy int
+
+// Eviction policies supported by WithEvictionPolicyNamespaceOption.
+const (
+	EvictLRU   EvictionPolicy = iota // Unloaded once idle, and least recently used first over the memory limit.
+	EvictEarly                       // As EvictLRU, but unloaded before other namespaces over the memory limit.
+	EvictNever                       // Never unloaded, for datasets that must be served from memory.
+)
+
+// namespaceConfig holds the settings of a namespace configured with WithNamespaceOption.
+// Settings a nested namespace leaves unset are inherited from the namespace that contains it.
+type namespaceConfig struct {
+	namespace   string
+	defaultTTL  time.Duration
+	memoryShare float64
+	eviction    *EvictionPolicy
+	persister   DataPersister
+	shareGroup  *namespaceConfig // The namespace whose memory share the keys count towards.
+}
+
+// NamespaceOption is a type for functions that configure a namespace set with WithNamespaceOption.
+type NamespaceOption func(ns *namespaceConfig)
+
+// WithDefaultTTLNamespaceOption returns a NamespaceOption that sets the TTL applied to new keys in
+// the namespace, instead of the store's default.
+//
+// Example:
+//
+//	WithNamespaceOption("sessions", WithDefaultTTLNamespaceOption(30*time.Minute))
+func WithDefaultTTLNamespaceOption(ttl time.Duration) NamespaceOption {
+	return func(ns *namespaceConfig) {
+		ns.defaultTTL = ttl
+	}
+}
+
+// WithMemoryShareNamespaceOption returns a NamespaceOption that limits the values the namespace
+// holds in memory to a fraction of the budget set with WithMemoryLimitOption. When the namespace
+// exceeds its share its values are unloaded, least recently used first, even if the store as a
+// whole is within budget. Nested namespaces without a share of their own count towards it.
+//
+// Example:
+//
+//	WithNamespaceOption("reports", WithMemoryShareNamespaceOption(0.25))
+func WithMemoryShareNamespaceOption(share float64) NamespaceOption {
+	return func(ns *namespaceConfig) {
+		ns.memoryShare = share
+	}
+}
+
+// WithEvictionPolicyNamespaceOption returns a NamespaceOption that sets when the namespace's values
+// are unloaded from memory. Namespaces use EvictLRU by default.
+//
+// Example:
+//
+//	WithNamespaceOption("config", WithEvictionPolicyNamespaceOption(EvictNever))
+func WithEvictionPolicyNamespaceOption(policy EvictionPolicy) NamespaceOption {
+	return func(ns *namespaceConfig) {
+		ns.eviction = &policy
+	}
+}
+
+// WithPersisterNamespaceOption returns a NamespaceOption that stores the namespace's keys in
+// persister instead of the store's first persister, such as to keep a dataset in a different
+// backend. The store must have a persister of its own; any further persisters still receive the
+// namespace's keys.
+//
+// Example:
+//
+//	WithNamespaceOption("images", WithPersisterNamespaceOption(objectStorage))
+func WithPersisterNamespaceOption(persister DataPersister) NamespaceOption {
+	return func(ns *namespaceConfig) {
+		ns.persister = persister
+	}
+}
+
+// contains reports whether key is in the namespace or a namespace nested within it.
+func (ns *namespaceConfig) contains(key string) bool {
+	return strings.HasPrefix(key, ns.namespace+NamespaceSeparator)
+}
+
+// evictionPolicy returns the namespace's eviction policy.
+func (ns *namespaceConfig) evictionPolicy() EvictionPolicy {
+	if ns == nil || ns.eviction == nil {
+		return EvictLRU
+	}
+	return *ns.eviction
+}
+
+// prepareNamespaces orders the configured namespaces from the most to the least nested, resolves
+// the settings nested namespaces inherit and routes namespaces with their own persister.
+func (kv *Store) prepareNamespaces() error {
+	if len(kv.namespaces) == 0 {
+		return nil
+	}
+	for _, ns := range kv.namespaces {
+		ns.namespace = kv.canonicalKey(ns.namespace)
+	}
+	sort.SliceStable(kv.namespaces, func(i, j int) bool {
+		return len(kv.namespaces[i].namespace) < len(kv.namespaces[j].namespace)
+	})
+
+	routes := make([]RouterOption, 0)
+	for i, ns := range kv.namespaces {
+		ns.shareGroup = ns
+		if parent := kv.enclosingNamespace(ns.namespace, kv.namespaces[:i]); parent != nil {
+			ns.inherit(parent)
+		}
+		if ns.memoryShare <= 0 && ns.shareGroup == ns {
+			ns.shareGroup = nil
+		}
+		if ns.persister != nil {
+			routes = append(routes, WithPrefixRouterOption(ns.namespace+NamespaceSeparator, ns.persister))
+		}
+	}
+	// Lookups match the most nested namespace first.
+	for i, j := 0, len(kv.namespaces)-1; i < j; i, j = i+1, j-1 {
+		kv.namespaces[i], kv.namespaces[j] = kv.namespaces[j], kv.namespaces[i]
+	}
+
+	if len(routes) == 0 {
+		return nil
+	}
+	if len(kv.persistence) == 0 {
+		return errors.New("namespace persisters require a store persister")
+	}
+	kv.persistence[0] = NewRouter(kv.persistence[0], routes...)
+	return nil
+}
+
+// inherit copies the settings a namespace leaves unset from the namespace that contains it.
+func (ns *namespaceConfig) inherit(parent *namespaceConfig) {
+	if ns.defaultTTL == 0 {
+		ns.defaultTTL = parent.defaultTTL
+	}
+	if ns.eviction == nil {
+		ns.eviction = parent.eviction
+	}
+	if ns.persister == nil {
+		ns.persister = parent.persister
+	}
+	if ns.memoryShare <= 0 {
+		ns.shareGroup = parent.shareGroup
+	}
+}
+
+// enclosingNamespace returns the most nested of namespaces that contains namespace, which must be
+// ordered from the least to the most nested.
+func (kv *Store) enclosingNamespace(namespace string, namespaces []*namespaceConfig) *namespaceConfig {
+	for i := len(namespaces) - 1; i >= 0; i-- {
+		if namespaces[i].contains(namespace) {
+			return namespaces[i]
+		}
+	}
+	return nil
+}
+
+// namespaceOf returns the settings of the most nested configured namespace containing key, or nil
+// if no configured namespace contains it.
+func (kv *Store) namespaceOf(key string) *namespaceConfig {
+	for _, ns := range kv.namespaces {
+		if ns.contains(key) {
+			return ns
+		}
+	}
+	return nil
+}
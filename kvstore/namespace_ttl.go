@@ -0,0 +1,120 @@
+package kvstore
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// namespaceExpiry is a deadline set with SetNamespaceTTL: keys in the namespace written before it
+// expire once it has passed.
+type namespaceExpiry struct {
+	namespace string
+	at        time.Time
+}
+
+// namespaceExpiries holds the namespace deadlines. The slice is replaced rather than modified so
+// that reads which do not hold the store's lock see a consistent set.
+type namespaceExpiries struct {
+	deadlines atomic.Pointer[[]namespaceExpiry]
+}
+
+func (e *namespaceExpiries) load() []namespaceExpiry {
+	if d := e.deadlines.Load(); d != nil {
+		return *d
+	}
+	return nil
+}
+
+func (e *namespaceExpiries) store(deadlines []namespaceExpiry) {
+	e.deadlines.Store(&deadlines)
+}
+
+// SetNamespaceTTL expires every key in a namespace, including the namespaces nested within it,
+// once ttl has passed. Keys written to the namespace after the deadline are not affected.
+// The keys are not touched when the TTL is set, so the cost does not depend on how many there are;
+// they stop being readable at the deadline and are deleted by the next eviction check.
+// Setting the TTL again moves the deadline, and a ttl of zero or less clears it. Namespace TTLs are
+// held in memory and are not restored when the store is reopened.
+func (kv *Store) SetNamespaceTTL(namespace string, ttl time.Duration) error {
+	namespace = kv.canonicalKey(namespace)
+	if err := kv.checkKey(namespace); err != nil {
+		return errors.Wrapf(err, "Store.SetNamespaceTTL %s", namespace)
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	now := kv.nowFunc()
+	deadlines := make([]namespaceExpiry, 0)
+	for _, d := range kv.nsExpiries.load() {
+		// Deadlines that have passed still apply to the keys written before them.
+		if d.namespace != namespace || !now.Before(d.at) {
+			deadlines = append(deadlines, d)
+		}
+	}
+	if ttl > 0 {
+		deadlines = append(deadlines, namespaceExpiry{namespace: namespace, at: now.Add(ttl)})
+	}
+	kv.nsExpiries.store(deadlines)
+	return nil
+}
+
+// NamespaceTTL returns the time left until a namespace set with SetNamespaceTTL expires, reporting
+// false if the namespace has no pending deadline.
+func (kv *Store) NamespaceTTL(namespace string) (time.Duration, bool) {
+	namespace = kv.canonicalKey(namespace)
+	now := kv.nowFunc()
+	for _, d := range kv.nsExpiries.load() {
+		if d.namespace == namespace && now.Before(d.at) {
+			return d.at.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// expired reports whether a key has expired at now, either through its own TTL or because it was
+// written before a namespace deadline that has passed.
+func (kv *Store) expired(key string, mv *ValueItem, now time.Time) bool {
+	if mv.Expired(now) {
+		return true
+	}
+	for _, d := range kv.nsExpiries.load() {
+		if !now.Before(d.at) && mv.Ts.Before(d.at) && strings.HasPrefix(key, d.namespace+NamespaceSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+// expiry returns when a key that has not expired at now will expire, through its own TTL or the
+// earliest pending namespace deadline it was written before, reporting false if neither applies.
+func (kv *Store) expiry(key string, mv *ValueItem, now time.Time) (time.Time, bool) {
+	at, ok := mv.expiry()
+	for _, d := range kv.nsExpiries.load() {
+		if now.Before(d.at) && mv.Ts.Before(d.at) && strings.HasPrefix(key, d.namespace+NamespaceSeparator) && (!ok || d.at.Before(at)) {
+			at, ok = d.at, true
+		}
+	}
+	return at, ok
+}
+
+// pruneNamespaceExpiries drops the namespace deadlines that had passed at now, once the eviction
+// check has deleted the keys they expired. Deadlines are kept while keys may still be read from the
+// persisters, as with lazily loaded metadata or a follower. The caller must hold the write lock.
+func (kv *Store) pruneNamespaceExpiries(now time.Time) {
+	if kv.lazyMetadata || kv.followFreq > 0 {
+		return
+	}
+	current := kv.nsExpiries.load()
+	deadlines := make([]namespaceExpiry, 0, len(current))
+	for _, d := range current {
+		if now.Before(d.at) {
+			deadlines = append(deadlines, d)
+		}
+	}
+	if len(deadlines) != len(current) {
+		kv.nsExpiries.store(deadlines)
+	}
+}
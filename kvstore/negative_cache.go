@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"sync"
+	"time"
+)
+
+// negativeEntry records a failed persister read and when it stops being cached.
+type negativeEntry struct {
+	err   error
+	until time.Time
+}
+
+// negativeCache briefly remembers keys whose values could not be read from persistence,
+// so that repeated lookups of a hot missing key do not hit the backend every time.
+// A nil *negativeCache is valid and caches nothing.
+type negativeCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	entries map[string]negativeEntry
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{
+		ttl:     ttl,
+		entries: make(map[string]negativeEntry),
+	}
+}
+
+// lookup returns the cached read error for a key, or nil if there is none.
+func (nc *negativeCache) lookup(key string, now time.Time) error {
+	if nc == nil {
+		return nil
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	e, ok := nc.entries[key]
+	if !ok {
+		return nil
+	}
+	if now.After(e.until) {
+		delete(nc.entries, key)
+		return nil
+	}
+	return e.err
+}
+
+// add caches a read error for a key.
+func (nc *negativeCache) add(key string, err error, now time.Time) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	nc.entries[key] = negativeEntry{err: err, until: now.Add(nc.ttl)}
+}
+
+// forget removes a key from the cache, typically because it has been written or deleted.
+func (nc *negativeCache) forget(key string) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	delete(nc.entries, key)
+}
+
+// purge removes all expired entries.
+func (nc *negativeCache) purge(now time.Time) {
+	if nc == nil {
+		return
+	}
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	for k, e := range nc.entries {
+		if now.After(e.until) {
+			delete(nc.entries, k)
+		}
+	}
+}
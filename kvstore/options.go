@@ -1,6 +1,9 @@
 package kvstore
 
-import "time"
+import (
+	"math"
+	"time"
+)
 
 // StoreOption is a type for functions that configure a Store.
 // These functions are intended to be used with the NewStore function
@@ -47,3 +50,599 @@ func WithNowFuncOption(nowFunc func() time.Time) StoreOption {
 		s.nowFunc = nowFunc
 	}
 }
+
+// SetOption is a type for functions that configure the ValueItem written by Set.
+type SetOption func(item *ValueItem)
+
+// WithContentTypeSetOption returns a SetOption that records the MIME type of the value,
+// so consumers know how to interpret the raw bytes.
+//
+// Example:
+//
+//	store.Set("doc", data, WithContentTypeSetOption("application/json"))
+func WithContentTypeSetOption(contentType string) SetOption {
+	return func(item *ValueItem) {
+		item.ContentType = contentType
+	}
+}
+
+// WithMetaSetOption returns a SetOption that attaches user metadata to the value,
+// such as its source, schema version or owner. Entries are merged into any existing metadata.
+//
+// Example:
+//
+//	store.Set("doc", data, WithMetaSetOption(map[string]string{"owner": "billing"}))
+func WithMetaSetOption(meta map[string]string) SetOption {
+	return func(item *ValueItem) {
+		if len(meta) == 0 {
+			return
+		}
+		if item.Meta == nil {
+			item.Meta = make(map[string]string, len(meta))
+		}
+		for k, v := range meta {
+			item.Meta[k] = v
+		}
+	}
+}
+
+// WithUsageCacheOption returns a StoreOption that sets how long Stats reuses the usage reported by
+// the persisters before asking them again. A ttl of zero asks them on every call.
+//
+// Example:
+//
+//	NewStore(WithUsageCacheOption(10 * time.Second))
+func WithUsageCacheOption(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.usage.ttl = ttl
+	}
+}
+
+// WithNegativeCacheOption returns a StoreOption that caches reads that found no value for ttl, so
+// repeated Gets of a key whose value is missing from the persister, and GetOrSet calls whose loader
+// reports ErrNotFound, don't hammer the backend. Other errors, which may be transient, are not cached.
+// Writing or deleting the key clears its cached miss.
+//
+// Example:
+//
+//	NewStore(WithNegativeCacheOption(5 * time.Second))
+func WithNegativeCacheOption(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.misses = newNegativeCache(ttl)
+	}
+}
+
+// WithRefreshTTLOnSetOption returns a StoreOption that chooses whether overwriting a key with Set
+// restarts its TTL. It does by default; when refresh is false a key keeps the expiry deadline it was
+// given when it was created or when its TTL was last set, however often it is updated.
+//
+// Example:
+//
+//	NewStore(WithRefreshTTLOnSetOption(false))
+func WithRefreshTTLOnSetOption(refresh bool) StoreOption {
+	return func(s *Store) {
+		s.refreshTTLOnSet = refresh
+	}
+}
+
+// WithTouchModeOption returns a StoreOption that selects what Touch updates: the key's TTL,
+// the time used to decide when its value is unloaded from memory, or both (the default).
+//
+// Example:
+//
+//	NewStore(WithTouchModeOption(TouchAccess))
+func WithTouchModeOption(mode TouchMode) StoreOption {
+	return func(s *Store) {
+		s.touchMode = mode
+	}
+}
+
+// WithBroadcasterOption returns a StoreOption that announces every persisted change to other
+// store instances through b, and invalidates local copies of keys they announce.
+//
+// Example:
+//
+//	p, err := peer.New(memberlist.DefaultLANConfig(), "10.0.0.2:7946")
+//	NewStore(WithPersistenceOption(sharedPersister), WithBroadcasterOption(p))
+func WithBroadcasterOption(b Broadcaster) StoreOption {
+	return func(s *Store) {
+		s.broadcaster = b
+	}
+}
+
+// WithPeerFillOption returns a StoreOption that asks sibling instances for values that are not in
+// memory before reading them from the persister. httpserver.PeerPool fetches them over HTTP.
+//
+// Example:
+//
+//	pool := httpserver.NewPeerPool("http://10.0.0.1:8080")
+//	NewStore(WithPersistenceOption(shared), WithPeerFillOption(pool))
+func WithPeerFillOption(f PeerFiller) StoreOption {
+	return func(s *Store) {
+		s.filler = f
+	}
+}
+
+// WithRefreshTTLSetOption returns a SetOption that overrides the store's WithRefreshTTLOnSetOption
+// setting for a single write.
+//
+// Example:
+//
+//	store.Set("session", data, WithRefreshTTLSetOption(true))
+func WithRefreshTTLSetOption(refresh bool) SetOption {
+	return func(item *ValueItem) {
+		item.refreshTTL = &refresh
+	}
+}
+
+// WithTTLSetOption returns a SetOption that gives the value a time-to-live, restarting it even when
+// the store is configured not to refresh TTLs on Set. The TTL is rounded up to whole seconds.
+//
+// Example:
+//
+//	store.Set("session", data, WithTTLSetOption(30*time.Minute))
+func WithTTLSetOption(ttl time.Duration) SetOption {
+	return func(item *ValueItem) {
+		refresh := true
+		item.TTL = TTLType(math.Ceil(ttl.Seconds()))
+		item.refreshTTL = &refresh
+	}
+}
+
+// WithDependsOnSetOption returns a SetOption that declares the keys a value is derived from.
+// Writing or deleting any of those keys automatically deletes the dependent value.
+// The dependencies replace any previously declared for the key. Set returns ErrDependencyCycle,
+// leaving the key unchanged, if one of them already depends, directly or transitively, on the key.
+//
+// Example:
+//
+//	store.Set("report:2023", report, WithDependsOnSetOption("sales:2023", "costs:2023"))
+func WithDependsOnSetOption(keys ...string) SetOption {
+	return func(item *ValueItem) {
+		item.DependsOn = append([]string(nil), keys...)
+	}
+}
+
+// WithNoCompressionSetOption returns a SetOption that stops compressing persisters, such as
+// persistence.Compressed, from compressing the key's value, for payloads that are already compressed.
+// The opt-out is kept for later writes of the key.
+//
+// Example:
+//
+//	store.Set("thumbnail:42", jpegBytes, WithNoCompressionSetOption())
+func WithNoCompressionSetOption() SetOption {
+	return func(item *ValueItem) {
+		item.NoCompression = true
+	}
+}
+
+// WithRecomputeCostSetOption returns a SetOption that records how long the value takes to produce,
+// which WithEarlyExpirationOption uses to decide how early the key may be reported as expired.
+// GetOrSet records the time its loader takes. The cost is kept for later writes of the key.
+//
+// Example:
+//
+//	store.Set("report", report, WithTTLSetOption(time.Hour), WithRecomputeCostSetOption(2*time.Second))
+func WithRecomputeCostSetOption(cost time.Duration) SetOption {
+	return func(item *ValueItem) {
+		item.RecomputeCost = cost
+	}
+}
+
+// WithPinSetOption returns a SetOption that pins the key's value in memory, so it is never unloaded
+// by the eviction controller or to stay within the memory limit. The pin is kept for later writes of
+// the key until Unpin is called.
+//
+// Example:
+//
+//	store.Set("config:flags", flags, WithPinSetOption())
+func WithPinSetOption() SetOption {
+	return func(item *ValueItem) {
+		item.Pinned = true
+	}
+}
+
+// WithPrioritySetOption returns a SetOption that sets the key's priority under memory pressure: when
+// the memory limit is exceeded, values with a lower priority are unloaded first. The priority is kept
+// for later writes of the key.
+//
+// Example:
+//
+//	store.Set("thumbnail:42", jpegBytes, WithPrioritySetOption(PriorityLow))
+func WithPrioritySetOption(priority Priority) SetOption {
+	return func(item *ValueItem) {
+		item.Priority = priority
+	}
+}
+
+// WithMemoryLimitOption returns a StoreOption that sets a budget, in bytes, for values held in memory.
+// When the budget is exceeded the eviction controller writes any dirty values to the persisters and
+// unloads values in least-recently-used order until the store fits. It requires a persister and
+// an eviction frequency set with WithUnloadFrequencyOption.
+//
+// Example:
+//
+//	NewStore(WithMemoryLimitOption(64 << 20))
+func WithMemoryLimitOption(maxBytes int64) StoreOption {
+	return func(s *Store) {
+		s.memoryLimit = maxBytes
+	}
+}
+
+// WithArenaOption returns a StoreOption that holds loaded values in an arena: slabs of slabSize bytes
+// carved into regions that are recycled when values are unloaded, overwritten or deleted. Very large
+// caches then consist of a few large allocations rather than one per value, which keeps garbage
+// collection cheap. Values are copied out of the arena on Get, and values larger than an eighth of a
+// slab are held on the heap as usual. A slabSize of zero uses DefaultArenaSlabSize.
+//
+// Example:
+//
+//	NewStore(WithArenaOption(16 << 20))
+func WithArenaOption(slabSize int) StoreOption {
+	return func(s *Store) {
+		s.arena = newArena(slabSize)
+	}
+}
+
+// WithReadViewOption returns a StoreOption that mirrors the keys in a sharded, lock-free read view
+// that Get uses instead of taking the store's read lock. It suits read-heavy workloads where
+// contention on the lock shows up in profiles, at the cost of extra memory per key and slightly
+// slower writes. Values held in an arena set with WithArenaOption are still copied under the lock.
+//
+// Example:
+//
+//	NewStore(WithReadViewOption())
+func WithReadViewOption() StoreOption {
+	return func(s *Store) {
+		s.readView = &readView{}
+	}
+}
+
+// WithNamespaceOption returns a StoreOption that tunes the keys of a namespace, those starting with
+// the namespace followed by NamespaceSeparator, so one store can serve differently tuned datasets.
+// Namespaces can be nested, as in "tenant1:reports"; a key uses the settings of the most nested
+// namespace containing it, which inherits any settings it leaves unset from the namespaces around it.
+//
+// Example:
+//
+//	NewStore(
+//		WithNamespaceOption("sessions", WithDefaultTTLNamespaceOption(30*time.Minute), WithEvictionPolicyNamespaceOption(EvictEarly)),
+//		WithNamespaceOption("config", WithEvictionPolicyNamespaceOption(EvictNever)),
+//	)
+func WithNamespaceOption(namespace string, options ...NamespaceOption) StoreOption {
+	return func(s *Store) {
+		ns := &namespaceConfig{namespace: namespace}
+		for _, opt := range options {
+			opt(ns)
+		}
+		s.namespaces = append(s.namespaces, ns)
+	}
+}
+
+// WithShutdownFlushOption returns a StoreOption that makes Close persist every value that has not
+// been persisted, such as values whose write failed, protecting against data loss on deploys.
+// Any targets passed in additionally receive a snapshot of every value loaded in memory, which
+// allows stores created without a persister to save their contents on shutdown.
+//
+// Example:
+//
+//	NewStore(WithShutdownFlushOption(persistence.NewFsPersistence("snapshot")))
+func WithShutdownFlushOption(targets ...DataPersister) StoreOption {
+	return func(s *Store) {
+		s.shutdownFlush = true
+		s.shutdownTargets = targets
+	}
+}
+
+// WithDefaultTTLOption returns a StoreOption that applies a TTL to every newly created key.
+// The TTL is rounded up to whole seconds.
+//
+// Example:
+//
+//	NewStore(WithDefaultTTLOption(time.Hour))
+func WithDefaultTTLOption(ttl time.Duration) StoreOption {
+	return func(s *Store) {
+		s.defaultTTL = ttl
+	}
+}
+
+// WithConfigFileOption returns a StoreOption that loads eviction, memory and TTL settings from a
+// YAML or JSON file, and watches the file so that changes are applied while the store runs.
+// Settings in the file take precedence over other options.
+//
+// Example:
+//
+//	NewStore(WithConfigFileOption("/etc/kvstore.yaml"))
+func WithConfigFileOption(path string) StoreOption {
+	return func(s *Store) {
+		s.configPath = path
+	}
+}
+
+// WithReconcileOption returns a StoreOption that periodically reconciles the in-memory key set
+// with the first persister, keeping long-running instances consistent. See Store.Reconcile.
+//
+// Example:
+//
+//	NewStore(WithReconcileOption(10 * time.Minute))
+func WithReconcileOption(frequency time.Duration) StoreOption {
+	return func(s *Store) {
+		s.reconcileFreq = frequency
+	}
+}
+
+// WithRemovalHandlerOption returns a StoreOption that calls handler whenever a key is deleted or
+// expires, or its value is unloaded from memory, with the reason, such as to save evicted values to
+// an upstream system. Deletions are reported once the persisters have removed the key, and keys
+// dropped because another process deleted them are reported too. Events are delivered in order on
+// a single goroutine, outside the store's lock, so the handler may call the store, but a slow
+// handler delays later events rather than the store; if it falls too far behind, events are dropped
+// with a warning.
+//
+// Example:
+//
+//	NewStore(WithRemovalHandlerOption(func(e RemovalEvent) {
+//		log.Printf("%s %s", e.Key, e.Reason)
+//	}))
+func WithRemovalHandlerOption(handler func(RemovalEvent)) StoreOption {
+	return func(s *Store) {
+		s.removalHandler = handler
+	}
+}
+
+// WithRemovalValuesOption returns a StoreOption that includes each key's final value in the events
+// passed to the handler set with WithRemovalHandlerOption. Values that are not in memory are read
+// from the first persister before the key is deleted, which slows deletes and expiry.
+//
+// Example:
+//
+//	NewStore(WithRemovalHandlerOption(saveUpstream), WithRemovalValuesOption())
+func WithRemovalValuesOption() StoreOption {
+	return func(s *Store) {
+		s.removalValues = true
+	}
+}
+
+// WithHitSamplingOption returns a StoreOption that samples the per-key hit counts reported by TopKeys,
+// counting roughly one in every n reads of a key and scaling it by n, to reduce contention on hot
+// keys. Counts are then estimates. An n of one or less counts every read.
+//
+// Example:
+//
+//	NewStore(WithHitSamplingOption(10))
+func WithHitSamplingOption(n int) StoreOption {
+	return func(s *Store) {
+		s.hitSampling = n
+	}
+}
+
+// WithExpvarOption returns a StoreOption that publishes the store's Stats with expvar under name, so
+// they are served at /debug/vars alongside the process's other variables. New fails if name is used by
+// another open store or was published by the program itself. After Close the variable reports null,
+// and a new store can reuse the name.
+//
+// Example:
+//
+//	NewStore(WithExpvarOption("kvstore.sessions"))
+func WithExpvarOption(name string) StoreOption {
+	return func(s *Store) {
+		s.expvarName = name
+	}
+}
+
+// WithReadOnlyOption returns a StoreOption that rejects every write with ErrReadOnly,
+// for serving a snapshot or a replica. Expired keys are still removed.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithReadOnlyOption())
+func WithReadOnlyOption() StoreOption {
+	return func(s *Store) {
+		s.readOnly = true
+	}
+}
+
+// WithFollowOption returns a StoreOption that makes the store a read-only follower of a persistence
+// folder written by another process, calling Store.Refresh at the given frequency to pick up its changes.
+// Expired keys are dropped from memory but left for the writer to delete. Use it with a persister opened
+// with persistence.LockReader so reads never see a key half written.
+//
+// Example:
+//
+//	p, _ := persistence.OpenFsPersistence("/shared/kv", persistence.LockReader)
+//	NewStore(WithPersistenceOption(p), WithFollowOption(5 * time.Second))
+func WithFollowOption(frequency time.Duration) StoreOption {
+	return func(s *Store) {
+		s.followFreq = frequency
+		s.readOnly = true
+	}
+}
+
+// WithKeyNormalizationOption returns a StoreOption that converts every key to Unicode NFC before it
+// is used, so composed and decomposed spellings of the same text address the same entry in memory and
+// on disk; Keys and QueryKeys list a key as it was first set. If caseFold is true keys are also case
+// folded, making them case-insensitive. Keys persisted before the option was enabled are not renamed;
+// see CanonicalKey.
+//
+// Example:
+//
+//	NewStore(WithKeyNormalizationOption(false))
+func WithKeyNormalizationOption(caseFold bool) StoreOption {
+	return func(s *Store) {
+		s.normalizeKeys = true
+		s.foldKeys = caseFold
+	}
+}
+
+// WithCaseInsensitiveKeysOption returns a StoreOption that looks keys up by their lower case form,
+// for applications migrating from case-insensitive systems. Keys are held in memory and persisted in
+// lower case, but Keys and QueryKeys list a key as it was first set.
+//
+// Example:
+//
+//	NewStore(WithCaseInsensitiveKeysOption())
+func WithCaseInsensitiveKeysOption() StoreOption {
+	return func(s *Store) {
+		s.lowerKeys = true
+	}
+}
+
+// WithMaxKeyLengthOption returns a StoreOption that rejects keys longer than max bytes with
+// ErrKeyTooLong. Filesystem persistence uses keys as directory names, which most filesystems
+// limit to 255 bytes. A max of zero or less allows keys of any length.
+//
+// Example:
+//
+//	NewStore(WithMaxKeyLengthOption(255))
+func WithMaxKeyLengthOption(max int) StoreOption {
+	return func(s *Store) {
+		s.maxKeyLength = max
+	}
+}
+
+// WithCounterFlushOption returns a StoreOption that reduces the writes made by high-rate counters.
+// Instead of persisting on every increment, Counter, Counters and CounterWindow persist a counter once
+// its unpersisted change reaches maxDelta, and every interval all counters with unpersisted changes
+// are checkpointed. Closing the store writes a final checkpoint. If the process crashes, at most the
+// changes made since the last checkpoint, or maxDelta per counter, are lost. A zero interval or maxDelta disables that trigger.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithCounterFlushOption(5*time.Second, 1000))
+func WithCounterFlushOption(interval time.Duration, maxDelta int64) StoreOption {
+	return func(s *Store) {
+		s.counterFlushFreq = interval
+		s.counterFlushDelta = maxDelta
+	}
+}
+
+// WithEphemeralPrefixOption returns a StoreOption that keeps keys starting with any of the prefixes
+// in memory only. They are never written to the persisters, so one store can hold both durable data
+// and throwaway scratch values. Ephemeral keys are lost when the process exits.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithEphemeralPrefixOption("tmp:", "cache:"))
+func WithEphemeralPrefixOption(prefixes ...string) StoreOption {
+	return func(s *Store) {
+		s.ephemeralPrefixes = append(s.ephemeralPrefixes, prefixes...)
+	}
+}
+
+// WithPurgeExpiredOnStartOption returns a StoreOption that drops keys whose metadata shows they
+// expired while the store was not running, deleting them from the persisters, instead of loading
+// them into the key map to be removed by the eviction controller later.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithPurgeExpiredOnStartOption())
+func WithPurgeExpiredOnStartOption() StoreOption {
+	return func(s *Store) {
+		s.purgeExpired = true
+	}
+}
+
+// WithLazyMetadataOption returns a StoreOption that only lists the persisted keys on startup, reading
+// each key's metadata from the first persister the first time the key is used. It suits large
+// datasets where most keys are rarely touched. Until a key's metadata is read, its expiry is not
+// known, so Keys lists it even if it has expired, its size is not included in Stats, and its
+// DependsOn links are not tracked; WithPurgeExpiredOnStartOption has no effect. Operations that
+// filter or report on the metadata of every key, such as QueryKeys and ExportChangedSince, first
+// read the metadata of all keys not yet used.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithLazyMetadataOption())
+func WithLazyMetadataOption() StoreOption {
+	return func(s *Store) {
+		s.lazyMetadata = true
+	}
+}
+
+// WithStartupProgressOption returns a StoreOption that calls progress as persisted keys are loaded on
+// startup, with the number of keys loaded so far and the total. It is called once before loading
+// begins and after each batch, from the goroutine loading the keys.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithStartupProgressOption(func(loaded, total int) {
+//		log.Printf("loaded %d/%d keys", loaded, total)
+//	}))
+func WithStartupProgressOption(progress func(loaded, total int)) StoreOption {
+	return func(s *Store) {
+		s.startupProgress = progress
+	}
+}
+
+// WithBackgroundStartupOption returns a StoreOption that makes New return before the persisted keys
+// are loaded, loading them in the background. Keys that have not been loaded yet behave as if they
+// do not exist, so callers should wait on Store.Ready before serving traffic. Keys written before
+// they are loaded keep the value written.
+//
+// Example:
+//
+//	store, _ := NewStore(WithPersistenceOption(persister), WithBackgroundStartupOption())
+//	<-store.Ready()
+func WithBackgroundStartupOption() StoreOption {
+	return func(s *Store) {
+		s.backgroundStartup = true
+	}
+}
+
+// WithLoadParallelismOption returns a StoreOption that reads keys from the first persister on up to
+// n goroutines when several are needed at once: the values GetMulti finds unloaded, and the metadata
+// read at startup, by Refresh and for lazily loaded keys. The persister must be safe for concurrent
+// reads, as those in the persistence package are; a persistence.Buffer only reads in parallel if it
+// has several workers. An n of one or less reads each batch on the calling goroutine.
+//
+// Example:
+//
+//	NewStore(WithPersistenceOption(persister), WithLoadParallelismOption(8))
+func WithLoadParallelismOption(n int) StoreOption {
+	return func(s *Store) {
+		s.loadParallelism = n
+	}
+}
+
+// WithEarlyExpirationOption returns a StoreOption that spreads out the reloading of keys that expire
+// together, using probabilistic early expiration (XFetch). As a key with a TTL and a recompute cost
+// nears its expiry, Get and GetMulti report it as not found with a probability that rises to one at
+// the expiry, so one caller usually reloads it before the others miss. Beta scales how early keys
+// are reloaded; 1 is the usual choice and larger values reload earlier.
+//
+// Example:
+//
+//	NewStore(WithEarlyExpirationOption(1))
+func WithEarlyExpirationOption(beta float64) StoreOption {
+	return func(s *Store) {
+		s.earlyExpiryBeta = beta
+	}
+}
+
+// WithTTLJitterOption returns a StoreOption that moves each key's expiry by a random amount of up to
+// fraction of its TTL either way, so keys written together do not all expire, and get deleted from
+// the persisters, at the same instant. A fraction of 0.1 spreads a one hour TTL over 54 to 66 minutes.
+// Fractions are limited to between 0 and 1.
+//
+// Example:
+//
+//	NewStore(WithDefaultTTLOption(time.Hour), WithTTLJitterOption(0.1))
+func WithTTLJitterOption(fraction float64) StoreOption {
+	return func(s *Store) {
+		s.ttlJitter = math.Max(0, math.Min(1, fraction))
+	}
+}
+
+// WithACLOption returns a StoreOption that checks operations made through Store.As against acl.
+// Operations made directly on the Store are not checked.
+//
+// Example:
+//
+//	acl := NewACL()
+//	acl.Grant("billing-service", "invoices", PermWrite)
+//	NewStore(WithACLOption(acl))
+func WithACLOption(acl *ACL) StoreOption {
+	return func(s *Store) {
+		s.acl = acl
+	}
+}
@@ -0,0 +1,53 @@
+package kvstore
+
+import "github.com/pkg/errors"
+
+// Patch overwrites the bytes of a key's value starting at offset, extending the value with zero
+// bytes if offset is beyond its end. A missing key is created. Persisters that implement Patcher
+// are given just the changed range, which suits fixed-size records and bitmaps.
+func (kv *Store) Patch(key string, offset int, data []byte) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	if offset < 0 {
+		return errors.New("Store.Patch offset must not be negative")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	var current []byte
+	canPatch := false
+	mv, err := kv.loadedItem(key)
+	if err == nil {
+		if mv.Type != RawValue {
+			return ErrWrongType
+		}
+		current = mv.Data
+		canPatch = !mv.dirty
+	} else if !errors.Is(err, ErrNotFound) {
+		return errors.Wrap(err, "Store.Patch kv.loadedItem")
+	}
+
+	size := max(len(current), offset+len(data))
+	patched := make([]byte, size)
+	copy(patched, current)
+	copy(patched[offset:], data)
+
+	if err := kv.updateData(key, patched); err != nil {
+		return errors.Wrap(err, "Store.Patch kv.updateData")
+	}
+	if !canPatch || kv.ephemeral(key) {
+		return kv.persistData(key)
+	}
+
+	// Bytes between the old end and offset are zero filled, so are part of the patch.
+	start := min(offset, len(current))
+	return kv.persistWith(key, func(p DataPersister, key string, item *ValueItem) error {
+		if patcher, ok := p.(Patcher); ok {
+			return errors.Wrap(patcher.Patch(key, int64(start), patched[start:offset+len(data)], item), "Store.Patch persist")
+		}
+		return errors.Wrap(p.Write(key, item), "Store.Patch persist")
+	})
+}
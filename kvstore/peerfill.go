@@ -0,0 +1,38 @@
+package kvstore
+
+// PeerFiller fetches values from sibling store instances. When a Get finds that a key's value is not in
+// memory, the store asks its PeerFiller before reading the persister, so that in a horizontally scaled
+// deployment each value is read from the backend by only the instance that owns it.
+type PeerFiller interface {
+	// Fill returns the value of key held by the instance that owns it, and false if this instance owns
+	// the key or the owner could not supply it, in which case the store reads its persister.
+	Fill(key string) ([]byte, bool)
+}
+
+// fillFromPeer loads a key's value from its owning peer into memory, if the store has a PeerFiller.
+func (kv *Store) fillFromPeer(key string) ([]byte, bool) {
+	if kv.filler == nil {
+		return nil, false
+	}
+	data, ok := kv.filler.Fill(key)
+	if !ok {
+		return nil, false
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	mv, exists := kv.data[key]
+	if !exists {
+		return nil, false
+	}
+	if mv.dataLoaded {
+		return kv.valueOf(mv), true
+	}
+	filled := *mv
+	if err := filled.SetData(data); err != nil {
+		return nil, false
+	}
+	filled.touchAccess(kv.nowFunc().UnixNano())
+	kv.replaceItem(key, &filled)
+	return data, true
+}
@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimeField selects which of a key's timestamps QueryKeys compares against its time period.
+type TimeField int
+
+// Timestamps that QueryKeys can filter on.
+const (
+	CreatedTime  TimeField = iota // When the key was first written.
+	UpdatedTime                   // When the key was last written.
+	AccessedTime                  // When the key was last read or written.
+)
+
+// keyQuery holds the filters applied by QueryKeys.
+type keyQuery struct {
+	field  TimeField
+	prefix string
+}
+
+// QueryOption is a type for functions that configure the filters applied by QueryKeys.
+type QueryOption func(q *keyQuery)
+
+// WithTimeFieldQueryOption returns a QueryOption that selects which timestamp must fall within the
+// time period. Keys are matched by their creation time by default.
+//
+// Example:
+//
+//	store.QueryKeys(time.Now().Add(-time.Hour), time.Now(), WithTimeFieldQueryOption(UpdatedTime))
+func WithTimeFieldQueryOption(field TimeField) QueryOption {
+	return func(q *keyQuery) {
+		q.field = field
+	}
+}
+
+// WithPrefixQueryOption returns a QueryOption that only matches keys starting with prefix.
+//
+// Example:
+//
+//	store.QueryKeys(from, to, WithPrefixQueryOption("invoices:"))
+func WithPrefixQueryOption(prefix string) QueryOption {
+	return func(q *keyQuery) {
+		q.prefix = prefix
+	}
+}
+
+// QueryKeys returns the keys, in sorted order, whose timestamp falls within a time period, inclusive
+// of both ends. By default keys are matched by when they were created; the options select a different
+// timestamp and restrict the keys to a prefix.
+func (kv *Store) QueryKeys(from, to time.Time, options ...QueryOption) ([]string, error) {
+	q := keyQuery{field: CreatedTime}
+	for _, opt := range options {
+		opt(&q)
+	}
+	q.prefix = kv.canonicalKey(q.prefix)
+	kv.resolveAll()
+
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	keys := make([]string, 0)
+	for k, v := range kv.data {
+		if !strings.HasPrefix(k, q.prefix) || kv.expired(k, v, now) {
+			continue
+		}
+		if ts := v.timestamp(q.field); !ts.Before(from) && !ts.After(to) {
+			keys = append(keys, v.displayKey(k))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// timestamp returns the item's timestamp selected by field.
+func (item *ValueItem) timestamp(field TimeField) time.Time {
+	switch field {
+	case UpdatedTime:
+		return item.Ts
+	case AccessedTime:
+		return item.accessedAt()
+	default:
+		return item.created()
+	}
+}
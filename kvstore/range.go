@@ -0,0 +1,116 @@
+package kvstore
+
+import (
+	"strings"
+	"time"
+)
+
+// rangeFilter holds the filters applied by Range.
+type rangeFilter struct {
+	prefix         string
+	metaName       string
+	metaValue      string
+	minSize        int64
+	expiringBefore time.Time
+}
+
+// RangeOption is a type for functions that configure the filters applied by Range.
+type RangeOption func(f *rangeFilter)
+
+// WithPrefixRangeOption returns a RangeOption that only visits keys starting with prefix.
+//
+// Example:
+//
+//	store.Range(visit, WithPrefixRangeOption("sessions:"))
+func WithPrefixRangeOption(prefix string) RangeOption {
+	return func(f *rangeFilter) {
+		f.prefix = prefix
+	}
+}
+
+// WithTagRangeOption returns a RangeOption that only visits keys tagged with a metadata entry,
+// as set with WithMetaSetOption, whose name and value match.
+//
+// Example:
+//
+//	store.Range(visit, WithTagRangeOption("tenant", "acme"))
+func WithTagRangeOption(name, value string) RangeOption {
+	return func(f *rangeFilter) {
+		f.metaName = name
+		f.metaValue = value
+	}
+}
+
+// WithMinSizeRangeOption returns a RangeOption that only visits keys whose value is at least size bytes.
+//
+// Example:
+//
+//	store.Range(visit, WithMinSizeRangeOption(1<<20))
+func WithMinSizeRangeOption(size int64) RangeOption {
+	return func(f *rangeFilter) {
+		f.minSize = size
+	}
+}
+
+// WithExpiringBeforeRangeOption returns a RangeOption that only visits keys with a TTL that expires before t.
+//
+// Example:
+//
+//	store.Range(visit, WithExpiringBeforeRangeOption(time.Now().Add(time.Hour)))
+func WithExpiringBeforeRangeOption(t time.Time) RangeOption {
+	return func(f *rangeFilter) {
+		f.expiringBefore = t
+	}
+}
+
+// newRangeFilter applies the options to a filter, canonicalizing its prefix.
+func (kv *Store) newRangeFilter(options []RangeOption) rangeFilter {
+	var f rangeFilter
+	for _, opt := range options {
+		opt(&f)
+	}
+	f.prefix = kv.canonicalKey(f.prefix)
+	return f
+}
+
+// matches reports whether the item stored under key passes the filter.
+func (f rangeFilter) matches(key string, mv *ValueItem) bool {
+	if !strings.HasPrefix(key, f.prefix) || mv.Size < f.minSize {
+		return false
+	}
+	if f.metaName != "" {
+		if v, ok := mv.Meta[f.metaName]; !ok || v != f.metaValue {
+			return false
+		}
+	}
+	if !f.expiringBefore.IsZero() {
+		if expiresAt, ok := mv.expiry(); !ok || !expiresAt.Before(f.expiringBefore) {
+			return false
+		}
+	}
+	return true
+}
+
+// Range calls fn with the key and metadata of every live key that passes the filters, in no
+// particular order, until fn returns false. Unlike Keys and QueryKeys it builds no list of keys,
+// so it suits maintenance jobs that walk large stores.
+//
+// fn is called while the store's read lock is held, so it must not call the Store's methods.
+// Jobs that change keys should collect them and act once Range returns, or use DeleteWhere and SetTTLWhere.
+func (kv *Store) Range(fn func(key string, meta ItemInfo) bool, options ...RangeOption) {
+	f := kv.newRangeFilter(options)
+	kv.resolveAll()
+
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	now := kv.nowFunc()
+	for k, v := range kv.data {
+		if kv.expired(k, v, now) || !f.matches(k, v) {
+			continue
+		}
+		if !fn(v.displayKey(k), v.info()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package kvstore
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// readViewShards is the number of shards of a read view.
+const readViewShards = 32
+
+// readView mirrors the store's key map in sharded sync.Maps, so Get can find keys without taking
+// the store's read lock. The map remains the source of truth: every change to it is made under the
+// write lock and applied to the view at the same time. Items are shared with the map, so only keys
+// being added, replaced or removed need to reach the view.
+type readView [readViewShards]sync.Map
+
+// shard returns the shard holding a key.
+func (v *readView) shard(key string) *sync.Map {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &v[h.Sum32()%readViewShards]
+}
+
+func (v *readView) load(key string) (*ValueItem, bool) {
+	mv, ok := v.shard(key).Load(key)
+	if !ok {
+		return nil, false
+	}
+	return mv.(*ValueItem), true
+}
+
+// putItem stores an item under a key. The caller must hold the write lock.
+func (kv *Store) putItem(key string, mv *ValueItem) {
+	kv.data[key] = mv
+	kv.touch(key)
+	kv.trackDeletion(key, mv)
+	if kv.readView != nil {
+		kv.readView.shard(key).Store(key, mv)
+	}
+}
+
+// removeItem removes a key's item. The caller must hold the write lock.
+func (kv *Store) removeItem(key string) {
+	delete(kv.data, key)
+	kv.touch(key)
+	delete(kv.deletions, key)
+	if kv.readView != nil {
+		kv.readView.shard(key).Delete(key)
+	}
+}
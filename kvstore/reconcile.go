@@ -0,0 +1,141 @@
+package kvstore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ReconcileReport describes the changes made by a reconciliation run.
+type ReconcileReport struct {
+	Repersisted []string // Keys held in memory that were missing from the first persister and were written back.
+	Loaded      []string // Keys found in the first persister that were not in memory and had their metadata loaded.
+	Dropped     []string // Keys missing from the first persister whose values were not in memory, so cannot be recovered.
+}
+
+// Reconcile compares the in-memory key set with the keys held by the first persister. Values held in
+// memory but missing from the persister are persisted again, and keys written to the persister by
+// another process have their metadata loaded. Keys missing from the persister whose values have been
+// unloaded are dropped, as there is nothing left to reload them from.
+func (kv *Store) Reconcile() (ReconcileReport, error) {
+	var report ReconcileReport
+	if len(kv.persistence) == 0 {
+		return report, nil
+	}
+
+	persisted, unindexed, err := kv.persistedIndex()
+	if err != nil {
+		return report, errors.Wrap(err, "Store.Reconcile")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	for k, mv := range kv.data {
+		if _, ok := persisted[k]; ok || kv.ephemeral(k) {
+			continue
+		}
+		if !mv.dataLoaded {
+			kv.forget(k)
+			report.Dropped = append(report.Dropped, k)
+			continue
+		}
+		if err := kv.persistData(k); err != nil {
+			return report, errors.Wrapf(err, "Store.Reconcile persist key %s", k)
+		}
+		report.Repersisted = append(report.Repersisted, k)
+	}
+	report.Loaded = kv.indexUnindexed(unindexed)
+	return report, nil
+}
+
+// persistedIndex lists the keys held by the first persister, for Reconcile and Refresh to compare
+// with the key map, and reads the metadata of those not in the key map.
+func (kv *Store) persistedIndex() (map[string]struct{}, map[string]*ValueItem, error) {
+	keys, err := kv.persistence[0].Keys()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Keys")
+	}
+	persisted := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		persisted[k] = struct{}{}
+	}
+
+	kv.lock.RLock()
+	newKeys := make([]string, 0)
+	for _, k := range keys {
+		if _, ok := kv.data[k]; !ok {
+			newKeys = append(newKeys, k)
+		}
+	}
+	kv.lock.RUnlock()
+	if len(newKeys) == 0 {
+		return persisted, nil, nil
+	}
+
+	unindexed, err := kv.readPersisted(newKeys, false)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "ReadMulti")
+	}
+	for _, k := range newKeys {
+		if _, ok := unindexed[k]; !ok {
+			unindexed[k] = kv.readMetadata(k)
+		}
+	}
+	return persisted, unindexed, nil
+}
+
+// indexUnindexed adds the items read by persistedIndex to the key map, skipping keys added since,
+// and returns the keys added. The caller must hold the write lock.
+func (kv *Store) indexUnindexed(items map[string]*ValueItem) []string {
+	var added []string
+	for k, mv := range items {
+		if _, ok := kv.data[k]; ok {
+			continue
+		}
+		kv.indexItem(k, mv)
+		kv.misses.forget(k)
+		added = append(added, k)
+	}
+	return added
+}
+
+// forget drops a key that is no longer persisted, such as one deleted by another process, from
+// memory, without deleting it from the persisters. The caller must hold the write lock.
+func (kv *Store) forget(key string) {
+	if mv, ok := kv.data[key]; ok {
+		kv.notifyRemoval(key, mv, RemovalDeleted)
+		kv.removeItem(key)
+		if mv.inArena {
+			kv.releaseValue(mv)
+		}
+		kv.trackDependencies(key, mv.DependsOn, nil)
+	}
+}
+
+// reconcileController runs Reconcile periodically until the store is closed.
+func (kv *Store) reconcileController() {
+	if kv.reconcileFreq <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(kv.reconcileFreq)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			report, err := kv.Reconcile()
+			if err != nil {
+				log.Error().Msgf("[kvstore reconcile] error: %s", err.Error())
+				continue
+			}
+			if len(report.Repersisted)+len(report.Loaded)+len(report.Dropped) > 0 {
+				log.Info().Msgf("[kvstore reconcile] repersisted: %d loaded: %d dropped: %d",
+					len(report.Repersisted), len(report.Loaded), len(report.Dropped))
+			}
+		case <-kv.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package kvstore
+
+import (
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RemovalReason describes why a key or its value was removed from the store.
+type RemovalReason int
+
+// Removal reasons reported to the handler set with WithRemovalHandlerOption.
+const (
+	RemovalDeleted RemovalReason = iota // Deleted by Delete, DeleteWhere or DeleteAfter with no delay, because a key it depends on changed, or by another process sharing the persisters.
+	RemovalExpired                      // Its TTL, namespace TTL or scheduled deletion passed, including while the store was not running.
+	RemovalEvicted                      // Its value was unloaded from memory, when idle or to stay within the memory limit. The key is still persisted.
+)
+
+// String returns the reason in lower case, as in "expired".
+func (r RemovalReason) String() string {
+	switch r {
+	case RemovalDeleted:
+		return "deleted"
+	case RemovalExpired:
+		return "expired"
+	case RemovalEvicted:
+		return "evicted"
+	default:
+		return "unknown"
+	}
+}
+
+// RemovalEvent describes a key or value removed from the store.
+type RemovalEvent struct {
+	Key    string
+	Reason RemovalReason
+	Info   ItemInfo // The key's metadata when it was removed.
+	Value  []byte   // The final value, if WithRemovalValuesOption was used and it could be read.
+}
+
+// maxQueuedRemovals bounds the removal events waiting for a slow handler. Later events are dropped,
+// and counted in a warning, until the handler catches up, so it cannot exhaust memory.
+const maxQueuedRemovals = 10000
+
+// removalQueue holds removal events until the removal controller delivers them, so handlers run
+// outside the store's lock and may call back into the store.
+type removalQueue struct {
+	lock    sync.Mutex
+	events  []RemovalEvent
+	dropped int
+	wake    chan struct{}
+}
+
+// notifyRemoval queues a removal event for the handler, if there is one. mv must still hold the
+// key's value, so the value can be copied before it is released. The caller must hold the write lock.
+func (kv *Store) notifyRemoval(key string, mv *ValueItem, reason RemovalReason) {
+	if event, ok := kv.removalEvent(key, mv, reason); ok {
+		kv.queueRemoval(event)
+	}
+}
+
+// removalEvent returns the event describing a key's removal, or false if there is no handler.
+// It is taken before the key is removed, to be queued once the removal succeeds. The caller must
+// hold the write lock.
+func (kv *Store) removalEvent(key string, mv *ValueItem, reason RemovalReason) (RemovalEvent, bool) {
+	if kv.removalHandler == nil {
+		return RemovalEvent{}, false
+	}
+	event := RemovalEvent{Key: mv.displayKey(key), Reason: reason, Info: mv.info()}
+	if kv.removalValues {
+		event.Value = kv.finalValue(key, mv)
+	}
+	return event, true
+}
+
+// queueRemoval queues a removal event for the removal controller, dropping it if the queue is full.
+func (kv *Store) queueRemoval(event RemovalEvent) {
+	kv.removals.lock.Lock()
+	if len(kv.removals.events) < maxQueuedRemovals {
+		kv.removals.events = append(kv.removals.events, event)
+	} else {
+		kv.removals.dropped++
+	}
+	kv.removals.lock.Unlock()
+	select {
+	case kv.removals.wake <- struct{}{}:
+	default:
+	}
+}
+
+// finalValue returns a copy of a key's value, reading it from the first persister if it is not in
+// memory, or nil if it cannot be read or is no longer persisted. The caller must hold the write lock.
+func (kv *Store) finalValue(key string, mv *ValueItem) []byte {
+	if mv.dataLoaded {
+		return append([]byte(nil), mv.Data...)
+	}
+	if len(kv.persistence) == 0 || kv.ephemeral(key) {
+		return nil
+	}
+	stored, err := kv.persistence[0].Read(key, true)
+	if notPersisted(err) {
+		// Removed by another process, so there is no final value to read.
+		return nil
+	} else if err != nil {
+		log.Warn().Msgf("[kvstore removal] error reading final value of key %s error: %s", key, err.Error())
+		return nil
+	}
+	return stored.Data
+}
+
+// unloadValue releases a key's value from memory, reporting it as evicted. The caller must hold the write lock.
+func (kv *Store) unloadValue(key string, mv *ValueItem) {
+	kv.notifyRemoval(key, mv, RemovalEvicted)
+	kv.releaseValue(mv)
+}
+
+// removalController delivers queued removal events to the handler in order until the store is
+// closed, then delivers those still queued.
+func (kv *Store) removalController() {
+	if kv.removalHandler == nil {
+		return
+	}
+	for {
+		select {
+		case <-kv.removals.wake:
+			kv.deliverRemovals()
+		case <-kv.ctx.Done():
+			kv.deliverRemovals()
+			return
+		}
+	}
+}
+
+func (kv *Store) deliverRemovals() {
+	for {
+		kv.removals.lock.Lock()
+		events, dropped := kv.removals.events, kv.removals.dropped
+		kv.removals.events, kv.removals.dropped = nil, 0
+		kv.removals.lock.Unlock()
+		if dropped > 0 {
+			log.Warn().Msgf("[kvstore removal] handler too slow, dropped %d removal events", dropped)
+		}
+		if len(events) == 0 {
+			return
+		}
+		for _, event := range events {
+			kv.removalHandler(event)
+		}
+	}
+}
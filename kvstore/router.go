@@ -0,0 +1,406 @@
+package kvstore
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Router is a DataPersister that sends each key to one of several persisters, so one store can keep
+// different classes of data in different backends, such as images in object storage and everything
+// else on local disk. Keys are routed by a metadata tag, then by the longest matching key prefix,
+// and otherwise to the default persister.
+//
+// The Router remembers which persister holds each key, listing them on first use, so keys routed by
+// tag can be read and deleted without their metadata. A key written to a different persister than
+// before is deleted from the old one. Stores route the namespaces set with WithPersisterNamespaceOption
+// with a Router, and the persistence package exposes it for routing by tag or prefix.
+type Router struct {
+	fallback   DataPersister
+	prefixes   []prefixRoute
+	tags       []tagRoute
+	persisters []DataPersister
+	lock       sync.Mutex
+	index      map[string]DataPersister
+}
+
+// prefixRoute sends keys starting with prefix to persister.
+type prefixRoute struct {
+	prefix    string
+	persister DataPersister
+}
+
+// tagRoute sends values whose metadata entry name equals value to persister.
+type tagRoute struct {
+	name      string
+	value     string
+	persister DataPersister
+}
+
+// RouterOption configures a Router.
+type RouterOption func(*Router)
+
+// WithPrefixRouterOption returns a RouterOption that sends keys starting with prefix to persister.
+// When several prefixes match a key the longest wins.
+//
+// Example:
+//
+//	NewRouter(local, WithPrefixRouterOption("images:", s3))
+func WithPrefixRouterOption(prefix string, persister DataPersister) RouterOption {
+	return func(r *Router) {
+		r.prefixes = append(r.prefixes, prefixRoute{prefix: prefix, persister: persister})
+		r.add(persister)
+	}
+}
+
+// WithTagRouterOption returns a RouterOption that sends values whose metadata entry name equals value
+// to persister, as set with WithMetaSetOption. Tag routes are checked before prefix routes,
+// in the order they were added.
+//
+// Example:
+//
+//	NewRouter(local, WithTagRouterOption("class", "archive", coldStorage))
+func WithTagRouterOption(name, value string, persister DataPersister) RouterOption {
+	return func(r *Router) {
+		r.tags = append(r.tags, tagRoute{name: name, value: value, persister: persister})
+		r.add(persister)
+	}
+}
+
+// NewRouter creates a Router that sends keys matching no route to fallback.
+func NewRouter(fallback DataPersister, options ...RouterOption) *Router {
+	r := &Router{fallback: fallback}
+	r.add(fallback)
+	for _, opt := range options {
+		opt(r)
+	}
+	sort.SliceStable(r.prefixes, func(i, j int) bool {
+		return len(r.prefixes[i].prefix) > len(r.prefixes[j].prefix)
+	})
+	return r
+}
+
+// add records a persister, once, in the order it was configured.
+func (r *Router) add(persister DataPersister) {
+	for _, p := range r.persisters {
+		if p == persister {
+			return
+		}
+	}
+	r.persisters = append(r.persisters, persister)
+}
+
+// route returns the persister a key is written to. The item may be nil when only the key is known.
+func (r *Router) route(key string, item *ValueItem) DataPersister {
+	if item != nil {
+		for _, t := range r.tags {
+			if v, ok := item.Meta[t.name]; ok && v == t.value {
+				return t.persister
+			}
+		}
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(key, p.prefix) {
+			return p.persister
+		}
+	}
+	return r.fallback
+}
+
+// buildIndex lists the keys of every persister, if that has not been done yet. A filesystem persister
+// whose folder has not been created yet holds no keys.
+// The caller must hold the lock.
+func (r *Router) buildIndex() error {
+	if r.index != nil {
+		return nil
+	}
+	index := make(map[string]DataPersister)
+	for _, p := range r.persisters {
+		keys, err := p.Keys()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "Router Keys")
+		}
+		for _, k := range keys {
+			if _, ok := index[k]; !ok {
+				index[k] = p
+			}
+		}
+	}
+	r.index = index
+	return nil
+}
+
+// locate returns the persister holding a key, or the persister it would be routed to if it is not held.
+func (r *Router) locate(key string) (DataPersister, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return nil, err
+	}
+	if p, ok := r.index[key]; ok {
+		return p, nil
+	}
+	return r.route(key, nil), nil
+}
+
+// Write writes the item to the persister it is routed to, deleting it from any persister that held it before.
+func (r *Router) Write(key string, data *ValueItem) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return errors.Wrap(err, "Router.Write")
+	}
+
+	target := r.target(key, data)
+	if err := target.Write(key, data); err != nil {
+		return errors.Wrap(err, "Router.Write")
+	}
+	return errors.Wrap(r.written(key, target), "Router.Write")
+}
+
+// WriteMulti writes the items to the persisters they are routed to, as a batch where supported,
+// deleting them from any persisters that held them before.
+func (r *Router) WriteMulti(items map[string]*ValueItem) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return errors.Wrap(err, "Router.WriteMulti")
+	}
+
+	groups := make(map[DataPersister]map[string]*ValueItem)
+	targets := make(map[string]DataPersister, len(items))
+	for k, item := range items {
+		target := r.target(k, item)
+		if groups[target] == nil {
+			groups[target] = make(map[string]*ValueItem)
+		}
+		groups[target][k] = item
+		targets[k] = target
+	}
+	for p, group := range groups {
+		if err := writeMulti(p, group); err != nil {
+			return errors.Wrap(err, "Router.WriteMulti")
+		}
+	}
+	for k, target := range targets {
+		if err := r.written(k, target); err != nil {
+			return errors.Wrap(err, "Router.WriteMulti")
+		}
+	}
+	return nil
+}
+
+// Patch updates part of a value in the persister holding it, writing the whole value if that
+// persister cannot patch or the value is routed elsewhere.
+func (r *Router) Patch(key string, offset int64, data []byte, item *ValueItem) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return errors.Wrap(err, "Router.Patch")
+	}
+
+	target := r.target(key, item)
+	patcher, ok := target.(Patcher)
+	if previous, held := r.index[key]; ok && held && previous == target {
+		return errors.Wrap(patcher.Patch(key, offset, data, item), "Router.Patch")
+	}
+	if err := target.Write(key, item); err != nil {
+		return errors.Wrap(err, "Router.Patch")
+	}
+	return errors.Wrap(r.written(key, target), "Router.Patch")
+}
+
+// target returns the persister an item is written to. A metadata-only write cannot move a value,
+// so it goes to the persister already holding the key. The caller must hold the lock.
+func (r *Router) target(key string, data *ValueItem) DataPersister {
+	target := r.route(key, data)
+	if previous, held := r.index[key]; held && previous != target && data.Data == nil {
+		return previous
+	}
+	return target
+}
+
+// written records that target holds a key, deleting it from the persister that held it before.
+// The caller must hold the lock.
+func (r *Router) written(key string, target DataPersister) error {
+	if previous, held := r.index[key]; held && previous != target {
+		if err := previous.Delete(key); err != nil {
+			return errors.Wrap(err, "delete moved key")
+		}
+	}
+	r.index[key] = target
+	return nil
+}
+
+// Read reads the item from the persister holding it.
+func (r *Router) Read(key string, readValue bool) (*ValueItem, error) {
+	p, err := r.locate(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Router.Read")
+	}
+	return p.Read(key, readValue)
+}
+
+// ReadMulti reads the keys from the persisters holding them, as a batch where supported.
+func (r *Router) ReadMulti(keys []string, readValue bool) (map[string]*ValueItem, error) {
+	r.lock.Lock()
+	if err := r.buildIndex(); err != nil {
+		r.lock.Unlock()
+		return nil, errors.Wrap(err, "Router.ReadMulti")
+	}
+	groups := r.partition(keys)
+	r.lock.Unlock()
+
+	items := make(map[string]*ValueItem, len(keys))
+	for p, group := range groups {
+		read, err := readMulti(p, group, readValue)
+		if err != nil {
+			return nil, errors.Wrap(err, "Router.ReadMulti")
+		}
+		for k, item := range read {
+			items[k] = item
+		}
+	}
+	return items, nil
+}
+
+// Delete removes the key from the persister holding it.
+func (r *Router) Delete(key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return errors.Wrap(err, "Router.Delete")
+	}
+
+	p, ok := r.index[key]
+	if !ok {
+		p = r.route(key, nil)
+	}
+	if err := p.Delete(key); err != nil {
+		return errors.Wrap(err, "Router.Delete")
+	}
+	delete(r.index, key)
+	return nil
+}
+
+// DeleteMulti removes the keys from the persisters holding them, as a batch where supported.
+func (r *Router) DeleteMulti(keys []string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.buildIndex(); err != nil {
+		return errors.Wrap(err, "Router.DeleteMulti")
+	}
+
+	for p, group := range r.partition(keys) {
+		if err := deleteMulti(p, group); err != nil {
+			return errors.Wrap(err, "Router.DeleteMulti")
+		}
+		for _, k := range group {
+			delete(r.index, k)
+		}
+	}
+	return nil
+}
+
+// partition groups keys by the persister holding them, or the persister they would be routed to if
+// they are not held. The caller must hold the lock.
+func (r *Router) partition(keys []string) map[DataPersister][]string {
+	groups := make(map[DataPersister][]string)
+	for _, k := range keys {
+		p, ok := r.index[k]
+		if !ok {
+			p = r.route(k, nil)
+		}
+		groups[p] = append(groups[p], k)
+	}
+	return groups
+}
+
+// Keys returns the keys held by every routed persister.
+func (r *Router) Keys() ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.index = nil
+	if err := r.buildIndex(); err != nil {
+		return nil, errors.Wrap(err, "Router.Keys")
+	}
+	keys := make([]string, 0, len(r.index))
+	for k := range r.index {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Usage returns the combined usage of the routed persisters that report usage.
+func (r *Router) Usage() (Usage, error) {
+	var total Usage
+	supported := false
+	for _, p := range r.persisters {
+		usage, err := UsageOf(p)
+		if errors.Is(err, ErrUsageNotSupported) {
+			continue
+		} else if err != nil {
+			return Usage{}, errors.Wrap(err, "Router.Usage")
+		}
+		supported = true
+		total.Bytes += usage.Bytes
+		total.Keys += usage.Keys
+	}
+	if !supported {
+		return Usage{}, ErrUsageNotSupported
+	}
+	return total, nil
+}
+
+// Flush flushes every routed persister that queues writes.
+func (r *Router) Flush() error {
+	var returnError error
+	for _, p := range r.persisters {
+		if f, ok := p.(Flusher); ok {
+			if err := f.Flush(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Router.Flush")
+			}
+		}
+	}
+	return returnError
+}
+
+// Compact compacts every routed persister that supports compaction.
+func (r *Router) Compact() error {
+	var returnError error
+	for _, p := range r.persisters {
+		if c, ok := p.(Compactor); ok {
+			if err := c.Compact(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Router.Compact")
+			}
+		}
+	}
+	return returnError
+}
+
+// Migrate upgrades every routed persister whose layout is versioned.
+func (r *Router) Migrate() error {
+	var returnError error
+	for _, p := range r.persisters {
+		if m, ok := p.(Migrator); ok {
+			if err := m.Migrate(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Router.Migrate")
+			}
+		}
+	}
+	return returnError
+}
+
+// Close closes every routed persister that holds resources.
+func (r *Router) Close() {
+	for _, p := range r.persisters {
+		if c, ok := p.(closer); ok {
+			c.Close()
+		}
+	}
+}
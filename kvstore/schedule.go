@@ -0,0 +1,210 @@
+package kvstore
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// scheduledWrite is a value staged with SetAt, to be written once at has passed.
+type scheduledWrite struct {
+	key     string
+	value   []byte
+	options []SetOption
+	at      time.Time
+}
+
+// SetAt stages a value to be stored at a future time, such as for a config rollout or embargoed
+// content. Until then reads return the key's current value, if any. The write is made by the
+// store's scheduler, and on each eviction check, with the options applied at that time, so a TTL
+// runs from when the value becomes visible. A time that is not in the future stores the value now.
+// Several writes can be staged for a key and are made in order. Staged writes are held in memory
+// and are dropped if the store is closed before they are due.
+//
+// Example:
+//
+//	err := kv.SetAt("banner", []byte("Sale now on"), launch, WithTTLSetOption(24*time.Hour))
+func (kv *Store) SetAt(key string, value []byte, at time.Time, options ...SetOption) error {
+	key, options = kv.canonicalSetKey(key, options)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	if err := kv.checkWritable(); err != nil {
+		kv.lock.Unlock()
+		return err
+	}
+	if !kv.nowFunc().Before(at) {
+		defer kv.lock.Unlock()
+		return kv.setData(key, value, options...)
+	}
+
+	write := scheduledWrite{key: key, value: append([]byte(nil), value...), options: options, at: at}
+	i := sort.Search(len(kv.scheduled), func(i int) bool {
+		return kv.scheduled[i].at.After(at)
+	})
+	kv.scheduled = append(kv.scheduled, scheduledWrite{})
+	copy(kv.scheduled[i+1:], kv.scheduled[i:])
+	kv.scheduled[i] = write
+	kv.lock.Unlock()
+	kv.signalReschedule()
+	return nil
+}
+
+// Scheduled returns the times of the writes staged for a key with SetAt, in order.
+func (kv *Store) Scheduled(key string) []time.Time {
+	key = kv.canonicalKey(key)
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	times := make([]time.Time, 0)
+	for _, w := range kv.scheduled {
+		if w.key == key {
+			times = append(times, w.at)
+		}
+	}
+	return times
+}
+
+// CancelScheduled drops the writes staged for a key with SetAt, returning how many were dropped.
+func (kv *Store) CancelScheduled(key string) int {
+	key = kv.canonicalKey(key)
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	pending := kv.scheduled[:0]
+	for _, w := range kv.scheduled {
+		if w.key != key {
+			pending = append(pending, w)
+		}
+	}
+	cancelled := len(kv.scheduled) - len(pending)
+	kv.scheduled = pending
+	return cancelled
+}
+
+// nextScheduled returns when the earliest staged write or scheduled deletion is due. The caller
+// must hold the lock.
+func (kv *Store) nextScheduled() (time.Time, bool) {
+	var next time.Time
+	if len(kv.scheduled) > 0 {
+		next = kv.scheduled[0].at
+	}
+	for _, at := range kv.deletions {
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// applyScheduled makes the staged writes and scheduled deletions that are due.
+func (kv *Store) applyScheduled() {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	now := kv.nowFunc()
+	kv.applyDeletions(now)
+	due := 0
+	for due < len(kv.scheduled) && !now.Before(kv.scheduled[due].at) {
+		w := kv.scheduled[due]
+		if err := kv.setData(w.key, w.value, w.options...); err != nil {
+			log.Error().Msgf("[kvstore schedule] error writing key %s error: %s", w.key, err.Error())
+		}
+		due++
+	}
+	kv.scheduled = kv.scheduled[due:]
+}
+
+// DeleteAfter schedules a key to be deleted once d has passed, so cleanup can be queued when a value
+// is written without the caller running a timer. The key stops being readable at that time and is
+// deleted by the store's scheduler. The deletion is recorded in the key's persisted metadata, so it
+// still happens if the store is reopened; overwriting the key does not cancel it. Calling
+// DeleteAfter again moves the deletion, and a duration of zero or less deletes the key now.
+//
+// Example:
+//
+//	err := kv.DeleteAfter("upload:tmp", 10*time.Minute)
+func (kv *Store) DeleteAfter(key string, d time.Duration) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	if err := kv.checkWritable(); err != nil {
+		kv.lock.Unlock()
+		return err
+	}
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		kv.lock.Unlock()
+		return ErrNotFound
+	}
+	if d <= 0 {
+		defer kv.lock.Unlock()
+		return kv.delete(key, RemovalDeleted)
+	}
+	mv.DeleteAt = kv.nowFunc().Add(d)
+	kv.trackDeletion(key, mv)
+	err := kv.persistData(key)
+	kv.lock.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Store.DeleteAfter kv.persist")
+	}
+	return nil
+}
+
+// CancelDelete cancels the deletion scheduled for a key by DeleteAfter.
+func (kv *Store) CancelDelete(key string) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return ErrNotFound
+	}
+	if mv.DeleteAt.IsZero() {
+		return nil
+	}
+	mv.DeleteAt = time.Time{}
+	kv.trackDeletion(key, mv)
+	if err := kv.persistData(key); err != nil {
+		return errors.Wrap(err, "Store.CancelDelete kv.persist")
+	}
+	return nil
+}
+
+// trackDeletion records whether a key has a deletion scheduled, so the scheduler can find the next
+// one without scanning every key, waking the scheduler if the deletion is new or has moved. The
+// caller must hold the write lock.
+func (kv *Store) trackDeletion(key string, mv *ValueItem) {
+	if mv.DeleteAt.IsZero() {
+		delete(kv.deletions, key)
+		return
+	}
+	if at, ok := kv.deletions[key]; !ok || !at.Equal(mv.DeleteAt) {
+		kv.deletions[key] = mv.DeleteAt
+		kv.signalReschedule()
+	}
+}
+
+// applyDeletions deletes the keys whose scheduled deletion is due. The caller must hold the write lock.
+func (kv *Store) applyDeletions(now time.Time) {
+	for k, at := range kv.deletions {
+		if now.Before(at) {
+			continue
+		}
+		if kv.followFreq > 0 {
+			kv.forget(k)
+			continue
+		}
+		if err := kv.delete(k, RemovalExpired); err != nil {
+			log.Error().Msgf("[kvstore schedule] error deleting key %s error: %s", k, err.Error())
+		}
+	}
+}
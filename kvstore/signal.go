@@ -0,0 +1,57 @@
+package kvstore
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// closer is implemented by DataPersisters that hold resources, such as the persistence buffer.
+type closer interface {
+	Close()
+}
+
+// Shutdown closes the store, then flushes and closes each of its persisters in order,
+// so that queued writes reach the backends before their resources are released.
+func (kv *Store) Shutdown() error {
+	kv.Close()
+
+	var returnError error
+	for _, p := range append(append([]DataPersister(nil), kv.persistence...), kv.shutdownTargets...) {
+		if f, ok := p.(Flusher); ok {
+			if err := f.Flush(); err != nil && returnError == nil {
+				returnError = errors.Wrap(err, "Store.Shutdown Flush")
+			}
+		}
+		if c, ok := p.(closer); ok {
+			c.Close()
+		}
+	}
+	return returnError
+}
+
+// RunUntilSignal blocks until one of the given signals is received, then shuts the store down
+// and returns the signal. SIGINT and SIGTERM are used if no signals are given.
+//
+// Example:
+//
+//	go server.ListenAndServe()
+//	kvstore.RunUntilSignal(store)
+func RunUntilSignal(store *Store, signals ...os.Signal) os.Signal {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	sig := <-ch
+	if err := store.Shutdown(); err != nil {
+		log.Error().Msgf("[kvstore shutdown] error: %s", err.Error())
+	}
+	return sig
+}
@@ -0,0 +1,189 @@
+package kvstore
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrSnapshotClosed returned when reading from a SnapshotView after it has been closed.
+	ErrSnapshotClosed error = errors.New("snapshot closed")
+
+	// ErrSnapshotUnavailable returned when a SnapshotView cannot read a value as it was when the
+	// snapshot was taken, such as when another instance changed the shared persister.
+	ErrSnapshotUnavailable error = errors.New("snapshot value unavailable")
+)
+
+// SnapshotView is an immutable view of the keys, values and metadata of a Store as of the time it
+// was taken, for exports and audits that need a coherent state while writes continue.
+//
+// Taking a snapshot copies the metadata of every key but not the values. Values in memory are
+// shared with the store, which replaces rather than modifies them, and values that have been
+// unloaded are read from the first persister when requested. While a snapshot is open the store
+// copies a key's unloaded value into it before the key is first overwritten or deleted, and keeps
+// arena regions from being reused, so a snapshot should be closed once it has been read.
+type SnapshotView struct {
+	store  *Store
+	at     time.Time
+	lock   sync.Mutex
+	items  map[string]*ValueItem
+	closed bool
+}
+
+// SnapshotView returns a view of the store as of now. The view must be closed when it is no longer needed.
+func (kv *Store) SnapshotView() *SnapshotView {
+	kv.resolveAll()
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	s := &SnapshotView{store: kv, at: kv.nowFunc(), items: make(map[string]*ValueItem, len(kv.data))}
+	for k, mv := range kv.data {
+		if !kv.expired(k, mv, s.at) {
+			s.items[k] = mv.Clone()
+		}
+	}
+	if kv.snapshots == nil {
+		kv.snapshots = make(map[*SnapshotView]struct{})
+	}
+	kv.snapshots[s] = struct{}{}
+	return s
+}
+
+// At returns the time the snapshot was taken.
+func (s *SnapshotView) At() time.Time {
+	return s.at
+}
+
+// Keys returns the keys of the snapshot in order.
+func (s *SnapshotView) Keys() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := make([]string, 0, len(s.items))
+	for k, mv := range s.items {
+		keys = append(keys, mv.displayKey(k))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Metadata returns the metadata of a key as it was when the snapshot was taken.
+func (s *SnapshotView) Metadata(key string) (ItemInfo, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ItemInfo{}, ErrSnapshotClosed
+	}
+	mv, ok := s.items[s.store.canonicalKey(key)]
+	if !ok {
+		return ItemInfo{}, ErrNotFound
+	}
+	return mv.info(), nil
+}
+
+// Get returns the value of a key as it was when the snapshot was taken.
+func (s *SnapshotView) Get(key string) ([]byte, error) {
+	key = s.store.canonicalKey(key)
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, ErrSnapshotClosed
+	}
+	mv, ok := s.items[key]
+	if !ok {
+		s.lock.Unlock()
+		return nil, ErrNotFound
+	}
+	if mv.dataLoaded || len(s.store.persistence) == 0 {
+		defer s.lock.Unlock()
+		return s.store.valueOf(mv), nil
+	}
+	version := mv.Version
+	s.lock.Unlock()
+
+	loaded, err := s.store.persistence[0].Read(key, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "SnapshotView.Get key %s", key)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if mv.dataLoaded {
+		// The store preserved the value while it was being read.
+		return s.store.valueOf(mv), nil
+	}
+	if loaded.Version != version {
+		return nil, errors.Wrapf(ErrSnapshotUnavailable, "SnapshotView.Get key %s", key)
+	}
+	mv.Data = loaded.Data
+	mv.inArena = false
+	mv.dataLoaded = true
+	return mv.Data, nil
+}
+
+// Close releases the snapshot, letting the store reuse the arena regions it was keeping for it.
+func (s *SnapshotView) Close() {
+	kv := s.store
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	s.lock.Lock()
+	s.closed = true
+	s.items = nil
+	s.lock.Unlock()
+
+	delete(kv.snapshots, s)
+	if len(kv.snapshots) == 0 {
+		for _, region := range kv.heldRegions {
+			kv.arena.release(region)
+		}
+		kv.heldRegions = nil
+	}
+}
+
+// preserveForSnapshots copies the current value of a key into the open snapshots that hold its
+// metadata but have not read its value, before the key is overwritten or deleted. The caller must
+// hold the write lock.
+func (kv *Store) preserveForSnapshots(key string) {
+	mv, ok := kv.data[key]
+	if len(kv.snapshots) == 0 || !ok {
+		return
+	}
+
+	data, inArena := mv.Data, mv.inArena
+	found, read := mv.dataLoaded, mv.dataLoaded || len(kv.persistence) == 0
+	for s := range kv.snapshots {
+		s.lock.Lock()
+		if item, ok := s.items[key]; ok && !item.dataLoaded && item.Version == mv.Version {
+			if !read {
+				read = true
+				loaded, err := kv.persistence[0].Read(key, true)
+				if err != nil {
+					log.Error().Msgf("[kvstore snapshot] error preserving key %s error: %s", key, err.Error())
+				} else if loaded.Version == mv.Version {
+					// A different version means the persister has already moved on.
+					data, inArena, found = loaded.Data, false, true
+				}
+			}
+			if found {
+				item.Data = data
+				item.inArena = inArena
+				item.dataLoaded = true
+			}
+		}
+		s.lock.Unlock()
+	}
+}
+
+// releaseRegion returns an arena region for reuse, or holds it until the open snapshots are closed.
+// The caller must hold the write lock.
+func (kv *Store) releaseRegion(region []byte) {
+	if len(kv.snapshots) > 0 {
+		kv.heldRegions = append(kv.heldRegions, region)
+		return
+	}
+	kv.arena.release(region)
+}
@@ -0,0 +1,38 @@
+package kvstore
+
+import "github.com/rs/zerolog/log"
+
+// startupBatchSize is the number of keys whose metadata is read between progress reports on startup.
+const startupBatchSize = 1000
+
+// Ready returns a channel that is closed once the persisted keys have been loaded. It is already
+// closed when New returns, unless WithBackgroundStartupOption was used.
+func (kv *Store) Ready() <-chan struct{} {
+	return kv.ready
+}
+
+// startInBackground loads the persisted keys and then signals that the store is ready.
+func (kv *Store) startInBackground() {
+	defer close(kv.ready)
+	if err := kv.initPersistence(); err != nil {
+		log.Error().Msgf("[kvstore init] background startup error: %s", err.Error())
+	}
+	kv.lock.Lock()
+	kv.touched = nil
+	kv.lock.Unlock()
+}
+
+// touch records that a key was written or deleted while the store is loading in the background.
+// The caller must hold the write lock.
+func (kv *Store) touch(key string) {
+	if kv.touched != nil {
+		kv.touched[key] = struct{}{}
+	}
+}
+
+// reportProgress calls the startup progress callback, if one was set.
+func (kv *Store) reportProgress(loaded, total int) {
+	if kv.startupProgress != nil {
+		kv.startupProgress(loaded, total)
+	}
+}
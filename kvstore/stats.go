@@ -0,0 +1,266 @@
+package kvstore
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultUsageCacheTTL is how long Stats reuses the usage reported by the persisters before asking
+// them again, as reporting usage may scan the whole backend.
+const DefaultUsageCacheTTL = time.Minute
+
+// Stats is a snapshot of the store's state and the activity of its persisters.
+type Stats struct {
+	Keys        int
+	LoadedKeys  int
+	LoadedBytes int64
+	TotalBytes  int64
+	ArenaBytes  int64 // Bytes allocated for the arena set with WithArenaOption.
+	Hits        uint64
+	Misses      uint64
+	Persisters  []PersisterStats
+}
+
+// PersisterStats describes the operations the store has made against one DataPersister.
+// QueueDepth is only reported for persisters that queue work, such as the persistence buffer.
+type PersisterStats struct {
+	Writes         uint64
+	Reads          uint64
+	Deletes        uint64
+	Errors         uint64
+	AverageLatency time.Duration
+	QueueDepth     int
+	Usage          *Usage // Space held by the backend, if the persister implements UsageReporter.
+	UsageError     string // Why the persister's usage could not be read, if it reports usage but failed to.
+}
+
+// usageCache holds the usage last reported by each persister, so frequent Stats calls from metrics
+// exporters don't scan the backends each time.
+type usageCache struct {
+	lock   sync.Mutex
+	ttl    time.Duration
+	at     time.Time
+	usage  []*Usage
+	errors []string
+}
+
+// Stats returns a snapshot of the store's statistics.
+// Persisters are reported in the order they were configured. Persisters that report usage may
+// scan their backend to do so, which is done without holding the store lock, and the usage is
+// reused for DefaultUsageCacheTTL, or the time set with WithUsageCacheOption.
+func (kv *Store) Stats() Stats {
+	stats := kv.memoryStats()
+	usage, errs := kv.persisterUsage()
+	for i := range stats.Persisters {
+		if i < len(usage) {
+			stats.Persisters[i].Usage = usage[i]
+			stats.Persisters[i].UsageError = errs[i]
+		}
+	}
+	return stats
+}
+
+// persisterUsage returns the usage of each persister, or why it could not be read, asking the
+// persisters again once the cached usage is older than its TTL.
+func (kv *Store) persisterUsage() ([]*Usage, []string) {
+	kv.usage.lock.Lock()
+	defer kv.usage.lock.Unlock()
+	now := kv.nowFunc()
+	if kv.usage.usage != nil && now.Sub(kv.usage.at) < kv.usage.ttl {
+		return kv.usage.usage, kv.usage.errors
+	}
+
+	usage := make([]*Usage, len(kv.persistence))
+	errs := make([]string, len(kv.persistence))
+	for i, p := range kv.persistence {
+		u, err := UsageOf(p)
+		if err == nil {
+			usage[i] = &u
+		} else if !errors.Is(err, ErrUsageNotSupported) {
+			errs[i] = err.Error()
+		}
+	}
+	kv.usage.usage, kv.usage.errors, kv.usage.at = usage, errs, now
+	return usage, errs
+}
+
+// memoryStats returns the statistics of the in-memory data and persister activity.
+func (kv *Store) memoryStats() Stats {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+
+	stats := Stats{
+		Keys:       len(kv.data),
+		Hits:       atomic.LoadUint64(&kv.hits),
+		Misses:     atomic.LoadUint64(&kv.missCount),
+		Persisters: make([]PersisterStats, 0, len(kv.persistence)),
+	}
+	for _, v := range kv.data {
+		stats.TotalBytes += v.Size
+		if v.dataLoaded {
+			stats.LoadedKeys++
+			stats.LoadedBytes += int64(len(v.Data))
+		}
+	}
+	if kv.arena != nil {
+		stats.ArenaBytes = kv.arena.size()
+	}
+	for _, p := range kv.persistence {
+		if ip, ok := p.(*instrumentedPersister); ok {
+			stats.Persisters = append(stats.Persisters, ip.stats())
+		}
+	}
+	return stats
+}
+
+// queueLengther is implemented by DataPersisters that queue operations.
+type queueLengther interface {
+	Len() int
+}
+
+// instrumentedPersister wraps a DataPersister, counting operations, errors and latency.
+// Optional interfaces of the wrapped persister are forwarded.
+type instrumentedPersister struct {
+	DataPersister
+	writes       uint64
+	reads        uint64
+	deletes      uint64
+	errors       uint64
+	operations   uint64
+	totalLatency int64
+}
+
+func newInstrumentedPersister(p DataPersister) *instrumentedPersister {
+	return &instrumentedPersister{DataPersister: p}
+}
+
+// Write persists the ValueItem and records the operation.
+func (ip *instrumentedPersister) Write(key string, data *ValueItem) error {
+	defer ip.record(&ip.writes, time.Now())
+	return ip.countError(ip.DataPersister.Write(key, data))
+}
+
+// WriteMulti persists a batch of ValueItems, as a single batch if the wrapped persister supports it.
+func (ip *instrumentedPersister) WriteMulti(items map[string]*ValueItem) error {
+	defer ip.record(&ip.writes, time.Now())
+	if bw, ok := ip.DataPersister.(BatchWriter); ok {
+		return ip.countError(bw.WriteMulti(items))
+	}
+	for k, mv := range items {
+		if err := ip.DataPersister.Write(k, mv); err != nil {
+			return ip.countError(err)
+		}
+	}
+	return nil
+}
+
+// Read retrieves the ValueItem and records the operation.
+func (ip *instrumentedPersister) Read(key string, readValue bool) (*ValueItem, error) {
+	defer ip.record(&ip.reads, time.Now())
+	mv, err := ip.DataPersister.Read(key, readValue)
+	return mv, ip.countError(err)
+}
+
+// ReadMulti reads the keys as a batch if the wrapped persister supports it, otherwise one at a time.
+func (ip *instrumentedPersister) ReadMulti(keys []string, readValue bool) (map[string]*ValueItem, error) {
+	defer ip.record(&ip.reads, time.Now())
+	items, err := readMulti(ip.DataPersister, keys, readValue)
+	return items, ip.countError(err)
+}
+
+// Delete removes the key and records the operation.
+func (ip *instrumentedPersister) Delete(key string) error {
+	defer ip.record(&ip.deletes, time.Now())
+	return ip.countError(ip.DataPersister.Delete(key))
+}
+
+// DeleteMulti removes a batch of keys, as a single batch if the wrapped persister supports it.
+func (ip *instrumentedPersister) DeleteMulti(keys []string) error {
+	defer ip.record(&ip.deletes, time.Now())
+	if bd, ok := ip.DataPersister.(BatchDeleter); ok {
+		return ip.countError(bd.DeleteMulti(keys))
+	}
+	for _, k := range keys {
+		if err := ip.DataPersister.Delete(k); err != nil {
+			return ip.countError(err)
+		}
+	}
+	return nil
+}
+
+// Flush forwards to the wrapped persister if it queues writes.
+func (ip *instrumentedPersister) Flush() error {
+	if f, ok := ip.DataPersister.(Flusher); ok {
+		return ip.countError(f.Flush())
+	}
+	return nil
+}
+
+// Patch forwards to the wrapped persister if it can patch values, otherwise writes the whole value.
+func (ip *instrumentedPersister) Patch(key string, offset int64, data []byte, item *ValueItem) error {
+	defer ip.record(&ip.writes, time.Now())
+	if p, ok := ip.DataPersister.(Patcher); ok {
+		return ip.countError(p.Patch(key, offset, data, item))
+	}
+	return ip.countError(ip.DataPersister.Write(key, item))
+}
+
+// Usage forwards to the wrapped persister if it reports usage.
+func (ip *instrumentedPersister) Usage() (Usage, error) {
+	return UsageOf(ip.DataPersister)
+}
+
+// Compact forwards to the wrapped persister if it can reclaim space.
+func (ip *instrumentedPersister) Compact() error {
+	if c, ok := ip.DataPersister.(Compactor); ok {
+		return ip.countError(c.Compact())
+	}
+	return nil
+}
+
+// Migrate forwards to the wrapped persister if its layout is versioned.
+func (ip *instrumentedPersister) Migrate() error {
+	if m, ok := ip.DataPersister.(Migrator); ok {
+		return ip.countError(m.Migrate())
+	}
+	return nil
+}
+
+// Close forwards to the wrapped persister if it holds resources.
+func (ip *instrumentedPersister) Close() {
+	if c, ok := ip.DataPersister.(closer); ok {
+		c.Close()
+	}
+}
+
+func (ip *instrumentedPersister) record(counter *uint64, start time.Time) {
+	atomic.AddUint64(counter, 1)
+	atomic.AddUint64(&ip.operations, 1)
+	atomic.AddInt64(&ip.totalLatency, int64(time.Since(start)))
+}
+
+func (ip *instrumentedPersister) countError(err error) error {
+	if err != nil {
+		atomic.AddUint64(&ip.errors, 1)
+	}
+	return err
+}
+
+func (ip *instrumentedPersister) stats() PersisterStats {
+	ps := PersisterStats{
+		Writes:  atomic.LoadUint64(&ip.writes),
+		Reads:   atomic.LoadUint64(&ip.reads),
+		Deletes: atomic.LoadUint64(&ip.deletes),
+		Errors:  atomic.LoadUint64(&ip.errors),
+	}
+	if ops := atomic.LoadUint64(&ip.operations); ops > 0 {
+		ps.AverageLatency = time.Duration(atomic.LoadInt64(&ip.totalLatency) / int64(ops))
+	}
+	if ql, ok := ip.DataPersister.(queueLengther); ok {
+		ps.QueueDepth = ql.Len()
+	}
+	return ps
+}
@@ -6,6 +6,7 @@ import (
 	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -22,6 +23,16 @@ const (
 	TTLNoExpirySet TTLType = -1 // Indicates that a key does not have an expiry time.
 )
 
+// TouchMode selects what Touch updates for a key.
+type TouchMode int
+
+// Touch modes that can be selected with WithTouchModeOption.
+const (
+	TouchAll    TouchMode = iota // Restart the TTL and keep the value in memory.
+	TouchExpiry                  // Only restart the TTL.
+	TouchAccess                  // Only keep the value in memory, delaying its unload.
+)
+
 // Error definitions for common error cases.
 var (
 	// ErrNotFound returned when a key is not found during read or delete operations.
@@ -29,19 +40,78 @@ var (
 
 	// ErrKeyInvalid returned when a key contains invalid characters.
 	ErrKeyInvalid error = errors.New("key contains invalid characters")
+
+	// ErrWrongType returned when an operation is applied to a key holding a different type of value.
+	ErrWrongType error = errors.New("operation against a key holding the wrong type of value")
+
+	// ErrETagMismatch returned when a conditional write's ETag does not match the current value.
+	ErrETagMismatch error = errors.New("etag does not match")
 )
 
 // Store represents the key-value storage system.
 // It is thread-safe and allows for optional data persistence.
 type Store struct {
-	lock            sync.RWMutex
-	nowFunc         func() time.Time
-	data            map[string]*ValueItem
-	persistence     []DataPersister
-	evictionFreq    time.Duration
-	unloadAfterTime time.Duration
-	ctx             context.Context
-	cancelFunc      context.CancelFunc
+	lock              sync.RWMutex
+	nowFunc           func() time.Time
+	data              map[string]*ValueItem
+	persistence       []DataPersister
+	evictionFreq      time.Duration // Guarded by lock, as it can be changed while the store runs.
+	unloadAfterTime   time.Duration // Guarded by lock, as it can be changed while the store runs.
+	memoryLimit       int64
+	defaultTTL        time.Duration
+	configPath        string
+	reconcileFreq     time.Duration
+	followFreq        time.Duration
+	refreshedAt       time.Time // When the last Refresh began, by the wall clock. Guarded by lock.
+	normalizeKeys     bool
+	foldKeys          bool
+	lowerKeys         bool
+	maxKeyLength      int
+	counterFlushFreq  time.Duration
+	counterFlushDelta int64
+	ephemeralPrefixes []string
+	purgeExpired      bool
+	lazyMetadata      bool
+	earlyExpiryBeta   float64
+	ttlJitter         float64
+	arena             *arena
+	readView          *readView
+	snapshots         map[*SnapshotView]struct{}
+	heldRegions       [][]byte // Arena regions kept for open snapshots.
+	namespaces        []*namespaceConfig
+	nsExpiries        namespaceExpiries
+	scheduled         []scheduledWrite     // Ordered by when they are due.
+	deletions         map[string]time.Time // Keys with a deletion scheduled by DeleteAfter.
+	backgroundStartup bool
+	loadParallelism   int
+	startupProgress   func(loaded, total int)
+	ready             chan struct{}
+	touched           map[string]struct{} // Keys written or deleted during a background startup, which loading leaves alone.
+	expvarName        string
+	readOnly          bool
+	refreshTTLOnSet   bool
+	touchMode         TouchMode
+	broadcaster       Broadcaster
+	filler            PeerFiller
+	shutdownFlush     bool
+	shutdownTargets   []DataPersister
+	version           uint64
+	hits              uint64
+	hitSampling       int
+	missCount         uint64
+	keyLocks          keyLocks
+	misses            *negativeCache
+	acl               *ACL
+	loads             flightGroup
+	dependents        map[string]map[string]struct{}
+	removalHandler    func(RemovalEvent)
+	removalValues     bool
+	removals          removalQueue
+	usage             usageCache
+	reconfigure       chan struct{}
+	rescheduled       chan struct{}
+	ctx               context.Context
+	cancelFunc        context.CancelFunc
 }
 
 // New initializes a new Store with optional configurations.
@@ -49,70 +119,427 @@ type Store struct {
 func New(options ...StoreOption) (*Store, error) {
 	store := &Store{
 		data:            make(map[string]*ValueItem),
+		dependents:      make(map[string]map[string]struct{}),
+		deletions:       make(map[string]time.Time),
 		persistence:     make([]DataPersister, 0),
 		evictionFreq:    0,
 		unloadAfterTime: 0,
 		nowFunc:         time.Now,
+		reconfigure:     make(chan struct{}, 1),
+		rescheduled:     make(chan struct{}, 1),
+		ready:           make(chan struct{}),
+		refreshTTLOnSet: true,
+		removals:        removalQueue{wake: make(chan struct{}, 1)},
+		usage:           usageCache{ttl: DefaultUsageCacheTTL},
 	}
 
 	for _, opt := range options {
 		opt(store)
 	}
+	if err := store.prepareNamespaces(); err != nil {
+		return nil, err
+	}
+	for i, p := range store.persistence {
+		store.persistence[i] = newInstrumentedPersister(p)
+	}
 
 	store.ctx, store.cancelFunc = context.WithCancel(context.Background())
 
-	if err := store.initPersistence(); err != nil {
+	if err := store.loadConfigFile(); err != nil {
+		store.cancelFunc()
 		return nil, err
 	}
+	if store.followFreq > 0 {
+		// Keys loaded below are current as of now, so the first Refresh only reads later changes.
+		store.refreshedAt = time.Now()
+	}
+	if store.backgroundStartup {
+		store.touched = make(map[string]struct{})
+		go store.startInBackground()
+	} else {
+		if err := store.initPersistence(); err != nil {
+			return nil, err
+		}
+		close(store.ready)
+	}
+	if store.broadcaster != nil {
+		store.broadcaster.Subscribe(store.Invalidate)
+	}
+	if store.expvarName != "" {
+		if err := store.publishExpvar(store.expvarName); err != nil {
+			store.cancelFunc()
+			return nil, errors.Wrap(err, "New")
+		}
+	}
 	go store.evictionController()
+	go store.reconcileController()
+	go store.followController()
+	go store.counterFlushController()
+	go store.removalController()
 	return store, nil
 }
 
 // Close stops the internal cache management routines.
+// If WithShutdownFlushOption was used, unpersisted values are flushed first.
 func (kv *Store) Close() {
 	kv.cancelFunc()
+	if kv.expvarName != "" {
+		kv.unpublishExpvar()
+	}
+	// A background startup stops loading at the next batch.
+	<-kv.ready
+	if kv.shutdownFlush {
+		kv.lock.Lock()
+		kv.flushOnShutdown()
+		kv.lock.Unlock()
+	} else if kv.deferCounters() {
+		if err := kv.CheckpointCounters(); err != nil {
+			log.Error().Msgf("[kvstore shutdown] error checkpointing counters error: %s", err.Error())
+		}
+	}
+}
+
+// SetEvictionFrequency changes how often the running eviction controller checks for expired
+// and unloadable items. A frequency of zero or less pauses the checks.
+func (kv *Store) SetEvictionFrequency(d time.Duration) {
+	kv.lock.Lock()
+	kv.evictionFreq = d
+	kv.lock.Unlock()
+	kv.signalReconfigure()
+}
+
+// SetUnloadAfter changes how long values stay in memory after their last write or Touch before being
+// unloaded. A duration of zero disables unloading.
+func (kv *Store) SetUnloadAfter(d time.Duration) {
+	kv.lock.Lock()
+	kv.unloadAfterTime = d
+	kv.lock.Unlock()
+	kv.signalReconfigure()
+}
+
+// signalReconfigure wakes the eviction controller so it picks up new settings.
+func (kv *Store) signalReconfigure() {
+	select {
+	case kv.reconfigure <- struct{}{}:
+	default:
+	}
+}
+
+// signalReschedule wakes the eviction controller so it finds the next staged write or scheduled
+// deletion, without delaying the next eviction check.
+func (kv *Store) signalReschedule() {
+	select {
+	case kv.rescheduled <- struct{}{}:
+	default:
+	}
 }
 
 // Set stores a key-value pair into the Store.
-func (kv *Store) Set(key string, value []byte) error {
-	if !KeyValid(key) {
-		return ErrKeyInvalid
+// Optional SetOptions can be supplied to attach metadata to the value.
+func (kv *Store) Set(key string, value []byte, options ...SetOption) error {
+	key, options = kv.canonicalSetKey(key, options)
+	if err := kv.useKey(key); err != nil {
+		return err
 	}
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
-	return kv.setData(key, value)
+	return kv.setData(key, value, options...)
+}
+
+// SetIfMatch stores a key-value pair only if the key's current ETag matches etag.
+// An etag of "*" matches any existing value. ErrETagMismatch is returned when the
+// key does not exist or has been modified since the ETag was read.
+func (kv *Store) SetIfMatch(key string, value []byte, etag string, options ...SetOption) error {
+	key, options = kv.canonicalSetKey(key, options)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return ErrETagMismatch
+	}
+	if etag != "*" && etag != mv.etag() {
+		return ErrETagMismatch
+	}
+	return kv.setData(key, value, options...)
+}
+
+// SetNX stores a value only if the key does not exist or has expired, reporting whether it was stored.
+// Combined with WithTTLSetOption it can be used as a lock that is released if its holder stops renewing it.
+func (kv *Store) SetNX(key string, value []byte, options ...SetOption) (bool, error) {
+	key, options = kv.canonicalSetKey(key, options)
+	if err := kv.useKey(key); err != nil {
+		return false, err
+	}
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	if mv, ok := kv.data[key]; ok {
+		if !kv.expired(key, mv, kv.nowFunc()) {
+			return false, nil
+		}
+		if err := kv.delete(key, RemovalExpired); err != nil {
+			return false, errors.Wrap(err, "Store.SetNX kv.delete expired")
+		}
+	}
+	if err := kv.setData(key, value, options...); err != nil {
+		return false, errors.Wrap(err, "Store.SetNX kv.setData")
+	}
+	return true, nil
 }
 
 // Get retrieves the value associated with a key from the Store.
+// With WithEarlyExpirationOption, a key close to expiring may be reported as not found early.
 func (kv *Store) Get(key string) ([]byte, error) {
-	if !KeyValid(key) {
-		return nil, ErrKeyInvalid
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return nil, err
 	}
 
+	data, loaded, ok := kv.getLoaded(key, kv.nowFunc())
+	if !ok {
+		atomic.AddUint64(&kv.missCount, 1)
+		return nil, ErrNotFound
+	}
+	if loaded {
+		return data, nil
+	}
+	return kv.readFromFirstStore(key)
+}
+
+// getLoaded finds a live key for Get, recording the hit, and returns its value if it is loaded in
+// memory. The item is read under the read lock, unless the store has a read view, which finds keys
+// without it.
+func (kv *Store) getLoaded(key string, now time.Time) (data []byte, loaded bool, ok bool) {
+	var mv *ValueItem
+	if kv.readView != nil {
+		mv, ok = kv.readView.load(key)
+	} else {
+		kv.lock.RLock()
+		defer kv.lock.RUnlock()
+		mv, ok = kv.data[key]
+	}
+	if !ok || kv.expired(key, mv, now) || kv.earlyExpired(mv, now) {
+		return nil, false, false
+	}
+
+	kv.recordHit(mv)
+	mv.touchAccess(now.UnixNano())
+	switch {
+	case !mv.dataLoaded:
+		return nil, false, true
+	case kv.readView == nil:
+		return kv.valueOf(mv), true, true
+	case kv.arena == nil:
+		return mv.Data, true, true
+	default:
+		data, loaded = kv.loadedValue(key)
+		return data, loaded, true
+	}
+}
+
+// GetMulti retrieves the values of several keys. Keys that do not exist are omitted from the result.
+// Values that have been unloaded are read from the first persister in a single batch where supported.
+// Keys no longer persisted are omitted, and remembered with WithNegativeCacheOption; any other error
+// reading a value is returned.
+// The result is keyed by the keys as given, even if WithKeyNormalizationOption changed them.
+func (kv *Store) GetMulti(keys []string) (map[string][]byte, error) {
+	values, err := kv.getMulti(kv.canonicalKeys(keys))
+	if err != nil || !kv.canonicalizing() {
+		return values, err
+	}
+	requested := make(map[string][]byte, len(values))
+	for _, k := range keys {
+		if v, ok := values[kv.canonicalKey(k)]; ok {
+			requested[k] = v
+		}
+	}
+	return requested, nil
+}
+
+// getMulti retrieves the values of several canonical keys.
+func (kv *Store) getMulti(keys []string) (map[string][]byte, error) {
+	kv.resolveKeys(keys...)
+	values := make(map[string][]byte, len(keys))
+	unloaded := make([]string, 0)
+	now := kv.nowFunc()
+
 	kv.lock.RLock()
-	mv, ok := kv.data[key]
+	for _, k := range keys {
+		mv, ok := kv.data[k]
+		if !ok || kv.expired(k, mv, now) || kv.earlyExpired(mv, now) {
+			atomic.AddUint64(&kv.missCount, 1)
+			continue
+		}
+		kv.recordHit(mv)
+		mv.touchAccess(now.UnixNano())
+		switch {
+		case mv.dataLoaded || len(kv.persistence) == 0:
+			values[k] = kv.valueOf(mv)
+		case kv.misses.lookup(k, now) == nil:
+			unloaded = append(unloaded, k)
+		}
+	}
 	kv.lock.RUnlock()
 
-	if !ok || mv.expired(kv.nowFunc()) {
-		return nil, ErrNotFound
+	if len(unloaded) == 0 {
+		return values, nil
+	}
+	items, err := kv.readPersisted(unloaded, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Store.GetMulti ReadMulti")
+	}
+	// Batch reads omit keys they cannot read, so each is read again to learn why.
+	for _, k := range unloaded {
+		if _, ok := items[k]; ok {
+			continue
+		}
+		mv, err := kv.persistence[0].Read(k, true)
+		if notPersisted(err) {
+			kv.misses.add(k, err, now)
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "Store.GetMulti key %s", k)
+		}
+		items[k] = mv
 	}
 
-	if mv.dataLoaded {
-		return mv.Data, nil
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for k, mv := range items {
+		current, ok := kv.data[k]
+		if !ok {
+			continue
+		}
+		if current.dataLoaded {
+			values[k] = kv.valueOf(current)
+			continue
+		}
+		mv.touchAccess(now.UnixNano())
+		kv.replaceItem(k, mv)
+		values[k] = kv.valueOf(mv)
+	}
+	return values, nil
+}
+
+// GetOrSet returns the value for a key, calling loader to produce and store it if the key
+// does not exist. Concurrent callers missing on the same key share a single loader call.
+// A ttl greater than zero is applied to the loaded value, rounded up to whole seconds.
+// The time loader takes is recorded as the value's recompute cost for WithEarlyExpirationOption.
+// With WithNegativeCacheOption, a loader error wrapping ErrNotFound is cached, so keys the backend
+// does not hold either are not loaded again until the cached miss expires.
+func (kv *Store) GetOrSet(key string, ttl time.Duration, loader func() ([]byte, error)) ([]byte, error) {
+	key = kv.canonicalKey(key)
+	value, err := kv.Get(key)
+	if !errors.Is(err, ErrNotFound) {
+		return value, err
 	}
 
-	return kv.readFromFirstStore(key)
+	return kv.loads.do(key, func() ([]byte, error) {
+		if value, err := kv.Get(key); !errors.Is(err, ErrNotFound) {
+			return value, err
+		}
+
+		if err := kv.misses.lookup(key, kv.nowFunc()); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		value, err := loader()
+		if err != nil {
+			err = errors.Wrap(err, "Store.GetOrSet loader")
+			if errors.Is(err, ErrNotFound) {
+				kv.misses.add(key, err, kv.nowFunc())
+			}
+			return nil, err
+		}
+		cost := time.Since(start)
+
+		kv.lock.Lock()
+		defer kv.lock.Unlock()
+		if err := kv.setData(key, value, WithRecomputeCostSetOption(cost)); err != nil {
+			return nil, errors.Wrap(err, "Store.GetOrSet kv.setData")
+		}
+		if ttl > 0 {
+			if err := kv.setTTL(key, TTLType(math.Ceil(ttl.Seconds()))); err != nil {
+				return nil, errors.Wrap(err, "Store.GetOrSet kv.setTTL")
+			}
+		}
+		return value, nil
+	})
+}
+
+// GetMetadata retrieves the metadata associated with a key without loading its value.
+func (kv *Store) GetMetadata(key string) (ItemInfo, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return ItemInfo{}, err
+	}
+
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return ItemInfo{}, ErrNotFound
+	}
+	return mv.info(), nil
+}
+
+// GetWithMetadata retrieves a key's value together with its metadata, read at the same time so the
+// metadata, such as the ETag, always describes the value returned even when the key is written
+// concurrently.
+func (kv *Store) GetWithMetadata(key string) ([]byte, ItemInfo, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return nil, ItemInfo{}, err
+	}
+
+	for {
+		data, info, loaded, err := kv.loadedWithMetadata(key, kv.nowFunc())
+		if err != nil || loaded {
+			return data, info, err
+		}
+		// Loading the value keeps it in memory, so the next attempt reads it with its metadata.
+		if _, err := kv.readFromFirstStore(key); err != nil {
+			return nil, ItemInfo{}, err
+		}
+	}
+}
+
+// loadedWithMetadata returns a live key's value and metadata under the read lock, recording the hit,
+// if its value is loaded in memory.
+func (kv *Store) loadedWithMetadata(key string, now time.Time) ([]byte, ItemInfo, bool, error) {
+	kv.lock.RLock()
+	defer kv.lock.RUnlock()
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, now) || kv.earlyExpired(mv, now) {
+		atomic.AddUint64(&kv.missCount, 1)
+		return nil, ItemInfo{}, false, ErrNotFound
+	}
+	if !mv.dataLoaded {
+		return nil, ItemInfo{}, false, nil
+	}
+	kv.recordHit(mv)
+	mv.touchAccess(now.UnixNano())
+	return kv.valueOf(mv), mv.info(), true, nil
 }
 
 // Delete removes a key and its value from the Store.
 func (kv *Store) Delete(key string) error {
+	key = kv.canonicalKey(key)
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
-	return kv.delete(key)
+	return kv.delete(key, RemovalDeleted)
 }
 
 // InMemory checks if the value for a given key is loaded into memory.
 func (kv *Store) InMemory(key string) bool {
+	key = kv.canonicalKey(key)
 	kv.lock.RLock()
 	defer kv.lock.RUnlock()
 	if _, ok := kv.data[key]; !ok {
@@ -122,37 +549,22 @@ func (kv *Store) InMemory(key string) bool {
 }
 
 // Keys returns a slice of all keys currently in the Store.
+// With WithCaseInsensitiveKeysOption, keys are listed as they were first set.
 func (kv *Store) Keys() ([]string, error) {
 	kv.lock.RLock()
 	defer kv.lock.RUnlock()
-	keys := make([]string, 0)
-	for k := range kv.data {
-		keys = append(keys, k)
-	}
-	return keys, nil
-}
-
-// QueryKeys returns the keys that have been created between a time period
-func (kv *Store) QueryKeys(from, to time.Time) ([]string, error) {
-	kv.lock.RLock()
-	defer kv.lock.RUnlock()
-
 	keys := make([]string, 0)
 	for k, v := range kv.data {
-		if v.expired(kv.nowFunc()) {
-			continue
-		}
-		if (v.Ts.Equal(from) || v.Ts.After(from)) && (v.Ts.Equal(to) || v.Ts.Before(to)) {
-			keys = append(keys, k)
-		}
+		keys = append(keys, v.displayKey(k))
 	}
 	return keys, nil
 }
 
 // SetTTL sets the time-to-live (TTL) for a specific key.
 func (kv *Store) SetTTL(key string, ttl int64) error {
-	if !KeyValid(key) {
-		return ErrKeyInvalid
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
 	}
 
 	kv.lock.Lock()
@@ -160,20 +572,26 @@ func (kv *Store) SetTTL(key string, ttl int64) error {
 	return kv.setTTL(key, TTLType(ttl))
 }
 
-// TTL retrieves the remaining TTL for a given key.
+// TTL retrieves the remaining TTL for a given key, in seconds, counting down to the earlier of its own
+// TTL and any pending namespace deadline set with SetNamespaceTTL.
 func (kv *Store) TTL(key string) TTLType {
-	if !KeyValid(key) {
+	key = kv.canonicalKey(key)
+	if kv.useKey(key) != nil {
 		return TTLKeyNotExist
 	}
 
 	kv.lock.RLock()
 	defer kv.lock.RUnlock()
-	if _, ok := kv.data[key]; !ok {
+	mv, ok := kv.data[key]
+	now := kv.nowFunc()
+	if !ok || kv.expired(key, mv, now) {
 		return TTLKeyNotExist
 	}
-	mv := kv.data[key]
-	expireTime := mv.Ts.Add(time.Duration(mv.TTL) * time.Second)
-	ttl := expireTime.Sub(kv.nowFunc()).Seconds()
+	expireTime, ok := kv.expiry(key, mv, now)
+	if !ok {
+		return TTLNoExpirySet
+	}
+	ttl := expireTime.Sub(now).Seconds()
 	ttl = math.Ceil(ttl)
 	if ttl < 0 {
 		ttl = 0
@@ -181,19 +599,32 @@ func (kv *Store) TTL(key string) TTLType {
 	return TTLType(ttl)
 }
 
-// Touch updates the last-accessed time for a given key.
+// Touch marks a key as in use. Depending on the store's TouchMode it restarts the key's TTL,
+// delays unloading its value from memory, or both. The key's timestamp is not changed.
 func (kv *Store) Touch(key string) error {
-	if !KeyValid(key) {
-		return ErrKeyInvalid
+	key = kv.canonicalKey(key)
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if err := kv.useKey(key); err != nil {
+		return err
 	}
 
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
 	mv, ok := kv.data[key]
-	if !ok || mv.expired(kv.nowFunc()) {
+	now := kv.nowFunc()
+	if !ok || kv.expired(key, mv, now) {
 		return ErrNotFound
 	}
-	mv.Ts = kv.nowFunc()
+	if kv.touchMode != TouchExpiry {
+		mv.touched = now
+		mv.touchAccess(now.UnixNano())
+	}
+	if kv.touchMode == TouchAccess {
+		return nil
+	}
+	kv.applyExpiry(mv, now)
 	if err := kv.persistData(key); err != nil {
 		return errors.Wrap(err, "Store.Touch kv.persist")
 	}
@@ -202,45 +633,171 @@ func (kv *Store) Touch(key string) error {
 
 // Counter initializes or updates a counter value for a given key.
 func (kv *Store) Counter(key string, delta int64) (int64, error) {
-	if !KeyValid(key) {
-		return 0, ErrKeyInvalid
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return 0, err
 	}
 
 	kv.lock.Lock()
 	defer kv.lock.Unlock()
 
-	var mv *ValueItem
-	var ok bool
-	if mv, ok = kv.data[key]; !ok {
-		intStr := fmt.Sprintf("%d", delta)
-		if err := kv.setData(key, []byte(intStr)); err != nil {
-			return 0, errors.Wrap(err, "Store.Counter kv.setData")
+	i, err := kv.nextCounterValue(key, delta)
+	if err != nil {
+		return 0, err
+	}
+	if err := kv.updateData(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+		return 0, errors.Wrap(err, "Store.Counter updateData")
+	}
+	if err := kv.persistCounter(key, delta); err != nil {
+		return 0, errors.Wrap(err, "Store.Counter persistCounter")
+	}
+	return i, nil
+}
+
+// Counters applies many counter increments under a single lock and persists them as one batch.
+// The increments are all-or-nothing: if any key is invalid or any counter would exceed its
+// limits, no counter is changed. The new value of every counter is returned.
+// Keys that normalize to the same key have their deltas combined.
+func (kv *Store) Counters(deltas map[string]int64) (map[string]int64, error) {
+	for key := range deltas {
+		if err := kv.checkKey(kv.canonicalKey(key)); err != nil {
+			return nil, errors.Wrapf(err, "Store.Counters key %q", key)
+		}
+	}
+	if kv.lazyMetadata {
+		keys := make([]string, 0, len(deltas))
+		for key := range deltas {
+			keys = append(keys, kv.canonicalKey(key))
+		}
+		kv.resolveKeys(keys...)
+	}
+	if kv.canonicalizing() {
+		canonical := make(map[string]int64, len(deltas))
+		for key, delta := range deltas {
+			canonical[kv.canonicalKey(key)] += delta
+		}
+		values, err := kv.counters(canonical)
+		if err != nil {
+			return nil, err
+		}
+		requested := make(map[string]int64, len(deltas))
+		for key := range deltas {
+			requested[key] = values[kv.canonicalKey(key)]
+		}
+		return requested, nil
+	}
+	return kv.counters(deltas)
+}
+
+// counters applies counter increments to canonical keys.
+func (kv *Store) counters(deltas map[string]int64) (map[string]int64, error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	values := make(map[string]int64, len(deltas))
+	for key, delta := range deltas {
+		i, err := kv.nextCounterValue(key, delta)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Store.Counters key %q", key)
+		}
+		values[key] = i
+	}
+
+	keys := make([]string, 0, len(values))
+	for key, i := range values {
+		if err := kv.updateData(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+			return nil, errors.Wrap(err, "Store.Counters kv.updateData")
+		}
+		if !kv.deferCounters() || kv.pendCounter(key, deltas[key]) {
+			keys = append(keys, key)
+		}
+	}
+	if err := kv.persistBatch(keys); err != nil {
+		return nil, errors.Wrap(err, "Store.Counters kv.persistBatch")
+	}
+	return values, nil
+}
+
+// CounterWindow updates a counter that automatically resets at the start of every window.
+// Windows are aligned to the wall clock, so a window of time.Minute counts per-minute tallies.
+// The key expires at the end of the window, so a counter that is not incremented reads as not found.
+func (kv *Store) CounterWindow(key string, delta int64, window time.Duration) (int64, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return 0, err
+	}
+	if window <= 0 {
+		return 0, errors.New("Store.CounterWindow window must be positive")
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	now := kv.nowFunc()
+	start := now.Truncate(window)
+
+	mv, ok := kv.data[key]
+	fresh := !ok || kv.expired(key, mv, now) || (mv.Counter != nil && !mv.Counter.WindowStart.Equal(start))
+
+	i := delta
+	if !fresh {
+		var err error
+		if i, err = kv.nextCounterValue(key, delta); err != nil {
+			return 0, err
 		}
+	} else if ok && mv.Counter != nil && i > mv.Counter.Max {
+		return 0, errors.Wrap(ErrCounterMaxReached, "Store.CounterWindow")
+	} else if ok && mv.Counter != nil && i < mv.Counter.Min {
+		return 0, errors.Wrap(ErrCounterMinReached, "Store.CounterWindow")
+	}
+
+	if err := kv.updateData(key, []byte(fmt.Sprintf("%d", i))); err != nil {
+		return 0, errors.Wrap(err, "Store.CounterWindow kv.updateData")
+	}
+	mv = kv.data[key]
+	mv.Counter.Window = window
+	mv.Counter.WindowStart = start
+	mv.TTL = TTLType(math.Max(1, math.Ceil(start.Add(window).Sub(now).Seconds())))
+	mv.ExpiresAt = start.Add(window)
+	if err := kv.persistCounter(key, delta); err != nil {
+		return 0, errors.Wrap(err, "Store.CounterWindow kv.persistCounter")
+	}
+	return i, nil
+}
+
+// nextCounterValue returns the value a counter would have after applying delta,
+// checking it against the counter's limits. A missing key starts from zero.
+func (kv *Store) nextCounterValue(key string, delta int64) (int64, error) {
+	mv, err := kv.loadedItem(key)
+	if errors.Is(err, ErrNotFound) {
 		return delta, nil
+	} else if err != nil {
+		return 0, errors.Wrap(err, "Store.Counter kv.loadedItem")
 	}
 	i, err := strconv.ParseInt(string(mv.Data), 10, 64)
 	if err != nil {
 		return 0, errors.Wrap(err, "Store.Counter strconv.ParseInt")
 	}
 	if mv.Counter == nil {
-		return 0, errors.Wrap(err, "Store.Counter counter boundaries not set")
+		return 0, errors.New("Store.Counter counter boundaries not set")
 	}
 	i += delta
 	if i > mv.Counter.Max {
-		return 0, errors.New("Store.Counter maximum value reached")
+		return 0, errors.Wrap(ErrCounterMaxReached, "Store.Counter")
 	} else if i < mv.Counter.Min {
-		return 0, errors.New("Store.Counter minimum value reached")
-	}
-	if err := kv.setData(key, []byte(fmt.Sprintf("%d", i))); err != nil {
-		return 0, errors.Wrap(err, "Store.Counter setData")
+		return 0, errors.Wrap(ErrCounterMinReached, "Store.Counter")
 	}
 	return i, nil
 }
 
 // SetCounterLimits sets the min/max limits for a counter associated with a key.
 func (kv *Store) SetCounterLimits(key string, min, max int64) error {
-	if !KeyValid(key) {
-		return ErrKeyInvalid
+	key = kv.canonicalKey(key)
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if err := kv.useKey(key); err != nil {
+		return err
 	}
 	var mv *ValueItem
 	var ok bool
@@ -258,55 +815,175 @@ func (kv *Store) SetCounterLimits(key string, min, max int64) error {
 	return kv.persistData(key)
 }
 
-func (kv *Store) setData(key string, data []byte) error {
+func (kv *Store) setData(key string, data []byte, options ...SetOption) error {
+	if err := kv.updateData(key, data, options...); err != nil {
+		return err
+	}
+	return kv.persistData(key)
+}
+
+// updateData updates the in-memory value of a key without persisting it.
+func (kv *Store) updateData(key string, data []byte, options ...SetOption) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	if err := kv.checkDependencyCycle(key, options); err != nil {
+		return err
+	}
+	now := kv.nowFunc()
+	kv.preserveForSnapshots(key)
 	mv, ok := kv.data[key]
 	if !ok {
-		mv = NewValueItem(data, kv.nowFunc())
+		mv = NewValueItem(data, now)
+		mv.TTL = kv.defaultTTLSeconds(key)
 	}
 
+	// The previous value is released only once the new one is copied, as it may be derived from it.
+	var previous []byte
+	if mv.inArena {
+		previous, mv.inArena = mv.Data, false
+		defer kv.releaseRegion(previous)
+	}
 	if err := mv.SetData(data); err != nil {
 		return errors.Wrap(err, "Store.get mv.SetData")
 	}
-	mv.Ts = kv.nowFunc()
-	kv.data[key] = mv
+	kv.markDirty(key, mv)
+	oldDeps := mv.DependsOn
+	for _, opt := range options {
+		opt(mv)
+	}
+	mv.DependsOn = kv.canonicalKeys(mv.DependsOn)
+	kv.trackDependencies(key, oldDeps, mv.DependsOn)
+	if mv.CreatedAt.IsZero() {
+		mv.CreatedAt = mv.Ts
+	}
+	refresh := kv.refreshTTLOnSet
+	if mv.refreshTTL != nil {
+		refresh, mv.refreshTTL = *mv.refreshTTL, nil
+	}
+	if !ok || refresh {
+		kv.applyExpiry(mv, now)
+	} else {
+		mv.ExpiresAt, _ = mv.expiry()
+	}
+	mv.Type = RawValue
+	kv.version++
+	mv.Version = kv.version
+	mv.Ts = now
+	mv.touchAccess(mv.Ts.UnixNano())
+	kv.replaceItem(key, mv)
+	kv.misses.forget(key)
+	kv.invalidateDependents(key)
+	return nil
+}
+
+// setTypedData stores encoded data of a non-raw value type and persists it.
+func (kv *Store) setTypedData(key string, data []byte, vt ValueType) error {
+	if err := kv.updateData(key, data); err != nil {
+		return err
+	}
+	mv := kv.data[key]
+	mv.Type = vt
+	mv.Counter = nil
 	return kv.persistData(key)
 }
 
-func (kv *Store) delete(key string) error {
-	if _, ok := kv.data[key]; !ok {
+// loadedItem returns the live item for a key with its data loaded into memory,
+// reading it from the first persister if it has been unloaded. The caller must hold the write lock.
+func (kv *Store) loadedItem(key string) (*ValueItem, error) {
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return nil, ErrNotFound
+	}
+	if mv.dataLoaded || len(kv.persistence) == 0 {
+		return mv, nil
+	}
+
+	loaded, err := kv.persistence[0].Read(key, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Store.loadedItem Read")
+	}
+	kv.replaceItem(key, loaded)
+	return loaded, nil
+}
+
+func (kv *Store) delete(key string, reason RemovalReason) error {
+	mv, ok := kv.data[key]
+	if !ok {
 		return ErrNotFound
 	}
-	delete(kv.data, key)
+	event, notify := kv.removalEvent(key, mv, reason)
+	kv.unindexItem(key, mv)
 
 	var returnError error
-	for _, p := range kv.persistence {
-		if err := p.Delete(key); err != nil {
-			returnError = errors.Wrap(err, "p.Delete")
+	if !kv.ephemeral(key) {
+		for _, p := range kv.persistence {
+			if err := p.Delete(key); err != nil {
+				returnError = errors.Wrap(err, "p.Delete")
+			}
 		}
 	}
+	// The handler only hears of removals that took effect, so a key still persisted is not reported.
+	if notify && returnError == nil {
+		kv.queueRemoval(event)
+	}
+	if kv.ephemeral(key) {
+		kv.invalidateDependents(key)
+		return nil
+	}
+	kv.broadcast(key)
+	kv.invalidateDependents(key)
 	return returnError
 }
 
+// unindexItem removes a key's item from memory before it is deleted. Its removal event must be taken
+// first, while the item still holds its value. The caller must hold the write lock.
+func (kv *Store) unindexItem(key string, mv *ValueItem) {
+	kv.preserveForSnapshots(key)
+	kv.removeItem(key)
+	if mv.inArena {
+		kv.releaseValue(mv)
+	}
+	kv.misses.forget(key)
+	kv.trackDependencies(key, mv.DependsOn, nil)
+}
+
 func (kv *Store) readFromFirstStore(key string) ([]byte, error) {
 	if len(kv.persistence) == 0 {
 		return nil, nil
 	}
 
+	if err := kv.misses.lookup(key, kv.nowFunc()); err != nil {
+		return nil, err
+	}
+	if data, ok := kv.fillFromPeer(key); ok {
+		return data, nil
+	}
+
 	mv, err := kv.persistence[0].Read(key, true)
+	if notPersisted(err) {
+		// Transient errors are not cached, so the next read retries the backend.
+		kv.misses.add(key, err, kv.nowFunc())
+	}
 	if err != nil {
 		return nil, err
 	}
+	mv.touchAccess(kv.nowFunc().UnixNano())
 	kv.lock.Lock()
-	kv.data[key] = mv
-	kv.lock.Unlock()
-	return mv.Data, nil
+	defer kv.lock.Unlock()
+	kv.replaceItem(key, mv)
+	return kv.valueOf(mv), nil
 }
 
 func (kv *Store) setTTL(key string, ttl TTLType) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
 	if _, ok := kv.data[key]; !ok {
 		return ErrNotFound
 	}
 	kv.data[key].TTL = ttl
+	kv.applyExpiry(kv.data[key], kv.nowFunc())
 	if err := kv.persistData(key); err != nil {
 		return errors.Wrap(err, "store.setTTL kv.persist")
 	}
@@ -317,29 +994,148 @@ func (kv *Store) initPersistence() error {
 	if len(kv.persistence) == 0 {
 		return nil
 	}
+	kv.migratePersistence()
 
 	keys, err := kv.persistence[0].Keys()
 	if err != nil {
 		log.Info().Msgf("store.InitialisePersistenceControllers %s", err.Error())
 		return nil
 	}
+	if kv.lazyMetadata {
+		kv.lock.Lock()
+		kv.listKeys(keys)
+		kv.lock.Unlock()
+		kv.reportProgress(len(keys), len(keys))
+		return nil
+	}
+
+	kv.reportProgress(0, len(keys))
+	for start := 0; start < len(keys); start += startupBatchSize {
+		if kv.ctx.Err() != nil {
+			return nil
+		}
+		end := min(start+startupBatchSize, len(keys))
+		kv.loadKeys(keys[start:end])
+		kv.reportProgress(end, len(keys))
+	}
+	return nil
+}
 
+// readPersisted reads several keys from the first persister, in parallel if WithLoadParallelismOption was used.
+func (kv *Store) readPersisted(keys []string, readValue bool) (map[string]*ValueItem, error) {
+	return readMultiConcurrently(kv.persistence[0], keys, readValue, kv.loadParallelism)
+}
+
+// loadKeys reads the metadata of a batch of persisted keys into the key map. Keys written or deleted
+// while the store was loading in the background are kept as they are, so neither is overwritten by,
+// nor purged for, the metadata read before the change.
+func (kv *Store) loadKeys(keys []string) {
+	items, err := kv.readPersisted(keys, false)
+	if err != nil {
+		log.Error().Msgf("[kvstore init] error reading metadata error: %s", err.Error())
+		items = map[string]*ValueItem{}
+	}
+	now := kv.nowFunc()
 	for _, k := range keys {
-		mv, err := kv.persistence[0].Read(k, false)
-		if err != nil {
-			kv.data[k] = &ValueItem{
-				Ts:         time.Now(),
-				dataLoaded: false,
-			}
+		if _, ok := items[k]; !ok {
+			items[k] = kv.readMetadata(k)
+		}
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	for _, k := range keys {
+		if !kv.loadable(k) {
+			continue
+		}
+		mv := items[k]
+		if kv.purgeExpired && kv.expired(k, mv, now) {
+			kv.purge(k, mv)
 			continue
 		}
-		kv.data[k] = mv
+		if kv.canonicalKey(k) != k {
+			log.Warn().Msgf("[kvstore init] persisted key %q is not in canonical form and cannot be looked up", k)
+		}
+		kv.indexItem(k, mv)
+		delete(kv.touched, k)
 	}
+}
 
-	return nil
+// loadable reports whether a persisted key should be loaded on startup: it is not already in the
+// key map and has not been written or deleted since a background startup began. The caller must
+// hold the write lock.
+func (kv *Store) loadable(key string) bool {
+	if _, exists := kv.data[key]; exists {
+		return false
+	}
+	_, touched := kv.touched[key]
+	return !touched
+}
+
+// migratePersistence upgrades persisters holding data in older layouts. Read-only stores leave the
+// data for the writer to upgrade; it is upgraded in memory as it is read.
+func (kv *Store) migratePersistence() {
+	if kv.readOnly {
+		return
+	}
+	for _, p := range kv.persistence {
+		if m, ok := p.(Migrator); ok {
+			if err := m.Migrate(); err != nil {
+				log.Error().Msgf("[kvstore init] migration error: %s", err.Error())
+			}
+		}
+	}
+}
+
+// purge deletes a key that expired while the store was not running from the persisters, reporting
+// it as expired once it is gone. Read-only stores leave it in place for the writer to delete.
+// The caller must hold the write lock.
+func (kv *Store) purge(key string, mv *ValueItem) {
+	if kv.readOnly {
+		return
+	}
+	event, notify := kv.removalEvent(key, mv, RemovalExpired)
+	purged := true
+	for _, p := range kv.persistence {
+		if err := p.Delete(key); err != nil {
+			purged = false
+			log.Error().Msgf("[kvstore init] error purging expired key %s error: %s", key, err.Error())
+		}
+	}
+	if notify && purged {
+		kv.queueRemoval(event)
+	}
+}
+
+// readMetadata reads a key's metadata from the first persister. If the metadata cannot be read,
+// a placeholder is returned so that the key is still listed and its value can be retried later.
+func (kv *Store) readMetadata(key string) *ValueItem {
+	mv, err := kv.persistence[0].Read(key, false)
+	if err != nil {
+		return &ValueItem{
+			Ts:         time.Now(),
+			dataLoaded: false,
+		}
+	}
+	return mv
+}
+
+// indexItem adds a persisted item to the in-memory key map. The caller must hold the write lock.
+func (kv *Store) indexItem(key string, mv *ValueItem) {
+	if mv.Version > kv.version {
+		kv.version = mv.Version
+	}
+	kv.replaceItem(key, mv)
+	kv.trackDependencies(key, nil, mv.DependsOn)
 }
 
 func (kv *Store) persistData(key string) error {
+	return kv.persistWith(key, DataPersister.Write)
+}
+
+// persistWith writes a key to every persister using write, then marks it clean and broadcasts the
+// change, as persistData does, so callers that write part of a value share its bookkeeping.
+func (kv *Store) persistWith(key string, write func(DataPersister, string, *ValueItem) error) error {
 	if len(kv.persistence) == 0 {
 		return nil
 	}
@@ -349,54 +1145,207 @@ func (kv *Store) persistData(key string) error {
 	}
 
 	mv := kv.data[key]
+	if kv.ephemeral(key) {
+		mv.dirty = false
+		return nil
+	}
+	mv.AccessedAt = mv.accessedAt()
+	item := kv.persisted(mv)
 	for _, d := range kv.persistence {
-		if err := d.Write(key, mv); err != nil {
+		if err := write(d, key, item); err != nil {
+			kv.markDirty(key, mv)
 			return errors.Wrap(err, "Store.persist Write error")
 		}
 	}
+	mv.dirty = false
+	mv.pendingDelta = 0
+	kv.broadcast(key)
 	return nil
 }
 
-func (kv *Store) evictionController() {
-	if kv.evictionFreq <= 0 {
-		return
+// persistBatch writes several keys to every persister, as a single batch where supported.
+func (kv *Store) persistBatch(keys []string) error {
+	if len(kv.persistence) == 0 || len(keys) == 0 {
+		return nil
+	}
+
+	items := make(map[string]*ValueItem, len(keys))
+	for _, k := range keys {
+		mv, ok := kv.data[k]
+		if !ok {
+			return fmt.Errorf("persist key: %s does not exist", k)
+		}
+		if kv.ephemeral(k) {
+			continue
+		}
+		items[k] = kv.persisted(mv)
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	for _, d := range kv.persistence {
+		if err := writeBatch(d, items); err != nil {
+			// Any of the items may not have been written, so Flush writes them all again.
+			for k := range items {
+				kv.markDirty(k, kv.data[k])
+			}
+			return err
+		}
+	}
+	for k := range items {
+		mv := kv.data[k]
+		mv.dirty = false
+		mv.pendingDelta = 0
+		kv.broadcast(k)
+	}
+	return nil
+}
+
+// writeBatch writes items to a persister, as a single batch if it implements BatchWriter.
+func writeBatch(d DataPersister, items map[string]*ValueItem) error {
+	if bw, ok := d.(BatchWriter); ok {
+		return errors.Wrap(bw.WriteMulti(items), "Store.persistBatch WriteMulti error")
+	}
+	for k, mv := range items {
+		if err := d.Write(k, mv); err != nil {
+			return errors.Wrap(err, "Store.persistBatch Write error")
+		}
 	}
+	return nil
+}
+
+// markDirty records that a key's in-memory item differs from the persisters, until persistWith or
+// persistBatch writes it, so it is not unloaded or replaced by a reload and Flush writes it again.
+// Keys that are not persisted are never dirty. The caller must hold the write lock.
+func (kv *Store) markDirty(key string, mv *ValueItem) {
+	mv.dirty = len(kv.persistence) > 0 && !kv.ephemeral(key)
+}
+
+// flushOnShutdown writes every dirty value to the persisters and every loaded value to the
+// shutdown targets. Errors are logged, as there is no caller left to handle them.
+// The caller must hold the write lock.
+func (kv *Store) flushOnShutdown() {
+	for k, mv := range kv.data {
+		if mv.dirty {
+			if err := kv.persistData(k); err != nil {
+				log.Error().Msgf("[kvstore shutdown] error flushing key %s error: %s", k, err.Error())
+			}
+		}
+		if !mv.dataLoaded || kv.ephemeral(k) {
+			continue
+		}
+		for _, t := range kv.shutdownTargets {
+			if err := t.Write(k, kv.persisted(mv)); err != nil {
+				log.Error().Msgf("[kvstore shutdown] error writing key %s to shutdown target error: %s", k, err.Error())
+			}
+		}
+	}
+}
 
-	timer := time.NewTimer(kv.evictionFreq)
+// evictionController runs eviction checks at the eviction frequency, and makes staged writes and
+// scheduled deletions when they are due, until the store is closed. The two have separate timers, so
+// scheduling writes does not delay eviction checks.
+func (kv *Store) evictionController() {
+	timer := time.NewTimer(0)
+	scheduleTimer := time.NewTimer(0)
 	defer timer.Stop()
+	defer scheduleTimer.Stop()
+	kv.resetEvictionTimer(timer)
+	kv.resetScheduleTimer(scheduleTimer)
 	for {
 		select {
 		case <-timer.C:
+			kv.applyScheduled()
 			kv.runEvictionCheck()
-			timer.Reset(kv.evictionFreq)
+			kv.resetEvictionTimer(timer)
+			kv.resetScheduleTimer(scheduleTimer)
+		case <-kv.reconfigure:
+			kv.resetEvictionTimer(timer)
+		case <-scheduleTimer.C:
+			kv.applyScheduled()
+			kv.resetScheduleTimer(scheduleTimer)
+		case <-kv.rescheduled:
+			kv.resetScheduleTimer(scheduleTimer)
 		case <-kv.ctx.Done():
 			return
 		}
 	}
 }
 
+// resetEvictionTimer restarts the eviction timer for the current eviction frequency, leaving it
+// stopped if checks are paused.
+func (kv *Store) resetEvictionTimer(t *time.Timer) {
+	kv.lock.RLock()
+	freq := kv.evictionFreq
+	kv.lock.RUnlock()
+	stopTimer(t)
+	if freq > 0 {
+		t.Reset(freq)
+	}
+}
+
+// resetScheduleTimer restarts the schedule timer for the next staged write or scheduled deletion,
+// leaving it stopped if there are none.
+func (kv *Store) resetScheduleTimer(t *time.Timer) {
+	kv.lock.RLock()
+	next, scheduled := kv.nextScheduled()
+	kv.lock.RUnlock()
+	stopTimer(t)
+	if scheduled {
+		t.Reset(max(next.Sub(kv.nowFunc()), 0))
+	}
+}
+
+// stopTimer stops a timer, discarding a tick it has sent but that was not received, so it can be Reset.
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// runEvictionCheck deletes expired keys and unloads idle values. Keys are found under the read lock
+// and checked again under the write lock, as they may have been written, or the settings changed, in between.
 func (kv *Store) runEvictionCheck() {
 	kv.lock.RLock()
 	timeNow := kv.nowFunc()
 	deletionKeys := make([]string, 0)
 	unloadKeys := make([]string, 0)
 	for k, v := range kv.data {
-		if v.expired(timeNow) {
+		if kv.expired(k, v, timeNow) {
 			deletionKeys = append(deletionKeys, k)
-		} else if v.unload(timeNow, kv.unloadAfterTime) && len(kv.persistence) > 0 {
+		} else if v.unload(timeNow, kv.unloadAfterTime) && len(kv.persistence) > 0 && kv.unloadable(k) {
 			unloadKeys = append(unloadKeys, k)
 		}
 	}
 	kv.lock.RUnlock()
+	kv.misses.purge(timeNow)
 	kv.lock.Lock()
+	deleted := true
 	for _, k := range deletionKeys {
-		if err := kv.delete(k); err != nil {
+		if mv, ok := kv.data[k]; !ok || !kv.expired(k, mv, timeNow) {
+			continue
+		}
+		if kv.followFreq > 0 {
+			kv.forget(k)
+			continue
+		}
+		if err := kv.delete(k, RemovalExpired); err != nil {
 			log.Error().Msgf("[kvstore eviction] error deleting key %s error: %s", k, err.Error())
+			deleted = false
 		}
 	}
+	if deleted {
+		kv.pruneNamespaceExpiries(timeNow)
+	}
 	for _, k := range unloadKeys {
-		kv.data[k].dataLoaded = false
-		kv.data[k].Data = nil
+		if mv, ok := kv.data[k]; ok && !mv.dirty && kv.evictionFreq > 0 && mv.unload(timeNow, kv.unloadAfterTime) {
+			kv.unloadValue(k, mv)
+		}
 	}
+	kv.enforceMemoryLimit()
 	kv.lock.Unlock()
 }
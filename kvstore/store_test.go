@@ -1,16 +1,23 @@
 package kvstore_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jrsteele09/go-kvstore/kvstore"
 	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -312,3 +319,2799 @@ func TestTTL(t *testing.T) {
 	require.NoError(t, s.Delete(key))
 	time.Sleep(100 * time.Millisecond)
 }
+
+func TestContentTypeMetadata(t *testing.T) {
+	const key = "k1:104"
+	const folder = "TestContentTypeMetadata"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, []byte(`{"a":1}`), kvstore.WithContentTypeSetOption("application/json")))
+
+	info, err := s.GetMetadata(key)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", info.ContentType)
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	info, err = s2.GetMetadata(key)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", info.ContentType)
+	require.False(t, info.Loaded)
+}
+
+func TestUserMetadata(t *testing.T) {
+	const key = "k1:105"
+	const folder = "TestUserMetadata"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, []byte("data"), kvstore.WithMetaSetOption(map[string]string{"source": "import", "schema": "v1"})))
+	require.NoError(t, s.Set(key, []byte("data2"), kvstore.WithMetaSetOption(map[string]string{"schema": "v2"})))
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	info, err := s2.GetMetadata(key)
+	require.NoError(t, err)
+	require.False(t, s2.InMemory(key))
+	require.Equal(t, map[string]string{"source": "import", "schema": "v2"}, info.Meta)
+}
+
+func TestSetIfMatch(t *testing.T) {
+	const key = "k1:106"
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.ErrorIs(t, s.SetIfMatch(key, []byte("v0"), "*"), kvstore.ErrETagMismatch)
+	require.NoError(t, s.Set(key, []byte("v1")))
+
+	info, err := s.GetMetadata(key)
+	require.NoError(t, err)
+	require.NoError(t, s.SetIfMatch(key, []byte("v2"), info.ETag))
+	require.ErrorIs(t, s.SetIfMatch(key, []byte("v3"), info.ETag), kvstore.ErrETagMismatch)
+
+	b, err := s.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	require.NoError(t, s.SetIfMatch(key, []byte("v4"), "*"))
+}
+
+func TestGetWithMetadata(t *testing.T) {
+	const key = "k1:107"
+	const folder = "TestGetWithMetadata"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, []byte("v1"), kvstore.WithContentTypeSetOption("text/plain")))
+
+	// Values that are not in memory are read from the persister with their metadata.
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.False(t, s2.InMemory(key))
+	value, info, err := s2.GetWithMetadata(key)
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(value))
+	require.Equal(t, "text/plain", info.ContentType)
+
+	require.NoError(t, s2.Set(key, []byte("v2")))
+	value, updated, err := s2.GetWithMetadata(key)
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(value))
+	require.NotEqual(t, info.ETag, updated.ETag)
+	require.NoError(t, s2.SetIfMatch(key, []byte("v3"), updated.ETag))
+
+	_, _, err = s2.GetWithMetadata("k1:missing")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestTransactionConflict(t *testing.T) {
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, s.Set("balance", []byte("10")))
+
+	tx := s.Watch("balance")
+	tx.Set("balance", []byte("20"))
+	tx.Set("audit", []byte("updated"))
+	require.NoError(t, s.Set("balance", []byte("15")))
+	require.ErrorIs(t, tx.Exec(), kvstore.ErrTxConflict)
+	_, err = s.Get("audit")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	tx = s.Watch("balance", "missing")
+	tx.Set("balance", []byte("20"))
+	tx.Delete("balance")
+	tx.Set("audit", []byte("updated"))
+	require.NoError(t, tx.Exec())
+	_, err = s.Get("balance")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	b, err := s.Get("audit")
+	require.NoError(t, err)
+	require.Equal(t, "updated", string(b))
+}
+
+func TestLockKey(t *testing.T) {
+	const key = "k1:107"
+	const nRoutines = 50
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, s.Set(key, []byte("")))
+
+	var wg sync.WaitGroup
+	wg.Add(nRoutines)
+	for i := 0; i < nRoutines; i++ {
+		go func() {
+			defer wg.Done()
+			unlock := s.LockKey(key)
+			defer unlock()
+			b, err := s.Get(key)
+			require.NoError(t, err)
+			require.NoError(t, s.Set(key, append(b, 'x')))
+		}()
+	}
+	wg.Wait()
+
+	b, err := s.Get(key)
+	require.NoError(t, err)
+	require.Len(t, b, nRoutines)
+}
+
+type failingWritePersister struct {
+	kvstore.DataPersister
+	fail atomic.Bool
+}
+
+func (f *failingWritePersister) Write(key string, data *kvstore.ValueItem) error {
+	if f.fail.Load() {
+		return kvstore.ErrPersisterUnavailable
+	}
+	return f.DataPersister.Write(key, data)
+}
+
+func TestFailedBatchWritesAreFlushed(t *testing.T) {
+	const folder = "TestFailedBatchWritesAreFlushed"
+	defer os.RemoveAll(folder)
+	p := &failingWritePersister{DataPersister: persistence.NewFsPersistence(folder)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("session:a", []byte("a")))
+
+	p.fail.Store(true)
+	_, err = s.Counters(map[string]int64{"hits": 3})
+	require.ErrorIs(t, err, kvstore.ErrPersisterUnavailable)
+	_, err = s.SetTTLWhere(nil, 60)
+	require.ErrorIs(t, err, kvstore.ErrPersisterUnavailable)
+	p.fail.Store(false)
+	require.NoError(t, s.Flush())
+	s.Close()
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer s2.Close()
+	b, err := s2.Get("hits")
+	require.NoError(t, err)
+	require.Equal(t, "3", string(b))
+	require.Equal(t, kvstore.TTLType(60), s2.TTL("session:a"))
+}
+
+func TestBatchCounters(t *testing.T) {
+	const folder = "TestBatchCounters"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewPersistenceBuffer(persistence.NewFsPersistence(folder), 10)))
+	require.NoError(t, err)
+
+	values, err := s.Counters(map[string]int64{"hits:a": 1, "hits:b": 5})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"hits:a": 1, "hits:b": 5}, values)
+
+	require.NoError(t, s.SetCounterLimits("hits:b", 0, 6))
+	_, err = s.Counters(map[string]int64{"hits:a": 1, "hits:b": 5})
+	require.Error(t, err)
+
+	values, err = s.Counters(map[string]int64{"hits:a": 2, "hits:b": -5})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"hits:a": 3, "hits:b": 0}, values)
+
+	// Counters keep changing while the buffer writes the batch, so it must hold copies of them.
+	for i := 0; i < 100; i++ {
+		_, err = s.Counters(map[string]int64{"hits:c": 1, "hits:d": 1})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Flush())
+	s.Close()
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer s2.Close()
+	b, err := s2.Get("hits:c")
+	require.NoError(t, err)
+	require.Equal(t, "100", string(b))
+	b, err = s2.Get("hits:a")
+	require.NoError(t, err)
+	require.Equal(t, "3", string(b))
+}
+
+func TestCounterWindow(t *testing.T) {
+	const key = "requests:minute"
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+
+	i, err := s.CounterWindow(key, 1, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), i)
+
+	now = now.Add(30 * time.Second)
+	i, err = s.CounterWindow(key, 2, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), i)
+	require.Equal(t, kvstore.TTLType(30), s.TTL(key))
+
+	now = now.Add(40 * time.Second)
+	i, err = s.CounterWindow(key, 1, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), i)
+
+	now = now.Add(2 * time.Minute)
+	_, err = s.Get(key)
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestTimeSeries(t *testing.T) {
+	const key = "cpu:host1"
+	const folder = "TestTimeSeries"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+
+	base := time.Unix(1700000000, 0)
+	for _, i := range []int{3, 0, 2, 1, 4} {
+		require.NoError(t, s.TSAdd(key, base.Add(time.Duration(i)*time.Minute), float64(i)*1.5))
+	}
+	require.NoError(t, s.TSAdd(key, base.Add(2*time.Minute), 42))
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	points, err := s2.TSRange(key, base.Add(time.Minute), base.Add(3*time.Minute))
+	require.NoError(t, err)
+	require.Len(t, points, 3)
+	require.True(t, points[0].T.Equal(base.Add(time.Minute)))
+	require.Equal(t, []float64{1.5, 42, 4.5}, []float64{points[0].Value, points[1].Value, points[2].Value})
+
+	require.NoError(t, s2.Set("plain", []byte("value")))
+	require.ErrorIs(t, s2.TSAdd("plain", base, 1), kvstore.ErrWrongType)
+}
+
+func TestTimeSeriesCorruptCount(t *testing.T) {
+	const folder = "TestTimeSeriesCorruptCount"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	// A count of 2^63 points followed by no data.
+	item := kvstore.NewValueItem([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, time.Now())
+	item.Type = kvstore.TimeSeriesValue
+	require.NoError(t, fs.Write("cpu:host1", item))
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.TSRange("cpu:host1", time.Time{}, time.Now())
+	require.ErrorIs(t, err, kvstore.ErrCorruptTimeSeries)
+}
+
+func TestGeoSearch(t *testing.T) {
+	const key = "stores:uk"
+	s, err := kvstore.New()
+	require.NoError(t, err)
+
+	added, err := s.GeoAdd(key,
+		kvstore.GeoMember{Name: "london", Latitude: 51.5074, Longitude: -0.1278},
+		kvstore.GeoMember{Name: "reading", Latitude: 51.4543, Longitude: -0.9781},
+		kvstore.GeoMember{Name: "manchester", Latitude: 53.4808, Longitude: -2.2426},
+	)
+	require.NoError(t, err)
+	require.Equal(t, 3, added)
+
+	results, err := s.GeoSearch(key, 51.5, -0.12, 100000, 0)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "london", results[0].Name)
+	require.Equal(t, "reading", results[1].Name)
+	require.InDelta(t, 59000, results[1].Distance, 2000)
+
+	results, err = s.GeoSearch(key, 51.5, -0.12, 1000000, 1)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+}
+
+func TestBloomFilter(t *testing.T) {
+	const key = "seen:emails"
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, s.BFReserve(key, 1000, 0.01))
+	require.ErrorIs(t, s.BFReserve(key, 1000, 0.01), kvstore.ErrKeyExists)
+
+	for i := 0; i < 1000; i++ {
+		_, err := s.BFAdd(key, []byte(fmt.Sprintf("user%d@example.com", i)))
+		require.NoError(t, err)
+	}
+	added, err := s.BFAdd(key, []byte("user1@example.com"))
+	require.NoError(t, err)
+	require.False(t, added)
+
+	falsePositives := 0
+	for i := 1000; i < 2000; i++ {
+		exists, err := s.BFExists(key, []byte(fmt.Sprintf("user%d@example.com", i)))
+		require.NoError(t, err)
+		if exists {
+			falsePositives++
+		}
+	}
+	require.Less(t, falsePositives, 50)
+
+	exists, err := s.BFExists("seen:missing", []byte("x"))
+	require.NoError(t, err)
+	require.False(t, exists)
+}
+
+type countingPersister struct {
+	kvstore.DataPersister
+	reads  int
+	writes int
+}
+
+func (c *countingPersister) Write(key string, data *kvstore.ValueItem) error {
+	c.writes++
+	return c.DataPersister.Write(key, data)
+}
+
+func (c *countingPersister) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	c.reads++
+	return c.DataPersister.Read(key, readValue)
+}
+
+func TestNegativeCache(t *testing.T) {
+	const testFolder = "TestNegativeCache"
+	const failKey = "key1"
+	defer os.RemoveAll(testFolder)
+	os.MkdirAll(path.Join(testFolder, failKey), 0700)
+
+	p := &countingPersister{DataPersister: persistence.NewFsPersistence(testFolder)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithNegativeCacheOption(time.Minute))
+	require.NoError(t, err)
+	startupReads := p.reads
+
+	for i := 0; i < 5; i++ {
+		_, err := s.Get(failKey)
+		require.Error(t, err)
+	}
+	require.Equal(t, startupReads+1, p.reads)
+
+	require.NoError(t, s.Set(failKey, []byte("data")))
+	b, err := s.Get(failKey)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(b))
+
+	// Transient errors are retried on every read.
+	failing := &failingReadPersister{DataPersister: persistence.NewFsPersistence(testFolder)}
+	counted := &countingPersister{DataPersister: failing}
+	reopened, err := kvstore.New(kvstore.WithPersistenceOption(counted), kvstore.WithNegativeCacheOption(time.Minute))
+	require.NoError(t, err)
+	defer reopened.Close()
+	failing.fail.Store(true)
+	startupReads = counted.reads
+	for i := 0; i < 3; i++ {
+		_, err := reopened.Get(failKey)
+		require.ErrorIs(t, err, kvstore.ErrPersisterUnavailable)
+	}
+	require.Equal(t, startupReads+3, counted.reads)
+	failing.fail.Store(false)
+	b, err = reopened.Get(failKey)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(b))
+
+	// Keys the loader cannot find are cached, unlike other loader errors.
+	loads := 0
+	for i := 0; i < 3; i++ {
+		_, err := s.GetOrSet("user:missing", 0, func() ([]byte, error) {
+			loads++
+			return nil, errors.Wrap(kvstore.ErrNotFound, "no such user")
+		})
+		require.ErrorIs(t, err, kvstore.ErrNotFound)
+	}
+	require.Equal(t, 1, loads)
+	for i := 0; i < 3; i++ {
+		_, err := s.GetOrSet("user:unavailable", 0, func() ([]byte, error) {
+			loads++
+			return nil, errors.New("database unavailable")
+		})
+		require.Error(t, err)
+	}
+	require.Equal(t, 4, loads)
+}
+
+func TestGetOrSet(t *testing.T) {
+	const key = "user:42"
+	const nRoutines = 20
+	s, err := kvstore.New()
+	require.NoError(t, err)
+
+	var loads int32
+	var loadLock sync.Mutex
+	loader := func() ([]byte, error) {
+		loadLock.Lock()
+		loads++
+		loadLock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return []byte("loaded"), nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(nRoutines)
+	for i := 0; i < nRoutines; i++ {
+		go func() {
+			defer wg.Done()
+			b, err := s.GetOrSet(key, time.Minute, loader)
+			require.NoError(t, err)
+			require.Equal(t, "loaded", string(b))
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), loads)
+	require.Equal(t, kvstore.TTLType(60), s.TTL(key))
+
+	_, err = s.GetOrSet("user:43", 0, func() ([]byte, error) { return nil, fmt.Errorf("backend down") })
+	require.Error(t, err)
+	_, err = s.Get("user:43")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestDependencyInvalidation(t *testing.T) {
+	const folder = "TestDependencyInvalidation"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("sales", []byte("100")))
+	require.NoError(t, s.Set("costs", []byte("60")))
+	require.NoError(t, s.Set("profit", []byte("40"), kvstore.WithDependsOnSetOption("sales", "costs")))
+	require.NoError(t, s.Set("summary", []byte("profit 40"), kvstore.WithDependsOnSetOption("profit")))
+
+	require.NoError(t, s.Set("sales", []byte("120")))
+	_, err = s.Get("profit")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	_, err = s.Get("summary")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	require.NoError(t, s.Set("profit", []byte("60"), kvstore.WithDependsOnSetOption("sales", "costs")))
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s2.Delete("costs"))
+	_, err = s2.Get("profit")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestDependencyCycleRejected(t *testing.T) {
+	s, err := kvstore.New()
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2"), kvstore.WithDependsOnSetOption("a")))
+	require.NoError(t, s.Set("c", []byte("3"), kvstore.WithDependsOnSetOption("b")))
+
+	err = s.Set("a", []byte("4"), kvstore.WithDependsOnSetOption("c"))
+	require.ErrorIs(t, err, kvstore.ErrDependencyCycle)
+	v, err := s.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+	v, err = s.Get("c")
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), v)
+
+	require.NoError(t, s.Set("a", []byte("5"), kvstore.WithDependsOnSetOption("a")))
+	_, err = s.Get("b")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestMemoryLimitSpill(t *testing.T) {
+	const folder = "TestMemoryLimitSpill"
+	defer os.RemoveAll(folder)
+	now := time.Now()
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+		kvstore.WithMemoryLimitOption(250),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+	)
+	require.NoError(t, err)
+
+	value := make([]byte, 100)
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Set(k, value))
+	}
+	_, err = s.Get("a")
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+
+	require.True(t, s.InMemory("a"))
+	require.False(t, s.InMemory("b"))
+	require.True(t, s.InMemory("c"))
+	b, err := s.Get("b")
+	require.NoError(t, err)
+	require.Len(t, b, 100)
+}
+
+func TestNamespaceSettings(t *testing.T) {
+	const folder = "TestNamespaceSettings"
+	const imagesFolder = "TestNamespaceSettingsImages"
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(imagesFolder)
+	now := time.Now()
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+
+	options := []kvstore.StoreOption{
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+		kvstore.WithMemoryLimitOption(1000),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithNamespaceOption("sessions", kvstore.WithDefaultTTLNamespaceOption(time.Hour)),
+		kvstore.WithNamespaceOption("sessions:admin", kvstore.WithEvictionPolicyNamespaceOption(kvstore.EvictNever)),
+		kvstore.WithNamespaceOption("reports", kvstore.WithMemoryShareNamespaceOption(0.1)),
+		kvstore.WithNamespaceOption("images", kvstore.WithPersisterNamespaceOption(persistence.NewFsPersistence(imagesFolder))),
+	}
+	s, err := kvstore.New(options...)
+	require.NoError(t, err)
+
+	// Nested namespaces inherit the settings they leave unset.
+	require.NoError(t, s.Set("sessions:admin:1", make([]byte, 100)))
+	require.NoError(t, s.Set("other", []byte("1")))
+	require.Equal(t, kvstore.TTLType(3600), s.TTL("sessions:admin:1"))
+	require.Equal(t, kvstore.TTLNoExpirySet, s.TTL("other"))
+
+	// The reports namespace may hold 100 bytes in memory.
+	require.NoError(t, s.Set("reports:1", make([]byte, 80)))
+	require.NoError(t, s.Set("reports:2", make([]byte, 80)))
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, s.InMemory("reports:1"))
+	require.True(t, s.InMemory("reports:2"))
+
+	// Pinned values stay in memory when the store is over its limit.
+	for i := 0; i < 12; i++ {
+		require.NoError(t, s.Set(fmt.Sprintf("bulk:%d", i), make([]byte, 100)))
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory("sessions:admin:1"))
+	require.False(t, s.InMemory("bulk:0"))
+
+	// Images are kept in their own persister.
+	require.NoError(t, s.Set("images:logo", []byte("png")))
+	_, err = os.Stat(path.Join(imagesFolder, "images:logo"))
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(folder, "images:logo"))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, s.Shutdown())
+
+	s, err = kvstore.New(options...)
+	require.NoError(t, err)
+	defer s.Close()
+	v, err := s.Get("images:logo")
+	require.NoError(t, err)
+	require.Equal(t, "png", string(v))
+
+	// Namespace persisters that don't report usage are left out of the store persister's usage.
+	unreported, err := kvstore.New(
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithNamespaceOption("images", kvstore.WithPersisterNamespaceOption(&countingPersister{DataPersister: persistence.NewFsPersistence(imagesFolder)})),
+	)
+	require.NoError(t, err)
+	defer unreported.Close()
+	usage := unreported.Stats().Persisters[0].Usage
+	require.NotNil(t, usage)
+	require.Greater(t, usage.Keys, 0)
+
+	_, err = kvstore.New(kvstore.WithNamespaceOption("images", kvstore.WithPersisterNamespaceOption(persistence.NewFsPersistence(imagesFolder))))
+	require.Error(t, err)
+}
+
+func TestNamespaceTTL(t *testing.T) {
+	const folder = "TestNamespaceTTL"
+	defer os.RemoveAll(folder)
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = now.Add(d)
+	}
+
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("tenant1:a", []byte("1")))
+	require.NoError(t, s.Set("tenant1:orders:b", []byte("2")))
+	require.NoError(t, s.Set("tenant2:a", []byte("3")))
+	require.NoError(t, s.SetNamespaceTTL("tenant1", time.Hour))
+	ttl, ok := s.NamespaceTTL("tenant1")
+	require.True(t, ok)
+	require.Equal(t, time.Hour, ttl)
+	_, ok = s.NamespaceTTL("tenant2")
+	require.False(t, ok)
+	require.Equal(t, kvstore.TTLType(3600), s.TTL("tenant1:a"))
+	require.Equal(t, kvstore.TTLNoExpirySet, s.TTL("tenant2:a"))
+	require.NoError(t, s.SetTTL("tenant1:orders:b", 60))
+	require.Equal(t, kvstore.TTLType(60), s.TTL("tenant1:orders:b"))
+
+	// Moving the deadline replaces the pending one.
+	require.NoError(t, s.SetNamespaceTTL("tenant1", 2*time.Hour))
+	advance(time.Hour)
+	_, err = s.Get("tenant1:a")
+	require.NoError(t, err)
+
+	advance(time.Hour)
+	_, ok = s.NamespaceTTL("tenant1")
+	require.False(t, ok)
+	_, err = s.Get("tenant1:a")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	_, err = s.Get("tenant1:orders:b")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	_, err = s.GetMetadata("tenant1:a")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	require.Equal(t, kvstore.TTLKeyNotExist, s.TTL("tenant1:a"))
+	v, err := s.Get("tenant2:a")
+	require.NoError(t, err)
+	require.Equal(t, "3", string(v))
+
+	// Keys written after the deadline are kept.
+	require.NoError(t, s.Set("tenant1:a", []byte("4")))
+	v, err = s.Get("tenant1:a")
+	require.NoError(t, err)
+	require.Equal(t, "4", string(v))
+
+	// A TTL of zero clears a pending deadline.
+	require.NoError(t, s.SetNamespaceTTL("tenant2", time.Minute))
+	require.NoError(t, s.SetNamespaceTTL("tenant2", 0))
+	advance(time.Hour)
+	_, err = s.Get("tenant2:a")
+	require.NoError(t, err)
+}
+
+func TestSetAt(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = now.Add(d)
+	}
+
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("config", []byte("v1")))
+	require.NoError(t, s.SetAt("config", []byte("v2"), now.Add(time.Hour)))
+	require.NoError(t, s.SetAt("config", []byte("v3"), now.Add(2*time.Hour)))
+	require.NoError(t, s.SetAt("embargoed", []byte("news"), now.Add(time.Hour), kvstore.WithTTLSetOption(time.Minute)))
+	require.Equal(t, []time.Time{now.Add(time.Hour), now.Add(2 * time.Hour)}, s.Scheduled("config"))
+
+	// Staged values are not visible before they are due.
+	time.Sleep(50 * time.Millisecond)
+	v, err := s.Get("config")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(v))
+	_, err = s.Get("embargoed")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	advance(time.Hour)
+	require.Eventually(t, func() bool {
+		v, err := s.Get("config")
+		return err == nil && string(v) == "v2"
+	}, time.Second, 10*time.Millisecond)
+	v, err = s.Get("embargoed")
+	require.NoError(t, err)
+	require.Equal(t, "news", string(v))
+	require.Equal(t, kvstore.TTLType(60), s.TTL("embargoed"))
+
+	// Cancelled writes are never made.
+	require.Equal(t, 1, s.CancelScheduled("config"))
+	require.Empty(t, s.Scheduled("config"))
+	advance(time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	v, err = s.Get("config")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(v))
+
+	// Without an eviction check, the scheduler makes the write when it is due.
+	s2, err := kvstore.New()
+	require.NoError(t, err)
+	defer s2.Close()
+	require.NoError(t, s2.SetAt("key", []byte("value"), time.Now().Add(20*time.Millisecond)))
+	require.Eventually(t, func() bool {
+		_, err := s2.Get("key")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSetAtDoesNotDelayEviction(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		return now
+	}
+
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("expiring", []byte("value"), kvstore.WithTTLSetOption(time.Minute)))
+	nowLock.Lock()
+	now = now.Add(2 * time.Minute)
+	nowLock.Unlock()
+
+	// Writes staged more often than the eviction frequency do not hold back the check.
+	require.Eventually(t, func() bool {
+		if err := s.SetAt("staged", []byte("value"), nowFunc().Add(24*time.Hour)); err != nil {
+			return false
+		}
+		keys, err := s.Keys()
+		return err == nil && len(keys) == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestDeleteAfter(t *testing.T) {
+	const folder = "TestDeleteAfter"
+	defer os.RemoveAll(folder)
+	options := []kvstore.StoreOption{kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder))}
+	s, err := kvstore.New(options...)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("upload", []byte("1")))
+	require.NoError(t, s.Set("kept", []byte("2")))
+	require.NoError(t, s.DeleteAfter("upload", 300*time.Millisecond))
+	require.NoError(t, s.DeleteAfter("kept", 300*time.Millisecond))
+	require.NoError(t, s.CancelDelete("kept"))
+	require.ErrorIs(t, s.DeleteAfter("missing", time.Second), kvstore.ErrNotFound)
+
+	// Overwriting the key keeps the scheduled deletion, which survives a restart.
+	require.NoError(t, s.Set("upload", []byte("3")))
+	info, err := s.GetMetadata("upload")
+	require.NoError(t, err)
+	require.False(t, info.DeleteAt.IsZero())
+	require.NoError(t, s.Shutdown())
+
+	s, err = kvstore.New(options...)
+	require.NoError(t, err)
+	defer s.Close()
+	v, err := s.Get("upload")
+	require.NoError(t, err)
+	require.Equal(t, "3", string(v))
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path.Join(folder, "upload"))
+		return os.IsNotExist(err)
+	}, 2*time.Second, 10*time.Millisecond)
+	_, err = s.Get("upload")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	_, err = s.Get("kept")
+	require.NoError(t, err)
+
+	// A duration of zero deletes the key now.
+	require.NoError(t, s.DeleteAfter("kept", 0))
+	_, err = s.Get("kept")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestPin(t *testing.T) {
+	const folder = "TestPin"
+	defer os.RemoveAll(folder)
+	options := []kvstore.StoreOption{
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 20*time.Millisecond),
+		kvstore.WithMemoryLimitOption(100),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+	}
+	s, err := kvstore.New(options...)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("hot", make([]byte, 80), kvstore.WithPinSetOption()))
+	require.NoError(t, s.Set("warm", make([]byte, 80)))
+	require.NoError(t, s.Set("cold", make([]byte, 10)))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory("hot"))
+	require.False(t, s.InMemory("warm"))
+	require.False(t, s.InMemory("cold"))
+
+	// Pin loads an unloaded value and keeps it in memory.
+	require.NoError(t, s.Pin("cold"))
+	require.True(t, s.InMemory("cold"))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory("cold"))
+	require.ErrorIs(t, s.Pin("missing"), kvstore.ErrNotFound)
+
+	require.NoError(t, s.Unpin("cold"))
+	time.Sleep(100 * time.Millisecond)
+	require.False(t, s.InMemory("cold"))
+	require.NoError(t, s.Shutdown())
+
+	// The pin is kept in the persisted metadata.
+	s, err = kvstore.New(options...)
+	require.NoError(t, err)
+	defer s.Close()
+	info, err := s.GetMetadata("hot")
+	require.NoError(t, err)
+	require.True(t, info.Pinned)
+	info, err = s.GetMetadata("cold")
+	require.NoError(t, err)
+	require.False(t, info.Pinned)
+}
+
+func TestPriority(t *testing.T) {
+	const folder = "TestPriority"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+		kvstore.WithMemoryLimitOption(100),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Low priority values are unloaded first, even if they were used more recently.
+	require.NoError(t, s.Set("high", make([]byte, 40), kvstore.WithPrioritySetOption(kvstore.PriorityHigh)))
+	require.NoError(t, s.Set("normal", make([]byte, 40)))
+	require.NoError(t, s.Set("low", make([]byte, 40), kvstore.WithPrioritySetOption(kvstore.PriorityLow)))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory("high"))
+	require.True(t, s.InMemory("normal"))
+	require.False(t, s.InMemory("low"))
+
+	require.NoError(t, s.SetPriority("normal", kvstore.PriorityHigh))
+	require.NoError(t, s.Set("normal2", make([]byte, 40)))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory("high"))
+	require.True(t, s.InMemory("normal"))
+	require.False(t, s.InMemory("normal2"))
+
+	info, err := s.GetMetadata("normal")
+	require.NoError(t, err)
+	require.Equal(t, kvstore.PriorityHigh, info.Priority)
+	require.ErrorIs(t, s.SetPriority("missing", kvstore.PriorityLow), kvstore.ErrNotFound)
+}
+
+func TestTopKeys(t *testing.T) {
+	const folder = "TestTopKeys"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("a", make([]byte, 10)))
+	require.NoError(t, s.Set("b", make([]byte, 30)))
+	require.NoError(t, s.Set("c", make([]byte, 20)))
+	for i := 0; i < 3; i++ {
+		_, err = s.Get("c")
+		require.NoError(t, err)
+	}
+	_, err = s.Get("a")
+	require.NoError(t, err)
+	_, err = s.GetMulti([]string{"a", "c"})
+	require.NoError(t, err)
+
+	top := s.TopKeys(2, kvstore.ByHits)
+	require.Len(t, top, 2)
+	require.Equal(t, "c", top[0].Key)
+	require.Equal(t, uint64(4), top[0].Hits)
+	require.Equal(t, "a", top[1].Key)
+	require.Equal(t, uint64(2), top[1].Hits)
+	require.False(t, top[0].LastAccess.IsZero())
+
+	top = s.TopKeys(10, kvstore.BySize)
+	require.Len(t, top, 3)
+	require.Equal(t, []string{"b", "c", "a"}, []string{top[0].Key, top[1].Key, top[2].Key})
+
+	// Sampled counts are scaled to estimate the total.
+	sampled, err := kvstore.New(kvstore.WithHitSamplingOption(10))
+	require.NoError(t, err)
+	defer sampled.Close()
+	require.NoError(t, sampled.Set("hot", []byte("1")))
+	for i := 0; i < 10000; i++ {
+		_, err = sampled.Get("hot")
+		require.NoError(t, err)
+	}
+	hits := sampled.TopKeys(1, kvstore.ByHits)[0].Hits
+	require.InDelta(t, 10000, float64(hits), 2000)
+	require.Zero(t, hits%10)
+}
+
+func TestMerge(t *testing.T) {
+	const folder = "TestMerge"
+	defer os.RemoveAll(folder)
+	now := time.Now()
+	older, newer := now.Add(-time.Hour), now.Add(time.Hour)
+
+	node2 := persistence.NewFsPersistence(path.Join(folder, "node2"))
+	require.NoError(t, node2.Write("only-node2", kvstore.NewValueItem([]byte("a"), now)))
+	require.NoError(t, node2.Write("stale", kvstore.NewValueItem([]byte("node2"), older)))
+	require.NoError(t, node2.Write("fresh", kvstore.NewValueItem([]byte("node2"), newer)))
+	expired := kvstore.NewValueItem([]byte("gone"), older)
+	expired.TTL = 60
+	expired.ExpiresAt = now.Add(-time.Minute)
+	require.NoError(t, node2.Write("expired", expired))
+
+	newStore := func(name string) *kvstore.Store {
+		s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(path.Join(folder, name))))
+		require.NoError(t, err)
+		require.NoError(t, s.Set("stale", []byte("local")))
+		require.NoError(t, s.Set("fresh", []byte("local")))
+		return s
+	}
+	get := func(s *kvstore.Store, key string) string {
+		v, err := s.Get(key)
+		require.NoError(t, err)
+		return string(v)
+	}
+
+	s := newStore("newest")
+	report, err := s.Merge(node2, kvstore.MergeKeepNewest)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Added)
+	require.Equal(t, 1, report.Replaced)
+	require.Equal(t, 2, report.Skipped)
+	require.Equal(t, "a", get(s, "only-node2"))
+	require.Equal(t, "local", get(s, "stale"))
+	require.Equal(t, "node2", get(s, "fresh"))
+	_, err = s.Get("expired")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	s = newStore("skip")
+	report, err = s.Merge(node2, kvstore.MergeSkipExisting)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Added)
+	require.Equal(t, 3, report.Skipped)
+	require.Equal(t, "local", get(s, "fresh"))
+
+	// Renamed keys are persisted, so they are read back after a restart.
+	s = newStore("rename")
+	require.NoError(t, s.Set("fresh#merged", []byte("taken")))
+	report, err = s.Merge(node2, kvstore.MergeRename)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"stale": "stale#merged", "fresh": "fresh#merged2"}, report.Renamed)
+	s, err = kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(path.Join(folder, "rename"))))
+	require.NoError(t, err)
+	require.Equal(t, "local", get(s, "stale"))
+	require.Equal(t, "node2", get(s, "stale#merged"))
+	require.Equal(t, "node2", get(s, "fresh#merged2"))
+	require.Equal(t, "taken", get(s, "fresh#merged"))
+
+	// Renamed keys keep the spelling they were first set with.
+	folded, err := kvstore.New(kvstore.WithCaseInsensitiveKeysOption())
+	require.NoError(t, err)
+	defer folded.Close()
+	require.NoError(t, folded.Set("Fresh", []byte("local")))
+	spelled := kvstore.NewValueItem([]byte("node2"), now)
+	spelled.Key = "Fresh"
+	spelledNode := persistence.NewFsPersistence(path.Join(folder, "spelled"))
+	require.NoError(t, spelledNode.Write("fresh", spelled))
+	_, err = folded.Merge(spelledNode, kvstore.MergeRename)
+	require.NoError(t, err)
+	keys, err := folded.Keys()
+	require.NoError(t, err)
+	sort.Strings(keys)
+	require.Equal(t, []string{"Fresh", "Fresh#merged"}, keys)
+
+	// With lazy metadata, every candidate name is resolved before one is chosen.
+	lazy, err := kvstore.New(kvstore.WithLazyMetadataOption(), kvstore.WithPersistenceOption(persistence.NewFsPersistence(path.Join(folder, "rename"))))
+	require.NoError(t, err)
+	defer lazy.Close()
+	report, err = lazy.Merge(node2, kvstore.MergeRename)
+	require.NoError(t, err)
+	require.Equal(t, "fresh#merged3", report.Renamed["fresh"])
+	require.Equal(t, "node2", get(lazy, "fresh#merged2"))
+}
+
+func TestRemovalHandler(t *testing.T) {
+	const folder = "TestRemovalHandler"
+	defer os.RemoveAll(folder)
+	now := time.Now()
+	var nowLock sync.Mutex
+	nowFunc := func() time.Time {
+		nowLock.Lock()
+		defer nowLock.Unlock()
+		now = now.Add(time.Millisecond)
+		return now
+	}
+	events := make(chan kvstore.RemovalEvent, 10)
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(nowFunc),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, 0),
+		kvstore.WithMemoryLimitOption(150),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithRemovalHandlerOption(func(e kvstore.RemovalEvent) { events <- e }),
+		kvstore.WithRemovalValuesOption(),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+	next := func() kvstore.RemovalEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "no removal event")
+			return kvstore.RemovalEvent{}
+		}
+	}
+
+	require.NoError(t, s.Set("a", []byte("first"), kvstore.WithMetaSetOption(map[string]string{"owner": "a"})))
+	require.NoError(t, s.Delete("a"))
+	e := next()
+	require.Equal(t, "a", e.Key)
+	require.Equal(t, kvstore.RemovalDeleted, e.Reason)
+	require.Equal(t, "first", string(e.Value))
+	require.Equal(t, map[string]string{"owner": "a"}, e.Info.Meta)
+
+	// Values unloaded to stay within the memory limit are reported as evicted.
+	require.NoError(t, s.Set("b", bytes.Repeat([]byte("b"), 100)))
+	require.NoError(t, s.Set("c", bytes.Repeat([]byte("c"), 100)))
+	e = next()
+	require.Equal(t, "b", e.Key)
+	require.Equal(t, kvstore.RemovalEvicted, e.Reason)
+	require.Equal(t, "evicted", e.Reason.String())
+	require.Len(t, e.Value, 100)
+
+	// Final values no longer in memory are read from the persister.
+	require.NoError(t, s.Delete("b"))
+	e = next()
+	require.Equal(t, kvstore.RemovalDeleted, e.Reason)
+	require.Equal(t, bytes.Repeat([]byte("b"), 100), e.Value)
+
+	require.NoError(t, s.Set("d", []byte("temporary"), kvstore.WithTTLSetOption(time.Minute)))
+	nowLock.Lock()
+	now = now.Add(2 * time.Minute)
+	nowLock.Unlock()
+	e = next()
+	require.Equal(t, "d", e.Key)
+	require.Equal(t, kvstore.RemovalExpired, e.Reason)
+	require.Equal(t, "temporary", string(e.Value))
+}
+
+// failingDeletes fails every delete, as a backend might while unavailable.
+type failingDeletes struct {
+	kvstore.DataPersister
+}
+
+func (failingDeletes) Delete(key string) error {
+	return errors.New("backend unavailable")
+}
+
+func TestRemovalEventsFollowPersisters(t *testing.T) {
+	const folder = "TestRemovalEventsFollowPersisters"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	expired := kvstore.NewValueItem([]byte("stale"), time.Now().Add(-time.Hour))
+	expired.TTL = 1
+	require.NoError(t, fs.Write("stale", expired))
+
+	events := make(chan kvstore.RemovalEvent, 10)
+	next := func() kvstore.RemovalEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(2 * time.Second):
+			require.FailNow(t, "no removal event")
+			return kvstore.RemovalEvent{}
+		}
+	}
+	s, err := kvstore.New(
+		kvstore.WithPersistenceOption(fs),
+		kvstore.WithPurgeExpiredOnStartOption(),
+		kvstore.WithRemovalHandlerOption(func(e kvstore.RemovalEvent) { events <- e }),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Keys purged on startup are reported as expired.
+	e := next()
+	require.Equal(t, "stale", e.Key)
+	require.Equal(t, kvstore.RemovalExpired, e.Reason)
+
+	// Keys deleted by another process are reported when the store drops them.
+	require.NoError(t, s.Set("shared", []byte("value")))
+	require.NoError(t, fs.Delete("shared"))
+	require.NoError(t, s.Reload("shared"))
+	e = next()
+	require.Equal(t, "shared", e.Key)
+	require.Equal(t, kvstore.RemovalDeleted, e.Reason)
+
+	// Deletes the persisters refused are not reported.
+	failing, err := kvstore.New(
+		kvstore.WithPersistenceOption(failingDeletes{fs}),
+		kvstore.WithEphemeralPrefixOption("tmp:"),
+		kvstore.WithRemovalHandlerOption(func(e kvstore.RemovalEvent) { events <- e }),
+	)
+	require.NoError(t, err)
+	defer failing.Close()
+	require.NoError(t, failing.Set("kept", []byte("value")))
+	require.Error(t, failing.Delete("kept"))
+	require.NoError(t, failing.Set("tmp:scratch", []byte("value")))
+	require.NoError(t, failing.Delete("tmp:scratch"))
+	require.Equal(t, "tmp:scratch", next().Key)
+}
+
+func TestShutdownFlush(t *testing.T) {
+	const folder = "TestShutdownFlush"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithShutdownFlushOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("k1", []byte("v1")))
+	require.NoError(t, s.Set("k2", []byte("v2")))
+	s.Close()
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	b, err := s2.Get("k2")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+}
+
+func TestShutdownFlushesBuffers(t *testing.T) {
+	const folder = "TestShutdownFlushesBuffers"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewPersistenceBuffer(persistence.NewFsPersistence(folder), 100)))
+	require.NoError(t, err)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, s.Set(fmt.Sprintf("key%d", i), []byte("value")))
+	}
+
+	require.NoError(t, s.Shutdown())
+
+	keys, err := persistence.NewFsPersistence(folder).Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 50)
+}
+
+func TestRuntimeUnloadSettings(t *testing.T) {
+	const key = "k1:108"
+	const folder = "TestRuntimeUnloadSettings"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set(key, []byte("data")))
+
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, s.InMemory(key))
+
+	s.SetUnloadAfter(50 * time.Millisecond)
+	s.SetEvictionFrequency(10 * time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	require.False(t, s.InMemory(key))
+
+	s.SetEvictionFrequency(0)
+	_, err = s.Get(key)
+	require.NoError(t, err)
+	time.Sleep(200 * time.Millisecond)
+	require.True(t, s.InMemory(key))
+}
+
+func TestConfigFileReload(t *testing.T) {
+	const configFile = "TestConfigFileReload.yaml"
+	defer os.Remove(configFile)
+	require.NoError(t, os.WriteFile(configFile, []byte("defaultTTL: 30s\n"), 0600))
+
+	s, err := kvstore.New(kvstore.WithConfigFileOption(configFile))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set("a", []byte("data")))
+	require.Equal(t, kvstore.TTLType(30), s.TTL("a"))
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.WriteFile(configFile, []byte(`{"defaultTTL": "2m"}`), 0600))
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(configFile, future, future))
+	time.Sleep(1500 * time.Millisecond)
+
+	require.NoError(t, s.Set("b", []byte("data")))
+	require.Equal(t, kvstore.TTLType(120), s.TTL("b"))
+
+	_, err = kvstore.New(kvstore.WithConfigFileOption("missing.yaml"))
+	require.Error(t, err)
+}
+
+func TestPersisterStats(t *testing.T) {
+	const folder = "TestPersisterStats"
+	const backupFolder = "TestPersisterStatsBackup"
+	defer func() {
+		os.RemoveAll(folder)
+		os.RemoveAll(backupFolder)
+	}()
+	s, err := kvstore.New(kvstore.WithPersistenceOption(
+		persistence.NewFsPersistence(folder),
+		persistence.NewFsPersistence(backupFolder),
+	))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+	require.NoError(t, s.Delete("a"))
+
+	stats := s.Stats()
+	require.Equal(t, 1, stats.Keys)
+	require.Equal(t, int64(1), stats.LoadedBytes)
+	require.Len(t, stats.Persisters, 2)
+	for _, ps := range stats.Persisters {
+		require.Equal(t, uint64(2), ps.Writes)
+		require.Equal(t, uint64(1), ps.Deletes)
+		require.Equal(t, uint64(0), ps.Errors)
+		require.Greater(t, ps.AverageLatency, time.Duration(0))
+		require.NotNil(t, ps.Usage)
+		require.Equal(t, 1, ps.Usage.Keys)
+		require.Greater(t, ps.Usage.Bytes, int64(0))
+	}
+
+	unreported, err := kvstore.New(kvstore.WithPersistenceOption(&countingPersister{DataPersister: persistence.NewFsPersistence(folder)}))
+	require.NoError(t, err)
+	require.Nil(t, unreported.Stats().Persisters[0].Usage)
+}
+
+// usageReporter counts the calls to Usage, failing them with err if it is set.
+type usageReporter struct {
+	kvstore.DataPersister
+	calls int
+	err   error
+}
+
+func (u *usageReporter) Usage() (kvstore.Usage, error) {
+	u.calls++
+	return kvstore.Usage{Keys: u.calls}, u.err
+}
+
+func TestStatsUsageCache(t *testing.T) {
+	const folder = "TestStatsUsageCache"
+	defer os.RemoveAll(folder)
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	reporter := &usageReporter{DataPersister: persistence.NewFsPersistence(folder)}
+	failing := &usageReporter{DataPersister: persistence.NewFsPersistence(folder), err: errors.New("backend unavailable")}
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(func() time.Time { return now }),
+		kvstore.WithPersistenceOption(reporter, failing),
+		kvstore.WithUsageCacheOption(time.Minute),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	stats := s.Stats()
+	require.Equal(t, 1, stats.Persisters[0].Usage.Keys)
+	require.Empty(t, stats.Persisters[0].UsageError)
+	require.Nil(t, stats.Persisters[1].Usage)
+	require.Equal(t, "backend unavailable", stats.Persisters[1].UsageError)
+
+	// Usage is reused until the cache expires.
+	now = now.Add(30 * time.Second)
+	require.Equal(t, 1, s.Stats().Persisters[0].Usage.Keys)
+	require.Equal(t, 1, reporter.calls)
+	now = now.Add(time.Minute)
+	require.Equal(t, 2, s.Stats().Persisters[0].Usage.Keys)
+}
+
+type failingReadPersister struct {
+	kvstore.DataPersister
+	fail atomic.Bool
+}
+
+func (f *failingReadPersister) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	if f.fail.Load() {
+		return nil, kvstore.ErrPersisterUnavailable
+	}
+	return f.DataPersister.Read(key, readValue)
+}
+
+func TestInvalidate(t *testing.T) {
+	const folder = "TestInvalidate"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	p := &failingReadPersister{DataPersister: fs}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Set("key", []byte("v1")))
+
+	// A transient error keeps the in-memory copy.
+	p.fail.Store(true)
+	s.Invalidate("key")
+	require.Error(t, s.Reload("key"))
+	b, err := s.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(b))
+
+	// A change written by another instance is picked up.
+	p.fail.Store(false)
+	require.NoError(t, fs.Write("key", kvstore.NewValueItem([]byte("v2"), time.Now())))
+	s.Invalidate("key")
+	b, err = s.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+
+	// A key deleted by another instance is removed.
+	require.NoError(t, fs.Delete("key"))
+	require.NoError(t, s.Reload("key"))
+	_, err = s.Get("key")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestReconcile(t *testing.T) {
+	const folder = "TestReconcile"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("lost", []byte("in memory")))
+	require.NoError(t, fs.Delete("lost"))
+	require.NoError(t, fs.Write("external", kvstore.NewValueItem([]byte("other process"), time.Now())))
+
+	report, err := s.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"lost"}, report.Repersisted)
+	require.Equal(t, []string{"external"}, report.Loaded)
+
+	_, err = fs.Read("lost", true)
+	require.NoError(t, err)
+	b, err := s.Get("external")
+	require.NoError(t, err)
+	require.Equal(t, "other process", string(b))
+}
+
+func TestFollowerRefresh(t *testing.T) {
+	const folder = "TestFollowerRefresh"
+	defer os.RemoveAll(folder)
+	writer, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer writer.Close()
+	require.NoError(t, writer.Set("changed", []byte("v1")))
+	require.NoError(t, writer.Set("removed", []byte("gone soon")))
+
+	follower, err := kvstore.New(
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithFollowOption(time.Hour),
+	)
+	require.NoError(t, err)
+	defer follower.Close()
+	b, err := follower.Get("changed")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(b))
+	require.ErrorIs(t, follower.Set("changed", []byte("local")), kvstore.ErrReadOnly)
+
+	require.NoError(t, writer.Set("changed", []byte("v2")))
+	require.NoError(t, writer.Set("added", []byte("new")))
+	require.NoError(t, writer.Delete("removed"))
+
+	report, err := follower.Refresh()
+	require.NoError(t, err)
+	require.Equal(t, []string{"added"}, report.Added)
+	require.Equal(t, []string{"changed"}, report.Updated)
+	require.Equal(t, []string{"removed"}, report.Removed)
+
+	b, err = follower.Get("changed")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+	b, err = follower.Get("added")
+	require.NoError(t, err)
+	require.Equal(t, "new", string(b))
+	_, err = follower.Get("removed")
+	require.Error(t, err)
+}
+
+type readCountingFs struct {
+	*persistence.Filesystem
+	reads atomic.Int32
+}
+
+func (r *readCountingFs) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	r.reads.Add(1)
+	return r.Filesystem.Read(key, readValue)
+}
+
+func TestFollowerRefreshReadsChangedKeys(t *testing.T) {
+	const folder = "TestFollowerRefreshReadsChangedKeys"
+	defer os.RemoveAll(folder)
+	writer, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer writer.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, writer.Set(k, []byte("v1")))
+	}
+	p := &readCountingFs{Filesystem: persistence.NewFsPersistence(folder)}
+	follower, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithFollowOption(time.Hour))
+	require.NoError(t, err)
+	defer follower.Close()
+
+	require.NoError(t, writer.Set("b", []byte("v2")))
+	// Date the unchanged keys before the follower started, beyond the overlap Refresh allows.
+	past := time.Now().Add(-time.Hour)
+	for _, k := range []string{"a", "c"} {
+		for _, f := range []string{"metadata.json", "data.bin"} {
+			require.NoError(t, os.Chtimes(path.Join(folder, k, f), past, past))
+		}
+	}
+
+	p.reads.Store(0)
+	report, err := follower.Refresh()
+	require.NoError(t, err)
+	require.Equal(t, []string{"b"}, report.Updated)
+	require.Equal(t, int32(1), p.reads.Load())
+	b, err := follower.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(b))
+}
+
+func TestKeyNormalization(t *testing.T) {
+	const folder = "TestKeyNormalization"
+	defer os.RemoveAll(folder)
+	const composed, decomposed = "caf\u00e9", "cafe\u0301"
+
+	s, err := kvstore.New(
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithKeyNormalizationOption(false),
+	)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(decomposed, []byte("latte")))
+	b, err := s.Get(composed)
+	require.NoError(t, err)
+	require.Equal(t, "latte", string(b))
+	require.NoError(t, s.Set(composed, []byte("mocha")))
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{decomposed}, keys)
+	_, err = persistence.NewFsPersistence(folder).Read(composed, true)
+	require.NoError(t, err)
+
+	values, err := s.GetMulti([]string{decomposed})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{decomposed: []byte("mocha")}, values)
+	_, err = s.Get("CAF\u00c9")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	folded, err := kvstore.New(kvstore.WithKeyNormalizationOption(true))
+	require.NoError(t, err)
+	require.NoError(t, folded.Set("Stra\u00dfe", []byte("street")))
+	b, err = folded.Get("STRASSE")
+	require.NoError(t, err)
+	require.Equal(t, "street", string(b))
+	counts, err := folded.Counters(map[string]int64{"Hits": 1, "hits": 2})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"Hits": 3, "hits": 3}, counts)
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	const folder = "TestCaseInsensitiveKeys"
+	defer os.RemoveAll(folder)
+
+	s, err := kvstore.New(
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithCaseInsensitiveKeysOption(),
+	)
+	require.NoError(t, err)
+	require.NoError(t, s.Set("User:Alice", []byte("1")))
+	require.NoError(t, s.Set("USER:ALICE", []byte("2")))
+	b, err := s.Get("user:alice")
+	require.NoError(t, err)
+	require.Equal(t, "2", string(b))
+
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"User:Alice"}, keys)
+	queried, err := s.QueryKeys(time.Time{}, time.Now(), kvstore.WithPrefixQueryOption("USER:"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"User:Alice"}, queried)
+	require.Equal(t, "User:Alice", s.TopKeys(1, kvstore.ByHits)[0].Key)
+
+	_, err = persistence.NewFsPersistence(folder).Read("user:alice", false)
+	require.NoError(t, err)
+	reopened, err := kvstore.New(
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+		kvstore.WithCaseInsensitiveKeysOption(),
+	)
+	require.NoError(t, err)
+	keys, err = reopened.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"User:Alice"}, keys)
+
+	// A key first set in lower case is listed in lower case, whatever case later writes use.
+	require.NoError(t, reopened.Set("user:bob", []byte("1")))
+	require.NoError(t, reopened.Set("User:Bob", []byte("2")))
+	keys, err = reopened.Keys()
+	require.NoError(t, err)
+	sort.Strings(keys)
+	require.Equal(t, []string{"User:Alice", "user:bob"}, keys)
+}
+
+func TestMaxKeyLength(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithMaxKeyLengthOption(8))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("12345678", []byte("fits")))
+	require.ErrorIs(t, s.Set("123456789", []byte("too long")), kvstore.ErrKeyTooLong)
+	require.ErrorIs(t, s.Set("123456789", []byte("too long")), kvstore.ErrKeyInvalid)
+	_, err = s.Get("123456789")
+	require.ErrorIs(t, err, kvstore.ErrKeyTooLong)
+	_, err = s.Counter("counter:123", 1)
+	require.ErrorIs(t, err, kvstore.ErrKeyTooLong)
+	require.ErrorIs(t, s.Set("bad key", []byte("x")), kvstore.ErrKeyInvalid)
+}
+
+func TestCounterFlush(t *testing.T) {
+	const folder = "TestCounterFlush"
+	defer os.RemoveAll(folder)
+
+	p := &countingPersister{DataPersister: persistence.NewFsPersistence(folder)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithCounterFlushOption(time.Hour, 10))
+	require.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		_, err := s.Counter("hits", 1)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 0, p.writes)
+	_, err = s.Counter("hits", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, p.writes)
+
+	_, err = s.Counter("hits", 3)
+	require.NoError(t, err)
+	require.Equal(t, 1, p.writes)
+	require.NoError(t, s.CheckpointCounters())
+	require.Equal(t, 2, p.writes)
+	require.NoError(t, s.CheckpointCounters())
+	require.Equal(t, 2, p.writes)
+
+	_, err = s.Counter("hits", 1)
+	require.NoError(t, err)
+	s.Close()
+	item, err := p.Read("hits", true)
+	require.NoError(t, err)
+	require.Equal(t, "14", string(item.Data))
+}
+
+func TestEphemeralPrefix(t *testing.T) {
+	const folder = "TestEphemeralPrefix"
+	defer os.RemoveAll(folder)
+
+	p := &countingPersister{DataPersister: persistence.NewFsPersistence(folder)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithEphemeralPrefixOption("tmp:"))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("tmp:scratch", []byte("scratch")))
+	_, err = s.Counter("tmp:count", 1)
+	require.NoError(t, err)
+	require.Equal(t, 0, p.writes)
+	require.NoError(t, s.Set("durable", []byte("kept")))
+	require.Equal(t, 1, p.writes)
+
+	b, err := s.Get("tmp:scratch")
+	require.NoError(t, err)
+	require.Equal(t, "scratch", string(b))
+	keys, err := p.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"durable"}, keys)
+
+	report, err := s.Reconcile()
+	require.NoError(t, err)
+	require.Empty(t, report.Repersisted)
+	require.NoError(t, s.Delete("tmp:scratch"))
+	_, err = s.Get("tmp:scratch")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestPurgeExpiredOnStart(t *testing.T) {
+	const folder = "TestPurgeExpiredOnStart"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	expired := kvstore.NewValueItem([]byte("old"), time.Now().Add(-time.Hour))
+	expired.TTL = 60
+	require.NoError(t, fs.Write("expired", expired))
+	require.NoError(t, fs.Write("live", kvstore.NewValueItem([]byte("new"), time.Now())))
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs), kvstore.WithPurgeExpiredOnStartOption())
+	require.NoError(t, err)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"live"}, keys)
+	keys, err = fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"live"}, keys)
+}
+
+func TestLazyMetadata(t *testing.T) {
+	const folder = "TestLazyMetadata"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	expired := kvstore.NewValueItem([]byte("old"), time.Now().Add(-time.Hour))
+	expired.TTL = 60
+	require.NoError(t, fs.Write("expired", expired))
+	live := kvstore.NewValueItem([]byte("new"), time.Now())
+	live.TTL = 3600
+	live.Version = 41
+	require.NoError(t, fs.Write("live", live))
+	require.NoError(t, fs.Write("other", kvstore.NewValueItem([]byte("other"), time.Now())))
+
+	p := &countingPersister{DataPersister: fs}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithLazyMetadataOption())
+	require.NoError(t, err)
+	defer s.Close()
+	require.Zero(t, p.reads)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"expired", "live", "other"}, keys)
+
+	// Metadata is read on first use.
+	require.Greater(t, s.TTL("live"), kvstore.TTLType(3500))
+	require.Equal(t, 1, p.reads)
+	_, err = s.Get("expired")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	// Versions continue from the persisted version of the key.
+	require.NoError(t, s.Set("live", []byte("newer")))
+	info, err := s.GetMetadata("live")
+	require.NoError(t, err)
+	require.Equal(t, "2a", info.ETag)
+
+	v, err := s.Get("other")
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), v)
+}
+
+func TestStartupProgress(t *testing.T) {
+	const folder = "TestStartupProgress"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	for i := 0; i < 2500; i++ {
+		require.NoError(t, fs.Write(fmt.Sprintf("key%d", i), kvstore.NewValueItem([]byte("value"), time.Now())))
+	}
+
+	var lock sync.Mutex
+	progress := make([]int, 0)
+	s, err := kvstore.New(
+		kvstore.WithPersistenceOption(fs),
+		kvstore.WithBackgroundStartupOption(),
+		kvstore.WithStartupProgressOption(func(loaded, total int) {
+			lock.Lock()
+			defer lock.Unlock()
+			require.Equal(t, 2500, total)
+			progress = append(progress, loaded)
+		}),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(10 * time.Second):
+		t.Fatal("store did not become ready")
+	}
+	lock.Lock()
+	require.Equal(t, []int{0, 1000, 2000, 2500}, progress)
+	lock.Unlock()
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2500)
+
+	// Without background startup the store is ready when New returns.
+	s2, err := kvstore.New()
+	require.NoError(t, err)
+	defer s2.Close()
+	select {
+	case <-s2.Ready():
+	default:
+		t.Fatal("store is not ready")
+	}
+}
+
+// gatedPersister holds back reads until its gate is closed.
+type gatedPersister struct {
+	kvstore.DataPersister
+	gate chan struct{}
+}
+
+func (g *gatedPersister) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	<-g.gate
+	return g.DataPersister.Read(key, readValue)
+}
+
+func TestBackgroundStartupKeepsChanges(t *testing.T) {
+	const folder = "TestBackgroundStartupKeepsChanges"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	for _, k := range []string{"written", "deleted", "expired"} {
+		require.NoError(t, fs.Write(k, kvstore.NewValueItem([]byte("persisted"), time.Now())))
+	}
+	expired := kvstore.NewValueItem([]byte("persisted"), time.Now().Add(-time.Hour))
+	expired.TTL = 1
+	require.NoError(t, fs.Write("expired", expired))
+
+	gated := &gatedPersister{DataPersister: fs, gate: make(chan struct{})}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(gated), kvstore.WithBackgroundStartupOption())
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("written", []byte("new")))
+	require.NoError(t, s.Set("deleted", []byte("new")))
+	require.NoError(t, s.Delete("deleted"))
+	require.NoError(t, s.Set("expired", []byte("new")))
+	close(gated.gate)
+	<-s.Ready()
+
+	v, err := s.Get("written")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), v)
+	_, err = s.Get("deleted")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	v, err = s.Get("expired")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), v)
+	stored, err := fs.Read("expired", true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), stored.Data)
+}
+
+func TestEarlyExpiration(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithEarlyExpirationOption(1))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("cheap", []byte("1"), kvstore.WithTTLSetOption(time.Minute), kvstore.WithRecomputeCostSetOption(time.Nanosecond)))
+	require.NoError(t, s.Set("costly", []byte("2"), kvstore.WithTTLSetOption(time.Minute), kvstore.WithRecomputeCostSetOption(time.Hour)))
+	require.NoError(t, s.Set("unknown", []byte("3"), kvstore.WithTTLSetOption(time.Minute)))
+
+	earlyMisses := 0
+	for i := 0; i < 50; i++ {
+		_, err := s.Get("cheap")
+		require.NoError(t, err)
+		_, err = s.Get("unknown")
+		require.NoError(t, err)
+		if _, err := s.Get("costly"); err == kvstore.ErrNotFound {
+			earlyMisses++
+		}
+	}
+	require.Greater(t, earlyMisses, 0)
+
+	// GetOrSet reloads a key reported as expired early.
+	loads := 0
+	for i := 0; i < 50; i++ {
+		_, err := s.GetOrSet("costly", time.Minute, func() ([]byte, error) {
+			loads++
+			return []byte("reloaded"), nil
+		})
+		require.NoError(t, err)
+		if loads > 0 {
+			break
+		}
+	}
+	require.Equal(t, 1, loads)
+}
+
+func TestTTLJitter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(func() time.Time { return now }),
+		kvstore.WithDefaultTTLOption(time.Hour),
+		kvstore.WithTTLJitterOption(0.1),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	expiries := make(map[time.Time]struct{})
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		require.NoError(t, s.Set(key, []byte("value")))
+		info, err := s.GetMetadata(key)
+		require.NoError(t, err)
+		require.False(t, info.ExpiresAt.Before(now.Add(54*time.Minute)), info.ExpiresAt)
+		require.False(t, info.ExpiresAt.After(now.Add(66*time.Minute)), info.ExpiresAt)
+		expiries[info.ExpiresAt] = struct{}{}
+	}
+	require.Greater(t, len(expiries), 1)
+
+	// SetTTL is jittered as well.
+	require.NoError(t, s.SetTTL("key0", 100))
+	ttl := s.TTL("key0")
+	require.GreaterOrEqual(t, ttl, kvstore.TTLType(90))
+	require.LessOrEqual(t, ttl, kvstore.TTLType(110))
+}
+
+func TestExportChangedSince(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("old", []byte("1")))
+	since := now
+	now = now.Add(time.Minute)
+	require.NoError(t, s.Set("new", []byte("2"), kvstore.WithContentTypeSetOption("text/plain")))
+
+	var buf bytes.Buffer
+	require.NoError(t, s.ExportChangedSince(since, &buf))
+
+	var record kvstore.ExportRecord
+	dec := json.NewDecoder(&buf)
+	require.NoError(t, dec.Decode(&record))
+	require.Equal(t, "new", record.Key)
+	require.Equal(t, "2", string(record.Data))
+	require.Equal(t, "text/plain", record.Item.ContentType)
+	require.False(t, dec.More())
+}
+
+func TestImportConflictPolicies(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	source, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, source.Set("a", []byte("exported")))
+	var export bytes.Buffer
+	require.NoError(t, source.ExportChangedSince(time.Time{}, &export))
+
+	importWith := func(policy kvstore.ConflictPolicy, existingTs time.Time) (string, error) {
+		target, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return existingTs }))
+		require.NoError(t, err)
+		require.NoError(t, target.Set("a", []byte("live")))
+		if err := target.Import(bytes.NewReader(export.Bytes()), policy); err != nil {
+			return "", err
+		}
+		b, err := target.Get("a")
+		require.NoError(t, err)
+		return string(b), nil
+	}
+
+	v, err := importWith(kvstore.ConflictOverwrite, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, "exported", v)
+
+	v, err = importWith(kvstore.ConflictSkipExisting, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, "live", v)
+
+	v, err = importWith(kvstore.ConflictKeepNewest, now.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, "exported", v)
+
+	v, err = importWith(kvstore.ConflictKeepNewest, now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, "live", v)
+
+	_, err = importWith(kvstore.ConflictFail, now)
+	require.ErrorIs(t, err, kvstore.ErrImportConflict)
+}
+
+func TestACL(t *testing.T) {
+	acl := kvstore.NewACL()
+	acl.Grant("alice", "tenant1", kvstore.PermAdmin)
+	acl.Grant("auditor", kvstore.AllNamespaces, kvstore.PermRead)
+	s, err := kvstore.New(kvstore.WithACLOption(acl))
+	require.NoError(t, err)
+
+	alice := s.As("alice")
+	require.NoError(t, alice.Set("tenant1:doc", []byte("a")))
+	require.ErrorIs(t, alice.Set("tenant2:doc", []byte("b")), kvstore.ErrPermissionDenied)
+
+	bob := s.As("bob")
+	_, err = bob.Get("tenant1:doc")
+	require.ErrorIs(t, err, kvstore.ErrPermissionDenied)
+	require.NoError(t, alice.Grant("bob", "tenant1", kvstore.PermRead))
+	b, err := bob.Get("tenant1:doc")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(b))
+	require.ErrorIs(t, bob.Delete("tenant1:doc"), kvstore.ErrPermissionDenied)
+	require.ErrorIs(t, bob.Grant("bob", "tenant1", kvstore.PermWrite), kvstore.ErrPermissionDenied)
+
+	require.NoError(t, s.Set("tenant2:doc", []byte("b")))
+	keys, err := s.As("auditor").Keys()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"tenant1:doc", "tenant2:doc"}, keys)
+	keys, err = bob.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant1:doc"}, keys)
+}
+
+func TestACLBulkAndTransactions(t *testing.T) {
+	acl := kvstore.NewACL()
+	acl.Grant("alice", "tenant1", kvstore.PermWrite)
+	acl.Grant("alice", "tenant2", kvstore.PermRead)
+	s, err := kvstore.New(kvstore.WithACLOption(acl))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("tenant1:a", []byte("a")))
+	require.NoError(t, s.Set("tenant2:b", []byte("b")))
+	alice := s.As("alice")
+
+	require.NoError(t, alice.Patch("tenant1:a", 1, []byte("z")))
+	require.ErrorIs(t, alice.Patch("tenant2:b", 0, []byte("z")), kvstore.ErrPermissionDenied)
+
+	tx := alice.Watch("tenant2:b")
+	tx.Set("tenant1:a", []byte("tx"))
+	tx.Delete("tenant2:b")
+	require.ErrorIs(t, tx.Exec(), kvstore.ErrPermissionDenied)
+	b, err := s.Get("tenant1:a")
+	require.NoError(t, err)
+	require.Equal(t, "az", string(b))
+	tx = alice.Watch("tenant2:b")
+	tx.Set("tenant1:a", []byte("tx"))
+	require.NoError(t, tx.Exec())
+
+	var export bytes.Buffer
+	require.NoError(t, s.ExportChangedSince(time.Time{}, &export))
+	require.ErrorIs(t, alice.Import(bytes.NewReader(export.Bytes()), kvstore.ConflictOverwrite), kvstore.ErrPermissionDenied)
+	_, err = alice.Merge(persistence.NewFsPersistence("TestACLBulkAndTransactions"), kvstore.MergeKeepNewest)
+	require.ErrorIs(t, err, kvstore.ErrPermissionDenied)
+
+	deleted, err := alice.DeleteWhere(nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"tenant2:b"}, keys)
+}
+
+func TestInsights(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("small", []byte("a")))
+	require.NoError(t, s.Set("large", []byte("abcdef")))
+	require.NoError(t, s.Set("medium", []byte("abc")))
+	require.NoError(t, s.SetTTL("medium", 30))
+	require.NoError(t, s.SetTTL("small", 3600))
+
+	require.Equal(t, []kvstore.KeySize{{Key: "large", Size: 6}, {Key: "medium", Size: 3}}, s.LargestKeys(2))
+	require.Equal(t, []kvstore.KeyExpiry{{Key: "medium", ExpiresAt: now.Add(30 * time.Second)}}, s.ExpiringKeys(10, time.Minute))
+
+	_, err = s.Get("large")
+	require.NoError(t, err)
+	_, err = s.Get("missing")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	stats := s.Stats()
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, uint64(1), stats.Misses)
+	require.Equal(t, int64(10), stats.TotalBytes)
+}
+
+func TestEstimate(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("old", []byte("0123456789")))
+	now = now.Add(2 * time.Hour)
+	require.NoError(t, s.Set("new1", []byte("abcd")))
+	require.NoError(t, s.Set("new2", []byte("abcdef")))
+
+	estimate := s.Estimate(time.Hour)
+	require.Equal(t, 3, estimate.Keys)
+	require.Equal(t, int64(20), estimate.TotalBytes)
+	require.Equal(t, int64(20), estimate.LoadedBytes)
+	require.Equal(t, int64(6), estimate.AverageValueSize)
+	require.Greater(t, estimate.ProjectedBytes, estimate.TotalBytes)
+	require.Equal(t, 2, estimate.NewKeys)
+	require.Equal(t, int64(10), estimate.NewBytes)
+	require.InDelta(t, 2.0/3600, estimate.KeysPerSecond, 1e-9)
+	require.InDelta(t, 10.0/3600, estimate.BytesPerSecond, 1e-9)
+}
+
+func TestArena(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithArenaOption(0))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, s.Set("key", []byte(fmt.Sprintf("value%d", i))))
+		require.NoError(t, s.Set(fmt.Sprintf("other%d", i%10), []byte(fmt.Sprintf("other%d", i))))
+	}
+	v, err := s.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "value999", string(v))
+
+	// Values are copied out, so changing one does not change the store.
+	v[0] = 'X'
+	v, err = s.Get("key")
+	require.NoError(t, err)
+	require.Equal(t, "value999", string(v))
+
+	// Overwritten values are recycled rather than taking new space.
+	require.Equal(t, int64(kvstore.DefaultArenaSlabSize), s.Stats().ArenaBytes)
+
+	require.NoError(t, s.Delete("key"))
+	require.NoError(t, s.Set("new", []byte("reused")))
+	values, err := s.GetMulti([]string{"new", "other9"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"new": []byte("reused"), "other9": []byte("other999")}, values)
+}
+
+type recordingPersister struct {
+	kvstore.DataPersister
+	written []*kvstore.ValueItem
+}
+
+func (r *recordingPersister) Write(key string, data *kvstore.ValueItem) error {
+	r.written = append(r.written, data)
+	return r.DataPersister.Write(key, data)
+}
+
+func TestArenaPersistedCopies(t *testing.T) {
+	const testFolder = "TestArenaPersistedCopies"
+	defer os.RemoveAll(testFolder)
+
+	p := &recordingPersister{DataPersister: persistence.NewFsPersistence(testFolder)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithArenaOption(0))
+	require.NoError(t, err)
+	defer s.Close()
+
+	// The region freed by the delete is reused by the next Set, so a persister still holding the
+	// first write, as an async buffer would, must have been given its own copy.
+	require.NoError(t, s.Set("a", []byte("first")))
+	require.NoError(t, s.Delete("a"))
+	require.NoError(t, s.Set("b", []byte("other")))
+	require.Equal(t, "first", string(p.written[0].Data))
+}
+
+func TestReadView(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithReadViewOption())
+	require.NoError(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key%d-%d", i, j)
+				require.NoError(t, s.Set(key, []byte(key)))
+				v, err := s.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, key, string(v))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	require.NoError(t, s.Delete("key0-0"))
+	_, err = s.Get("key0-0")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	require.NoError(t, s.Set("key0-0", []byte("again")))
+	v, err := s.Get("key0-0")
+	require.NoError(t, err)
+	require.Equal(t, "again", string(v))
+}
+
+func TestSnapshotView(t *testing.T) {
+	const folder = "TestSnapshotView"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+	s.Close()
+
+	// The reopened store has not loaded the values, so the snapshot must preserve them.
+	s, err = kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)), kvstore.WithArenaOption(0))
+	require.NoError(t, err)
+	defer s.Close()
+	snapshot := s.SnapshotView()
+	require.NoError(t, s.Set("a", []byte("changed")))
+	require.NoError(t, s.Delete("b"))
+	require.NoError(t, s.Set("c", []byte("3")))
+	require.NoError(t, s.SetTTL("a", 60))
+
+	require.Equal(t, []string{"a", "b"}, snapshot.Keys())
+	for key, want := range map[string]string{"a": "1", "b": "2"} {
+		v, err := snapshot.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, want, string(v))
+	}
+	_, err = snapshot.Get("c")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	info, err := snapshot.Metadata("a")
+	require.NoError(t, err)
+	require.Equal(t, kvstore.TTLNoExpirySet, info.TTL)
+
+	// Values held in the arena are kept until the snapshot is closed.
+	require.NoError(t, s.Set("d", []byte("before")))
+	arenaSnapshot := s.SnapshotView()
+	require.NoError(t, s.Set("d", []byte("after")))
+	require.NoError(t, s.Set("e", []byte("reuse")))
+	v, err := arenaSnapshot.Get("d")
+	require.NoError(t, err)
+	require.Equal(t, "before", string(v))
+
+	v, err = s.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(v))
+
+	snapshot.Close()
+	arenaSnapshot.Close()
+	_, err = snapshot.Get("a")
+	require.ErrorIs(t, err, kvstore.ErrSnapshotClosed)
+}
+
+func TestRange(t *testing.T) {
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("sessions:1", []byte("0123456789"), kvstore.WithMetaSetOption(map[string]string{"tenant": "acme"})))
+	require.NoError(t, s.Set("sessions:2", []byte("01"), kvstore.WithMetaSetOption(map[string]string{"tenant": "acme"}), kvstore.WithTTLSetOption(time.Minute)))
+	require.NoError(t, s.Set("sessions:3", []byte("0123456789"), kvstore.WithTTLSetOption(time.Hour)))
+	require.NoError(t, s.Set("users:1", []byte("0123456789")))
+
+	visit := func(options ...kvstore.RangeOption) []string {
+		keys := make([]string, 0)
+		s.Range(func(key string, meta kvstore.ItemInfo) bool {
+			keys = append(keys, key)
+			return true
+		}, options...)
+		sort.Strings(keys)
+		return keys
+	}
+	require.Equal(t, []string{"sessions:1", "sessions:2", "sessions:3", "users:1"}, visit())
+	require.Equal(t, []string{"sessions:1", "sessions:2", "sessions:3"}, visit(kvstore.WithPrefixRangeOption("sessions:")))
+	require.Equal(t, []string{"sessions:1", "sessions:2"}, visit(kvstore.WithTagRangeOption("tenant", "acme")))
+	require.Equal(t, []string{"sessions:1", "sessions:3"}, visit(kvstore.WithPrefixRangeOption("sessions:"), kvstore.WithMinSizeRangeOption(5)))
+	require.Equal(t, []string{"sessions:2"}, visit(kvstore.WithExpiringBeforeRangeOption(now.Add(10*time.Minute))))
+
+	visited := 0
+	s.Range(func(key string, meta kvstore.ItemInfo) bool {
+		visited++
+		return false
+	})
+	require.Equal(t, 1, visited)
+}
+
+func TestBulkWhere(t *testing.T) {
+	const folder = "TestBulkWhere"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for i := 0; i < 1200; i++ {
+		tier := "free"
+		if i%2 == 0 {
+			tier = "paid"
+		}
+		require.NoError(t, s.Set(fmt.Sprintf("user:%d", i), []byte("data"), kvstore.WithMetaSetOption(map[string]string{"tier": tier})))
+	}
+	require.NoError(t, s.Set("other", []byte("data"), kvstore.WithMetaSetOption(map[string]string{"tier": "free"})))
+
+	deleted, err := s.DeleteWhere(nil, kvstore.WithPrefixRangeOption("user:"), kvstore.WithTagRangeOption("tier", "free"))
+	require.NoError(t, err)
+	require.Equal(t, 600, deleted)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 601)
+	persisted, err := fs.Keys()
+	require.NoError(t, err)
+	require.Len(t, persisted, 601)
+
+	changed, err := s.SetTTLWhere(func(key string, meta kvstore.ItemInfo) bool {
+		return strings.HasSuffix(key, "0")
+	}, 60, kvstore.WithPrefixRangeOption("user:"))
+	require.NoError(t, err)
+	require.Equal(t, 120, changed)
+	require.Equal(t, kvstore.TTLType(60), s.TTL("user:10"))
+	require.Equal(t, kvstore.TTLNoExpirySet, s.TTL("user:12"))
+	item, err := fs.Read("user:10", false)
+	require.NoError(t, err)
+	require.Equal(t, kvstore.TTLType(60), item.TTL)
+}
+
+func TestStoreGroup(t *testing.T) {
+	const folder = "TestStoreGroup"
+	defer os.RemoveAll(folder)
+	group := kvstore.NewStoreGroup(
+		kvstore.WithPersisterGroupOption(persistence.FsPersisterFactory(folder)),
+		kvstore.WithStoreOptionsGroupOption(kvstore.WithDefaultTTLOption(time.Hour)),
+	)
+
+	acme, err := group.Open("acme")
+	require.NoError(t, err)
+	globex, err := group.Open("globex")
+	require.NoError(t, err)
+	again, err := group.Open("acme")
+	require.NoError(t, err)
+	require.Same(t, acme, again)
+	_, err = group.Open("../escape")
+	require.ErrorIs(t, err, kvstore.ErrStoreName)
+
+	require.NoError(t, acme.Set("a", []byte("1")))
+	require.NoError(t, acme.Set("b", []byte("2")))
+	require.NoError(t, globex.Set("a", []byte("3")))
+	require.Equal(t, []string{"acme", "globex"}, group.Names())
+	require.Greater(t, acme.TTL("a"), kvstore.TTLType(0))
+
+	stats := group.Stats()
+	require.Equal(t, 3, stats.Total.Keys)
+	require.Equal(t, 2, stats.Stores["acme"].Keys)
+	_, err = os.Stat(path.Join(folder, "globex", "a"))
+	require.NoError(t, err)
+
+	require.NoError(t, group.Close())
+	_, err = group.Open("acme")
+	require.ErrorIs(t, err, kvstore.ErrGroupClosed)
+
+	// The stores' data is kept in their subfolders.
+	group = kvstore.NewStoreGroup(kvstore.WithPersisterGroupOption(persistence.FsPersisterFactory(folder)))
+	defer group.Close()
+	acme, err = group.Open("acme")
+	require.NoError(t, err)
+	v, err := acme.Get("b")
+	require.NoError(t, err)
+	require.Equal(t, "2", string(v))
+}
+
+func TestExpvar(t *testing.T) {
+	s, err := kvstore.New(kvstore.WithExpvarOption("TestExpvar"))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+
+	var stats kvstore.Stats
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("TestExpvar").String()), &stats))
+	require.Equal(t, 1, stats.Keys)
+
+	_, err = kvstore.New(kvstore.WithExpvarOption("TestExpvar"))
+	require.Error(t, err)
+
+	s.Close()
+	require.Equal(t, "null", expvar.Get("TestExpvar").String())
+
+	s2, err := kvstore.New(kvstore.WithExpvarOption("TestExpvar"))
+	require.NoError(t, err)
+	defer s2.Close()
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("TestExpvar").String()), &stats))
+	require.Equal(t, 0, stats.Keys)
+
+	// Names the program published itself are reported rather than panicking.
+	expvar.NewInt("TestExpvarTaken")
+	_, err = kvstore.New(kvstore.WithExpvarOption("TestExpvarTaken"))
+	require.Error(t, err)
+}
+
+func TestDebugReport(t *testing.T) {
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, s.Set("sessions:1", []byte("0123456789")))
+	require.NoError(t, s.Set("sessions:2", []byte("0123456789")))
+	require.NoError(t, s.Set("users:1", []byte("abc")))
+	require.NoError(t, s.Set("plain", []byte("a")))
+
+	var buf bytes.Buffer
+	require.NoError(t, s.DebugReport(&buf))
+	lines := strings.Split(buf.String(), "\n")
+	require.Equal(t, []string{"sessions", "2", "2", "20", "20"}, strings.Fields(lines[1]))
+	require.Equal(t, []string{"users", "1", "1", "3", "3"}, strings.Fields(lines[2]))
+	require.Equal(t, []string{"(none)", "1", "1", "1", "1"}, strings.Fields(lines[3]))
+	require.Contains(t, buf.String(), "sessions:1")
+}
+
+func TestTypedStore(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	users := kvstore.Typed[user](s, nil)
+
+	require.NoError(t, users.Set("user:1", user{Name: "John", Age: 42}))
+	u, err := users.Get("user:1")
+	require.NoError(t, err)
+	require.Equal(t, user{Name: "John", Age: 42}, u)
+
+	_, err = users.Get("user:2")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	require.NoError(t, s.Set("user:3", []byte("not json")))
+	_, err = users.Get("user:3")
+	require.Error(t, err)
+}
+
+func TestJSONPath(t *testing.T) {
+	s, err := kvstore.New()
+	require.NoError(t, err)
+	require.NoError(t, s.Set("doc", []byte(`{"user":{"name":"John","tags":["a","b"]},"count":12345678901234567890}`),
+		kvstore.WithContentTypeSetOption("application/json")))
+
+	b, err := s.GetPath("doc", "$.user.name")
+	require.NoError(t, err)
+	require.Equal(t, `"John"`, string(b))
+	b, err = s.GetPath("doc", `$["user"].tags[1]`)
+	require.NoError(t, err)
+	require.Equal(t, `"b"`, string(b))
+	_, err = s.GetPath("doc", "$.user.age")
+	require.ErrorIs(t, err, kvstore.ErrPathNotFound)
+	_, err = s.GetPath("doc", "user")
+	require.ErrorIs(t, err, kvstore.ErrInvalidPath)
+
+	require.NoError(t, s.SetPath("doc", "$.user.name", []byte(`"Jane"`)))
+	require.NoError(t, s.SetPath("doc", "$.user.address.city", []byte(`"Leeds"`)))
+	require.NoError(t, s.SetPath("doc", "$.user.tags[0]", []byte(`"z"`)))
+	require.ErrorIs(t, s.SetPath("doc", "$.user.tags[5]", []byte(`"z"`)), kvstore.ErrPathNotFound)
+
+	b, err = s.Get("doc")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"user":{"name":"Jane","tags":["z","b"],"address":{"city":"Leeds"}},"count":12345678901234567890}`, string(b))
+	info, err := s.GetMetadata("doc")
+	require.NoError(t, err)
+	require.Equal(t, "application/json", info.ContentType)
+
+	require.NoError(t, s.Set("text", []byte("not json")))
+	_, err = s.GetPath("text", "$.a")
+	require.ErrorIs(t, err, kvstore.ErrWrongType)
+}
+
+// recordingBroadcaster records the keys a store broadcasts.
+type recordingBroadcaster struct {
+	lock sync.Mutex
+	keys []string
+}
+
+func (b *recordingBroadcaster) Broadcast(key string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.keys = append(b.keys, key)
+}
+
+func (b *recordingBroadcaster) Subscribe(func(key string)) {}
+
+func TestPatch(t *testing.T) {
+	const folder = "TestPatch"
+	defer os.RemoveAll(folder)
+	broadcasts := &recordingBroadcaster{}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)), kvstore.WithBroadcasterOption(broadcasts))
+	require.NoError(t, err)
+
+	require.NoError(t, s.Set("record", []byte("aaaa")))
+	require.NoError(t, s.Patch("record", 1, []byte("bb")))
+	require.NoError(t, s.Patch("record", 6, []byte("c")))
+	require.NoError(t, s.Patch("new", 2, []byte("x")))
+	b, err := s.Get("record")
+	require.NoError(t, err)
+	require.Equal(t, []byte("abba\x00\x00c"), b)
+	// Patches are announced to peers like any other write.
+	require.Equal(t, []string{"record", "record", "record", "new"}, broadcasts.keys)
+
+	report, err := persistence.Check(folder, persistence.CheckOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	b, err = s2.Get("record")
+	require.NoError(t, err)
+	require.Equal(t, []byte("abba\x00\x00c"), b)
+	b, err = s2.Get("new")
+	require.NoError(t, err)
+	require.Equal(t, []byte("\x00\x00x"), b)
+}
+
+func TestLog(t *testing.T) {
+	const folder = "TestLog"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+
+	for i, e := range []string{"created", "paid", "shipped"} {
+		seq, err := s.LogAppend("order:1", []byte(e))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i+1), seq)
+	}
+
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	entries, err := s2.LogRange("order:1", 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, []kvstore.LogEntry{{Seq: 2, Data: []byte("paid")}, {Seq: 3, Data: []byte("shipped")}}, entries)
+	entries, err = s2.LogRange("order:1", 4, 5)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, s2.Set("plain", []byte("x")))
+	_, err = s2.LogAppend("plain", []byte("y"))
+	require.ErrorIs(t, err, kvstore.ErrWrongType)
+}
+
+func TestLogCorruptCount(t *testing.T) {
+	const folder = "TestLogCorruptCount"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	// A count of 2^63 entries followed by no data.
+	item := kvstore.NewValueItem([]byte{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}, time.Now())
+	item.Type = kvstore.LogValue
+	require.NoError(t, fs.Write("order:1", item))
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	defer s.Close()
+	_, err = s.LogRange("order:1", 1, 10)
+	require.ErrorIs(t, err, kvstore.ErrCorruptLog)
+}
+
+type batchCountingPersister struct {
+	*persistence.Filesystem
+	batches int
+}
+
+func (b *batchCountingPersister) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	b.batches++
+	return b.Filesystem.ReadMulti(keys, readValue)
+}
+
+func TestGetMultiBatchRead(t *testing.T) {
+	const folder = "TestGetMultiBatchRead"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("1")))
+	require.NoError(t, s.Set("b", []byte("2")))
+	require.NoError(t, s.Set("c", []byte("3")))
+
+	p := &batchCountingPersister{Filesystem: persistence.NewFsPersistence(folder)}
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(p))
+	require.NoError(t, err)
+	require.Equal(t, 1, p.batches)
+	require.False(t, s2.InMemory("a"))
+
+	values, err := s2.GetMulti([]string{"a", "b", "missing"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("1"), "b": []byte("2")}, values)
+	require.Equal(t, 2, p.batches)
+	require.True(t, s2.InMemory("a"))
+	require.False(t, s2.InMemory("c"))
+}
+
+func TestGetMultiReadErrors(t *testing.T) {
+	const folder = "TestGetMultiReadErrors"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	require.NoError(t, fs.Write("a", kvstore.NewValueItem([]byte("1"), time.Now())))
+	require.NoError(t, fs.Write("b", kvstore.NewValueItem([]byte("2"), time.Now())))
+
+	failing := &failingReadPersister{DataPersister: fs}
+	counted := &countingPersister{DataPersister: failing}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(counted), kvstore.WithNegativeCacheOption(time.Minute))
+	require.NoError(t, err)
+	defer s.Close()
+	require.False(t, s.InMemory("a"))
+
+	failing.fail.Store(true)
+	_, err = s.GetMulti([]string{"a", "b"})
+	require.ErrorIs(t, err, kvstore.ErrPersisterUnavailable)
+	failing.fail.Store(false)
+
+	// A key removed behind the store is omitted and not read again while its miss is cached.
+	require.NoError(t, fs.Delete("b"))
+	values, err := s.GetMulti([]string{"a", "b"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("1")}, values)
+	reads := counted.reads
+	values, err = s.GetMulti([]string{"a", "b"})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"a": []byte("1")}, values)
+	require.Equal(t, reads, counted.reads)
+}
+
+type concurrentReadPersister struct {
+	kvstore.DataPersister
+	inFlight    int32
+	maxInFlight int32
+}
+
+func (c *concurrentReadPersister) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	n := atomic.AddInt32(&c.inFlight, 1)
+	defer atomic.AddInt32(&c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&c.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return c.DataPersister.Read(key, readValue)
+}
+
+func TestLoadParallelism(t *testing.T) {
+	const folder = "TestLoadParallelism"
+	defer os.RemoveAll(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	keys := make([]string, 0)
+	for i := 0; i < 8; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+		require.NoError(t, s.Set(keys[i], []byte(fmt.Sprint(i))))
+	}
+	require.NoError(t, s.Shutdown())
+
+	p := &concurrentReadPersister{DataPersister: persistence.NewFsPersistence(folder)}
+	s, err = kvstore.New(kvstore.WithPersistenceOption(p), kvstore.WithLoadParallelismOption(4))
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, int32(4), atomic.LoadInt32(&p.maxInFlight))
+	require.False(t, s.InMemory("key0"))
+
+	atomic.StoreInt32(&p.maxInFlight, 0)
+	values, err := s.GetMulti(keys)
+	require.NoError(t, err)
+	require.Len(t, values, 8)
+	require.Equal(t, "7", string(values["key7"]))
+	require.Equal(t, int32(4), atomic.LoadInt32(&p.maxInFlight))
+}
+
+type slowPersister struct {
+	kvstore.DataPersisterV2
+}
+
+func (s slowPersister) Write(ctx context.Context, key string, data *kvstore.ValueItem) error {
+	select {
+	case <-time.After(time.Second):
+		return s.DataPersisterV2.Write(ctx, key, data)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestDataPersisterV2Timeout(t *testing.T) {
+	const folder = "TestDataPersisterV2Timeout"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	require.Equal(t, kvstore.DataPersister(fs), kvstore.AdaptV2(kvstore.AdaptV1(fs), time.Second))
+
+	slow := slowPersister{DataPersisterV2: kvstore.AdaptV1(fs)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(kvstore.AdaptV2(slow, 10*time.Millisecond)))
+	require.NoError(t, err)
+	require.ErrorIs(t, s.Set("a", []byte("1")), context.DeadlineExceeded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, kvstore.AdaptV1(fs).Write(ctx, "a", kvstore.NewValueItem([]byte("1"), time.Now())), context.Canceled)
+}
+
+type batchingPersisterV2 struct {
+	kvstore.DataPersisterV2
+	batches int32
+}
+
+func (b *batchingPersisterV2) WriteMulti(ctx context.Context, items map[string]*kvstore.ValueItem) error {
+	atomic.AddInt32(&b.batches, 1)
+	for k, mv := range items {
+		if err := b.DataPersisterV2.Write(ctx, k, mv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestDataPersisterV2Forwarding(t *testing.T) {
+	const folder = "TestDataPersisterV2Forwarding"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+
+	batching := &batchingPersisterV2{DataPersisterV2: kvstore.AdaptV1(fs)}
+	s, err := kvstore.New(kvstore.WithPersistenceOption(kvstore.AdaptV2(batching, time.Second)))
+	require.NoError(t, err)
+	_, err = s.Counters(map[string]int64{"a": 1, "b": 2})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&batching.batches))
+	mv, err := fs.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, "2", string(mv.Data))
+
+	_, ok := kvstore.AdaptV1(fs).(kvstore.BatchWriterV2)
+	require.True(t, ok)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err = kvstore.New(kvstore.WithPersistenceOption(kvstore.AdaptV2Context(ctx, kvstore.AdaptV1(fs), 0)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("c", []byte("3")))
+	cancel()
+	require.ErrorIs(t, s.Set("c", []byte("4")), context.Canceled)
+}
+
+func TestErrorTaxonomy(t *testing.T) {
+	const folder = "TestErrorTaxonomy"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+
+	_, err = s.Counter("hits", 0)
+	require.NoError(t, err)
+	require.NoError(t, s.SetCounterLimits("hits", 0, 1))
+	_, err = s.Counter("hits", 2)
+	require.ErrorIs(t, err, kvstore.ErrCounterMaxReached)
+	_, err = s.Counter("hits", -1)
+	require.ErrorIs(t, err, kvstore.ErrCounterMinReached)
+
+	require.NoError(t, s.Set("doc", []byte("value")))
+	require.NoError(t, os.WriteFile(path.Join(folder, "doc", "metadata.json"), []byte("{"), 0600))
+	_, err = fs.Read("doc", false)
+	require.ErrorIs(t, err, kvstore.ErrCorrupted)
+	require.ErrorIs(t, kvstore.ErrCorruptTimeSeries, kvstore.ErrCorrupted)
+	s.Close()
+
+	ro, err := kvstore.New(kvstore.WithReadOnlyOption())
+	require.NoError(t, err)
+	defer ro.Close()
+	require.ErrorIs(t, ro.Set("doc", []byte("value")), kvstore.ErrReadOnly)
+	require.ErrorIs(t, ro.Delete("doc"), kvstore.ErrReadOnly)
+	_, err = ro.Counter("hits", 1)
+	require.ErrorIs(t, err, kvstore.ErrReadOnly)
+}
+
+func TestExpiresAt(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }), kvstore.WithRefreshTTLOnSetOption(false))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("session", []byte("a")))
+	require.Equal(t, kvstore.TTLNoExpirySet, s.TTL("session"))
+	require.NoError(t, s.SetTTL("session", 60))
+	info, err := s.GetMetadata("session")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute), info.ExpiresAt)
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, s.Set("session", []byte("b")))
+	require.Equal(t, kvstore.TTLType(30), s.TTL("session"))
+
+	require.NoError(t, s.Set("session", []byte("c"), kvstore.WithRefreshTTLSetOption(true)))
+	require.Equal(t, kvstore.TTLType(60), s.TTL("session"))
+
+	now = now.Add(61 * time.Second)
+	_, err = s.Get("session")
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestTouchModes(t *testing.T) {
+	const folder = "TestTouchModes"
+	defer os.RemoveAll(folder)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var offset atomic.Int64
+	clock := func() time.Time { return start.Add(time.Duration(offset.Load())) }
+
+	s, err := kvstore.New(
+		kvstore.WithNowFuncOption(clock),
+		kvstore.WithTouchModeOption(kvstore.TouchAccess),
+		kvstore.WithUnloadFrequencyOption(10*time.Millisecond, time.Minute),
+		kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("a", []byte("data")))
+	require.NoError(t, s.SetTTL("a", 120))
+	offset.Store(int64(50 * time.Second))
+	require.NoError(t, s.Touch("a"))
+	require.Equal(t, kvstore.TTLType(70), s.TTL("a"))
+	keys, err := s.QueryKeys(start, start)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, keys)
+
+	offset.Store(int64(100 * time.Second))
+	time.Sleep(50 * time.Millisecond)
+	require.True(t, s.InMemory("a"))
+	offset.Store(int64(111 * time.Second))
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, s.InMemory("a"))
+
+	e, err := kvstore.New(kvstore.WithNowFuncOption(clock), kvstore.WithTouchModeOption(kvstore.TouchExpiry))
+	require.NoError(t, err)
+	defer e.Close()
+	require.NoError(t, e.Set("b", []byte("data")))
+	require.NoError(t, e.SetTTL("b", 60))
+	offset.Store(int64(141 * time.Second))
+	require.NoError(t, e.Touch("b"))
+	require.Equal(t, kvstore.TTLType(60), e.TTL("b"))
+}
+
+func TestItemTimestamps(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.Set("a", []byte("1")))
+	now = start.Add(time.Minute)
+	require.NoError(t, s.Set("a", []byte("2")))
+	now = start.Add(2 * time.Minute)
+	_, err = s.Get("a")
+	require.NoError(t, err)
+
+	info, err := s.GetMetadata("a")
+	require.NoError(t, err)
+	require.True(t, info.CreatedAt.Equal(start))
+	require.True(t, info.UpdatedAt.Equal(start.Add(time.Minute)))
+	require.True(t, info.AccessedAt.Equal(start.Add(2*time.Minute)))
+
+	keys, err := s.QueryKeys(start, start)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, keys)
+	keys, err = s.QueryKeys(start.Add(time.Second), now)
+	require.NoError(t, err)
+	require.Empty(t, keys)
+}
+
+func TestQueryKeysOptions(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	defer s.Close()
+
+	for _, k := range []string{"invoices:1", "invoices:2", "users:1"} {
+		require.NoError(t, s.Set(k, []byte("data")))
+	}
+	now = start.Add(time.Hour)
+	require.NoError(t, s.Set("invoices:2", []byte("paid")))
+	require.NoError(t, s.Set("users:1", []byte("renamed")))
+	now = start.Add(2 * time.Hour)
+	_, err = s.Get("invoices:1")
+	require.NoError(t, err)
+
+	invoices := kvstore.WithPrefixQueryOption("invoices:")
+	keys, err := s.QueryKeys(start.Add(time.Minute), now, invoices, kvstore.WithTimeFieldQueryOption(kvstore.UpdatedTime))
+	require.NoError(t, err)
+	require.Equal(t, []string{"invoices:2"}, keys)
+
+	keys, err = s.QueryKeys(start.Add(time.Minute), now, invoices, kvstore.WithTimeFieldQueryOption(kvstore.AccessedTime))
+	require.NoError(t, err)
+	require.Equal(t, []string{"invoices:1", "invoices:2"}, keys)
+
+	keys, err = s.QueryKeys(start, start, invoices)
+	require.NoError(t, err)
+	require.Equal(t, []string{"invoices:1", "invoices:2"}, keys)
+}
+
+func TestSetNX(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time { return now }))
+	require.NoError(t, err)
+	defer s.Close()
+
+	ok, err := s.SetNX("lock", []byte("a"), kvstore.WithTTLSetOption(10*time.Second))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s.SetNX("lock", []byte("b"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	now = now.Add(11 * time.Second)
+	ok, err = s.SetNX("lock", []byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, kvstore.TTLNoExpirySet, s.TTL("lock"))
+}
@@ -0,0 +1,166 @@
+package kvstore
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrCorruptTimeSeries returned when the stored encoding of a time series cannot be decoded.
+var ErrCorruptTimeSeries error = errors.Wrap(ErrCorrupted, "time series encoding")
+
+// TSPoint is a single timestamped sample in a time series.
+type TSPoint struct {
+	T     time.Time
+	Value float64
+}
+
+// TSAdd adds a point to the time series stored under key, creating the series if it does not exist.
+// Points are kept in time order; adding a point with an existing timestamp replaces its value.
+func (kv *Store) TSAdd(key string, t time.Time, value float64) error {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	points, err := kv.timeSeries(key)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(points), func(i int) bool { return !points[i].T.Before(t) })
+	if i < len(points) && points[i].T.Equal(t) {
+		points[i].Value = value
+	} else {
+		points = append(points, TSPoint{})
+		copy(points[i+1:], points[i:])
+		points[i] = TSPoint{T: t, Value: value}
+	}
+
+	if err := kv.setTypedData(key, encodeTimeSeries(points), TimeSeriesValue); err != nil {
+		return errors.Wrap(err, "Store.TSAdd kv.setTypedData")
+	}
+	return nil
+}
+
+// TSRange returns the points of the time series stored under key whose timestamps fall
+// between from and to inclusive, in time order.
+func (kv *Store) TSRange(key string, from, to time.Time) ([]TSPoint, error) {
+	key = kv.canonicalKey(key)
+	if err := kv.useKey(key); err != nil {
+		return nil, err
+	}
+
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+
+	mv, err := kv.loadedItem(key)
+	if err != nil {
+		return nil, err
+	}
+	if mv.Type != TimeSeriesValue {
+		return nil, ErrWrongType
+	}
+	points, err := decodeTimeSeries(mv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	start := sort.Search(len(points), func(i int) bool { return !points[i].T.Before(from) })
+	end := sort.Search(len(points), func(i int) bool { return points[i].T.After(to) })
+	if start >= end {
+		return []TSPoint{}, nil
+	}
+	return points[start:end], nil
+}
+
+// timeSeries returns the decoded points stored under key, or an empty series if the key does not exist.
+// The caller must hold the write lock.
+func (kv *Store) timeSeries(key string) ([]TSPoint, error) {
+	mv, err := kv.loadedItem(key)
+	if errors.Is(err, ErrNotFound) {
+		return []TSPoint{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if mv.Type != TimeSeriesValue {
+		return nil, ErrWrongType
+	}
+	return decodeTimeSeries(mv.Data)
+}
+
+// encodeTimeSeries compresses time-ordered points. Timestamps are stored as deltas from the
+// previous point and values as the XOR of their bits with the previous value, bit-reversed so
+// that slowly changing series encode to short varints.
+func encodeTimeSeries(points []TSPoint) []byte {
+	buf := make([]byte, 0, binary.MaxVarintLen64*(1+2*len(points)))
+	buf = binary.AppendUvarint(buf, uint64(len(points)))
+
+	var prevT int64
+	var prevV uint64
+	for i, p := range points {
+		t := p.T.UnixNano()
+		v := math.Float64bits(p.Value)
+		if i == 0 {
+			buf = binary.AppendVarint(buf, t)
+		} else {
+			buf = binary.AppendUvarint(buf, uint64(t-prevT))
+		}
+		buf = binary.AppendUvarint(buf, bits.Reverse64(v^prevV))
+		prevT, prevV = t, v
+	}
+	return buf
+}
+
+// decodeTimeSeries reverses encodeTimeSeries.
+func decodeTimeSeries(data []byte) ([]TSPoint, error) {
+	if len(data) == 0 {
+		return []TSPoint{}, nil
+	}
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, ErrCorruptTimeSeries
+	}
+	data = data[n:]
+	// Every point takes at least two bytes, so a larger count is corrupt and must not size the slice.
+	if count > uint64(len(data)) {
+		return nil, ErrCorruptTimeSeries
+	}
+
+	points := make([]TSPoint, 0, count)
+	var prevT int64
+	var prevV uint64
+	for i := uint64(0); i < count; i++ {
+		var t int64
+		if i == 0 {
+			t, n = binary.Varint(data)
+		} else {
+			var delta uint64
+			delta, n = binary.Uvarint(data)
+			t = prevT + int64(delta)
+		}
+		if n <= 0 {
+			return nil, ErrCorruptTimeSeries
+		}
+		data = data[n:]
+
+		x, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, ErrCorruptTimeSeries
+		}
+		data = data[n:]
+
+		v := bits.Reverse64(x) ^ prevV
+		points = append(points, TSPoint{T: time.Unix(0, t), Value: math.Float64frombits(v)})
+		prevT, prevV = t, v
+	}
+	return points, nil
+}
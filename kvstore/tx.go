@@ -0,0 +1,142 @@
+package kvstore
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrTxConflict returned by Tx.Exec when a watched key was modified after it was watched.
+var ErrTxConflict error = errors.New("transaction aborted: watched key modified")
+
+// Tx is an optimistic transaction, modelled on Redis WATCH/MULTI/EXEC.
+// Commands are queued on the Tx and only applied when Exec is called, and then only
+// if none of the watched keys have been written, deleted or expired in the meantime.
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	store    *Store
+	watched  map[string]uint64
+	commands []func() error
+	written  []string                             // Keys the queued commands change, for check.
+	check    func(key string, p Permission) error // Set by ScopedStore.Watch to check the caller's permissions.
+}
+
+// Watch starts a transaction that watches the given keys for modification.
+func (kv *Store) Watch(keys ...string) *Tx {
+	tx := &Tx{
+		store:   kv,
+		watched: make(map[string]uint64),
+	}
+	tx.Watch(keys...)
+	return tx
+}
+
+// Watch adds keys to the set of keys watched by the transaction.
+func (tx *Tx) Watch(keys ...string) {
+	keys = tx.store.canonicalKeys(keys)
+	tx.store.resolveKeys(keys...)
+	tx.store.lock.RLock()
+	defer tx.store.lock.RUnlock()
+	for _, k := range keys {
+		tx.watched[k] = tx.store.currentVersion(k)
+	}
+}
+
+// Set queues a Set command.
+func (tx *Tx) Set(key string, value []byte, options ...SetOption) {
+	key, options = tx.store.canonicalSetKey(key, options)
+	tx.store.resolveKeys(key)
+	tx.written = append(tx.written, key)
+	tx.commands = append(tx.commands, func() error {
+		if err := tx.store.checkKey(key); err != nil {
+			return err
+		}
+		return tx.store.setData(key, value, options...)
+	})
+}
+
+// Delete queues a Delete command.
+func (tx *Tx) Delete(key string) {
+	key = tx.store.canonicalKey(key)
+	tx.written = append(tx.written, key)
+	tx.commands = append(tx.commands, func() error {
+		if err := tx.store.checkWritable(); err != nil {
+			return err
+		}
+		return tx.store.delete(key, RemovalDeleted)
+	})
+}
+
+// SetTTL queues a SetTTL command.
+func (tx *Tx) SetTTL(key string, ttl int64) {
+	key = tx.store.canonicalKey(key)
+	tx.store.resolveKeys(key)
+	tx.written = append(tx.written, key)
+	tx.commands = append(tx.commands, func() error {
+		if err := tx.store.checkKey(key); err != nil {
+			return err
+		}
+		return tx.store.setTTL(key, TTLType(ttl))
+	})
+}
+
+// Discard drops all queued commands and watched keys.
+func (tx *Tx) Discard() {
+	tx.commands = nil
+	tx.written = nil
+	tx.watched = make(map[string]uint64)
+}
+
+// Exec atomically applies the queued commands if no watched key has changed,
+// otherwise it returns ErrTxConflict and nothing is applied.
+// As with Redis, a failing command does not roll back the others; the first error is returned.
+func (tx *Tx) Exec() error {
+	defer tx.Discard()
+
+	if err := tx.checkPermissions(); err != nil {
+		return errors.Wrap(err, "Tx.Exec")
+	}
+	tx.store.lock.Lock()
+	defer tx.store.lock.Unlock()
+
+	for k, v := range tx.watched {
+		if tx.store.currentVersion(k) != v {
+			return ErrTxConflict
+		}
+	}
+
+	var returnError error
+	for _, cmd := range tx.commands {
+		if err := cmd(); err != nil && returnError == nil {
+			returnError = errors.Wrap(err, "Tx.Exec")
+		}
+	}
+	return returnError
+}
+
+// checkPermissions checks that a transaction started by ScopedStore.Watch may read the keys it
+// watches and write the keys it changes, before any command is applied.
+func (tx *Tx) checkPermissions() error {
+	if tx.check == nil {
+		return nil
+	}
+	for k := range tx.watched {
+		if err := tx.check(k, PermRead); err != nil {
+			return err
+		}
+	}
+	for _, k := range tx.written {
+		if err := tx.check(k, PermWrite); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentVersion returns the version of a key, or 0 if it does not exist or has expired.
+// The caller must hold the store lock.
+func (kv *Store) currentVersion(key string) uint64 {
+	mv, ok := kv.data[key]
+	if !ok || kv.expired(key, mv, kv.nowFunc()) {
+		return 0
+	}
+	return mv.Version
+}
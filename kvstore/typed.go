@@ -0,0 +1,50 @@
+package kvstore
+
+import "github.com/pkg/errors"
+
+// TypedStore gives typed access to values of type T held in a Store, encoding them with a Codec.
+type TypedStore[T any] struct {
+	store *Store
+	codec Codec
+}
+
+// Typed returns a TypedStore for values of type T in s. A nil codec uses JSONCodec.
+//
+// Example:
+//
+//	users := kvstore.Typed[User](store, nil)
+//	err := users.Set("user:42", User{Name: "John"})
+//	user, err := users.Get("user:42")
+func Typed[T any](s *Store, codec Codec) *TypedStore[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &TypedStore[T]{store: s, codec: codec}
+}
+
+// Get retrieves and decodes the value of a key.
+func (ts *TypedStore[T]) Get(key string) (T, error) {
+	var v T
+	data, err := ts.store.Get(key)
+	if err != nil {
+		return v, err
+	}
+	if err := ts.codec.Unmarshal(data, &v); err != nil {
+		return v, errors.Wrap(err, "TypedStore.Get Unmarshal")
+	}
+	return v, nil
+}
+
+// Set encodes and stores the value of a key.
+func (ts *TypedStore[T]) Set(key string, v T, options ...SetOption) error {
+	data, err := ts.codec.Marshal(v)
+	if err != nil {
+		return errors.Wrap(err, "TypedStore.Set Marshal")
+	}
+	return ts.store.Set(key, data, options...)
+}
+
+// Delete removes a key.
+func (ts *TypedStore[T]) Delete(key string) error {
+	return ts.store.Delete(key)
+}
@@ -1,7 +1,12 @@
 package kvstore
 
 import (
+	"strings"
 	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Prepopulated map for valid special runes.
@@ -30,3 +35,68 @@ func KeyValid(key string) bool {
 func isValidRune(r rune) bool {
 	return unicode.IsLetter(r) || unicode.IsDigit(r) || validRunesMap[r]
 }
+
+// CanonicalKey returns key in NFC form, so that composed and decomposed spellings of the same
+// text are the same key. If caseFold is true the key is also case folded.
+func CanonicalKey(key string, caseFold bool) string {
+	if caseFold {
+		key = cases.Fold().String(key)
+	}
+	return norm.NFC.String(key)
+}
+
+// checkKey returns ErrKeyInvalid if key contains invalid characters, or ErrKeyTooLong if it is
+// longer than the store's maximum key length.
+func (kv *Store) checkKey(key string) error {
+	if !KeyValid(key) {
+		return ErrKeyInvalid
+	}
+	if kv.maxKeyLength > 0 && len(key) > kv.maxKeyLength {
+		return errors.Wrapf(ErrKeyTooLong, "%d bytes exceeds the maximum of %d", len(key), kv.maxKeyLength)
+	}
+	return nil
+}
+
+// canonicalizing reports whether keys are changed before they are used.
+func (kv *Store) canonicalizing() bool {
+	return kv.normalizeKeys || kv.lowerKeys
+}
+
+// canonicalKey returns the form of key used in memory and by the persisters.
+// Keys are unchanged unless WithKeyNormalizationOption or WithCaseInsensitiveKeysOption was used.
+func (kv *Store) canonicalKey(key string) string {
+	if kv.normalizeKeys {
+		key = CanonicalKey(key, kv.foldKeys)
+	}
+	if kv.lowerKeys {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// canonicalSetKey returns the canonical form of a key being set. When keys are canonicalized it adds
+// a SetOption that records the key as given the first time it is set, even if it is already in
+// canonical form, so that it is listed as it was first set whatever spelling later writes use.
+func (kv *Store) canonicalSetKey(key string, options []SetOption) (string, []SetOption) {
+	canonical := kv.canonicalKey(key)
+	if !kv.canonicalizing() {
+		return canonical, options
+	}
+	return canonical, append(options[:len(options):len(options)], func(item *ValueItem) {
+		if item.Key == "" {
+			item.Key = key
+		}
+	})
+}
+
+// canonicalKeys returns the canonical form of each key.
+func (kv *Store) canonicalKeys(keys []string) []string {
+	if !kv.canonicalizing() {
+		return keys
+	}
+	canonical := make([]string, len(keys))
+	for i, k := range keys {
+		canonical[i] = kv.canonicalKey(k)
+	}
+	return canonical
+}
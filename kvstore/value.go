@@ -7,20 +7,82 @@ import (
 )
 
 // CounterConstraints holds the current integer value of a counter, bounded by Min and Max.
+// Window counters also record the length and start of the window they are counting.
 type CounterConstraints struct {
-	Min int64 `json:"min"`
-	Max int64 `json:"max"`
+	Min         int64         `json:"min"`
+	Max         int64         `json:"max"`
+	Window      time.Duration `json:"window,omitempty"`
+	WindowStart time.Time     `json:"windowStart"`
 }
 
+// ValueType identifies how the data of a ValueItem is encoded.
+type ValueType int
+
+// Value types supported by the store.
+const (
+	RawValue        ValueType = iota // Plain bytes written by Set.
+	TimeSeriesValue                  // Time-ordered points written by TSAdd.
+	GeoValue                         // Geohash-encoded members written by GeoAdd.
+	BloomValue                       // Bloom filter written by BFReserve and BFAdd.
+	LogValue                         // Append-only log written by LogAppend.
+)
+
 // ValueItem represents the value associated with a key.
 // The data can be in a loaded or unloaded state, which indicates whether it's in memory.
 // Unloaded data will be reloaded when accessed.
+// Ts is the time of the last write; CreatedAt and AccessedAt record when the key was first written and last read.
+// Key holds the key as it was first set when the store canonicalizes keys and the spelling differed.
+// Envelope is reserved for persisters that wrap others, such as the ID of the key that encrypted the
+// value; the store never sets it and it is kept apart from Meta so it cannot clash with user metadata.
 type ValueItem struct {
-	Data       []byte              `json:"-"`
-	Counter    *CounterConstraints `json:"counterConstraints,omitempty"`
-	Ts         time.Time           `json:"timestamp"`
-	TTL        TTLType             `json:"ttl"`
-	dataLoaded bool                `json:"-"`
+	Data          []byte              `json:"-"`
+	Key           string              `json:"key,omitempty"`
+	Type          ValueType           `json:"type,omitempty"`
+	Counter       *CounterConstraints `json:"counterConstraints,omitempty"`
+	ContentType   string              `json:"contentType,omitempty"`
+	Meta          map[string]string   `json:"meta,omitempty"`
+	Envelope      map[string]string   `json:"envelope,omitempty"`
+	Version       uint64              `json:"version,omitempty"`
+	DependsOn     []string            `json:"dependsOn,omitempty"`
+	Size          int64               `json:"size,omitempty"`
+	Ts            time.Time           `json:"timestamp"`
+	CreatedAt     time.Time           `json:"createdAt"`
+	AccessedAt    time.Time           `json:"accessedAt"`
+	TTL           TTLType             `json:"ttl"`
+	ExpiresAt     time.Time           `json:"expiresAt"`
+	DeleteAt      time.Time           `json:"deleteAt"`
+	NoCompression bool                `json:"noCompression,omitempty"`
+	RecomputeCost time.Duration       `json:"recomputeCost,omitempty"`
+	Pinned        bool                `json:"pinned,omitempty"`
+	Priority      Priority            `json:"priority,omitempty"`
+	dataLoaded    bool                `json:"-"`
+	dirty         bool                `json:"-"`
+	metaPending   bool                `json:"-"`
+	inArena       bool                `json:"-"`
+	pendingDelta  int64               `json:"-"`
+	lastAccess    int64               `json:"-"`
+	hitCount      uint64              `json:"-"`
+	refreshTTL    *bool               `json:"-"`
+	touched       time.Time           `json:"-"`
+}
+
+// ItemInfo describes the metadata held for a key, without its value.
+// Ts is the time of the last write, the same as UpdatedAt.
+type ItemInfo struct {
+	ContentType string
+	Meta        map[string]string
+	ETag        string
+	Size        int64
+	Ts          time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	AccessedAt  time.Time
+	TTL         TTLType
+	ExpiresAt   time.Time
+	DeleteAt    time.Time
+	Pinned      bool
+	Priority    Priority
+	Loaded      bool
 }
 
 // NewValueItem initializes a new ValueItem with a given timestamp.
@@ -29,8 +91,10 @@ func NewValueItem(dataBytes []byte, ts time.Time) *ValueItem {
 	if _, err := strconv.ParseInt(string(dataBytes), 10, 64); err == nil {
 		return &ValueItem{
 			Data:       dataBytes,
+			Size:       int64(len(dataBytes)),
 			Counter:    &CounterConstraints{Min: math.MinInt64, Max: math.MaxInt64},
 			Ts:         ts,
+			CreatedAt:  ts,
 			TTL:        TTLNoExpirySet,
 			dataLoaded: true,
 		}
@@ -38,7 +102,9 @@ func NewValueItem(dataBytes []byte, ts time.Time) *ValueItem {
 
 	return &ValueItem{
 		Data:       dataBytes,
+		Size:       int64(len(dataBytes)),
 		Ts:         ts,
+		CreatedAt:  ts,
 		TTL:        TTLNoExpirySet,
 		dataLoaded: true,
 	}
@@ -51,22 +117,126 @@ func (item *ValueItem) SetData(dataBytes []byte) error {
 		item.Counter = &CounterConstraints{Min: math.MinInt64, Max: math.MaxInt64}
 	}
 	item.Data = dataBytes
+	item.Size = int64(len(dataBytes))
 	item.dataLoaded = true
 	return nil
 }
 
-// expired checks if a ValueItem is expired based on its TTL.
-func (item *ValueItem) expired(now time.Time) bool {
+// info returns a copy of the ValueItem's metadata.
+func (item *ValueItem) info() ItemInfo {
+	return ItemInfo{
+		ContentType: item.ContentType,
+		Meta:        copyMeta(item.Meta),
+		ETag:        item.etag(),
+		Size:        item.Size,
+		Ts:          item.Ts,
+		CreatedAt:   item.created(),
+		UpdatedAt:   item.Ts,
+		AccessedAt:  item.accessedAt(),
+		TTL:         item.TTL,
+		ExpiresAt:   item.ExpiresAt,
+		DeleteAt:    item.DeleteAt,
+		Pinned:      item.Pinned,
+		Priority:    item.Priority,
+		Loaded:      item.dataLoaded,
+	}
+}
+
+// displayKey returns the key to list for the item stored under key.
+func (item *ValueItem) displayKey(key string) string {
+	if item.Key != "" {
+		return item.Key
+	}
+	return key
+}
+
+// created returns the time the key was first written. Items persisted before CreatedAt was
+// recorded report the time of their last write.
+func (item *ValueItem) created() time.Time {
+	if item.CreatedAt.IsZero() {
+		return item.Ts
+	}
+	return item.CreatedAt
+}
+
+// accessedAt returns the time the item was last read, or written if it has not been read since.
+func (item *ValueItem) accessedAt() time.Time {
+	if n := item.accessed(); n > 0 {
+		if t := time.Unix(0, n); t.After(item.AccessedAt) {
+			return t
+		}
+	}
+	return item.AccessedAt
+}
+
+// etag returns the entity tag for the current version of the value.
+func (item *ValueItem) etag() string {
+	return strconv.FormatUint(item.Version, 16)
+}
+
+// Clone returns a copy of the item that shares its value but none of its metadata, so the copy's
+// metadata can be changed without affecting the item.
+func (item *ValueItem) Clone() *ValueItem {
+	cp := *item
+	cp.Meta = copyMeta(item.Meta)
+	cp.Envelope = copyMeta(item.Envelope)
+	cp.DependsOn = append([]string(nil), item.DependsOn...)
+	if item.Counter != nil {
+		c := *item.Counter
+		cp.Counter = &c
+	}
+	return &cp
+}
+
+// copyMeta returns a copy of a metadata map, or nil if it is empty.
+func copyMeta(meta map[string]string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	cp := make(map[string]string, len(meta))
+	for k, v := range meta {
+		cp[k] = v
+	}
+	return cp
+}
+
+// Expired reports whether the ValueItem's expiry deadline, or the deletion scheduled by DeleteAfter, has passed.
+func (item *ValueItem) Expired(now time.Time) bool {
+	if !item.DeleteAt.IsZero() && !now.Before(item.DeleteAt) {
+		return true
+	}
+	expiresAt, ok := item.expiry()
+	return ok && expiresAt.Before(now)
+}
+
+// expiry returns the time the ValueItem expires, if it has a TTL. Items persisted before
+// ExpiresAt was recorded expire TTL seconds after their timestamp.
+func (item *ValueItem) expiry() (time.Time, bool) {
 	if item.TTL <= 0 {
-		return false
+		return time.Time{}, false
+	}
+	if item.ExpiresAt.IsZero() {
+		return item.Ts.Add(time.Duration(item.TTL) * time.Second), true
 	}
-	return item.Ts.Add(time.Duration(item.TTL) * time.Second).Before(now)
+	return item.ExpiresAt, true
 }
 
-// unload checks if a ValueItem should be unloaded based on a duration.
+// setExpiry sets the expiry deadline to TTL seconds after now, or clears it if there is no TTL.
+func (item *ValueItem) setExpiry(now time.Time) {
+	item.ExpiresAt = time.Time{}
+	if item.TTL > 0 {
+		item.ExpiresAt = now.Add(time.Duration(item.TTL) * time.Second)
+	}
+}
+
+// unload checks if a ValueItem should be unloaded because it has not been written or touched for a duration.
 func (item *ValueItem) unload(now time.Time, unloadAfter time.Duration) bool {
 	if unloadAfter == 0 {
 		return false
 	}
-	return now.Sub(item.Ts) > unloadAfter
+	last := item.Ts
+	if item.touched.After(last) {
+		last = item.touched
+	}
+	return now.Sub(last) > unloadAfter
 }
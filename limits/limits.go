@@ -0,0 +1,126 @@
+// Package limits bounds how much of a server its clients can use: a per-client request rate counted
+// with kvstore window counters, and a maximum number of simultaneous connections. It is shared by the
+// httpserver and respserver packages.
+package limits
+
+import (
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// rateLimitPrefix prefixes the keys of the window counters used for rate limiting.
+const rateLimitPrefix = "ratelimit:"
+
+// RateLimiter allows each client at most a fixed number of requests per window.
+type RateLimiter struct {
+	counters *kvstore.Store
+	limit    int64
+	window   time.Duration
+}
+
+// NewRateLimiter creates a RateLimiter that counts requests with window counters in counters, which is
+// typically a memory-only store so that counting requests does not write to the persisters. The
+// eviction frequency of counters is set to window, so the counters of clients that stop sending
+// requests are deleted once their window ends.
+//
+// Example:
+//
+//	counters, _ := kvstore.New()
+//	limiter := limits.NewRateLimiter(counters, 100, time.Second)
+func NewRateLimiter(counters *kvstore.Store, limit int64, window time.Duration) *RateLimiter {
+	if window > 0 {
+		counters.SetEvictionFrequency(window)
+	}
+	return &RateLimiter{counters: counters, limit: limit, window: window}
+}
+
+// Allow counts a request from client and reports whether it is within the limit. When it is not,
+// retryAfter is the number of seconds until the current window ends, or zero if unknown. A limiter
+// with no limit allows every request.
+func (l *RateLimiter) Allow(client string) (allowed bool, retryAfter int64, err error) {
+	if l == nil || l.limit <= 0 {
+		return true, 0, nil
+	}
+	key := rateLimitPrefix + hex.EncodeToString([]byte(client))
+	count, err := l.counters.CounterWindow(key, 1, l.window)
+	if err != nil {
+		return true, 0, errors.Wrapf(err, "RateLimiter.Allow client %s", client)
+	}
+	if count <= l.limit {
+		return true, 0, nil
+	}
+	if ttl := l.counters.TTL(key); ttl > 0 {
+		retryAfter = int64(ttl)
+	}
+	return false, retryAfter, nil
+}
+
+// RemoteIP returns the IP address of a remote address such as net.Conn.RemoteAddr().String(), to
+// identify clients that have not authenticated.
+func RemoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// limitListener accepts at most a fixed number of simultaneous connections.
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener wraps a listener so that at most n connections are open at once. Further connections
+// wait until an existing one is closed, or until the listener is closed.
+//
+// Example:
+//
+//	ln, _ := net.Listen("tcp", ":6379")
+//	ln = limits.NewListener(ln, 1000)
+func NewListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, slots: make(chan struct{}, n), closed: make(chan struct{})}
+}
+
+// Accept waits for a free slot before accepting a connection, returning net.ErrClosed if the
+// listener is closed while it waits.
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitConn{Conn: conn, release: func() { <-l.slots }}, nil
+}
+
+// Close closes the listener, releasing an Accept waiting for a free slot.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// limitConn frees its listener slot when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and frees its slot.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,95 @@
+// Package memo memoizes expensive functions using a kvstore.Store as the cache.
+package memo
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// Option is a type for functions that configure a memoized function.
+type Option func(o *options)
+
+type options struct {
+	ttl     time.Duration
+	codec   kvstore.Codec
+	keyFunc any
+}
+
+// WithTTL returns an Option that expires cached results after ttl.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithCodec returns an Option that sets the Codec used to store results. The default is kvstore.JSONCodec.
+func WithCodec(codec kvstore.Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithKeyFunc returns an Option that derives the cache key suffix for an argument.
+// The key type K must match the memoized function's argument type.
+func WithKeyFunc[K comparable](keyFunc func(K) string) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// New wraps fn so that its results are cached in store under keys of the form "name:<arg>".
+// Concurrent calls with the same argument share a single call of fn.
+//
+// Example:
+//
+//	getUser := memo.New(store, "user", loadUser, memo.WithTTL(time.Minute))
+//	user, err := getUser(42)
+func New[K comparable, V any](store *kvstore.Store, name string, fn func(K) (V, error), opts ...Option) func(K) (V, error) {
+	o := options{codec: kvstore.JSONCodec{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	keyFunc, ok := o.keyFunc.(func(K) string)
+	if !ok {
+		keyFunc = defaultKey[K]
+	}
+
+	return func(arg K) (V, error) {
+		var result V
+		key := name + ":" + keyFunc(arg)
+		if !kvstore.KeyValid(key) {
+			key = name + ":" + hashKey(key)
+		}
+
+		data, err := store.GetOrSet(key, o.ttl, func() ([]byte, error) {
+			v, err := fn(arg)
+			if err != nil {
+				return nil, err
+			}
+			return o.codec.Marshal(v)
+		})
+		if err != nil {
+			return result, errors.Wrap(err, "memo store.GetOrSet")
+		}
+		if err := o.codec.Unmarshal(data, &result); err != nil {
+			return result, errors.Wrap(err, "memo codec.Unmarshal")
+		}
+		return result, nil
+	}
+}
+
+// defaultKey formats the argument with fmt.
+func defaultKey[K comparable](arg K) string {
+	return fmt.Sprint(arg)
+}
+
+// hashKey maps an arbitrary string onto valid key characters.
+func hashKey(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,41 @@
+package memo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/memo"
+	"github.com/stretchr/testify/require"
+)
+
+type user struct {
+	ID   int
+	Name string
+}
+
+func TestMemoize(t *testing.T) {
+	s, err := kvstore.New()
+	require.NoError(t, err)
+
+	calls := 0
+	getUser := memo.New(s, "user", func(id int) (user, error) {
+		calls++
+		return user{ID: id, Name: "John"}, nil
+	}, memo.WithTTL(time.Minute))
+
+	for i := 0; i < 3; i++ {
+		u, err := getUser(42)
+		require.NoError(t, err)
+		require.Equal(t, user{ID: 42, Name: "John"}, u)
+	}
+	require.Equal(t, 1, calls)
+	require.Equal(t, kvstore.TTLType(60), s.TTL("user:42"))
+
+	search := memo.New(s, "search", func(q string) ([]string, error) {
+		return []string{q}, nil
+	})
+	r, err := search("hello world?")
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello world?"}, r)
+}
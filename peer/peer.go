@@ -0,0 +1,166 @@
+// Package peer keeps the in-memory caches of several kvstore instances coherent when they share a
+// persister. Each instance joins a gossip cluster and announces the keys it changes, and the other
+// instances discard their copies of those keys so the next read reloads them from the persister.
+package peer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Message types exchanged between peers.
+const (
+	invalidateMessage byte = iota + 1
+)
+
+// leaveTimeout is how long Close waits for the cluster to learn that a peer is leaving.
+const leaveTimeout = 5 * time.Second
+
+// Peer is a member of a gossip cluster of store instances. It implements kvstore.Broadcaster,
+// so it is attached to a store with kvstore.WithBroadcasterOption. A Peer serves a single store.
+type Peer struct {
+	list       *memberlist.Memberlist
+	queue      *memberlist.TransmitLimitedQueue
+	lock       sync.RWMutex
+	invalidate func(key string)
+}
+
+// New starts a peer with the given memberlist configuration and joins the cluster through any of
+// the existing members in join. A nil config uses memberlist.DefaultLANConfig. The first peer of a
+// cluster is started without members to join.
+func New(config *memberlist.Config, join ...string) (*Peer, error) {
+	if config == nil {
+		config = memberlist.DefaultLANConfig()
+	}
+	p := &Peer{}
+	p.queue = &memberlist.TransmitLimitedQueue{
+		NumNodes:       p.numMembers,
+		RetransmitMult: config.RetransmitMult,
+	}
+	config.Delegate = delegate{peer: p}
+	if config.Logger == nil {
+		config.LogOutput = log.Logger
+	}
+
+	list, err := memberlist.Create(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "peer.New Create")
+	}
+	p.lock.Lock()
+	p.list = list
+	p.lock.Unlock()
+
+	if len(join) > 0 {
+		if _, err := list.Join(join); err != nil {
+			_ = list.Shutdown()
+			return nil, errors.Wrap(err, "peer.New Join")
+		}
+	}
+	return p, nil
+}
+
+// Broadcast queues an invalidation of key for gossip to the other peers.
+func (p *Peer) Broadcast(key string) {
+	p.queue.QueueBroadcast(invalidation{key: key})
+}
+
+// Subscribe registers the function called for each key another peer invalidates.
+func (p *Peer) Subscribe(invalidate func(key string)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.invalidate = invalidate
+}
+
+// Addr returns the address other peers can join this peer on.
+func (p *Peer) Addr() string {
+	return p.list.LocalNode().Address()
+}
+
+// Members returns the names of the peers currently in the cluster, including this one.
+func (p *Peer) Members() []string {
+	members := p.list.Members()
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+// Close leaves the cluster and stops the peer.
+func (p *Peer) Close() error {
+	if err := p.list.Leave(leaveTimeout); err != nil {
+		log.Error().Msgf("[kvstore peer] leave error: %s", err.Error())
+	}
+	if err := p.list.Shutdown(); err != nil {
+		return errors.Wrap(err, "Peer.Close Shutdown")
+	}
+	return nil
+}
+
+// numMembers returns the size of the cluster, which sets how many times each broadcast is retransmitted.
+func (p *Peer) numMembers() int {
+	p.lock.RLock()
+	list := p.list
+	p.lock.RUnlock()
+	if list == nil {
+		return 1
+	}
+	return list.NumMembers()
+}
+
+// receive handles a message gossiped by another peer.
+func (p *Peer) receive(msg []byte) {
+	if len(msg) == 0 || msg[0] != invalidateMessage {
+		return
+	}
+	p.lock.RLock()
+	invalidate := p.invalidate
+	p.lock.RUnlock()
+	if invalidate != nil {
+		invalidate(string(msg[1:]))
+	}
+}
+
+// invalidation is a queued announcement that a key changed. A newer invalidation of the same key
+// replaces one that has not yet been fully gossiped.
+type invalidation struct {
+	key string
+}
+
+func (i invalidation) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(invalidation)
+	return ok && o.key == i.key
+}
+
+func (i invalidation) Message() []byte {
+	return append([]byte{invalidateMessage}, i.key...)
+}
+
+func (i invalidation) Finished() {}
+
+// delegate connects a Peer to memberlist's gossip.
+type delegate struct {
+	peer *Peer
+}
+
+func (d delegate) NodeMeta(limit int) []byte {
+	return nil
+}
+
+func (d delegate) NotifyMsg(msg []byte) {
+	d.peer.receive(msg)
+}
+
+func (d delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.peer.queue.GetBroadcasts(overhead, limit)
+}
+
+func (d delegate) LocalState(join bool) []byte {
+	return nil
+}
+
+func (d delegate) MergeRemoteState(buf []byte, join bool) {}
@@ -0,0 +1,64 @@
+package peer_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/peer"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func localConfig(name string) *memberlist.Config {
+	config := memberlist.DefaultLocalConfig()
+	config.Name = name
+	config.BindAddr = "127.0.0.1"
+	config.BindPort = 0
+	config.GossipInterval = 10 * time.Millisecond
+	return config
+}
+
+func TestPeerInvalidation(t *testing.T) {
+	const folder = "TestPeerInvalidation"
+	defer os.RemoveAll(folder)
+
+	p1, err := peer.New(localConfig("node-1"))
+	require.NoError(t, err)
+	defer p1.Close()
+	p2, err := peer.New(localConfig("node-2"), p1.Addr())
+	require.NoError(t, err)
+	defer p2.Close()
+	require.ElementsMatch(t, []string{"node-1", "node-2"}, p1.Members())
+
+	s1, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)), kvstore.WithBroadcasterOption(p1))
+	require.NoError(t, err)
+	defer s1.Close()
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)), kvstore.WithBroadcasterOption(p2))
+	require.NoError(t, err)
+	defer s2.Close()
+
+	require.NoError(t, s2.Set("config", []byte("v1")))
+	require.Eventually(t, func() bool {
+		v, err := s1.Get("config")
+		return err == nil && string(v) == "v1"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for i := 2; i <= 3; i++ {
+		value := fmt.Sprintf("v%d", i)
+		require.NoError(t, s1.Set("config", []byte(value)))
+		require.Eventually(t, func() bool {
+			v, err := s2.Get("config")
+			return err == nil && string(v) == value
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	require.NoError(t, s1.Delete("config"))
+	require.Eventually(t, func() bool {
+		_, err := s2.Get("config")
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,230 @@
+package persistence
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Backup writes a zstd compressed tarball of a filesystem persistence folder to w.
+// It can run while the store is in use: the key set is snapshotted first, and each key's
+// files are read in full before being archived, so keys deleted during the backup are
+// skipped rather than archived partially.
+func Backup(folder string, w io.Writer) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return errors.Wrap(err, "Backup: ReadDir")
+	}
+
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return errors.Wrap(err, "Backup: zstd.NewWriter")
+	}
+	tw := tar.NewWriter(zw)
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := backupKey(tw, folder, entry.Name()); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "Backup: tar Close")
+	}
+	if err := zw.Close(); err != nil {
+		return errors.Wrap(err, "Backup: zstd Close")
+	}
+	return nil
+}
+
+// backupKey archives the files of a single key, skipping the key if it has been deleted.
+func backupKey(tw *tar.Writer, folder, key string) error {
+	files := make(map[string][]byte)
+	for _, name := range []string{metaDataFilename, dataFilename} {
+		content, err := os.ReadFile(path.Join(folder, key, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "Backup: ReadFile %s/%s", key, name)
+		}
+		files[name] = content
+	}
+	if _, ok := files[metaDataFilename]; !ok {
+		return nil
+	}
+
+	for _, name := range []string{metaDataFilename, dataFilename} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		header := &tar.Header{
+			Name:    key + "/" + name,
+			Mode:    fileMode,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Wrapf(err, "Backup: WriteHeader %s", header.Name)
+		}
+		if _, err := tw.Write(content); err != nil {
+			return errors.Wrapf(err, "Backup: Write %s", header.Name)
+		}
+	}
+	return nil
+}
+
+// Restore extracts a tarball written by Backup into a filesystem persistence folder, overwriting
+// keys that already exist. The store using the folder should not be running.
+//
+// Deprecated: use RestoreWithPolicy, which can keep existing keys or refuse to restore over them.
+func Restore(r io.Reader, folder string) error {
+	return RestoreWithPolicy(r, folder, kvstore.ConflictOverwrite)
+}
+
+// RestoreWithPolicy extracts a tarball written by Backup into a filesystem persistence folder. Keys
+// that already exist in the folder are resolved using policy. The archive is extracted beside the
+// folder before any key is restored, so with kvstore.ConflictFail a conflicting restore leaves the
+// folder unchanged. The store using the folder should not be running.
+//
+// Example:
+//
+//	err := RestoreWithPolicy(archive, "./data", kvstore.ConflictKeepNewest)
+func RestoreWithPolicy(r io.Reader, folder string, policy kvstore.ConflictPolicy) error {
+	if err := os.MkdirAll(folder, fileMode); err != nil {
+		return errors.Wrap(err, "Restore: MkdirAll")
+	}
+	clean := filepath.Clean(folder)
+	staging, err := os.MkdirTemp(filepath.Dir(clean), filepath.Base(clean)+".restore-")
+	if err != nil {
+		return errors.Wrap(err, "Restore: MkdirTemp")
+	}
+	defer os.RemoveAll(staging)
+
+	keys, err := extractArchive(r, staging)
+	if err != nil {
+		return err
+	}
+	if policy == kvstore.ConflictFail {
+		for _, key := range keys {
+			if _, err := os.Stat(path.Join(folder, key, metaDataFilename)); err == nil {
+				return errors.Wrapf(kvstore.ErrImportConflict, "Restore: key %s", key)
+			} else if !os.IsNotExist(err) {
+				return errors.Wrapf(err, "Restore: Stat %s", key)
+			}
+		}
+	}
+
+	if err := invalidateIndex(folder); err != nil {
+		return errors.Wrap(err, "Restore")
+	}
+	for _, key := range keys {
+		if err := restoreKey(folder, staging, key, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchive writes the files of a tarball written by Backup under staging, returning the keys
+// that have metadata in the order they were archived.
+func extractArchive(r io.Reader, staging string) ([]string, error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "Restore: zstd.NewReader")
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	keys := make([]string, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return keys, nil
+		} else if err != nil {
+			return nil, errors.Wrap(err, "Restore: tar Next")
+		}
+
+		key, name, ok := splitArchivePath(header.Name)
+		if !ok {
+			return nil, errors.Errorf("Restore: unexpected archive entry %q", header.Name)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Restore: read %s", header.Name)
+		}
+		if err := os.MkdirAll(path.Join(staging, key), fileMode); err != nil {
+			return nil, errors.Wrap(err, "Restore: MkdirAll")
+		}
+		if err := os.WriteFile(path.Join(staging, key, name), content, fileMode); err != nil {
+			return nil, errors.Wrapf(err, "Restore: WriteFile %s", header.Name)
+		}
+		if name == metaDataFilename {
+			keys = append(keys, key)
+		}
+	}
+}
+
+// restoreKey moves the extracted files of a single key into folder, unless policy keeps the existing key.
+func restoreKey(folder, staging, key string, policy kvstore.ConflictPolicy) error {
+	metadata, err := os.ReadFile(path.Join(staging, key, metaDataFilename))
+	if err != nil {
+		return errors.Wrapf(err, "Restore: ReadFile %s", key)
+	}
+	existing, err := os.ReadFile(path.Join(folder, key, metaDataFilename))
+	if err == nil {
+		if !policy.Resolve(metadataTimestamp(existing), metadataTimestamp(metadata)) {
+			return nil
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Restore: ReadFile %s", key)
+	}
+
+	if err := os.MkdirAll(path.Join(folder, key), fileMode); err != nil {
+		return errors.Wrap(err, "Restore: MkdirAll")
+	}
+	if err := os.Remove(path.Join(folder, key, dataFilename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Restore: Remove %s", key)
+	}
+	// The metadata is moved last, so a key is only visible once its value is in place.
+	for _, name := range []string{dataFilename, metaDataFilename} {
+		err := os.Rename(path.Join(staging, key, name), path.Join(folder, key, name))
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Restore: Rename %s/%s", key, name)
+		}
+	}
+	return nil
+}
+
+// metadataTimestamp returns the timestamp recorded in a metadata file, or the zero time if it cannot be read.
+func metadataTimestamp(metadata []byte) time.Time {
+	var item kvstore.ValueItem
+	if err := json.Unmarshal(metadata, &item); err != nil {
+		return time.Time{}
+	}
+	return item.Ts
+}
+
+// splitArchivePath validates an archive entry name of the form "key/file".
+func splitArchivePath(name string) (key, file string, ok bool) {
+	key, file, found := strings.Cut(name, "/")
+	if !found || key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) || filepath.IsAbs(key) {
+		return "", "", false
+	}
+	if file != metaDataFilename && file != dataFilename {
+		return "", "", false
+	}
+	return key, file, true
+}
@@ -0,0 +1,68 @@
+package persistence_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	const folder = "TestBackupRestore"
+	const restoreFolder = "TestBackupRestoreTarget"
+	defer func() {
+		os.RemoveAll(folder)
+		os.RemoveAll(restoreFolder)
+	}()
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("alpha")))
+	require.NoError(t, s.Set("b", bytes.Repeat([]byte("b"), 10000)))
+	require.NoError(t, s.SetTTL("b", 3600))
+
+	var archive bytes.Buffer
+	require.NoError(t, persistence.Backup(folder, &archive))
+	require.Less(t, archive.Len(), 10000)
+
+	require.NoError(t, persistence.Restore(bytes.NewReader(archive.Bytes()), restoreFolder))
+	s2, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(restoreFolder)))
+	require.NoError(t, err)
+	b, err := s2.Get("a")
+	require.NoError(t, err)
+	require.Equal(t, "alpha", string(b))
+	require.Greater(t, s2.TTL("b"), kvstore.TTLType(3500))
+}
+
+func TestRestoreConflictFail(t *testing.T) {
+	const folder = "TestRestoreConflictFail"
+	defer os.RemoveAll(folder)
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("a", []byte("alpha")))
+	require.NoError(t, s.Set("b", []byte("beta")))
+
+	var archive bytes.Buffer
+	require.NoError(t, persistence.Backup(folder, &archive))
+	require.NoError(t, s.Delete("a"))
+
+	// "a" comes before the conflicting "b" in the archive, but is not restored either.
+	err = persistence.RestoreWithPolicy(bytes.NewReader(archive.Bytes()), folder, kvstore.ConflictFail)
+	require.ErrorIs(t, err, kvstore.ErrImportConflict)
+	_, err = os.Stat(path.Join(folder, "a"))
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, persistence.RestoreWithPolicy(bytes.NewReader(archive.Bytes()), folder, kvstore.ConflictSkipExisting))
+	_, err = os.Stat(path.Join(folder, "a"))
+	require.NoError(t, err)
+	entries, err := os.ReadDir(".")
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), folder+".restore-")
+	}
+}
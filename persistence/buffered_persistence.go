@@ -2,6 +2,9 @@ package persistence
 
 import (
 	"context"
+	"hash/fnv"
+	"sync"
+	"time"
 
 	"github.com/jrsteele09/go-kvstore/kvstore"
 	"github.com/pkg/errors"
@@ -21,6 +24,8 @@ const (
 	deleteCommand
 	readMetadataCommand
 	readValueCommand
+	writeMultiCommand
+	flushCommand
 )
 
 type responseType struct {
@@ -32,37 +37,183 @@ type commandBuffer struct {
 	cmdType  commandType
 	key      string
 	mv       *kvstore.ValueItem
+	items    map[string]*kvstore.ValueItem
 	response chan responseType
+	done     chan error
 }
 
 // Buffer provides a thread-safe way to interact with a DataPersister.
 type Buffer struct {
-	cb          chan commandBuffer
+	workers     []chan commandBuffer
+	ctx         context.Context
 	cancel      context.CancelFunc
 	persistence kvstore.DataPersister
+	pending     *pendingKeys
+	acknowledge bool
+	nWorkers    int
+	flushDelay  time.Duration
+	failFast    bool
+	stopped     *sync.WaitGroup // Done once every worker has returned.
+}
+
+// BufferOption is a type for functions that configure a Buffer.
+type BufferOption func(b *Buffer)
+
+// WithAcknowledgedWritesOption returns a BufferOption that makes Write, WriteMulti and Delete
+// wait until the command has been applied to the DataPersister and return its error,
+// so that a crash straight after a call cannot lose the operation.
+func WithAcknowledgedWritesOption() BufferOption {
+	return func(b *Buffer) {
+		b.acknowledge = true
+	}
+}
+
+// WithWorkersOption returns a BufferOption that processes commands on n goroutines, so that I/O for
+// different keys runs in parallel. Keys are hash partitioned across the workers, which preserves
+// the order of commands for any single key. Each worker has its own queue of bufferSize commands.
+func WithWorkersOption(n int) BufferOption {
+	return func(b *Buffer) {
+		if n > 0 {
+			b.nWorkers = n
+		}
+	}
+}
+
+// WithFlushDelayOption returns a BufferOption that holds writes for up to delay before applying them.
+// Further writes to the same key within that window are merged, so that a key updated in a burst is
+// written once. Reads, deletes, Flush and Close apply any held write for their keys first. Held
+// writes are copies of the items written, so later changes to an item are not written with them.
+func WithFlushDelayOption(delay time.Duration) BufferOption {
+	return func(b *Buffer) {
+		b.flushDelay = delay
+	}
+}
+
+// WithFailWhenFullOption returns a BufferOption that rejects commands with kvstore.ErrBufferFull
+// when a worker's queue is full, rather than blocking until there is room. Rejected writes and
+// deletes have not been applied, so the caller must retry them or accept the loss.
+func WithFailWhenFullOption() BufferOption {
+	return func(b *Buffer) {
+		b.failFast = true
+	}
+}
+
+// pendingKeys counts the queued writes and deletes for each key.
+type pendingKeys struct {
+	lock   sync.Mutex
+	counts map[string]int
 }
 
 // NewPersistenceBuffer creates a new Buffer.
-func NewPersistenceBuffer(persistence kvstore.DataPersister, bufferSize uint) Buffer {
+func NewPersistenceBuffer(persistence kvstore.DataPersister, bufferSize uint, options ...BufferOption) Buffer {
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	buffer := Buffer{
-		cb:          make(chan commandBuffer, bufferSize),
+		ctx:         ctx,
 		cancel:      cancelFunc,
 		persistence: persistence,
+		pending:     &pendingKeys{counts: make(map[string]int)},
+		nWorkers:    1,
+		stopped:     &sync.WaitGroup{},
+	}
+	for _, opt := range options {
+		opt(&buffer)
+	}
+	buffer.workers = make([]chan commandBuffer, buffer.nWorkers)
+	for i := range buffer.workers {
+		buffer.workers[i] = make(chan commandBuffer, bufferSize)
+		buffer.stopped.Add(1)
+		go buffer.commandBuffer(ctx, buffer.workers[i])
 	}
-	go buffer.commandBuffer(ctx)
 	return buffer
 }
 
-// Close cancels the background command processing.
+// Close cancels the background command processing, applying the writes held back by the flush
+// delay before it returns. Commands issued after Close return kvstore.ErrPersisterUnavailable.
 func (b Buffer) Close() {
 	b.cancel()
+	b.stopped.Wait()
+}
+
+// Len returns the number of commands waiting in the buffer.
+func (b Buffer) Len() int {
+	n := 0
+	for _, w := range b.workers {
+		n += len(w)
+	}
+	return n
+}
+
+// Pending returns true if a write or delete for the key has not yet reached the DataPersister.
+func (b Buffer) Pending(key string) bool {
+	b.pending.lock.Lock()
+	defer b.pending.lock.Unlock()
+	return b.pending.counts[key] > 0
+}
+
+// Flush waits until every command queued before it has been processed.
+func (b Buffer) Flush() error {
+	responses := make([]chan responseType, len(b.workers))
+	for i, w := range b.workers {
+		responses[i] = make(chan responseType, 1)
+		if err := b.send(w, commandBuffer{cmdType: flushCommand, response: responses[i]}, false); err != nil {
+			return errors.Wrap(err, "Buffer.Flush")
+		}
+	}
+	var returnError error
+	for _, response := range responses {
+		r, err := b.receive(response)
+		if err == nil {
+			err = r.err
+		}
+		if err != nil {
+			returnError = errors.Wrap(err, "Buffer.Flush")
+		}
+	}
+	return returnError
 }
 
 // Write queues a write command.
 func (b Buffer) Write(key string, data *kvstore.ValueItem) error {
-	b.cb <- commandBuffer{cmdType: writeCommand, key: key, mv: data}
-	return nil
+	return b.complete(b.WriteAsync(key, data))
+}
+
+// WriteAsync queues a write command and returns a channel that receives its result once applied.
+func (b Buffer) WriteAsync(key string, data *kvstore.ValueItem) <-chan error {
+	if b.flushDelay > 0 {
+		data = heldCopy(data)
+	}
+	b.pending.add(1, key)
+	return b.enqueue(commandBuffer{cmdType: writeCommand, key: key, mv: data})
+}
+
+// WriteMulti queues a batch write command. The batch is passed to the underlying
+// DataPersister in one call if it implements kvstore.BatchWriter.
+// With several workers the batch is split so that each worker receives the items for its keys.
+func (b Buffer) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	b.pending.add(1, keysOf(items)...)
+	if len(b.workers) == 1 {
+		return b.complete(b.enqueue(commandBuffer{cmdType: writeMultiCommand, items: items}))
+	}
+
+	partitions := make(map[int]map[string]*kvstore.ValueItem)
+	for k, mv := range items {
+		w := b.worker(k)
+		if partitions[w] == nil {
+			partitions[w] = make(map[string]*kvstore.ValueItem)
+		}
+		partitions[w][k] = mv
+	}
+	dones := make([]<-chan error, 0, len(partitions))
+	for _, p := range partitions {
+		dones = append(dones, b.enqueue(commandBuffer{cmdType: writeMultiCommand, items: p}))
+	}
+	var returnError error
+	for _, done := range dones {
+		if err := b.complete(done); err != nil {
+			returnError = err
+		}
+	}
+	return returnError
 }
 
 // Read queues a read command and waits for a response.
@@ -72,36 +223,247 @@ func (b Buffer) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
 		cmd = readValueCommand
 	}
 
-	response := make(chan responseType)
-	b.cb <- commandBuffer{cmdType: cmd, key: key, response: response}
-	r := <-response
-	if r.err != nil {
-		return nil, errors.Wrap(r.err, "Buffer.Read")
+	response := make(chan responseType, 1)
+	if err := b.send(b.workers[b.worker(key)], commandBuffer{cmdType: cmd, key: key, response: response}, b.failFast); err != nil {
+		return nil, errors.Wrap(err, "Buffer.Read")
+	}
+	r, err := b.receive(response)
+	if err == nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "Buffer.Read")
 	}
 	return r.mv, nil
 }
 
 // Delete queues a delete command.
 func (b Buffer) Delete(key string) error {
-	b.cb <- commandBuffer{cmdType: deleteCommand, key: key}
+	return b.complete(b.DeleteAsync(key))
+}
+
+// DeleteAsync queues a delete command and returns a channel that receives its result once applied.
+func (b Buffer) DeleteAsync(key string) <-chan error {
+	b.pending.add(1, key)
+	return b.enqueue(commandBuffer{cmdType: deleteCommand, key: key})
+}
+
+// enqueue queues a command on the worker responsible for its keys, with a completion channel.
+// A command that cannot be queued completes straight away with the reason, and is no longer pending.
+func (b Buffer) enqueue(command commandBuffer) <-chan error {
+	command.done = make(chan error, 1)
+	key := command.key
+	for k := range command.items {
+		key = k
+		break
+	}
+	if err := b.send(b.workers[b.worker(key)], command, b.failFast); err != nil {
+		if command.items != nil {
+			b.pending.add(-1, keysOf(command.items)...)
+		} else {
+			b.pending.add(-1, command.key)
+		}
+		command.done <- errors.Wrap(err, "Buffer.enqueue")
+	}
+	return command.done
+}
+
+// send queues a command on a worker, failing if the buffer is closed or, when failFast is set, full.
+func (b Buffer) send(worker chan commandBuffer, command commandBuffer, failFast bool) error {
+	if b.ctx.Err() != nil {
+		return errors.Wrap(kvstore.ErrPersisterUnavailable, "buffer closed")
+	}
+	if failFast {
+		select {
+		case worker <- command:
+			return nil
+		default:
+			return errors.Wrapf(kvstore.ErrBufferFull, "%d commands queued", len(worker))
+		}
+	}
+	select {
+	case worker <- command:
+		return nil
+	case <-b.ctx.Done():
+		return errors.Wrap(kvstore.ErrPersisterUnavailable, "buffer closed")
+	}
+}
+
+// receive waits for the response to a queued command, failing if the buffer is closed before it is processed.
+func (b Buffer) receive(response <-chan responseType) (responseType, error) {
+	select {
+	case r := <-response:
+		return r, nil
+	case <-b.ctx.Done():
+		select {
+		case r := <-response:
+			return r, nil
+		default:
+			return responseType{}, errors.Wrap(kvstore.ErrPersisterUnavailable, "buffer closed")
+		}
+	}
+}
+
+// worker returns the index of the worker responsible for a key.
+func (b Buffer) worker(key string) int {
+	if len(b.workers) == 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(b.workers)))
+}
+
+// complete waits for a queued command when writes are acknowledged. Otherwise it returns immediately,
+// reporting only a command that could not be queued.
+func (b Buffer) complete(done <-chan error) error {
+	if b.acknowledge {
+		select {
+		case err := <-done:
+			return err
+		case <-b.ctx.Done():
+			select {
+			case err := <-done:
+				return err
+			default:
+				return errors.Wrap(kvstore.ErrPersisterUnavailable, "Buffer closed before the command was applied")
+			}
+		}
+	}
+	select {
+	case err := <-done:
+		if errors.Is(err, kvstore.ErrBufferFull) || errors.Is(err, kvstore.ErrPersisterUnavailable) {
+			return err
+		}
+	default:
+	}
 	return nil
 }
 
+// Compact flushes queued commands, then compacts the persistence layer if it supports compaction.
+func (b Buffer) Compact() error {
+	c, ok := b.persistence.(kvstore.Compactor)
+	if !ok {
+		return nil
+	}
+	if err := b.Flush(); err != nil {
+		return errors.Wrap(err, "Buffer.Compact Flush")
+	}
+	return c.Compact()
+}
+
+// Migrate upgrades the layout of the persistence layer if it is versioned, after applying queued writes.
+func (b Buffer) Migrate() error {
+	m, ok := b.persistence.(kvstore.Migrator)
+	if !ok {
+		return nil
+	}
+	if err := b.Flush(); err != nil {
+		return errors.Wrap(err, "Buffer.Migrate Flush")
+	}
+	return m.Migrate()
+}
+
+// Usage returns the usage of the persistence layer if it reports usage. Queued writes are not included.
+func (b Buffer) Usage() (kvstore.Usage, error) {
+	return kvstore.UsageOf(b.persistence)
+}
+
 // Keys retrieves keys from the persistence layer.
 func (b Buffer) Keys() ([]string, error) {
 	return b.persistence.Keys()
 }
 
-// commandBuffer processes commands.
-func (b Buffer) commandBuffer(ctx context.Context) {
+// commandBuffer processes the commands queued for one worker.
+func (b Buffer) commandBuffer(ctx context.Context, cb chan commandBuffer) {
+	defer b.stopped.Done()
+	held := newHeldWrites()
 	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		if deadline, ok := held.nextDeadline(); ok {
+			timer = time.NewTimer(time.Until(deadline))
+			due = timer.C
+		}
+
 		select {
-		case command := <-b.cb:
-			b.processCommand(command)
+		case command := <-cb:
+			b.handleCommand(command, held)
+		case <-due:
+			for _, w := range held.popDue(time.Now()) {
+				b.applyHeldWrite(w)
+			}
 		case <-ctx.Done():
 			log.Info().Msg("Buffer.commandBuffer cancelled")
+			if timer != nil {
+				timer.Stop()
+			}
+			for _, w := range held.popAll() {
+				b.applyHeldWrite(w)
+			}
 			return
 		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// handleCommand processes a command, holding back writes when a flush delay is configured.
+func (b Buffer) handleCommand(command commandBuffer, held *heldWrites) {
+	if b.flushDelay <= 0 {
+		b.processCommand(command)
+		return
+	}
+
+	switch command.cmdType {
+	case writeCommand:
+		held.add(command, time.Now().Add(b.flushDelay))
+		return
+	case deleteCommand:
+		if w, ok := held.remove(command.key); ok {
+			b.discardHeldWrite(w)
+		}
+	case writeMultiCommand:
+		for k := range command.items {
+			if w, ok := held.remove(k); ok {
+				b.applyHeldWrite(w)
+			}
+		}
+	case flushCommand:
+		for _, w := range held.popAll() {
+			b.applyHeldWrite(w)
+		}
+	default:
+		if w, ok := held.remove(command.key); ok {
+			b.applyHeldWrite(w)
+		}
+	}
+	b.processCommand(command)
+}
+
+// applyHeldWrite writes the latest value of a held write and completes every merged command.
+func (b Buffer) applyHeldWrite(w *heldWrite) {
+	b.processCommand(w.command)
+	b.completeMerged(w, nil)
+}
+
+// discardHeldWrite drops a held write that was superseded by a delete.
+func (b Buffer) discardHeldWrite(w *heldWrite) {
+	b.pending.add(-1, w.command.key)
+	if w.command.done != nil {
+		w.command.done <- nil
+	}
+	b.completeMerged(w, nil)
+}
+
+// completeMerged completes the commands that were merged into a held write.
+func (b Buffer) completeMerged(w *heldWrite, err error) {
+	b.pending.add(-len(w.merged), w.command.key)
+	for _, done := range w.merged {
+		if done != nil {
+			done <- err
+		}
 	}
 }
 
@@ -111,6 +473,8 @@ func (b Buffer) processCommand(command commandBuffer) {
 	switch command.cmdType {
 	case writeCommand:
 		err = b.persistence.Write(command.key, command.mv)
+	case writeMultiCommand:
+		err = b.writeMulti(command.items)
 	case deleteCommand:
 		err = b.persistence.Delete(command.key)
 	case readMetadataCommand:
@@ -119,9 +483,145 @@ func (b Buffer) processCommand(command commandBuffer) {
 	case readValueCommand:
 		mv, readErr := b.persistence.Read(command.key, true)
 		command.response <- responseType{mv: mv, err: readErr}
+	case flushCommand:
+		command.response <- responseType{}
+	}
+
+	switch command.cmdType {
+	case writeCommand, deleteCommand:
+		b.pending.add(-1, command.key)
+	case writeMultiCommand:
+		b.pending.add(-1, keysOf(command.items)...)
+	}
+
+	if command.done != nil {
+		command.done <- err
 	}
 
 	if err != nil {
 		log.Error().Msgf("Buffer.processCommand command: %d error: %s", command.cmdType, err.Error())
 	}
 }
+
+// writeMulti writes a batch of items to the underlying DataPersister.
+func (b Buffer) writeMulti(items map[string]*kvstore.ValueItem) error {
+	if bw, ok := b.persistence.(kvstore.BatchWriter); ok {
+		return bw.WriteMulti(items)
+	}
+	for k, mv := range items {
+		if err := b.persistence.Write(k, mv); err != nil {
+			return errors.Wrapf(err, "Buffer.writeMulti key %s", k)
+		}
+	}
+	return nil
+}
+
+// add adjusts the pending count of each key by delta.
+func (p *pendingKeys) add(delta int, keys ...string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, k := range keys {
+		p.counts[k] += delta
+		if p.counts[k] <= 0 {
+			delete(p.counts, k)
+		}
+	}
+}
+
+// heldCopy returns a copy of an item and its value, for a write held back by the flush delay.
+func heldCopy(item *kvstore.ValueItem) *kvstore.ValueItem {
+	cp := item.Clone()
+	if item.Data != nil {
+		cp.Data = append([]byte{}, item.Data...)
+	}
+	return cp
+}
+
+// keysOf returns the keys of a batch of items.
+func keysOf(items map[string]*kvstore.ValueItem) []string {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// heldWrite is a write being held back by the flush delay, along with the
+// completion channels of earlier writes to the same key that were merged into it.
+type heldWrite struct {
+	command  commandBuffer
+	merged   []chan error
+	deadline time.Time
+}
+
+// heldWrites holds back writes per key until their deadline, in deadline order.
+type heldWrites struct {
+	byKey map[string]*heldWrite
+	order []*heldWrite
+}
+
+func newHeldWrites() *heldWrites {
+	return &heldWrites{byKey: make(map[string]*heldWrite)}
+}
+
+// add holds a write, merging it with any write already held for the key.
+func (h *heldWrites) add(command commandBuffer, deadline time.Time) {
+	if w, ok := h.byKey[command.key]; ok {
+		w.merged = append(w.merged, w.command.done)
+		w.command = command
+		return
+	}
+	w := &heldWrite{command: command, deadline: deadline}
+	h.byKey[command.key] = w
+	h.order = append(h.order, w)
+}
+
+// remove releases the write held for a key, if any.
+func (h *heldWrites) remove(key string) (*heldWrite, bool) {
+	w, ok := h.byKey[key]
+	if ok {
+		delete(h.byKey, key)
+	}
+	return w, ok
+}
+
+// nextDeadline returns the deadline of the oldest held write.
+func (h *heldWrites) nextDeadline() (time.Time, bool) {
+	h.compact()
+	if len(h.order) == 0 {
+		return time.Time{}, false
+	}
+	return h.order[0].deadline, true
+}
+
+// popDue releases every held write whose deadline has passed.
+func (h *heldWrites) popDue(now time.Time) []*heldWrite {
+	due := make([]*heldWrite, 0)
+	for h.compact(); len(h.order) > 0 && !h.order[0].deadline.After(now); h.compact() {
+		w := h.order[0]
+		h.order = h.order[1:]
+		delete(h.byKey, w.command.key)
+		due = append(due, w)
+	}
+	return due
+}
+
+// popAll releases every held write.
+func (h *heldWrites) popAll() []*heldWrite {
+	all := make([]*heldWrite, 0, len(h.byKey))
+	for _, w := range h.order {
+		if h.byKey[w.command.key] == w {
+			all = append(all, w)
+		}
+	}
+	h.byKey = make(map[string]*heldWrite)
+	h.order = nil
+	return all
+}
+
+// compact drops writes from the front of the order that have already been released.
+func (h *heldWrites) compact() {
+	for len(h.order) > 0 && h.byKey[h.order[0].command.key] != h.order[0] {
+		h.order = h.order[1:]
+	}
+}
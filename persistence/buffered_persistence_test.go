@@ -0,0 +1,160 @@
+package persistence_test
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+type slowPersister struct {
+	kvstore.DataPersister
+	delay time.Duration
+}
+
+func (s slowPersister) Write(key string, data *kvstore.ValueItem) error {
+	time.Sleep(s.delay)
+	return s.DataPersister.Write(key, data)
+}
+
+func TestBufferIntrospection(t *testing.T) {
+	const folder = "TestBufferIntrospection"
+	defer os.RemoveAll(folder)
+	b := persistence.NewPersistenceBuffer(slowPersister{DataPersister: persistence.NewFsPersistence(folder), delay: 20 * time.Millisecond}, 10)
+	defer b.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, b.Write(k, kvstore.NewValueItem([]byte("data"), time.Now())))
+	}
+	require.True(t, b.Pending("c"))
+	require.False(t, b.Pending("d"))
+	require.GreaterOrEqual(t, b.Len(), 1)
+
+	require.NoError(t, b.Flush())
+	require.Equal(t, 0, b.Len())
+	require.False(t, b.Pending("c"))
+}
+
+func TestBufferAcknowledgedDelete(t *testing.T) {
+	const folder = "TestBufferAcknowledgedDelete"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	b := persistence.NewPersistenceBuffer(fs, 10)
+	defer b.Close()
+
+	require.NoError(t, <-b.WriteAsync("a", kvstore.NewValueItem([]byte("data"), time.Now())))
+	_, err := fs.Read("a", true)
+	require.NoError(t, err)
+
+	require.NoError(t, <-b.DeleteAsync("a"))
+	_, err = fs.Read("a", true)
+	require.Error(t, err)
+
+	acked := persistence.NewPersistenceBuffer(fs, 10, persistence.WithAcknowledgedWritesOption())
+	defer acked.Close()
+	require.NoError(t, acked.Write("b", kvstore.NewValueItem([]byte("data"), time.Now())))
+	_, err = fs.Read("b", true)
+	require.NoError(t, err)
+}
+
+func TestBufferWorkers(t *testing.T) {
+	const folder = "TestBufferWorkers"
+	const nKeys = 40
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	b := persistence.NewPersistenceBuffer(slowPersister{DataPersister: fs, delay: 10 * time.Millisecond}, 100, persistence.WithWorkersOption(8))
+	defer b.Close()
+
+	start := time.Now()
+	for i := 0; i < nKeys; i++ {
+		key := fmt.Sprintf("key%d", i%10)
+		require.NoError(t, b.Write(key, kvstore.NewValueItem([]byte(fmt.Sprintf("%d", i)), time.Now())))
+	}
+	require.NoError(t, b.Flush())
+	require.Less(t, time.Since(start), time.Duration(nKeys)*10*time.Millisecond)
+
+	for i := 30; i < nKeys; i++ {
+		mv, err := b.Read(fmt.Sprintf("key%d", i%10), true)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("%d", i), string(mv.Data))
+	}
+}
+
+type countingWriter struct {
+	kvstore.DataPersister
+	writes *int32
+}
+
+func (c countingWriter) Write(key string, data *kvstore.ValueItem) error {
+	atomic.AddInt32(c.writes, 1)
+	return c.DataPersister.Write(key, data)
+}
+
+func TestBufferFlushDelay(t *testing.T) {
+	const folder = "TestBufferFlushDelay"
+	defer os.RemoveAll(folder)
+	var writes int32
+	fs := persistence.NewFsPersistence(folder)
+	b := persistence.NewPersistenceBuffer(countingWriter{DataPersister: fs, writes: &writes}, 100, persistence.WithFlushDelayOption(50*time.Millisecond))
+	defer b.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, b.Write("burst", kvstore.NewValueItem([]byte(fmt.Sprintf("%d", i)), time.Now())))
+	}
+	mv, err := b.Read("burst", true)
+	require.NoError(t, err)
+	require.Equal(t, "19", string(mv.Data))
+	require.Equal(t, int32(1), atomic.LoadInt32(&writes))
+
+	require.NoError(t, b.Write("later", kvstore.NewValueItem([]byte("a"), time.Now())))
+	require.NoError(t, b.Write("later", kvstore.NewValueItem([]byte("b"), time.Now())))
+	require.True(t, b.Pending("later"))
+	time.Sleep(150 * time.Millisecond)
+	require.False(t, b.Pending("later"))
+	require.Equal(t, int32(2), atomic.LoadInt32(&writes))
+	mv, err = fs.Read("later", true)
+	require.NoError(t, err)
+	require.Equal(t, "b", string(mv.Data))
+
+	// Held writes keep the value as written and are applied on Close.
+	item := kvstore.NewValueItem([]byte("held"), time.Now())
+	require.NoError(t, b.Write("closing", item))
+	copy(item.Data, "changed")
+	b.Close()
+	mv, err = fs.Read("closing", true)
+	require.NoError(t, err)
+	require.Equal(t, "held", string(mv.Data))
+}
+
+func TestBufferFailWhenFull(t *testing.T) {
+	const folder = "TestBufferFailWhenFull"
+	defer os.RemoveAll(folder)
+	b := persistence.NewPersistenceBuffer(slowPersister{DataPersister: persistence.NewFsPersistence(folder), delay: 50 * time.Millisecond}, 1, persistence.WithFailWhenFullOption())
+	defer b.Close()
+
+	var err error
+	for i := 0; i < 5 && err == nil; i++ {
+		err = b.Write(fmt.Sprintf("key%d", i), kvstore.NewValueItem([]byte("data"), time.Now()))
+	}
+	require.ErrorIs(t, err, kvstore.ErrBufferFull)
+	require.NoError(t, b.Flush())
+	require.Equal(t, 0, b.Len())
+}
+
+func TestBufferClosed(t *testing.T) {
+	const folder = "TestBufferClosed"
+	defer os.RemoveAll(folder)
+	b := persistence.NewPersistenceBuffer(persistence.NewFsPersistence(folder), 10)
+	b.Close()
+
+	require.ErrorIs(t, b.Write("a", kvstore.NewValueItem([]byte("data"), time.Now())), kvstore.ErrPersisterUnavailable)
+	require.False(t, b.Pending("a"))
+	_, err := b.Read("a", true)
+	require.ErrorIs(t, err, kvstore.ErrPersisterUnavailable)
+	require.ErrorIs(t, b.Flush(), kvstore.ErrPersisterUnavailable)
+}
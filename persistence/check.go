@@ -0,0 +1,164 @@
+package persistence
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// Issues that Check can report for a key folder.
+const (
+	IssueMetadataMissing  = "metadata missing"
+	IssueMetadataCorrupt  = "metadata does not parse"
+	IssueDataMissing      = "data missing"
+	IssueChecksumMismatch = "checksum mismatch"
+)
+
+// CheckOptions configures what Check does with the problems it finds.
+type CheckOptions struct {
+	// QuarantineFolder, if set, is where broken key folders are moved. It must be outside the checked folder.
+	QuarantineFolder string
+
+	// Fix deletes broken key folders when no QuarantineFolder is set.
+	Fix bool
+
+	// RebuildMetadata regenerates missing or corrupt metadata from the key's data file, using the
+	// file's modification time as the timestamp. Rebuilt keys have no TTL and are not quarantined or deleted.
+	RebuildMetadata bool
+}
+
+// Problem is an issue found with a single key folder.
+type Problem struct {
+	Key         string
+	Issue       string
+	Fixed       bool
+	Quarantined bool
+	Rebuilt     bool
+}
+
+// Report summarises a Check run.
+type Report struct {
+	Checked  int
+	Problems []Problem
+}
+
+// Check validates every key folder in a filesystem persistence folder: the metadata must parse,
+// the data file must be present when the metadata records a checksum, and its checksum must match.
+// Depending on the options, broken keys are left in place, quarantined or deleted.
+// The store using the folder should not be running while it is checked.
+func Check(folder string, options CheckOptions) (Report, error) {
+	var report Report
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return report, errors.Wrap(err, "Check: ReadDir")
+	}
+	if options.Fix || options.RebuildMetadata || options.QuarantineFolder != "" {
+		if err := invalidateIndex(folder); err != nil {
+			return report, errors.Wrap(err, "Check")
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		report.Checked++
+		key := entry.Name()
+		issue := checkKey(path.Join(folder, key))
+		if issue == "" {
+			continue
+		}
+
+		problem := Problem{Key: key, Issue: issue}
+		rebuildable := issue == IssueMetadataMissing || issue == IssueMetadataCorrupt
+		switch {
+		case options.RebuildMetadata && rebuildable && rebuildMetadata(path.Join(folder, key)) == nil:
+			problem.Rebuilt = true
+		case options.QuarantineFolder != "":
+			if err := quarantine(folder, options.QuarantineFolder, key); err != nil {
+				return report, err
+			}
+			problem.Quarantined = true
+		case options.Fix:
+			if err := os.RemoveAll(path.Join(folder, key)); err != nil {
+				return report, errors.Wrapf(err, "Check: RemoveAll %s", key)
+			}
+			problem.Fixed = true
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+	return report, nil
+}
+
+// checkKey returns the first issue found with a key folder, or an empty string if it is healthy.
+func checkKey(keyFolder string) string {
+	metaData, err := os.ReadFile(path.Join(keyFolder, metaDataFilename))
+	if err != nil {
+		return IssueMetadataMissing
+	}
+
+	metadata, _, err := decodeMetadata(metaData)
+	if errors.Is(err, ErrUnsupportedSchema) {
+		// Metadata written by a newer version cannot be judged by this one.
+		return ""
+	} else if err != nil {
+		return IssueMetadataCorrupt
+	}
+	if metadata.Checksum == "" {
+		return ""
+	}
+
+	data, err := os.ReadFile(path.Join(keyFolder, dataFilename))
+	if err != nil {
+		return IssueDataMissing
+	}
+	if checksum(data) != metadata.Checksum {
+		return IssueChecksumMismatch
+	}
+	return ""
+}
+
+// quarantine moves a key folder into the quarantine folder.
+func quarantine(folder, quarantineFolder, key string) error {
+	if err := os.MkdirAll(quarantineFolder, fileMode); err != nil {
+		return errors.Wrap(err, "Check: MkdirAll quarantine")
+	}
+	target := path.Join(quarantineFolder, key)
+	if err := os.RemoveAll(target); err != nil {
+		return errors.Wrapf(err, "Check: RemoveAll quarantined %s", key)
+	}
+	if err := os.Rename(path.Join(folder, key), target); err != nil {
+		return errors.Wrapf(err, "Check: Rename %s", key)
+	}
+	return nil
+}
+
+// rebuildMetadata writes new metadata for a key folder from its data file.
+func rebuildMetadata(keyFolder string) error {
+	dataFile := path.Join(keyFolder, dataFilename)
+	info, err := os.Stat(dataFile)
+	if err != nil {
+		return errors.Wrap(err, "rebuildMetadata: Stat")
+	}
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		return errors.Wrap(err, "rebuildMetadata: ReadFile")
+	}
+
+	metadata := fsMetadata{
+		ValueItem:     kvstore.NewValueItem(data, info.ModTime()),
+		Checksum:      checksum(data),
+		SchemaVersion: MetadataSchemaVersion,
+	}
+	serializedData, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "rebuildMetadata: Marshal")
+	}
+	if err := os.WriteFile(path.Join(keyFolder, metaDataFilename), serializedData, fileMode); err != nil {
+		return errors.Wrap(err, "rebuildMetadata: WriteFile")
+	}
+	return nil
+}
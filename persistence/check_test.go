@@ -0,0 +1,129 @@
+package persistence_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	const folder = "TestCheck"
+	const quarantineFolder = "TestCheckQuarantine"
+	defer func() {
+		os.RemoveAll(folder)
+		os.RemoveAll(quarantineFolder)
+	}()
+
+	fs := persistence.NewFsPersistence(folder)
+	for _, k := range []string{"good", "corrupt", "missing", "badjson"} {
+		require.NoError(t, fs.Write(k, kvstore.NewValueItem([]byte("value"), time.Now())))
+	}
+	require.NoError(t, os.WriteFile(path.Join(folder, "corrupt", "data.bin"), []byte("valve"), 0700))
+	require.NoError(t, os.Remove(path.Join(folder, "missing", "data.bin")))
+	require.NoError(t, os.WriteFile(path.Join(folder, "badjson", "metadata.json"), []byte("{"), 0700))
+
+	report, err := persistence.Check(folder, persistence.CheckOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 4, report.Checked)
+	issues := make(map[string]string)
+	for _, p := range report.Problems {
+		issues[p.Key] = p.Issue
+	}
+	require.Equal(t, map[string]string{
+		"corrupt": persistence.IssueChecksumMismatch,
+		"missing": persistence.IssueDataMissing,
+		"badjson": persistence.IssueMetadataCorrupt,
+	}, issues)
+
+	report, err = persistence.Check(folder, persistence.CheckOptions{QuarantineFolder: quarantineFolder})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 3)
+	keys, err := fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"good"}, keys)
+	_, err = os.Stat(path.Join(quarantineFolder, "corrupt", "data.bin"))
+	require.NoError(t, err)
+}
+
+func TestCheckRebuildMetadata(t *testing.T) {
+	const folder = "TestCheckRebuildMetadata"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	require.NoError(t, fs.Write("counter", kvstore.NewValueItem([]byte("42"), time.Now())))
+	require.NoError(t, fs.Write("orphan", kvstore.NewValueItem([]byte("value"), time.Now())))
+	require.NoError(t, os.Remove(path.Join(folder, "counter", "metadata.json")))
+	require.NoError(t, os.Remove(path.Join(folder, "orphan", "data.bin")))
+	require.NoError(t, os.Remove(path.Join(folder, "orphan", "metadata.json")))
+
+	report, err := persistence.Check(folder, persistence.CheckOptions{RebuildMetadata: true, Fix: true})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 2)
+	for _, p := range report.Problems {
+		if p.Key == "counter" {
+			require.True(t, p.Rebuilt)
+		} else {
+			require.True(t, p.Fixed)
+		}
+	}
+
+	s, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	i, err := s.Counter("counter", 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(43), i)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"counter"}, keys)
+}
+
+func TestFilesystemCompact(t *testing.T) {
+	const folder = "TestFilesystemCompact"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	expired := kvstore.NewValueItem([]byte("old"), time.Now().Add(-time.Hour))
+	expired.TTL = 60
+	require.NoError(t, fs.Write("expired", expired))
+	require.NoError(t, fs.Write("live", kvstore.NewValueItem([]byte("new"), time.Now())))
+
+	require.NoError(t, fs.Compact())
+	keys, err := fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"live"}, keys)
+}
+
+func TestGC(t *testing.T) {
+	const folder = "TestGC"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	expired := kvstore.NewValueItem([]byte("old"), time.Now().Add(-time.Hour))
+	expired.TTL = 60
+	require.NoError(t, fs.Write("expired", expired))
+	require.NoError(t, fs.Write("live", kvstore.NewValueItem([]byte("new"), time.Now())))
+
+	report, err := persistence.GC(folder, persistence.GCOptions{DryRun: true})
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Scanned)
+	require.Equal(t, []string{"expired"}, report.Expired)
+	require.Greater(t, report.Freed, int64(0))
+	keys, err := fs.Keys()
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	report, err = persistence.GC(folder, persistence.GCOptions{Now: time.Now().Add(-2 * time.Hour)})
+	require.NoError(t, err)
+	require.Empty(t, report.Expired)
+
+	_, err = persistence.GC(folder, persistence.GCOptions{})
+	require.NoError(t, err)
+	keys, err = fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"live"}, keys)
+}
@@ -0,0 +1,240 @@
+package persistence
+
+import (
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// CompressionEnvelope is the kvstore.ValueItem Envelope entry recording how a value was compressed.
+// It is only held by the wrapped persister and is removed from items returned by Read.
+const CompressionEnvelope = "compression"
+
+// DefaultCompressionThreshold is the smallest value, in bytes, that Compressed compresses by default.
+const DefaultCompressionThreshold = 512
+
+const zstdCompression = "zstd"
+
+// Compressed wraps another DataPersister, compressing values with zstd before they are written.
+// Values smaller than the threshold, values set with kvstore.WithNoCompressionSetOption and values
+// that do not get smaller are written uncompressed, so tiny or already-compressed payloads cost no CPU on read.
+type Compressed struct {
+	wrapped
+	threshold   int
+	compression *CompressionTransformer
+}
+
+// CompressedOption configures a Compressed persister.
+type CompressedOption func(*Compressed)
+
+// WithThresholdCompressedOption returns a CompressedOption that only compresses values of at least bytes in size.
+//
+// Example:
+//
+//	NewCompressedPersistence(persister, WithThresholdCompressedOption(4096))
+func WithThresholdCompressedOption(bytes int) CompressedOption {
+	return func(c *Compressed) {
+		c.threshold = bytes
+	}
+}
+
+// NewCompressedPersistence creates a compressing wrapper around persister.
+// It can be combined with NewEncryptedPersistence by compressing before encrypting:
+//
+//	enc, _ := NewEncryptedPersistence(NewFsPersistence("./data"), keys, "v1")
+//	c, _ := NewCompressedPersistence(enc)
+func NewCompressedPersistence(persister kvstore.DataPersister, options ...CompressedOption) (*Compressed, error) {
+	c := &Compressed{
+		wrapped:   wrapped{persister},
+		threshold: DefaultCompressionThreshold,
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+
+	var err error
+	if c.compression, err = NewCompressionTransformer(c.threshold); err != nil {
+		return nil, errors.Wrap(err, "NewCompressedPersistence")
+	}
+	return c, nil
+}
+
+// Write compresses the item's data if it is worth compressing and writes it to the wrapped persister.
+func (c *Compressed) Write(key string, data *kvstore.ValueItem) error {
+	if err := c.persistence.Write(key, c.compress(key, data)); err != nil {
+		return errors.Wrap(err, "Compressed.Write")
+	}
+	return nil
+}
+
+// WriteMulti compresses every item and writes them as a batch if the wrapped persister supports it.
+func (c *Compressed) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	bw, ok := c.persistence.(kvstore.BatchWriter)
+	if !ok {
+		for k, item := range items {
+			if err := c.Write(k, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	compressed := make(map[string]*kvstore.ValueItem, len(items))
+	for k, item := range items {
+		compressed[k] = c.compress(k, item)
+	}
+	if err := bw.WriteMulti(compressed); err != nil {
+		return errors.Wrap(err, "Compressed.WriteMulti")
+	}
+	return nil
+}
+
+// compress returns a copy of the item with its data compressed and the compression recorded in its envelope.
+// Metadata-only writes keep the compression of the value already stored, as that value is not rewritten.
+func (c *Compressed) compress(key string, data *kvstore.ValueItem) *kvstore.ValueItem {
+	compressed := withEnvelope(data)
+	if data.Data == nil {
+		if stored, err := c.persistence.Read(key, false); err == nil && stored.Envelope[CompressionEnvelope] != "" {
+			compressed.Envelope[CompressionEnvelope] = stored.Envelope[CompressionEnvelope]
+		}
+		return compressed
+	}
+	encoded, _, ok, err := c.compression.Encode(key, data, data.Data)
+	if err != nil || !ok {
+		return compressed
+	}
+	compressed.Data = encoded
+	compressed.Envelope[CompressionEnvelope] = zstdCompression
+	return compressed
+}
+
+// Read reads an item from the wrapped persister, decompressing its data if requested.
+func (c *Compressed) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	item, err := c.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	return c.decompress(key, item, readValue)
+}
+
+// ReadMulti reads several items from the wrapped persister, as a batch if it supports batch reads.
+// Items that cannot be decompressed are omitted, as with items that cannot be read.
+func (c *Compressed) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	br, ok := c.persistence.(kvstore.BatchReader)
+	if !ok {
+		items := make(map[string]*kvstore.ValueItem, len(keys))
+		for _, k := range keys {
+			if item, err := c.Read(k, readValue); err == nil {
+				items[k] = item
+			}
+		}
+		return items, nil
+	}
+
+	compressed, err := br.ReadMulti(keys, readValue)
+	if err != nil {
+		return nil, errors.Wrap(err, "Compressed.ReadMulti")
+	}
+	items := make(map[string]*kvstore.ValueItem, len(compressed))
+	for k, item := range compressed {
+		if decompressed, err := c.decompress(k, item, readValue); err == nil {
+			items[k] = decompressed
+		}
+	}
+	return items, nil
+}
+
+// decompress removes the compression from an item read from the wrapped persister and decompresses its data if it was read.
+func (c *Compressed) decompress(key string, item *kvstore.ValueItem, readValue bool) (*kvstore.ValueItem, error) {
+	compression := takeEnvelope(item, CompressionEnvelope)
+	if !readValue || compression == "" {
+		return item, nil
+	}
+	if compression != zstdCompression {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "Compressed.Read key %s: unknown compression %q", key, compression)
+	}
+
+	plain, err := c.compression.Decode(key, "", item.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Compressed.Read")
+	}
+	if err := item.SetData(plain); err != nil {
+		return nil, errors.Wrap(err, "Compressed.Read SetData")
+	}
+	return item, nil
+}
+
+// Delete removes the key from the wrapped persister.
+func (c *Compressed) Delete(key string) error {
+	return c.persistence.Delete(key)
+}
+
+// Keys returns the keys held by the wrapped persister.
+func (c *Compressed) Keys() ([]string, error) {
+	return c.persistence.Keys()
+}
+
+// Close closes the wrapped persister if it holds resources, and releases the compressor.
+func (c *Compressed) Close() {
+	c.wrapped.Close()
+	c.compression.Close()
+}
+
+// CompressionTransformer is a Transformer that compresses values with zstd. Values smaller than its
+// threshold, values set with kvstore.WithNoCompressionSetOption and values that do not get smaller
+// are left as they are. It is the compressor used by Compressed.
+type CompressionTransformer struct {
+	threshold int
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// NewCompressionTransformer creates a CompressionTransformer that compresses values of at least
+// threshold bytes, such as DefaultCompressionThreshold.
+//
+// Example:
+//
+//	compression, err := NewCompressionTransformer(DefaultCompressionThreshold)
+func NewCompressionTransformer(threshold int) (*CompressionTransformer, error) {
+	t := &CompressionTransformer{threshold: threshold}
+	var err error
+	if t.encoder, err = zstd.NewWriter(nil); err != nil {
+		return nil, errors.Wrap(err, "NewCompressionTransformer zstd.NewWriter")
+	}
+	if t.decoder, err = zstd.NewReader(nil); err != nil {
+		return nil, errors.Wrap(err, "NewCompressionTransformer zstd.NewReader")
+	}
+	return t, nil
+}
+
+// Name returns "zstd".
+func (t *CompressionTransformer) Name() string {
+	return zstdCompression
+}
+
+// Encode compresses data if it is worth compressing.
+func (t *CompressionTransformer) Encode(_ string, item *kvstore.ValueItem, data []byte) ([]byte, string, bool, error) {
+	if item.NoCompression || len(data) < t.threshold {
+		return data, "", false, nil
+	}
+	encoded := t.encoder.EncodeAll(data, make([]byte, 0, len(data)))
+	if len(encoded) >= len(data) {
+		return data, "", false, nil
+	}
+	return encoded, "", true, nil
+}
+
+// Decode decompresses data.
+func (t *CompressionTransformer) Decode(key, _ string, data []byte) ([]byte, error) {
+	plain, err := t.decoder.DecodeAll(data, nil)
+	if err != nil {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "CompressionTransformer.Decode key %s: %s", key, err.Error())
+	}
+	return plain, nil
+}
+
+// Close releases the compressor.
+func (t *CompressionTransformer) Close() {
+	t.encoder.Close()
+	t.decoder.Close()
+}
@@ -0,0 +1,45 @@
+package persistence_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedThresholdAndOptOut(t *testing.T) {
+	const folder = "TestCompressedThresholdAndOptOut"
+	defer os.RemoveAll(folder)
+	large := bytes.Repeat([]byte("compressible "), 100)
+
+	fs := persistence.NewFsPersistence(folder)
+	c, err := persistence.NewCompressedPersistence(fs, persistence.WithThresholdCompressedOption(64))
+	require.NoError(t, err)
+	defer c.Close()
+	s, err := kvstore.New(kvstore.WithPersistenceOption(c))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("large", large, kvstore.WithMetaSetOption(map[string]string{"owner": "a", "compression": "user"})))
+	require.NoError(t, s.Set("small", []byte("tiny")))
+	require.NoError(t, s.Set("optout", large, kvstore.WithNoCompressionSetOption()))
+
+	sizeOnDisk := func(key string) int {
+		data, err := os.ReadFile(path.Join(folder, key, "data.bin"))
+		require.NoError(t, err)
+		return len(data)
+	}
+	require.Less(t, sizeOnDisk("large"), len(large))
+	require.Equal(t, len("tiny"), sizeOnDisk("small"))
+	require.Equal(t, len(large), sizeOnDisk("optout"))
+
+	item, err := c.Read("large", true)
+	require.NoError(t, err)
+	require.Equal(t, large, item.Data)
+	require.Equal(t, map[string]string{"owner": "a", "compression": "user"}, item.Meta)
+
+	require.NoError(t, s.Set("optout", large))
+	require.Equal(t, len(large), sizeOnDisk("optout"))
+}
@@ -0,0 +1,210 @@
+package persistence
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// ContentHashEnvelope is the kvstore.ValueItem Envelope entry recording the SHA-256 of a value stored
+// by Deduplicated. It is only held by the wrapped persister and is removed from items returned by Read.
+const ContentHashEnvelope = "content-hash"
+
+// DedupRefsEnvelope is the Envelope entry of a content blob counting the keys that reference it.
+const DedupRefsEnvelope = "refs"
+
+// DedupBlobPrefix starts the keys under which Deduplicated stores content blobs in the wrapped
+// persister. It starts with '~', which kvstore.KeyValid rejects, so blobs cannot clash with the
+// store's keys.
+const DedupBlobPrefix = "~blob-"
+
+// Deduplicated wraps another DataPersister, storing each distinct value once as a content blob keyed
+// by its SHA-256 and writing each key as a reference to its blob. Blobs count their references and
+// are deleted with the last key that references them, so many keys holding the same payload cost one
+// copy on disk. Writes and deletes are serialized, as they update reference counts. A crash part way
+// through a write can leave a blob with a reference too many, so it is kept, but never a key whose
+// blob is missing. The wrapped persister must not be shared with other writers.
+type Deduplicated struct {
+	wrapped
+	lock sync.RWMutex
+}
+
+// NewDeduplicatedPersistence creates a deduplicating wrapper around persister. Wrap it around
+// Compressed or Encrypted, rather than the other way round, so identical values are found before
+// they are transformed.
+//
+// Example:
+//
+//	c, _ := NewCompressedPersistence(NewFsPersistence("./data"))
+//	p := NewDeduplicatedPersistence(c)
+func NewDeduplicatedPersistence(persister kvstore.DataPersister) *Deduplicated {
+	return &Deduplicated{wrapped: wrapped{persister}}
+}
+
+// blobKey returns the key of the blob holding content with the given hash.
+func blobKey(hash string) string {
+	return DedupBlobPrefix + hash
+}
+
+// contentHash returns the hex encoded SHA-256 of data.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Write stores the item's data in its content blob, adding a reference to the blob, and writes the
+// key as a reference to it, releasing the blob it referenced before.
+func (d *Deduplicated) Write(key string, data *kvstore.ValueItem) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ref := withEnvelope(data)
+	previous, err := d.storedHash(key)
+	if err != nil {
+		return errors.Wrapf(err, "Deduplicated.Write key %s", key)
+	}
+
+	if data.Data == nil {
+		if previous != "" {
+			ref.Envelope[ContentHashEnvelope] = previous
+		}
+		return errors.Wrap(d.persistence.Write(key, ref), "Deduplicated.Write")
+	}
+
+	hash := contentHash(data.Data)
+	ref.Envelope[ContentHashEnvelope] = hash
+	ref.Data = []byte{}
+	if hash != previous {
+		if err := d.addRef(hash, data.Data); err != nil {
+			return errors.Wrapf(err, "Deduplicated.Write key %s", key)
+		}
+	}
+	if err := d.persistence.Write(key, ref); err != nil {
+		return errors.Wrap(err, "Deduplicated.Write")
+	}
+	if previous != "" && hash != previous {
+		if err := d.release(previous); err != nil {
+			return errors.Wrapf(err, "Deduplicated.Write key %s", key)
+		}
+	}
+	return nil
+}
+
+// storedHash returns the content hash recorded for a key, or an empty string if it is not stored
+// or was written without deduplication.
+func (d *Deduplicated) storedHash(key string) (string, error) {
+	stored, err := d.persistence.Read(key, false)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", errors.Wrap(err, "Read")
+	}
+	return stored.Envelope[ContentHashEnvelope], nil
+}
+
+// addRef adds a reference to the blob holding content, writing the blob if it does not exist.
+func (d *Deduplicated) addRef(hash string, content []byte) error {
+	blob, err := d.persistence.Read(blobKey(hash), false)
+	if errors.Is(err, os.ErrNotExist) {
+		blob := kvstore.NewValueItem(content, time.Now())
+		blob.Envelope = map[string]string{DedupRefsEnvelope: "1"}
+		return d.persistence.Write(blobKey(hash), blob)
+	} else if err != nil {
+		return errors.Wrapf(err, "blob %s", hash)
+	}
+	return d.setRefs(hash, blob, blobRefs(blob)+1)
+}
+
+// release removes a reference from a blob, deleting it when no references remain. A blob that is
+// already gone needs no release.
+func (d *Deduplicated) release(hash string) error {
+	blob, err := d.persistence.Read(blobKey(hash), false)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "blob %s", hash)
+	}
+	refs := blobRefs(blob) - 1
+	if refs <= 0 {
+		return d.persistence.Delete(blobKey(hash))
+	}
+	return d.setRefs(hash, blob, refs)
+}
+
+// setRefs writes a blob's reference count without rewriting its content.
+func (d *Deduplicated) setRefs(hash string, blob *kvstore.ValueItem, refs int) error {
+	return d.persistence.Write(blobKey(hash), &kvstore.ValueItem{
+		Ts:       time.Now(),
+		Size:     blob.Size,
+		Envelope: map[string]string{DedupRefsEnvelope: strconv.Itoa(refs)},
+	})
+}
+
+func blobRefs(blob *kvstore.ValueItem) int {
+	refs, _ := strconv.Atoi(blob.Envelope[DedupRefsEnvelope])
+	return refs
+}
+
+// Read reads a key from the wrapped persister and, if its data is requested, reads its content blob.
+func (d *Deduplicated) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	item, err := d.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	hash := takeEnvelope(item, ContentHashEnvelope)
+	if !readValue || hash == "" {
+		return item, nil
+	}
+
+	blob, err := d.persistence.Read(blobKey(hash), true)
+	if err != nil {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "Deduplicated.Read key %s: blob %s: %s", key, hash, err.Error())
+	}
+	if err := item.SetData(blob.Data); err != nil {
+		return nil, errors.Wrap(err, "Deduplicated.Read SetData")
+	}
+	return item, nil
+}
+
+// Delete removes the key from the wrapped persister and releases its content blob.
+func (d *Deduplicated) Delete(key string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	hash, err := d.storedHash(key)
+	if err != nil {
+		return errors.Wrapf(err, "Deduplicated.Delete key %s", key)
+	}
+	if err := d.persistence.Delete(key); err != nil {
+		return errors.Wrap(err, "Deduplicated.Delete")
+	}
+	if hash == "" {
+		return nil
+	}
+	return errors.Wrapf(d.release(hash), "Deduplicated.Delete key %s", key)
+}
+
+// Keys returns the keys held by the wrapped persister, without the content blobs.
+func (d *Deduplicated) Keys() ([]string, error) {
+	keys, err := d.persistence.Keys()
+	if err != nil {
+		return nil, err
+	}
+	filtered := keys[:0]
+	for _, k := range keys {
+		if !strings.HasPrefix(k, DedupBlobPrefix) {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered, nil
+}
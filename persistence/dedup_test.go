@@ -0,0 +1,101 @@
+package persistence_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeduplicated(t *testing.T) {
+	const folder = "TestDeduplicated"
+	defer os.RemoveAll(folder)
+	payload := bytes.Repeat([]byte("shared payload "), 100)
+
+	fs := persistence.NewFsPersistence(folder)
+	p := persistence.NewDeduplicatedPersistence(fs)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p))
+	require.NoError(t, err)
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, s.Set(k, payload, kvstore.WithMetaSetOption(map[string]string{"owner": k, "content-hash": "user"})))
+	}
+
+	blobs := func() []string {
+		keys, err := fs.Keys()
+		require.NoError(t, err)
+		var blobs []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, persistence.DedupBlobPrefix) {
+				blobs = append(blobs, k)
+			}
+		}
+		return blobs
+	}
+	require.Len(t, blobs(), 1)
+	blob, err := fs.Read(blobs()[0], false)
+	require.NoError(t, err)
+	require.Equal(t, "3", blob.Envelope[persistence.DedupRefsEnvelope])
+
+	// Keys list only the user's keys, and values and metadata read back.
+	keys, err := p.Keys()
+	require.NoError(t, err)
+	sort.Strings(keys)
+	require.Equal(t, []string{"a", "b", "c"}, keys)
+	item, err := p.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, payload, item.Data)
+	require.Equal(t, map[string]string{"owner": "b", "content-hash": "user"}, item.Meta)
+
+	// Overwriting a key moves its reference to a new blob.
+	require.NoError(t, s.Set("c", []byte("different")))
+	require.Len(t, blobs(), 2)
+	require.NoError(t, s.Delete("c"))
+	require.Len(t, blobs(), 1)
+
+	// The blob is deleted with the last key referencing it.
+	require.NoError(t, s.Delete("a"))
+	require.Len(t, blobs(), 1)
+	require.NoError(t, s.Delete("b"))
+	require.Empty(t, blobs())
+
+	// Blob keys cannot be set through the store.
+	require.ErrorIs(t, s.Set(persistence.DedupBlobPrefix+"x", payload), kvstore.ErrKeyInvalid)
+}
+
+// failingBlobReads fails reads of content blobs, as a backend might on a transient error.
+type failingBlobReads struct {
+	kvstore.DataPersister
+}
+
+func (f failingBlobReads) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	if strings.HasPrefix(key, persistence.DedupBlobPrefix) {
+		return nil, errors.New("backend unavailable")
+	}
+	return f.DataPersister.Read(key, readValue)
+}
+
+func TestDeduplicatedReadErrors(t *testing.T) {
+	const folder = "TestDeduplicatedReadErrors"
+	defer os.RemoveAll(folder)
+	payload := []byte("payload")
+
+	fs := persistence.NewFsPersistence(folder)
+	require.NoError(t, persistence.NewDeduplicatedPersistence(fs).Write("a", kvstore.NewValueItem(payload, time.Now())))
+
+	// A blob that cannot be read is not recreated, losing the references it holds.
+	p := persistence.NewDeduplicatedPersistence(failingBlobReads{fs})
+	require.Error(t, p.Write("b", kvstore.NewValueItem(payload, time.Now())))
+	item, err := persistence.NewDeduplicatedPersistence(fs).Read("a", true)
+	require.NoError(t, err)
+	require.Equal(t, payload, item.Data)
+
+	// Nor is a failure to release it ignored.
+	require.Error(t, p.Delete("a"))
+}
@@ -0,0 +1,313 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// DeltaCountEnvelope is the kvstore.ValueItem Envelope entry recording how many deltas follow a
+// value's last full version. It is only held by the wrapped persister and is removed from items
+// returned by Read.
+const DeltaCountEnvelope = "deltas"
+
+// DeltaKeyPrefix starts the keys under which Delta stores the deltas of a value in the wrapped
+// persister, followed by the delta's number and the value's key. It starts with '~', which
+// kvstore.KeyValid rejects, so deltas cannot clash with the store's keys.
+const DeltaKeyPrefix = "~delta-"
+
+// DefaultDeltaThreshold is the smallest value, in bytes, that Delta stores as deltas by default.
+const DefaultDeltaThreshold = 64 << 10
+
+// DefaultDeltaCheckpoint is the number of deltas Delta writes by default before writing a value in full again.
+const DefaultDeltaCheckpoint = 16
+
+// Delta wraps another DataPersister, writing changes to large values as deltas against their last
+// full version rather than rewriting them, to cut write bandwidth for values that change often.
+// Ranges written with kvstore.Store.Patch become deltas directly; other writes are compared with the
+// stored value, which is read back, and the changed range between their common prefix and suffix is
+// written, which suits appends and edits to one region. A full checkpoint is written after a number
+// of deltas, or when the changed range is at least half the value, bounding the work of reads, which
+// rebuild values from their checkpoint and deltas. Writes and deletes are serialized.
+type Delta struct {
+	wrapped
+	threshold  int
+	checkpoint int
+	lock       sync.RWMutex
+}
+
+// DeltaOption configures a Delta persister.
+type DeltaOption func(*Delta)
+
+// WithThresholdDeltaOption returns a DeltaOption that only stores values of at least bytes in size
+// as deltas. Smaller values are always written in full.
+//
+// Example:
+//
+//	NewDeltaPersistence(persister, WithThresholdDeltaOption(1<<20))
+func WithThresholdDeltaOption(bytes int) DeltaOption {
+	return func(d *Delta) {
+		d.threshold = bytes
+	}
+}
+
+// WithCheckpointDeltaOption returns a DeltaOption that writes a value in full once it has n deltas.
+//
+// Example:
+//
+//	NewDeltaPersistence(persister, WithCheckpointDeltaOption(64))
+func WithCheckpointDeltaOption(n int) DeltaOption {
+	return func(d *Delta) {
+		d.checkpoint = n
+	}
+}
+
+// NewDeltaPersistence creates a wrapper around persister that writes changes to large values as deltas.
+//
+// Example:
+//
+//	p := NewDeltaPersistence(NewFsPersistence("./data"))
+//	kv, _ := kvstore.New(kvstore.WithPersistenceOption(p))
+//	kv.Patch("log", offset, entry) // Writes only the entry.
+func NewDeltaPersistence(persister kvstore.DataPersister, options ...DeltaOption) *Delta {
+	d := &Delta{
+		wrapped:    wrapped{persister},
+		threshold:  DefaultDeltaThreshold,
+		checkpoint: DefaultDeltaCheckpoint,
+	}
+	for _, opt := range options {
+		opt(d)
+	}
+	return d
+}
+
+// deltaKey returns the key of a value's nth delta.
+func deltaKey(key string, n int) string {
+	return DeltaKeyPrefix + strconv.Itoa(n) + "-" + key
+}
+
+// delta replaces removed bytes at offset in a value with inserted bytes.
+type delta struct {
+	offset   int
+	removed  int
+	inserted []byte
+}
+
+func (d delta) encode() []byte {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(d.inserted))
+	buf = binary.AppendUvarint(buf, uint64(d.offset))
+	buf = binary.AppendUvarint(buf, uint64(d.removed))
+	return append(buf, d.inserted...)
+}
+
+func decodeDelta(data []byte) (delta, error) {
+	offset, n := binary.Uvarint(data)
+	if n <= 0 {
+		return delta{}, errors.New("invalid offset")
+	}
+	removed, m := binary.Uvarint(data[n:])
+	if m <= 0 {
+		return delta{}, errors.New("invalid length")
+	}
+	if offset > math.MaxInt || removed > math.MaxInt {
+		return delta{}, errors.Errorf("delta at %d removing %d bytes is out of range", offset, removed)
+	}
+	return delta{offset: int(offset), removed: int(removed), inserted: data[n+m:]}, nil
+}
+
+// apply returns value with the delta applied.
+func (d delta) apply(value []byte) ([]byte, error) {
+	if d.offset < 0 || d.removed < 0 || d.offset > len(value)-d.removed {
+		return nil, errors.Errorf("delta at %d removing %d bytes exceeds value of %d bytes", d.offset, d.removed, len(value))
+	}
+	out := make([]byte, 0, len(value)-d.removed+len(d.inserted))
+	out = append(out, value[:d.offset]...)
+	out = append(out, d.inserted...)
+	return append(out, value[d.offset+d.removed:]...), nil
+}
+
+// diff returns the delta that turns old into updated, replacing the range between their common
+// prefix and suffix.
+func diff(old, updated []byte) delta {
+	prefix := 0
+	for prefix < len(old) && prefix < len(updated) && old[prefix] == updated[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(updated)-prefix && old[len(old)-1-suffix] == updated[len(updated)-1-suffix] {
+		suffix++
+	}
+	return delta{offset: prefix, removed: len(old) - prefix - suffix, inserted: updated[prefix : len(updated)-suffix]}
+}
+
+// Write writes the item as a delta against the stored value if the change is small enough,
+// otherwise as a full checkpoint.
+func (d *Delta) Write(key string, data *kvstore.ValueItem) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if data.Data == nil {
+		stored, err := d.persistence.Read(key, false)
+		if err != nil || stored.Envelope[DeltaCountEnvelope] == "" {
+			return errors.Wrap(d.persistence.Write(key, data), "Delta.Write")
+		}
+		return errors.Wrap(d.persistence.Write(key, withDeltaCount(data, deltaCount(stored))), "Delta.Write")
+	}
+
+	if len(data.Data) >= d.threshold {
+		if stored, err := d.read(key, true); err == nil {
+			return d.writeDelta(key, data, deltaCount(stored), diff(stored.Data, data.Data))
+		}
+	}
+	return d.writeCheckpoint(key, data)
+}
+
+// Patch writes the patched range as a delta, writing the whole item if the value is not stored as
+// deltas or is due a checkpoint.
+func (d *Delta) Patch(key string, offset int64, data []byte, item *kvstore.ValueItem) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	stored, err := d.persistence.Read(key, false)
+	if err != nil || len(item.Data) < d.threshold {
+		return d.writeCheckpoint(key, item)
+	}
+	// The value only grows, so the patch replaces stored bytes up to the old end.
+	removed := min(len(data), max(int(stored.Size)-int(offset), 0))
+	return d.writeDelta(key, item, deltaCount(stored), delta{offset: int(offset), removed: removed, inserted: data})
+}
+
+// writeDelta writes the nth delta of a value, then records it in the value's envelope, so a delta
+// written by an interrupted write is not read. A checkpoint is written instead if it is due.
+// The caller must hold the write lock.
+func (d *Delta) writeDelta(key string, item *kvstore.ValueItem, n int, change delta) error {
+	if n+1 > d.checkpoint || 2*len(change.inserted) >= len(item.Data) {
+		return d.writeCheckpoint(key, item)
+	}
+	record := kvstore.NewValueItem(change.encode(), item.Ts)
+	if err := d.persistence.Write(deltaKey(key, n+1), record); err != nil {
+		return errors.Wrapf(err, "Delta.Write key %s delta %d", key, n+1)
+	}
+	meta := item.Clone()
+	meta.Data = nil
+	if err := d.persistence.Write(key, withDeltaCount(meta, n+1)); err != nil {
+		return errors.Wrapf(err, "Delta.Write key %s", key)
+	}
+	return nil
+}
+
+// writeCheckpoint writes the item in full, then deletes the deltas of its previous version.
+// The caller must hold the write lock.
+func (d *Delta) writeCheckpoint(key string, item *kvstore.ValueItem) error {
+	n := 0
+	if stored, err := d.persistence.Read(key, false); err == nil {
+		n = deltaCount(stored)
+	}
+	if err := d.persistence.Write(key, withDeltaCount(item, 0)); err != nil {
+		return errors.Wrap(err, "Delta.Write")
+	}
+	return d.deleteDeltas(key, n)
+}
+
+// deleteDeltas deletes a value's first n deltas.
+func (d *Delta) deleteDeltas(key string, n int) error {
+	for i := 1; i <= n; i++ {
+		if err := d.persistence.Delete(deltaKey(key, i)); err != nil {
+			return errors.Wrapf(err, "Delta key %s delta %d", key, i)
+		}
+	}
+	return nil
+}
+
+// withDeltaCount returns a copy of item recording its number of deltas in its envelope.
+func withDeltaCount(item *kvstore.ValueItem, n int) *kvstore.ValueItem {
+	counted := withEnvelope(item)
+	counted.Envelope[DeltaCountEnvelope] = strconv.Itoa(n)
+	return counted
+}
+
+func deltaCount(item *kvstore.ValueItem) int {
+	n, _ := strconv.Atoi(item.Envelope[DeltaCountEnvelope])
+	return n
+}
+
+// Read reads an item from the wrapped persister, rebuilding its value from its last full version
+// and deltas if its data is requested.
+func (d *Delta) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	item, err := d.read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	takeEnvelope(item, DeltaCountEnvelope)
+	return item, nil
+}
+
+// read reads an item, applying its deltas if its data is requested, and keeps its delta count.
+// The caller must hold the lock.
+func (d *Delta) read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	item, err := d.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	n := deltaCount(item)
+	if !readValue || n == 0 {
+		return item, nil
+	}
+
+	value := item.Data
+	for i := 1; i <= n; i++ {
+		record, err := d.persistence.Read(deltaKey(key, i), true)
+		if err != nil {
+			return nil, errors.Wrapf(kvstore.ErrCorrupted, "Delta.Read key %s delta %d: %s", key, i, err.Error())
+		}
+		change, err := decodeDelta(record.Data)
+		if err == nil {
+			value, err = change.apply(value)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(kvstore.ErrCorrupted, "Delta.Read key %s delta %d: %s", key, i, err.Error())
+		}
+	}
+	if err := item.SetData(value); err != nil {
+		return nil, errors.Wrap(err, "Delta.Read SetData")
+	}
+	return item, nil
+}
+
+// Delete removes the key and its deltas from the wrapped persister.
+func (d *Delta) Delete(key string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	n := 0
+	if stored, err := d.persistence.Read(key, false); err == nil {
+		n = deltaCount(stored)
+	}
+	if err := d.persistence.Delete(key); err != nil {
+		return errors.Wrap(err, "Delta.Delete")
+	}
+	return d.deleteDeltas(key, n)
+}
+
+// Keys returns the keys held by the wrapped persister, without the deltas.
+func (d *Delta) Keys() ([]string, error) {
+	keys, err := d.persistence.Keys()
+	if err != nil {
+		return nil, err
+	}
+	filtered := keys[:0]
+	for _, k := range keys {
+		if !strings.HasPrefix(k, DeltaKeyPrefix) {
+			filtered = append(filtered, k)
+		}
+	}
+	return filtered, nil
+}
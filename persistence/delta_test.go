@@ -0,0 +1,104 @@
+package persistence_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeltaPersistence(t *testing.T) {
+	const folder = "TestDeltaPersistence"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	newStore := func() *kvstore.Store {
+		p := persistence.NewDeltaPersistence(fs, persistence.WithThresholdDeltaOption(16), persistence.WithCheckpointDeltaOption(3))
+		s, err := kvstore.New(kvstore.WithPersistenceOption(p))
+		require.NoError(t, err)
+		return s
+	}
+	deltas := func() []string {
+		keys, err := fs.Keys()
+		require.NoError(t, err)
+		var deltas []string
+		for _, k := range keys {
+			if strings.HasPrefix(k, persistence.DeltaKeyPrefix) {
+				deltas = append(deltas, k)
+			}
+		}
+		return deltas
+	}
+	checkpoint := func() []byte {
+		data, err := os.ReadFile(path.Join(folder, "doc", "data.bin"))
+		require.NoError(t, err)
+		return data
+	}
+
+	base := bytes.Repeat([]byte("0123456789"), 10)
+	s := newStore()
+	require.NoError(t, s.Set("doc", base, kvstore.WithMetaSetOption(map[string]string{"deltas": "user"})))
+	require.Empty(t, deltas())
+
+	// Patches and small changes are written as deltas, leaving the checkpoint as it was.
+	require.NoError(t, s.Patch("doc", 10, []byte("XY")))
+	expected := append(append(append([]byte{}, base[:10]...), "XY"...), base[12:]...)
+	require.NoError(t, s.Set("doc", append(append([]byte{}, expected...), "appended"...)))
+	expected = append(expected, "appended"...)
+	require.Len(t, deltas(), 2)
+	require.Equal(t, base, checkpoint())
+
+	// Values are rebuilt from the checkpoint and deltas when read.
+	s = newStore()
+	v, err := s.Get("doc")
+	require.NoError(t, err)
+	require.Equal(t, expected, v)
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"doc"}, keys)
+	info, err := s.GetMetadata("doc")
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"deltas": "user"}, info.Meta)
+	require.ErrorIs(t, s.Set(persistence.DeltaKeyPrefix+"1-doc", base), kvstore.ErrKeyInvalid)
+
+	// A checkpoint is written once the value has enough deltas, removing them.
+	require.NoError(t, s.Patch("doc", 0, []byte("A")))
+	require.Len(t, deltas(), 3)
+	require.NoError(t, s.Patch("doc", 1, []byte("B")))
+	require.Empty(t, deltas())
+	expected[0], expected[1] = 'A', 'B'
+	require.Equal(t, expected, checkpoint())
+
+	// Deleting the key removes its deltas.
+	require.NoError(t, s.Patch("doc", 2, []byte("C")))
+	require.Len(t, deltas(), 1)
+	require.NoError(t, s.Delete("doc"))
+	require.Empty(t, deltas())
+}
+
+func TestDeltaCorruptRecord(t *testing.T) {
+	const folder = "TestDeltaCorruptRecord"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(folder)
+	item := kvstore.NewValueItem([]byte("value"), time.Now())
+	item.Envelope = map[string]string{persistence.DeltaCountEnvelope: "1"}
+	require.NoError(t, fs.Write("doc", item))
+
+	// Offsets and lengths that overflow int, or run past the value, are rejected rather than panicking.
+	for _, record := range [][]byte{
+		binary.AppendUvarint(binary.AppendUvarint(nil, math.MaxUint64), 1),
+		binary.AppendUvarint(binary.AppendUvarint(nil, 1), math.MaxUint64),
+		binary.AppendUvarint(binary.AppendUvarint(nil, 3), 3),
+	} {
+		require.NoError(t, fs.Write(persistence.DeltaKeyPrefix+"1-doc", kvstore.NewValueItem(record, time.Now())))
+		_, err := persistence.NewDeltaPersistence(fs).Read("doc", true)
+		require.ErrorIs(t, err, kvstore.ErrCorrupted)
+	}
+}
@@ -0,0 +1,476 @@
+package persistence
+
+import (
+	"container/list"
+	"hash/fnv"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DiskCache wraps a remote DataPersister, such as an S3 or SQL backend, with a bounded local
+// persister holding copies of the most recently read values, so that cold reads of keys the store
+// has unloaded avoid the network more often without holding every value in memory. Writes go to the
+// remote persister first and are then copied locally; reads that miss the local copy are served by
+// the remote persister and copied locally, evicting the least recently used values once the local
+// copies exceed the size limit. The local copies survive restarts. Changes made to the remote
+// persister by another process are not seen until the key is evicted or written, so the cache is not
+// suited to remote persisters shared with other writers.
+type DiskCache struct {
+	wrapped  // The remote persister.
+	local    kvstore.DataPersister
+	maxBytes int64
+	keyLocks [diskCacheStripes]sync.Mutex // Serialize local reads, writes and deletes of each key.
+	lock     sync.Mutex                   // Guards the fields below, and is never held during I/O.
+	order    *list.List                   // Most recently used first; elements hold the key.
+	entries  map[string]*diskCacheEntry
+	bytes    int64
+	pending  map[string]*diskCacheGeneration // Keys being read from or written to the remote persister.
+}
+
+// diskCacheStripes is the number of mutexes shared between all keys for local I/O.
+const diskCacheStripes = 64
+
+type diskCacheEntry struct {
+	size    int64
+	element *list.Element
+}
+
+// diskCacheGeneration counts the invalidations of a key while it is read from or written to the
+// remote persister, so a value read before a write completed is not copied locally.
+type diskCacheGeneration struct {
+	gen  uint64
+	refs int
+}
+
+// NewDiskCache creates a cache of up to maxBytes of values from remote, held in local, such as a
+// Filesystem on a local disk. Values already held by local, from before a restart, are kept, with
+// the most recently written treated as the most recently used; local must not be used for anything else.
+//
+// Example:
+//
+//	cached, err := NewDiskCache(remote, NewFsPersistence("/var/cache/kvstore"), 10<<30)
+func NewDiskCache(remote, local kvstore.DataPersister, maxBytes int64) (*DiskCache, error) {
+	d := &DiskCache{
+		wrapped:  wrapped{remote},
+		local:    local,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*diskCacheEntry),
+		pending:  make(map[string]*diskCacheGeneration),
+	}
+	keys, err := local.Keys()
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "NewDiskCache Keys")
+	}
+	items, err := readMultiLocal(local, keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewDiskCache")
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := items[keys[i]], items[keys[j]]
+		return a != nil && (b == nil || a.Ts.Before(b.Ts))
+	})
+
+	var unreadable []string
+	d.lock.Lock()
+	for _, k := range keys {
+		if item, ok := items[k]; ok {
+			d.track(k, item.Size)
+		} else {
+			unreadable = append(unreadable, k)
+		}
+	}
+	evicted := d.evict()
+	d.lock.Unlock()
+	d.deleteLocal(append(unreadable, evicted...))
+	return d, nil
+}
+
+// readMultiLocal reads the metadata of keys from the local persister.
+func readMultiLocal(local kvstore.DataPersister, keys []string) (map[string]*kvstore.ValueItem, error) {
+	if br, ok := local.(kvstore.BatchReader); ok {
+		return br.ReadMulti(keys, false)
+	}
+	items := make(map[string]*kvstore.ValueItem, len(keys))
+	for _, k := range keys {
+		if item, err := local.Read(k, false); err == nil {
+			items[k] = item
+		}
+	}
+	return items, nil
+}
+
+// Write writes the item to the remote persister and copies it locally. Metadata-only writes update
+// the local copy's metadata if the value is cached.
+func (d *DiskCache) Write(key string, data *kvstore.ValueItem) error {
+	if data.Data == nil {
+		if err := d.persistence.Write(key, data); err != nil {
+			return errors.Wrap(err, "DiskCache.Write")
+		}
+		d.writeMetadata(key, data)
+		return nil
+	}
+
+	gen := d.begin(key, true)
+	defer d.end(key)
+	if err := d.persistence.Write(key, data); err != nil {
+		return errors.Wrap(err, "DiskCache.Write")
+	}
+	d.put(key, data, gen)
+	return nil
+}
+
+// WriteMulti writes the items to the remote persister, as a batch if it supports it, and copies them locally.
+func (d *DiskCache) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	bw, ok := d.persistence.(kvstore.BatchWriter)
+	if !ok {
+		for k, item := range items {
+			if err := d.Write(k, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gens := make(map[string]uint64, len(items))
+	for k, item := range items {
+		if item.Data != nil {
+			gens[k] = d.begin(k, true)
+			defer d.end(k)
+		}
+	}
+	if err := bw.WriteMulti(items); err != nil {
+		return errors.Wrap(err, "DiskCache.WriteMulti")
+	}
+	for k, item := range items {
+		if item.Data == nil {
+			d.writeMetadata(k, item)
+		} else {
+			d.put(k, item, gens[k])
+		}
+	}
+	return nil
+}
+
+// Read reads the key's local copy if it is cached, otherwise it reads the key from the remote
+// persister, copying the value locally if it was read.
+func (d *DiskCache) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	if item, ok := d.get(key, readValue); ok {
+		return item, nil
+	}
+	gen := d.begin(key, false)
+	defer d.end(key)
+	item, err := d.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	if readValue {
+		d.put(key, item, gen)
+	}
+	return item, nil
+}
+
+// ReadMulti reads several keys, serving cached keys from their local copies and reading the rest
+// from the remote persister as a batch if it supports batch reads.
+func (d *DiskCache) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	items := make(map[string]*kvstore.ValueItem, len(keys))
+	gens := make(map[string]uint64, len(keys))
+	missing := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if item, ok := d.get(k, readValue); ok {
+			items[k] = item
+		} else if _, ok := gens[k]; !ok {
+			gens[k] = d.begin(k, false)
+			defer d.end(k)
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return items, nil
+	}
+
+	var read map[string]*kvstore.ValueItem
+	if br, ok := d.persistence.(kvstore.BatchReader); ok {
+		var err error
+		if read, err = br.ReadMulti(missing, readValue); err != nil {
+			return nil, errors.Wrap(err, "DiskCache.ReadMulti")
+		}
+	} else {
+		read = make(map[string]*kvstore.ValueItem, len(missing))
+		for _, k := range missing {
+			if item, err := d.persistence.Read(k, readValue); err == nil {
+				read[k] = item
+			}
+		}
+	}
+	for k, item := range read {
+		if readValue {
+			d.put(k, item, gens[k])
+		}
+		items[k] = item
+	}
+	return items, nil
+}
+
+// Delete removes the key's local copy and removes it from the remote persister.
+func (d *DiskCache) Delete(key string) error {
+	d.invalidate(key)
+	return d.persistence.Delete(key)
+}
+
+// DeleteMulti removes the keys' local copies and removes them from the remote persister, as a batch
+// if it supports it.
+func (d *DiskCache) DeleteMulti(keys []string) error {
+	for _, k := range keys {
+		d.invalidate(k)
+	}
+	if bd, ok := d.persistence.(kvstore.BatchDeleter); ok {
+		return bd.DeleteMulti(keys)
+	}
+	for _, k := range keys {
+		if err := d.persistence.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys held by the remote persister.
+func (d *DiskCache) Keys() ([]string, error) {
+	return d.persistence.Keys()
+}
+
+// Len returns the number of keys with a local copy.
+func (d *DiskCache) Len() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.entries)
+}
+
+// Bytes returns the total size of the values with a local copy.
+func (d *DiskCache) Bytes() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.bytes
+}
+
+// Close closes the remote and local persisters if they hold resources.
+func (d *DiskCache) Close() {
+	d.wrapped.Close()
+	if cl, ok := d.local.(interface{ Close() }); ok {
+		cl.Close()
+	}
+}
+
+// get reads a key's local copy if it is cached, marking it as recently used. A local copy that
+// cannot be read is dropped, so the key is read from the remote persister instead.
+func (d *DiskCache) get(key string, readValue bool) (*kvstore.ValueItem, bool) {
+	kl := d.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+
+	d.lock.Lock()
+	entry, ok := d.entries[key]
+	if ok {
+		d.order.MoveToFront(entry.element)
+	}
+	d.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	item, err := d.local.Read(key, readValue)
+	if err != nil {
+		log.Warn().Msgf("[kvstore disk cache] error reading cached key %s: %s", key, err.Error())
+		d.lock.Lock()
+		d.untrack(key)
+		d.lock.Unlock()
+		d.removeLocal(key)
+		return nil, false
+	}
+	return item, true
+}
+
+// begin registers a read from or write to the remote persister of a key, returning the key's
+// generation to pass to put. Writes start a new generation, so reads begun before them are not
+// copied locally, and drop the key's local copy. Each call must be followed by end.
+func (d *DiskCache) begin(key string, write bool) uint64 {
+	d.lock.Lock()
+	g, ok := d.pending[key]
+	if !ok {
+		g = &diskCacheGeneration{}
+		d.pending[key] = g
+	}
+	g.refs++
+	tracked := false
+	if write {
+		g.gen++
+		tracked = d.untrack(key)
+	}
+	gen := g.gen
+	d.lock.Unlock()
+	if tracked {
+		d.deleteLocal([]string{key})
+	}
+	return gen
+}
+
+// end releases a key registered with begin.
+func (d *DiskCache) end(key string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if g := d.pending[key]; g != nil {
+		if g.refs--; g.refs == 0 {
+			delete(d.pending, key)
+		}
+	}
+}
+
+// current reports whether gen is still the generation of a key registered with begin. The caller
+// must hold the lock.
+func (d *DiskCache) current(key string, gen uint64) bool {
+	g, ok := d.pending[key]
+	return ok && g.gen == gen
+}
+
+// put copies a value read from or written to the remote persister locally, evicting the least
+// recently used values if the cache is full. Nothing is copied if the key was invalidated since
+// gen was taken with begin, as the value may be stale, or if the value alone exceeds the size limit.
+func (d *DiskCache) put(key string, item *kvstore.ValueItem, gen uint64) {
+	if int64(len(item.Data)) > d.maxBytes {
+		return
+	}
+	kl := d.keyLock(key)
+	kl.Lock()
+	d.lock.Lock()
+	current := d.current(key, gen)
+	d.lock.Unlock()
+	if !current {
+		kl.Unlock()
+		return
+	}
+
+	if err := d.local.Write(key, item); err != nil {
+		log.Warn().Msgf("[kvstore disk cache] error caching key %s: %s", key, err.Error())
+		d.lock.Lock()
+		d.untrack(key)
+		d.lock.Unlock()
+		d.removeLocal(key)
+		kl.Unlock()
+		return
+	}
+
+	d.lock.Lock()
+	current = d.current(key, gen)
+	var evicted []string
+	if current {
+		d.untrack(key)
+		d.track(key, int64(len(item.Data)))
+		evicted = d.evict()
+	}
+	d.lock.Unlock()
+	if !current {
+		d.removeLocal(key)
+	}
+	kl.Unlock()
+	d.deleteLocal(evicted)
+}
+
+// writeMetadata updates the metadata of a key's local copy if it is cached.
+func (d *DiskCache) writeMetadata(key string, item *kvstore.ValueItem) {
+	kl := d.keyLock(key)
+	kl.Lock()
+	defer kl.Unlock()
+	d.lock.Lock()
+	_, ok := d.entries[key]
+	d.lock.Unlock()
+	if !ok {
+		return
+	}
+	if err := d.local.Write(key, item); err != nil {
+		log.Warn().Msgf("[kvstore disk cache] error caching metadata of key %s: %s", key, err.Error())
+		d.lock.Lock()
+		d.untrack(key)
+		d.lock.Unlock()
+		d.removeLocal(key)
+	}
+}
+
+// invalidate drops a key's local copy, and starts a new generation for reads of it in progress.
+func (d *DiskCache) invalidate(key string) {
+	d.lock.Lock()
+	if g, ok := d.pending[key]; ok {
+		g.gen++
+	}
+	tracked := d.untrack(key)
+	d.lock.Unlock()
+	if tracked {
+		d.deleteLocal([]string{key})
+	}
+}
+
+// track records a local copy as the most recently used. The caller must hold the lock.
+func (d *DiskCache) track(key string, size int64) {
+	d.entries[key] = &diskCacheEntry{size: size, element: d.order.PushFront(key)}
+	d.bytes += size
+}
+
+// untrack forgets a key's local copy, reporting whether it had one. The caller must hold the lock.
+func (d *DiskCache) untrack(key string) bool {
+	entry, ok := d.entries[key]
+	if ok {
+		d.bytes -= entry.size
+		d.order.Remove(entry.element)
+		delete(d.entries, key)
+	}
+	return ok
+}
+
+// evict forgets the least recently used local copies until the cache is within its size limit,
+// returning their keys for deleteLocal. The caller must hold the lock.
+func (d *DiskCache) evict() []string {
+	var evicted []string
+	for d.bytes > d.maxBytes && d.order.Len() > 0 {
+		key := d.order.Back().Value.(string)
+		d.untrack(key)
+		evicted = append(evicted, key)
+	}
+	return evicted
+}
+
+// deleteLocal deletes the local copies of untracked keys, unless a copy was put again meanwhile.
+// The caller must not hold the lock or a key lock.
+func (d *DiskCache) deleteLocal(keys []string) {
+	for _, key := range keys {
+		kl := d.keyLock(key)
+		kl.Lock()
+		d.lock.Lock()
+		_, tracked := d.entries[key]
+		d.lock.Unlock()
+		if !tracked {
+			d.removeLocal(key)
+		}
+		kl.Unlock()
+	}
+}
+
+// removeLocal deletes a key's local copy. The caller must hold the key's lock.
+func (d *DiskCache) removeLocal(key string) {
+	if err := d.local.Delete(key); err != nil && !errors.Is(err, os.ErrNotExist) && !errors.Is(err, kvstore.ErrNotFound) {
+		log.Warn().Msgf("[kvstore disk cache] error deleting cached key %s: %s", key, err.Error())
+	}
+}
+
+// keyLock returns the mutex serializing local I/O of a key.
+func (d *DiskCache) keyLock(key string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &d.keyLocks[h.Sum32()%diskCacheStripes]
+}
@@ -0,0 +1,125 @@
+package persistence_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+// countingReader counts the reads of the persister it wraps.
+type countingReader struct {
+	kvstore.DataPersister
+	reads int
+}
+
+func (c *countingReader) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	c.reads++
+	return c.DataPersister.Read(key, readValue)
+}
+
+func TestDiskCache(t *testing.T) {
+	const folder = "TestDiskCache"
+	defer os.RemoveAll(folder)
+	remote := &countingReader{DataPersister: persistence.NewFsPersistence(path.Join(folder, "remote"))}
+	local := persistence.NewFsPersistence(path.Join(folder, "local"))
+	cache, err := persistence.NewDiskCache(remote, local, 10)
+	require.NoError(t, err)
+	now := time.Now()
+
+	// Written values are copied locally and read back without going to the remote persister.
+	require.NoError(t, cache.Write("a", kvstore.NewValueItem([]byte("aaaa"), now)))
+	require.NoError(t, cache.Write("b", kvstore.NewValueItem([]byte("bbbb"), now.Add(time.Second))))
+	item, err := cache.Read("a", true)
+	require.NoError(t, err)
+	require.Equal(t, "aaaa", string(item.Data))
+	require.Equal(t, 0, remote.reads)
+	require.Equal(t, int64(8), cache.Bytes())
+
+	// The least recently used value is evicted once the size limit is exceeded.
+	require.NoError(t, cache.Write("c", kvstore.NewValueItem([]byte("cccc"), now.Add(2*time.Second))))
+	require.Equal(t, 2, cache.Len())
+	_, err = local.Read("b", true)
+	require.Error(t, err)
+
+	// Misses are read from the remote persister and copied locally.
+	item, err = cache.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, "bbbb", string(item.Data))
+	require.Equal(t, 1, remote.reads)
+	_, err = cache.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, 1, remote.reads)
+	require.LessOrEqual(t, cache.Bytes(), int64(10))
+
+	// Metadata-only writes update the local copy.
+	require.NoError(t, cache.Write("b", &kvstore.ValueItem{Ts: now, Size: 4, TTL: 60}))
+	item, err = cache.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, kvstore.TTLType(60), item.TTL)
+	require.Equal(t, "bbbb", string(item.Data))
+	require.Equal(t, 1, remote.reads)
+
+	// Local copies survive a restart, and deletes remove them.
+	cache, err = persistence.NewDiskCache(remote, local, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, cache.Len())
+	require.NoError(t, cache.Delete("b"))
+	require.Equal(t, 1, cache.Len())
+	_, err = cache.Read("b", true)
+	require.Error(t, err)
+}
+
+// hookedReader runs a function after each read of the persister it wraps.
+type hookedReader struct {
+	kvstore.DataPersister
+	after func(key string)
+	reads int
+}
+
+func (h *hookedReader) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	h.reads++
+	item, err := h.DataPersister.Read(key, readValue)
+	h.after(key)
+	return item, err
+}
+
+func TestDiskCacheConcurrentWrites(t *testing.T) {
+	const folder = "TestDiskCacheConcurrentWrites"
+	defer os.RemoveAll(folder)
+	fs := persistence.NewFsPersistence(path.Join(folder, "remote"))
+	now := time.Now()
+	require.NoError(t, fs.Write("a", kvstore.NewValueItem([]byte("old"), now)))
+	require.NoError(t, fs.Write("b", kvstore.NewValueItem([]byte("b"), now)))
+	remote := &hookedReader{DataPersister: fs}
+	cache, err := persistence.NewDiskCache(remote, persistence.NewFsPersistence(path.Join(folder, "local")), 100)
+	require.NoError(t, err)
+
+	// A write to another key while a read is in progress does not stop the read being cached.
+	remote.after = func(key string) {
+		require.NoError(t, cache.Write("c", kvstore.NewValueItem([]byte("c"), now)))
+	}
+	_, err = cache.Read("b", true)
+	require.NoError(t, err)
+	remote.after = func(string) {}
+	_, err = cache.Read("b", true)
+	require.NoError(t, err)
+	require.Equal(t, 1, remote.reads)
+
+	// A read that raced with a write to the same key is not cached, so the written value is read.
+	remote.after = func(key string) {
+		remote.after = func(string) {}
+		require.NoError(t, cache.Delete(key))
+		require.NoError(t, fs.Write(key, kvstore.NewValueItem([]byte("new"), now)))
+	}
+	item, err := cache.Read("a", true)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(item.Data))
+	item, err = cache.Read("a", true)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(item.Data))
+}
@@ -0,0 +1,391 @@
+package persistence
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// EncryptionKeyEnvelope is the kvstore.ValueItem Envelope entry recording which key encrypted a value.
+// It is only held by the wrapped persister and is removed from items returned by Read.
+const EncryptionKeyEnvelope = "encryption-key"
+
+// ErrUnknownEncryptionKey returned when a value was encrypted with a key the persister does not hold.
+var ErrUnknownEncryptionKey error = errors.New("unknown encryption key")
+
+// KeyProvider returns the AES key with the given ID for a namespace, as returned by kvstore.Namespace.
+// Returning different keys per namespace cryptographically isolates the data of different tenants.
+type KeyProvider func(namespace, keyID string) ([]byte, error)
+
+// Encrypted wraps another DataPersister, encrypting values with AES-GCM before they are written.
+// Several key versions can be held at once: values are written with the current key and read with
+// the key recorded in their envelope, so keys can be rotated without rewriting everything at once.
+type Encrypted struct {
+	wrapped
+	keys      *EncryptionTransformer
+	writeLock sync.Mutex
+}
+
+// NewEncryptedPersistence creates an encrypting wrapper around persister that uses the same keys for every namespace.
+// keys maps key IDs to 16, 24 or 32 byte AES keys, and current names the key used for writes.
+func NewEncryptedPersistence(persister kvstore.DataPersister, keys map[string][]byte, current string) (*Encrypted, error) {
+	t, err := NewEncryptionTransformer(keys, current)
+	if err != nil {
+		return nil, err
+	}
+	return &Encrypted{wrapped: wrapped{persister}, keys: t}, nil
+}
+
+// NewEncryptedPersistenceWithProvider creates an encrypting wrapper around persister that asks provider
+// for the keys of each namespace, such as from a KMS. Keys are fetched on first use and then cached.
+func NewEncryptedPersistenceWithProvider(persister kvstore.DataPersister, provider KeyProvider, current string) *Encrypted {
+	return &Encrypted{wrapped: wrapped{persister}, keys: NewEncryptionTransformerWithProvider(provider, current)}
+}
+
+// AddKey adds a key version that can be used to read values, without using it for writes.
+// It can only be used when the keys were passed to NewEncryptedPersistence rather than supplied by a KeyProvider.
+func (e *Encrypted) AddKey(id string, key []byte) error {
+	return e.keys.AddKey(id, key)
+}
+
+// SetCurrentKey selects the key used for subsequent writes. When the keys were passed to
+// NewEncryptedPersistence the key must already have been added.
+func (e *Encrypted) SetCurrentKey(id string) error {
+	return e.keys.SetCurrentKey(id)
+}
+
+// Rotate re-encrypts every value that was not written with the current key.
+// Once it returns, keys other than the current one are no longer needed to read the data.
+func (e *Encrypted) Rotate() error {
+	keys, err := e.persistence.Keys()
+	if err != nil {
+		return errors.Wrap(err, "Encrypted.Rotate Keys")
+	}
+
+	for _, k := range keys {
+		if err := e.rotateKey(k); err != nil {
+			return errors.Wrapf(err, "Encrypted.Rotate key %s", k)
+		}
+	}
+	return nil
+}
+
+// rotateKey re-encrypts a single value if it was written with an old key.
+// Holding the write lock stops a concurrent Write being overwritten by the value read here.
+func (e *Encrypted) rotateKey(key string) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	stored, err := e.persistence.Read(key, false)
+	if err != nil {
+		return err
+	}
+	if stored.Envelope[EncryptionKeyEnvelope] == e.keys.CurrentKey() {
+		return nil
+	}
+
+	item, err := e.Read(key, true)
+	if err != nil {
+		return err
+	}
+	return e.write(key, item)
+}
+
+// Write encrypts the item's data with the current key and writes it to the wrapped persister.
+func (e *Encrypted) Write(key string, data *kvstore.ValueItem) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+	return e.write(key, data)
+}
+
+func (e *Encrypted) write(key string, data *kvstore.ValueItem) error {
+	sealed, err := e.seal(key, data)
+	if err != nil {
+		return err
+	}
+	if err := e.persistence.Write(key, sealed); err != nil {
+		return errors.Wrap(err, "Encrypted.Write")
+	}
+	return nil
+}
+
+// WriteMulti encrypts every item and writes them as a batch if the wrapped persister supports it.
+func (e *Encrypted) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	e.writeLock.Lock()
+	defer e.writeLock.Unlock()
+
+	bw, ok := e.persistence.(kvstore.BatchWriter)
+	if !ok {
+		for k, item := range items {
+			if err := e.write(k, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	sealed := make(map[string]*kvstore.ValueItem, len(items))
+	for k, item := range items {
+		s, err := e.seal(k, item)
+		if err != nil {
+			return err
+		}
+		sealed[k] = s
+	}
+	if err := bw.WriteMulti(sealed); err != nil {
+		return errors.Wrap(err, "Encrypted.WriteMulti")
+	}
+	return nil
+}
+
+// seal returns a copy of the item with its data encrypted and the key ID recorded in its envelope.
+// Metadata-only writes keep the key ID of the value already stored, as that value is not rewritten.
+func (e *Encrypted) seal(key string, data *kvstore.ValueItem) (*kvstore.ValueItem, error) {
+	sealed := withEnvelope(data)
+	if data.Data == nil {
+		if stored, err := e.persistence.Read(key, false); err == nil {
+			sealed.Envelope[EncryptionKeyEnvelope] = stored.Envelope[EncryptionKeyEnvelope]
+		}
+		return sealed, nil
+	}
+
+	encrypted, id, _, err := e.keys.Encode(key, data, data.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encrypted.seal")
+	}
+	sealed.Data = encrypted
+	sealed.Envelope[EncryptionKeyEnvelope] = id
+	return sealed, nil
+}
+
+// Read reads an item from the wrapped persister, decrypting its data if requested.
+func (e *Encrypted) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	item, err := e.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(key, item, readValue)
+}
+
+// ReadMulti reads several items from the wrapped persister, as a batch if it supports batch reads.
+// Items that cannot be decrypted are omitted, as with items that cannot be read.
+func (e *Encrypted) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	br, ok := e.persistence.(kvstore.BatchReader)
+	if !ok {
+		items := make(map[string]*kvstore.ValueItem, len(keys))
+		for _, k := range keys {
+			if item, err := e.Read(k, readValue); err == nil {
+				items[k] = item
+			}
+		}
+		return items, nil
+	}
+
+	sealed, err := br.ReadMulti(keys, readValue)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encrypted.ReadMulti")
+	}
+	items := make(map[string]*kvstore.ValueItem, len(sealed))
+	for k, item := range sealed {
+		if opened, err := e.open(k, item, readValue); err == nil {
+			items[k] = opened
+		}
+	}
+	return items, nil
+}
+
+// open removes the key ID from an item read from the wrapped persister and decrypts its data if it was read.
+func (e *Encrypted) open(key string, item *kvstore.ValueItem, readValue bool) (*kvstore.ValueItem, error) {
+	id := takeEnvelope(item, EncryptionKeyEnvelope)
+	if !readValue {
+		return item, nil
+	}
+
+	plain, err := e.keys.Decode(key, id, item.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Encrypted.Read")
+	}
+	if err := item.SetData(plain); err != nil {
+		return nil, errors.Wrap(err, "Encrypted.Read SetData")
+	}
+	return item, nil
+}
+
+// Delete removes the key from the wrapped persister.
+func (e *Encrypted) Delete(key string) error {
+	return e.persistence.Delete(key)
+}
+
+// Keys returns the keys held by the wrapped persister.
+func (e *Encrypted) Keys() ([]string, error) {
+	return e.persistence.Keys()
+}
+
+// EncryptionTransformer is a Transformer that encrypts values with AES-GCM, recording the ID of the
+// key that encrypted each value so that keys can be rotated. The key is bound to the store key, so a
+// value copied to another key cannot be decrypted. It holds the keys used by Encrypted.
+type EncryptionTransformer struct {
+	lock     sync.RWMutex
+	provider KeyProvider
+	static   map[string][]byte
+	ciphers  map[cipherID]cipher.AEAD
+	current  string
+}
+
+// cipherID identifies a cached cipher by namespace and key ID.
+type cipherID struct {
+	namespace string
+	keyID     string
+}
+
+// NewEncryptionTransformer creates an EncryptionTransformer that uses the same keys for every namespace.
+// keys maps key IDs to 16, 24 or 32 byte AES keys, and current names the key used to encrypt.
+//
+// Example:
+//
+//	enc, err := NewEncryptionTransformer(map[string][]byte{"v1": key}, "v1")
+func NewEncryptionTransformer(keys map[string][]byte, current string) (*EncryptionTransformer, error) {
+	t := &EncryptionTransformer{
+		static:  make(map[string][]byte),
+		ciphers: make(map[cipherID]cipher.AEAD),
+	}
+	t.provider = t.staticKey
+	for id, key := range keys {
+		if err := t.AddKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.SetCurrentKey(current); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// NewEncryptionTransformerWithProvider creates an EncryptionTransformer that asks provider for the
+// keys of each namespace. Keys are fetched on first use and then cached.
+func NewEncryptionTransformerWithProvider(provider KeyProvider, current string) *EncryptionTransformer {
+	return &EncryptionTransformer{
+		provider: provider,
+		ciphers:  make(map[cipherID]cipher.AEAD),
+		current:  current,
+	}
+}
+
+// AddKey adds a key version that can be used to decrypt values, without using it to encrypt.
+// It can only be used when the keys were passed to NewEncryptionTransformer rather than supplied by a KeyProvider.
+func (t *EncryptionTransformer) AddKey(id string, key []byte) error {
+	if _, err := newAEAD(key); err != nil {
+		return errors.Wrapf(err, "EncryptionTransformer.AddKey %s", id)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.static == nil {
+		return errors.New("EncryptionTransformer.AddKey: keys are supplied by a KeyProvider")
+	}
+	t.static[id] = key
+	return nil
+}
+
+// SetCurrentKey selects the key used to encrypt subsequent values. When the keys were passed to
+// NewEncryptionTransformer the key must already have been added.
+func (t *EncryptionTransformer) SetCurrentKey(id string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.static[id]; t.static != nil && !ok {
+		return errors.Wrapf(ErrUnknownEncryptionKey, "EncryptionTransformer.SetCurrentKey %s", id)
+	}
+	t.current = id
+	return nil
+}
+
+// CurrentKey returns the ID of the key used to encrypt.
+func (t *EncryptionTransformer) CurrentKey() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.current
+}
+
+// Name returns "aes-gcm".
+func (t *EncryptionTransformer) Name() string {
+	return "aes-gcm"
+}
+
+// Encode encrypts data with the current key, returning the key's ID as the parameter to record.
+func (t *EncryptionTransformer) Encode(key string, _ *kvstore.ValueItem, data []byte) ([]byte, string, bool, error) {
+	id := t.CurrentKey()
+	aead, err := t.cipher(key, id)
+	if err != nil {
+		return nil, "", false, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, "", false, errors.Wrap(err, "EncryptionTransformer.Encode nonce")
+	}
+	return aead.Seal(nonce, nonce, data, []byte(key)), id, true, nil
+}
+
+// Decode decrypts data with the key whose ID was recorded.
+func (t *EncryptionTransformer) Decode(key, keyID string, data []byte) ([]byte, error) {
+	aead, err := t.cipher(key, keyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "EncryptionTransformer.Decode key %s", key)
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "EncryptionTransformer.Decode key %s: ciphertext too short", key)
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(key))
+	if err != nil {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "EncryptionTransformer.Decode key %s: %s", key, err.Error())
+	}
+	return plain, nil
+}
+
+// staticKey is the KeyProvider for keys passed to NewEncryptionTransformer.
+func (t *EncryptionTransformer) staticKey(_, keyID string) ([]byte, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	key, ok := t.static[keyID]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownEncryptionKey, "key %q", keyID)
+	}
+	return key, nil
+}
+
+// cipher returns the cipher for a key ID in the namespace of key, asking the provider on first use.
+func (t *EncryptionTransformer) cipher(key, keyID string) (cipher.AEAD, error) {
+	id := cipherID{namespace: kvstore.Namespace(key), keyID: keyID}
+	t.lock.RLock()
+	aead, ok := t.ciphers[id]
+	t.lock.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	secret, err := t.provider(id.namespace, id.keyID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key provider namespace %q", id.namespace)
+	}
+	aead, err = newAEAD(secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %q namespace %q", id.keyID, id.namespace)
+	}
+	t.lock.Lock()
+	t.ciphers[id] = aead
+	t.lock.Unlock()
+	return aead, nil
+}
+
+// newAEAD creates an AES-GCM cipher from a 16, 24 or 32 byte key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,76 @@
+package persistence_test
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedKeyRotation(t *testing.T) {
+	const folder = "TestEncryptedKeyRotation"
+	defer os.RemoveAll(folder)
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	fs := persistence.NewFsPersistence(folder)
+	enc, err := persistence.NewEncryptedPersistence(fs, map[string][]byte{"v1": oldKey}, "v1")
+	require.NoError(t, err)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(enc))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("secret", []byte("plaintext"), kvstore.WithMetaSetOption(map[string]string{"owner": "a", "encryption-key": "user"})))
+
+	onDisk, err := os.ReadFile(path.Join(folder, "secret", "data.bin"))
+	require.NoError(t, err)
+	require.NotContains(t, string(onDisk), "plaintext")
+
+	require.NoError(t, enc.AddKey("v2", newKey))
+	require.NoError(t, enc.SetCurrentKey("v2"))
+	require.NoError(t, enc.Rotate())
+
+	rotated, err := persistence.NewEncryptedPersistence(fs, map[string][]byte{"v2": newKey}, "v2")
+	require.NoError(t, err)
+	item, err := rotated.Read("secret", true)
+	require.NoError(t, err)
+	require.Equal(t, "plaintext", string(item.Data))
+	require.Equal(t, map[string]string{"owner": "a", "encryption-key": "user"}, item.Meta)
+
+	require.NoError(t, rotated.Write("secret", &kvstore.ValueItem{Ts: time.Now(), Meta: item.Meta}))
+	item, err = rotated.Read("secret", true)
+	require.NoError(t, err)
+	require.Equal(t, "plaintext", string(item.Data))
+}
+
+func TestEncryptedPerNamespaceKeys(t *testing.T) {
+	const folder = "TestEncryptedPerNamespaceKeys"
+	defer os.RemoveAll(folder)
+	tenantKeys := map[string][]byte{
+		"tenant1": bytes.Repeat([]byte{1}, 32),
+		"tenant2": bytes.Repeat([]byte{2}, 32),
+	}
+	provider := func(namespace, keyID string) ([]byte, error) {
+		return tenantKeys[namespace], nil
+	}
+
+	fs := persistence.NewFsPersistence(folder)
+	enc := persistence.NewEncryptedPersistenceWithProvider(fs, provider, "v1")
+	require.NoError(t, enc.Write("tenant1:doc", kvstore.NewValueItem([]byte("one"), time.Now())))
+	require.NoError(t, enc.Write("tenant2:doc", kvstore.NewValueItem([]byte("two"), time.Now())))
+
+	item, err := enc.Read("tenant2:doc", true)
+	require.NoError(t, err)
+	require.Equal(t, "two", string(item.Data))
+
+	tenantKeys["tenant2"] = tenantKeys["tenant1"]
+	other := persistence.NewEncryptedPersistenceWithProvider(fs, provider, "v1")
+	_, err = other.Read("tenant2:doc", true)
+	require.Error(t, err)
+	item, err = other.Read("tenant1:doc", true)
+	require.NoError(t, err)
+	require.Equal(t, "one", string(item.Data))
+}
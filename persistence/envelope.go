@@ -0,0 +1,24 @@
+package persistence
+
+import "github.com/jrsteele09/go-kvstore/kvstore"
+
+// withEnvelope returns a copy of an item to hand to a wrapped persister, with its own Meta and
+// Envelope so the entries a wrapper records are not seen by the caller.
+func withEnvelope(item *kvstore.ValueItem) *kvstore.ValueItem {
+	cp := item.Clone()
+	if cp.Envelope == nil {
+		cp.Envelope = make(map[string]string, 1)
+	}
+	return cp
+}
+
+// takeEnvelope removes an entry from the envelope of an item read from a wrapped persister,
+// returning its value.
+func takeEnvelope(item *kvstore.ValueItem, name string) string {
+	value := item.Envelope[name]
+	delete(item.Envelope, name)
+	if len(item.Envelope) == 0 {
+		item.Envelope = nil
+	}
+	return value
+}
@@ -0,0 +1,189 @@
+package persistence
+
+import (
+	"os"
+	"path"
+	"sync"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// LockMode selects how a Filesystem coordinates with other processes using the same folder.
+type LockMode int
+
+// Lock modes supported by OpenFsPersistence.
+const (
+	LockNone   LockMode = iota // No coordination; the folder must only be used by one process.
+	LockWriter                 // The single process allowed to modify the folder.
+	LockReader                 // A process that only reads the folder while a writer may be running.
+)
+
+const (
+	writerLockFilename = ".writer.lock"
+	ioLockFilename     = ".io.lock"
+)
+
+// ErrFolderLocked is returned by OpenFsPersistence when another process already holds the folder's writer lock.
+var ErrFolderLocked = errors.Wrap(kvstore.ErrPersisterUnavailable, "folder is locked by another writer")
+
+// folderLock holds the advisory locks that a Filesystem takes on its folder.
+// The writer lock is held for the lifetime of a LockWriter Filesystem, so that a second writer fails fast.
+// The io lock is taken exclusively around writes and shared around reads, so that readers never see a
+// key half written. flock does not exclude goroutines sharing a file, so an in-process lock is held as well.
+type folderLock struct {
+	mode    LockMode
+	writer  *os.File
+	io      *os.File
+	mu      sync.RWMutex
+	countMu sync.Mutex
+	readers int
+}
+
+// openFolderLock creates the lock files in folder and takes the locks required by mode.
+func openFolderLock(folder string, mode LockMode) (*folderLock, error) {
+	l := &folderLock{mode: mode}
+	if mode == LockWriter {
+		f, err := os.OpenFile(path.Join(folder, writerLockFilename), os.O_CREATE|os.O_RDWR, fileMode)
+		if err != nil {
+			return nil, errors.Wrap(err, "openFolderLock: OpenFile writer lock")
+		}
+		if err := lockFile(f, true, false); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "openFolderLock: writer lock")
+		}
+		l.writer = f
+	}
+
+	f, err := os.OpenFile(path.Join(folder, ioLockFilename), os.O_CREATE|os.O_RDWR, fileMode)
+	if err != nil {
+		l.close()
+		return nil, errors.Wrap(err, "openFolderLock: OpenFile io lock")
+	}
+	l.io = f
+	return l, nil
+}
+
+// checkWritable returns ErrReadOnly if the folder was opened as a reader.
+func (l *folderLock) checkWritable() error {
+	if l != nil && l.mode == LockReader {
+		return errors.Wrap(kvstore.ErrReadOnly, "folder opened as a reader")
+	}
+	return nil
+}
+
+// lockWrite takes the io lock exclusively.
+func (l *folderLock) lockWrite() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if err := lockFile(l.io, true, true); err != nil {
+		l.mu.Unlock()
+		return errors.Wrap(err, "lockWrite")
+	}
+	return nil
+}
+
+// unlockWrite releases the io lock taken by lockWrite.
+func (l *folderLock) unlockWrite() {
+	if l == nil {
+		return
+	}
+	_ = unlockFile(l.io)
+	l.mu.Unlock()
+}
+
+// lockRead takes the io lock shared. Only readers need it; the writer's own reads cannot race its writes on disk.
+func (l *folderLock) lockRead() error {
+	if l == nil || l.mode != LockReader {
+		return nil
+	}
+	l.mu.RLock()
+	l.countMu.Lock()
+	defer l.countMu.Unlock()
+	if l.readers == 0 {
+		if err := lockFile(l.io, false, true); err != nil {
+			l.mu.RUnlock()
+			return errors.Wrap(err, "lockRead")
+		}
+	}
+	l.readers++
+	return nil
+}
+
+// unlockRead releases the io lock taken by lockRead once no other goroutine is reading.
+func (l *folderLock) unlockRead() {
+	if l == nil || l.mode != LockReader {
+		return
+	}
+	l.countMu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		_ = unlockFile(l.io)
+	}
+	l.countMu.Unlock()
+	l.mu.RUnlock()
+}
+
+// close releases all locks held on the folder.
+func (l *folderLock) close() {
+	if l == nil {
+		return
+	}
+	if l.io != nil {
+		l.io.Close()
+		l.io = nil
+	}
+	if l.writer != nil {
+		_ = unlockFile(l.writer)
+		l.writer.Close()
+		l.writer = nil
+	}
+}
+
+// FileLock is an exclusive advisory lock on a file, held against other goroutines and other
+// processes, such as the candidates of an election whose stores share a data folder. The file is
+// created if it does not exist and is kept afterwards.
+type FileLock struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+// NewFileLock creates a lock on the file at path. The lock is not taken until Lock is called.
+//
+// Example:
+//
+//	lock := NewFileLock(path.Join("./data", ".election.lock"))
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Lock takes the lock, waiting until no other goroutine or process holds it.
+func (l *FileLock) Lock() error {
+	l.mu.Lock()
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_RDWR, fileMode)
+	if err != nil {
+		l.mu.Unlock()
+		return errors.Wrap(err, "FileLock.Lock OpenFile")
+	}
+	if err := lockFile(f, true, true); err != nil {
+		f.Close()
+		l.mu.Unlock()
+		return errors.Wrap(err, "FileLock.Lock")
+	}
+	l.f = f
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func (l *FileLock) Unlock() error {
+	defer l.mu.Unlock()
+	err := unlockFile(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	l.f = nil
+	return errors.Wrap(err, "FileLock.Unlock")
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package persistence
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// lockFile is not supported on this platform, so folders can only be opened with LockNone.
+func lockFile(f *os.File, exclusive, block bool) error {
+	return errors.New("advisory file locking is not supported on this platform")
+}
+
+// unlockFile does nothing on this platform.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,68 @@
+//go:build unix
+
+package persistence_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFsPersistenceLocking(t *testing.T) {
+	const folder = "TestOpenFsPersistenceLocking"
+	defer os.RemoveAll(folder)
+
+	writer, err := persistence.OpenFsPersistence(folder, persistence.LockWriter)
+	require.NoError(t, err)
+	require.NoError(t, writer.Write("key", kvstore.NewValueItem([]byte("value"), time.Now())))
+
+	_, err = persistence.OpenFsPersistence(folder, persistence.LockWriter)
+	require.True(t, errors.Is(err, persistence.ErrFolderLocked))
+	require.True(t, errors.Is(err, kvstore.ErrPersisterUnavailable))
+
+	reader, err := persistence.OpenFsPersistence(folder, persistence.LockReader)
+	require.NoError(t, err)
+	defer reader.Close()
+	item, err := reader.Read("key", true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), item.Data)
+	require.True(t, errors.Is(reader.Write("key", item), kvstore.ErrReadOnly))
+	require.True(t, errors.Is(reader.Delete("key"), kvstore.ErrReadOnly))
+
+	keys, err := reader.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"key"}, keys)
+
+	writer.Close()
+	second, err := persistence.OpenFsPersistence(folder, persistence.LockWriter)
+	require.NoError(t, err)
+	second.Close()
+}
+
+func TestFileLock(t *testing.T) {
+	const file = "TestFileLock.lock"
+	defer os.Remove(file)
+
+	// Separate locks on the same file exclude each other, as they would in separate processes.
+	first, second := persistence.NewFileLock(file), persistence.NewFileLock(file)
+	require.NoError(t, first.Lock())
+	locked := make(chan struct{})
+	go func() {
+		defer close(locked)
+		require.NoError(t, second.Lock())
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("second lock taken while the first was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, first.Unlock())
+	<-locked
+	require.NoError(t, second.Unlock())
+}
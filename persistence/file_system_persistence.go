@@ -1,9 +1,12 @@
 package persistence
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"hash/crc32"
 	"os"
 	"path"
+	"time"
 
 	"github.com/jrsteele09/go-kvstore/kvstore"
 	"github.com/pkg/errors"
@@ -13,20 +16,94 @@ import (
 // It uses folders as keys and files within those folders as values.
 type Filesystem struct {
 	folder string
+	lock   *folderLock
+	index  *metadataIndex
+}
+
+// fsMetadata is the layout of a key's metadata file: the ValueItem's metadata plus a checksum of
+// the data file, which lets Check detect corrupted values, and the schema version of the layout.
+type fsMetadata struct {
+	*kvstore.ValueItem
+	Checksum      string `json:"checksum,omitempty"`
+	SchemaVersion int    `json:"schemaVersion,omitempty"`
+}
+
+// checksum returns the hex encoded CRC-32C of data.
+func checksum(data []byte) string {
+	sum := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+	return hex.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
 }
 
 // NewFsPersistence initializes a new Filesystem persistence object.
-func NewFsPersistence(folder string) *Filesystem {
-	return &Filesystem{folder: folder}
+func NewFsPersistence(folder string, options ...FsOption) *Filesystem {
+	fs := &Filesystem{folder: folder}
+	for _, opt := range options {
+		opt(fs)
+	}
+	return fs
 }
 
-// Close cleans up resources. Currently, it does nothing.
+// OpenFsPersistence opens a folder that may be shared with other processes, using advisory file locks
+// to coordinate them. At most one process can open the folder with LockWriter; a second writer fails
+// fast with ErrFolderLocked. Any number of processes can open it with LockReader: their reads wait for
+// in-flight writes, and writes through a reader return kvstore.ErrReadOnly.
+// Locks are released by Close. Locking is only supported on unix platforms.
+// Readers ignore WithIndexFsOption.
+//
+// Example:
+//
+//	p, err := persistence.OpenFsPersistence("/var/lib/kv", persistence.LockWriter)
+//	if errors.Is(err, persistence.ErrFolderLocked) {
+//		// Another process is already writing to the folder.
+//	}
+func OpenFsPersistence(folder string, mode LockMode, options ...FsOption) (*Filesystem, error) {
+	fs := NewFsPersistence(folder, options...)
+	if mode == LockReader {
+		fs.index = nil
+	}
+	if mode == LockNone {
+		return fs, nil
+	}
+	if err := os.MkdirAll(folder, fileMode); err != nil {
+		return nil, errors.Wrap(err, "OpenFsPersistence: MkdirAll")
+	}
+	lock, err := openFolderLock(folder, mode)
+	if err != nil {
+		return nil, errors.Wrapf(err, "OpenFsPersistence %s", folder)
+	}
+	fs.lock = lock
+	return fs, nil
+}
+
+// FsPersisterFactory returns a kvstore.PersisterFactory that gives each store of a kvstore.StoreGroup
+// a Filesystem in the subfolder of root named after the store.
+//
+// Example:
+//
+//	group := kvstore.NewStoreGroup(kvstore.WithPersisterGroupOption(persistence.FsPersisterFactory("./tenants")))
+func FsPersisterFactory(root string, options ...FsOption) kvstore.PersisterFactory {
+	return func(name string) (kvstore.DataPersister, error) {
+		return NewFsPersistence(path.Join(root, name), options...), nil
+	}
+}
+
+// Close closes the metadata index and releases any locks held on the folder.
 func (fs Filesystem) Close() {
-	// Intentionally left empty
+	fs.index.close()
+	fs.lock.close()
 }
 
 // Keys returns a list of keys available in the folder.
 func (fs Filesystem) Keys() ([]string, error) {
+	if fs.index != nil {
+		if _, err := os.Stat(fs.folder); err != nil {
+			return nil, errors.Wrap(err, "Keys: ReadDir")
+		}
+		if keys, ok := fs.index.keys(); ok {
+			return keys, nil
+		}
+	}
+
 	fileInfoList, err := os.ReadDir(fs.folder)
 	if err != nil {
 		return nil, errors.Wrap(err, "Keys: ReadDir")
@@ -44,19 +121,32 @@ func (fs Filesystem) Keys() ([]string, error) {
 
 // Write writes the ValueItem to the folder specified by the key.
 func (fs Filesystem) Write(key string, data *kvstore.ValueItem) error {
+	if err := fs.lock.checkWritable(); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	if err := fs.lock.lockWrite(); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	defer fs.lock.unlockWrite()
+	return fs.write(key, data)
+}
+
+// write writes the ValueItem to the key's folder. The caller must hold the write lock.
+func (fs Filesystem) write(key string, data *kvstore.ValueItem) error {
 	targetFolder := path.Join(fs.folder, key)
 
 	if err := os.MkdirAll(targetFolder, fileMode); err != nil {
 		return errors.Wrap(err, "Write: MkdirAll")
 	}
 
-	serializedData, err := json.Marshal(data)
-	if err != nil {
-		return errors.Wrap(err, "Write: Marshal")
+	var sum string
+	if data.Data != nil {
+		sum = checksum(data.Data)
+	} else {
+		sum = fs.existingChecksum(targetFolder)
 	}
-
-	if err := os.WriteFile(path.Join(targetFolder, metaDataFilename), serializedData, fileMode); err != nil {
-		return errors.Wrap(err, "Write: WriteFile metadata")
+	if err := fs.putMetadata(key, data, sum); err != nil {
+		return errors.Wrap(err, "Write")
 	}
 
 	if data.Data != nil {
@@ -68,28 +158,104 @@ func (fs Filesystem) Write(key string, data *kvstore.ValueItem) error {
 	return nil
 }
 
+// Patch writes data at offset within the key's data file, then rewrites its metadata.
+// If the data file does not exist the whole item is written instead.
+func (fs Filesystem) Patch(key string, offset int64, data []byte, item *kvstore.ValueItem) error {
+	if err := fs.lock.checkWritable(); err != nil {
+		return errors.Wrap(err, "Patch")
+	}
+	if err := fs.lock.lockWrite(); err != nil {
+		return errors.Wrap(err, "Patch")
+	}
+	defer fs.lock.unlockWrite()
+
+	targetFolder := path.Join(fs.folder, key)
+	f, err := os.OpenFile(path.Join(targetFolder, dataFilename), os.O_WRONLY, fileMode)
+	if os.IsNotExist(err) {
+		return fs.write(key, item)
+	} else if err != nil {
+		return errors.Wrap(err, "Patch: OpenFile")
+	}
+
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return errors.Wrap(err, "Patch: WriteAt")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "Patch: Close")
+	}
+	if err := fs.putMetadata(key, item, checksum(item.Data)); err != nil {
+		return errors.Wrap(err, "Patch")
+	}
+	return nil
+}
+
+// putMetadata writes a key's metadata file and records it in the metadata index, if there is one.
+func (fs Filesystem) putMetadata(key string, item *kvstore.ValueItem, sum string) error {
+	serializedData, err := writeMetadata(path.Join(fs.folder, key), item, sum)
+	if err != nil {
+		return err
+	}
+	if fs.index != nil {
+		return fs.index.append(indexSet, key, serializedData)
+	}
+	return nil
+}
+
+// writeMetadata writes a key's metadata file with the checksum of its data file, returning its contents.
+func writeMetadata(targetFolder string, item *kvstore.ValueItem, sum string) ([]byte, error) {
+	serializedData, err := json.Marshal(fsMetadata{ValueItem: item, Checksum: sum, SchemaVersion: MetadataSchemaVersion})
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal")
+	}
+	if err := os.WriteFile(path.Join(targetFolder, metaDataFilename), serializedData, fileMode); err != nil {
+		return nil, errors.Wrap(err, "WriteFile metadata")
+	}
+	return serializedData, nil
+}
+
 // Delete removes the folder specified by the key.
 func (fs Filesystem) Delete(key string) error {
+	if err := fs.lock.checkWritable(); err != nil {
+		return errors.Wrap(err, "Delete")
+	}
+	if err := fs.lock.lockWrite(); err != nil {
+		return errors.Wrap(err, "Delete")
+	}
+	defer fs.lock.unlockWrite()
+
 	targetFolder := path.Join(fs.folder, key)
 	if err := os.RemoveAll(targetFolder); err != nil {
 		return errors.Wrap(err, "Delete: RemoveAll")
 	}
+	if fs.index != nil {
+		return errors.Wrap(fs.index.append(indexDelete, key, nil), "Delete")
+	}
 	return nil
 }
 
 // Read retrieves the ValueItem identified by the key.
 func (fs Filesystem) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	if err := fs.lock.lockRead(); err != nil {
+		return nil, errors.Wrap(err, "Read")
+	}
+	defer fs.lock.unlockRead()
+
 	targetFolder := path.Join(fs.folder, key)
 
-	metaData, err := os.ReadFile(path.Join(targetFolder, metaDataFilename))
-	if err != nil {
-		return nil, errors.Wrap(err, "Read: ReadFile metadata")
+	metaData, indexed := fs.indexedMetadata(key, readValue)
+	if !indexed {
+		var err error
+		if metaData, err = os.ReadFile(path.Join(targetFolder, metaDataFilename)); err != nil {
+			return nil, errors.Wrap(err, "Read: ReadFile metadata")
+		}
 	}
 
-	var valueItem kvstore.ValueItem
-	if err := json.Unmarshal(metaData, &valueItem); err != nil {
-		return nil, errors.Wrap(err, "Read: Unmarshal")
+	metadata, _, err := decodeMetadata(metaData)
+	if err != nil {
+		return nil, errors.Wrap(err, "Read")
 	}
+	valueItem := metadata.ValueItem
 
 	if readValue {
 		data, err := os.ReadFile(path.Join(targetFolder, dataFilename))
@@ -102,5 +268,97 @@ func (fs Filesystem) Read(key string, readValue bool) (*kvstore.ValueItem, error
 		}
 	}
 
-	return &valueItem, nil
+	return valueItem, nil
+}
+
+// indexedMetadata returns a key's metadata from the metadata index when only its metadata is being read.
+func (fs Filesystem) indexedMetadata(key string, readValue bool) ([]byte, bool) {
+	if fs.index == nil || readValue {
+		return nil, false
+	}
+	return fs.index.metadata(key)
+}
+
+// Compact removes the folders of keys whose TTL has passed. The store deletes expired keys as it finds
+// them, but keys that expired while no store was running are otherwise kept on disk indefinitely.
+// The metadata index, if there is one, is then rewritten without superseded records.
+func (fs Filesystem) Compact() error {
+	if err := fs.lock.checkWritable(); err != nil {
+		return errors.Wrap(err, "Compact")
+	}
+	keys, err := fs.Keys()
+	if err != nil {
+		return errors.Wrap(err, "Compact: Keys")
+	}
+
+	now := time.Now()
+	for _, k := range keys {
+		item, err := fs.Read(k, false)
+		if err != nil {
+			continue
+		}
+		if item.Expired(now) {
+			if err := fs.Delete(k); err != nil {
+				return errors.Wrapf(err, "Compact: key %s", k)
+			}
+		}
+	}
+	if fs.index != nil {
+		return errors.Wrap(fs.index.compact(), "Compact")
+	}
+	return nil
+}
+
+// Usage returns the total size of the files in the folder and the number of keys it holds.
+func (fs Filesystem) Usage() (kvstore.Usage, error) {
+	keys, err := fs.Keys()
+	if err != nil {
+		return kvstore.Usage{}, errors.Wrap(err, "Usage")
+	}
+	return kvstore.Usage{Bytes: folderSize(fs.folder), Keys: len(keys)}, nil
+}
+
+// ReadMulti retrieves several ValueItems. Keys that cannot be read are omitted.
+func (fs Filesystem) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	items := make(map[string]*kvstore.ValueItem, len(keys))
+	for _, k := range keys {
+		if item, err := fs.Read(k, readValue); err == nil {
+			items[k] = item
+		}
+	}
+	return items, nil
+}
+
+// existingChecksum returns the checksum recorded in a key's current metadata, so that metadata-only
+// writes of unloaded values keep describing the data file already on disk.
+func (fs Filesystem) existingChecksum(targetFolder string) string {
+	metaData, err := os.ReadFile(path.Join(targetFolder, metaDataFilename))
+	if err != nil {
+		return ""
+	}
+	existing, _, err := decodeMetadata(metaData)
+	if err != nil {
+		return ""
+	}
+	return existing.Checksum
+}
+
+// ChangedSince returns the keys whose metadata or data file was modified at or after since, from the
+// files' modification times, without reading them.
+func (fs Filesystem) ChangedSince(since time.Time) ([]string, error) {
+	keys, err := fs.Keys()
+	if err != nil {
+		return nil, errors.Wrap(err, "ChangedSince")
+	}
+	changed := make([]string, 0)
+	for _, k := range keys {
+		for _, name := range []string{metaDataFilename, dataFilename} {
+			info, err := os.Stat(path.Join(fs.folder, k, name))
+			if err == nil && !info.ModTime().Before(since) {
+				changed = append(changed, k)
+				break
+			}
+		}
+	}
+	return changed, nil
 }
@@ -0,0 +1,401 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	indexFilename      = ".index"
+	indexCleanFilename = ".index.clean"
+	indexTempFilename  = ".index.tmp"
+)
+
+// Index record operations.
+const (
+	indexSet    byte = 's'
+	indexDelete byte = 'd'
+)
+
+// FsOption configures a Filesystem.
+type FsOption func(*Filesystem)
+
+// WithIndexFsOption returns an FsOption that maintains a consolidated metadata index in the folder.
+// Every metadata write is appended to the index, so listing the keys and reading their metadata on
+// startup reads one file instead of one metadata file per key. The index is rebuilt from the key
+// folders if the folder was not closed cleanly or was changed by GC, Check or Restore, and is
+// rewritten without superseded records by Compact. Folders opened with LockReader do not use the
+// index, as the writer may be appending to it.
+//
+// Example:
+//
+//	NewFsPersistence("./data", WithIndexFsOption())
+func WithIndexFsOption() FsOption {
+	return func(fs *Filesystem) {
+		fs.index = &metadataIndex{folder: fs.folder}
+	}
+}
+
+// indexEntry locates the latest metadata of a key within the index file.
+type indexEntry struct {
+	offset int64
+	length int
+}
+
+// metadataIndex is an append-only log of the metadata written for each key. Each record is an
+// operation byte, the uvarint length of the key, the key, the uvarint length of the metadata and
+// the metadata itself, which is empty for deletes. Only the offsets of each key's latest metadata
+// are held in memory.
+//
+// A marker file records that the index was closed cleanly. It is removed before the first append
+// after the index is loaded, so an index left by a crash, which may be missing the last writes, is
+// rebuilt from the key folders rather than trusted.
+type metadataIndex struct {
+	folder   string
+	lock     sync.Mutex
+	loaded   bool
+	disabled bool
+	file     *os.File
+	size     int64
+	entries  map[string]indexEntry
+	dirty    bool // The clean marker has been removed since the index was loaded.
+}
+
+// invalidateIndex removes the clean marker of a folder's index, so it is rebuilt when next opened.
+// Tools that change the key folders directly call it.
+func invalidateIndex(folder string) error {
+	if err := os.Remove(path.Join(folder, indexCleanFilename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "invalidateIndex")
+	}
+	return nil
+}
+
+// usable loads the index if it has not been loaded, reporting whether it can be used.
+// The caller must hold the lock.
+func (ix *metadataIndex) usable() bool {
+	if ix == nil || ix.disabled {
+		return false
+	}
+	if ix.loaded {
+		return true
+	}
+	if err := ix.load(); err != nil {
+		ix.disabled = true
+		return false
+	}
+	ix.loaded = true
+	return true
+}
+
+// load reads the index file if it was closed cleanly, and rebuilds it from the key folders otherwise.
+// The caller must hold the lock.
+func (ix *metadataIndex) load() error {
+	ix.entries = make(map[string]indexEntry)
+	if _, err := os.Stat(ix.folder); os.IsNotExist(err) {
+		// Nothing has been written yet; the index is created with the folder.
+		return nil
+	}
+
+	_, cleanErr := os.Stat(path.Join(ix.folder, indexCleanFilename))
+	f, err := os.OpenFile(path.Join(ix.folder, indexFilename), os.O_RDWR|os.O_APPEND, fileMode)
+	if cleanErr != nil || err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return ix.rebuild()
+	}
+
+	entries, size, err := scanIndex(f)
+	if err != nil {
+		f.Close()
+		return ix.rebuild()
+	}
+	ix.file = f
+	ix.size = size
+	ix.entries = entries
+	return nil
+}
+
+// scanIndex reads every record of an index file, returning the latest entry of each key and the
+// length of the file.
+func scanIndex(f *os.File) (map[string]indexEntry, int64, error) {
+	entries := make(map[string]indexEntry)
+	r := &countingReader{r: bufio.NewReader(f)}
+	for {
+		start := r.n
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return entries, start, nil
+		} else if err != nil {
+			return nil, 0, errors.Wrap(err, "scanIndex")
+		}
+
+		key, err := r.readField()
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "scanIndex key")
+		}
+		metaLength, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "scanIndex metadata length")
+		}
+		offset := r.n
+		if _, err := io.CopyN(io.Discard, r, int64(metaLength)); err != nil {
+			return nil, 0, errors.Wrap(err, "scanIndex metadata")
+		}
+
+		switch op {
+		case indexSet:
+			entries[string(key)] = indexEntry{offset: offset, length: int(metaLength)}
+		case indexDelete:
+			delete(entries, string(key))
+		default:
+			return nil, 0, errors.Errorf("scanIndex: unknown operation %q", op)
+		}
+	}
+}
+
+// rebuild writes a new index from the metadata files of the key folders. The caller must hold the lock.
+func (ix *metadataIndex) rebuild() error {
+	dirs, err := os.ReadDir(ix.folder)
+	if err != nil {
+		return errors.Wrap(err, "rebuildIndex: ReadDir")
+	}
+
+	records := make(map[string][]byte, len(dirs))
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		metaData, err := os.ReadFile(path.Join(ix.folder, d.Name(), metaDataFilename))
+		if err != nil {
+			// Keys without readable metadata are left out of the index; Check reports them.
+			continue
+		}
+		records[d.Name()] = metaData
+	}
+	return ix.rewrite(records)
+}
+
+// rewrite replaces the index file with one holding a single record for each key. The caller must hold the lock.
+func (ix *metadataIndex) rewrite(records map[string][]byte) error {
+	if ix.file != nil {
+		ix.file.Close()
+		ix.file = nil
+	}
+	if err := invalidateIndex(ix.folder); err != nil {
+		return err
+	}
+	ix.dirty = true
+
+	tempFile := path.Join(ix.folder, indexTempFilename)
+	f, err := os.OpenFile(tempFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileMode)
+	if err != nil {
+		return errors.Wrap(err, "rewriteIndex: OpenFile")
+	}
+	w := bufio.NewWriter(f)
+	entries := make(map[string]indexEntry, len(records))
+	var size int64
+	for k, metaData := range records {
+		record, offset := encodeIndexRecord(indexSet, k, metaData)
+		if _, err := w.Write(record); err != nil {
+			f.Close()
+			return errors.Wrap(err, "rewriteIndex: Write")
+		}
+		entries[k] = indexEntry{offset: size + offset, length: len(metaData)}
+		size += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "rewriteIndex: Flush")
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return errors.Wrap(err, "rewriteIndex: Sync")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "rewriteIndex: Close")
+	}
+	if err := os.Rename(tempFile, path.Join(ix.folder, indexFilename)); err != nil {
+		return errors.Wrap(err, "rewriteIndex: Rename")
+	}
+
+	if ix.file, err = os.OpenFile(path.Join(ix.folder, indexFilename), os.O_RDWR|os.O_APPEND, fileMode); err != nil {
+		return errors.Wrap(err, "rewriteIndex: OpenFile")
+	}
+	ix.size = size
+	ix.entries = entries
+	return nil
+}
+
+// encodeIndexRecord returns an index record and the offset of its metadata within it.
+func encodeIndexRecord(op byte, key string, metaData []byte) ([]byte, int64) {
+	record := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(key)+len(metaData))
+	record = append(record, op)
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendUvarint(record, uint64(len(metaData)))
+	offset := int64(len(record))
+	record = append(record, metaData...)
+	return record, offset
+}
+
+// append adds a record to the index. If it cannot be written the index is disabled, and rebuilt when
+// the folder is next opened.
+func (ix *metadataIndex) append(op byte, key string, metaData []byte) error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if !ix.usable() {
+		return nil
+	}
+	if err := ix.appendRecord(op, key, metaData); err != nil {
+		ix.disabled = true
+		return errors.Wrap(err, "index")
+	}
+	return nil
+}
+
+// appendRecord writes a record to the end of the index file. The caller must hold the lock.
+func (ix *metadataIndex) appendRecord(op byte, key string, metaData []byte) error {
+	if !ix.dirty {
+		if err := invalidateIndex(ix.folder); err != nil {
+			return err
+		}
+		ix.dirty = true
+	}
+	if ix.file == nil {
+		f, err := os.OpenFile(path.Join(ix.folder, indexFilename), os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, fileMode)
+		if err != nil {
+			return errors.Wrap(err, "OpenFile")
+		}
+		ix.file = f
+		ix.size = 0
+	}
+
+	record, offset := encodeIndexRecord(op, key, metaData)
+	if _, err := ix.file.Write(record); err != nil {
+		return errors.Wrap(err, "Write")
+	}
+	if op == indexSet {
+		ix.entries[key] = indexEntry{offset: ix.size + offset, length: len(metaData)}
+	} else {
+		delete(ix.entries, key)
+	}
+	ix.size += int64(len(record))
+	return nil
+}
+
+// keys returns the indexed keys in order, reporting false if the index cannot be used.
+func (ix *metadataIndex) keys() ([]string, bool) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if !ix.usable() {
+		return nil, false
+	}
+	keys := make([]string, 0, len(ix.entries))
+	for k := range ix.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, true
+}
+
+// metadata returns the latest metadata indexed for key, reporting false if it is not indexed.
+func (ix *metadataIndex) metadata(key string) ([]byte, bool) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if !ix.usable() {
+		return nil, false
+	}
+	entry, ok := ix.entries[key]
+	if !ok || ix.file == nil {
+		return nil, false
+	}
+	metaData := make([]byte, entry.length)
+	if _, err := ix.file.ReadAt(metaData, entry.offset); err != nil {
+		return nil, false
+	}
+	return metaData, true
+}
+
+// compact rewrites the index with only the latest metadata of each key.
+func (ix *metadataIndex) compact() error {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if !ix.usable() || ix.file == nil {
+		return nil
+	}
+
+	records := make(map[string][]byte, len(ix.entries))
+	for k, entry := range ix.entries {
+		metaData := make([]byte, entry.length)
+		if _, err := ix.file.ReadAt(metaData, entry.offset); err != nil {
+			return errors.Wrap(err, "compactIndex: ReadAt")
+		}
+		records[k] = metaData
+	}
+	if err := ix.rewrite(records); err != nil {
+		ix.disabled = true
+		return err
+	}
+	return nil
+}
+
+// close syncs and closes the index file, marking it clean if every write reached it.
+func (ix *metadataIndex) close() {
+	if ix == nil {
+		return
+	}
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if ix.file == nil {
+		return
+	}
+	syncErr := ix.file.Sync()
+	closeErr := ix.file.Close()
+	ix.file = nil
+	if syncErr == nil && closeErr == nil && !ix.disabled {
+		_ = os.WriteFile(path.Join(ix.folder, indexCleanFilename), nil, fileMode)
+	}
+	ix.loaded = false
+	ix.dirty = false
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// readField reads a uvarint length followed by that many bytes.
+func (c *countingReader) readField() ([]byte, error) {
+	length, err := binary.ReadUvarint(c)
+	if err != nil {
+		return nil, err
+	}
+	field := make([]byte, length)
+	if _, err := io.ReadFull(c, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
@@ -0,0 +1,73 @@
+package persistence_test
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataIndex(t *testing.T) {
+	const folder = "TestMetadataIndex"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder, persistence.WithIndexFsOption())
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, fs.Write(k, kvstore.NewValueItem([]byte("value-"+k), time.Now())))
+	}
+	require.NoError(t, fs.Write("b", &kvstore.ValueItem{ContentType: "text/plain", Ts: time.Now()}))
+	require.NoError(t, fs.Delete("a"))
+
+	keys, err := fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, keys)
+	fs.Close()
+	_, err = os.Stat(path.Join(folder, ".index.clean"))
+	require.NoError(t, err)
+
+	// After a clean close, metadata is read from the index rather than the key folders.
+	require.NoError(t, os.Remove(path.Join(folder, "c", "metadata.json")))
+	fs = persistence.NewFsPersistence(folder, persistence.WithIndexFsOption())
+	keys, err = fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "c"}, keys)
+	item, err := fs.Read("b", false)
+	require.NoError(t, err)
+	require.Equal(t, "text/plain", item.ContentType)
+	_, err = fs.Read("c", false)
+	require.NoError(t, err)
+
+	// A folder that was not closed cleanly is re-indexed from the key folders.
+	require.NoError(t, fs.Write("d", kvstore.NewValueItem([]byte("value-d"), time.Now())))
+	fs = persistence.NewFsPersistence(folder, persistence.WithIndexFsOption())
+	keys, err = fs.Keys()
+	require.NoError(t, err)
+	require.Equal(t, []string{"b", "d"}, keys)
+
+	// Compact drops superseded records.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, fs.Write("d", kvstore.NewValueItem([]byte("value-d"), time.Now())))
+	}
+	before, err := os.Stat(path.Join(folder, ".index"))
+	require.NoError(t, err)
+	require.NoError(t, fs.Compact())
+	after, err := os.Stat(path.Join(folder, ".index"))
+	require.NoError(t, err)
+	require.Less(t, after.Size(), before.Size())
+	item, err = fs.Read("d", true)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-d"), item.Data)
+	fs.Close()
+
+	// The store starts from the index.
+	store, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder, persistence.WithIndexFsOption())))
+	require.NoError(t, err)
+	defer store.Close()
+	v, err := store.Get("d")
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-d"), v)
+}
@@ -0,0 +1,90 @@
+package persistence
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GCOptions configures what GC does with the expired keys it finds.
+type GCOptions struct {
+	// DryRun reports expired keys without deleting them.
+	DryRun bool
+
+	// Now is the time expiry is evaluated against. The zero value means the current time.
+	Now time.Time
+}
+
+// GCReport summarises a GC run.
+type GCReport struct {
+	Scanned int
+	Expired []string
+	Freed   int64 // Bytes held by the expired key folders.
+}
+
+// GC deletes the key folders of a filesystem persistence folder whose TTL has passed, reading only
+// their metadata, so dormant datasets can be cleaned up from cron without starting a Store.
+// Keys whose metadata cannot be read are left for Check. The store using the folder should not be running.
+func GC(folder string, options GCOptions) (GCReport, error) {
+	var report GCReport
+	now := options.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return report, errors.Wrap(err, "GC: ReadDir")
+	}
+	if !options.DryRun {
+		if err := invalidateIndex(folder); err != nil {
+			return report, errors.Wrap(err, "GC")
+		}
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		report.Scanned++
+		key := entry.Name()
+		keyFolder := path.Join(folder, key)
+
+		metaData, err := os.ReadFile(path.Join(keyFolder, metaDataFilename))
+		if err != nil {
+			continue
+		}
+		metadata, _, err := decodeMetadata(metaData)
+		if err != nil || !metadata.Expired(now) {
+			continue
+		}
+
+		report.Expired = append(report.Expired, key)
+		report.Freed += folderSize(keyFolder)
+		if options.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(keyFolder); err != nil {
+			return report, errors.Wrapf(err, "GC: RemoveAll %s", key)
+		}
+	}
+	return report, nil
+}
+
+// folderSize returns the total size of the files in a folder.
+func folderSize(folder string) int64 {
+	var size int64
+	_ = filepath.WalkDir(folder, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,200 @@
+package persistence
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// KeyCodec translates between the keys the store uses and the names a backend stores them under,
+// decoupling the keys users see from the backend's naming rules, such as S3 object keys, SQL
+// collations or filesystem restrictions.
+type KeyCodec interface {
+
+	// Encode returns the name key is stored under.
+	Encode(key string) string
+
+	// Decode returns the key stored under name, or an error if name was not produced by Encode.
+	Decode(name string) (string, error)
+}
+
+// base32Encoding is lower case and unpadded, so names only hold a-z and 2-7.
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Base32KeyCodec stores keys as lower case base32, which only uses a-z and 2-7, so keys that differ
+// only in case or hold characters a backend reserves, such as ':' on Windows filesystems, are
+// stored under distinct, portable names. Names are about 60% longer than the keys.
+type Base32KeyCodec struct{}
+
+// Encode returns the lower case base32 encoding of key.
+func (Base32KeyCodec) Encode(key string) string {
+	return strings.ToLower(base32Encoding.EncodeToString([]byte(key)))
+}
+
+// Decode returns the key encoded in name.
+func (Base32KeyCodec) Decode(name string) (string, error) {
+	key, err := base32Encoding.DecodeString(strings.ToUpper(name))
+	if err != nil {
+		return "", errors.Wrapf(err, "Base32KeyCodec.Decode %q", name)
+	}
+	return string(key), nil
+}
+
+// EscapedKeyCodec stores keys with every byte other than ASCII letters, digits, '-' and '_'
+// percent-encoded, as in "tenant1%3Acaf%C3%A9", keeping names readable where the backend restricts
+// characters but not case.
+type EscapedKeyCodec struct{}
+
+// Encode returns key with reserved bytes percent-encoded.
+func (EscapedKeyCodec) Encode(key string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0xf])
+	}
+	return b.String()
+}
+
+// Decode returns the key escaped in name.
+func (EscapedKeyCodec) Decode(name string) (string, error) {
+	key, err := url.PathUnescape(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "EscapedKeyCodec.Decode %q", name)
+	}
+	return key, nil
+}
+
+// KeyCodecPersistence wraps another DataPersister, storing each key under the name given by a
+// KeyCodec and decoding the names it lists. Stored names that cannot be decoded are skipped by Keys.
+type KeyCodecPersistence struct {
+	wrapped
+	codec KeyCodec
+}
+
+// NewKeyCodecPersistence creates a wrapper around persister that stores keys under the names
+// given by codec. A persister's keys must always be stored with the same codec.
+//
+// Example:
+//
+//	p := NewKeyCodecPersistence(NewFsPersistence("./data"), Base32KeyCodec{})
+func NewKeyCodecPersistence(persister kvstore.DataPersister, codec KeyCodec) *KeyCodecPersistence {
+	return &KeyCodecPersistence{wrapped: wrapped{persister}, codec: codec}
+}
+
+// Write writes the item under the key's encoded name.
+func (k *KeyCodecPersistence) Write(key string, data *kvstore.ValueItem) error {
+	return k.persistence.Write(k.codec.Encode(key), data)
+}
+
+// WriteMulti writes the items under their encoded names, as a batch if the wrapped persister supports it.
+func (k *KeyCodecPersistence) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	bw, ok := k.persistence.(kvstore.BatchWriter)
+	if !ok {
+		for key, item := range items {
+			if err := k.Write(key, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	encoded := make(map[string]*kvstore.ValueItem, len(items))
+	for key, item := range items {
+		encoded[k.codec.Encode(key)] = item
+	}
+	return bw.WriteMulti(encoded)
+}
+
+// Patch patches the value stored under the key's encoded name, writing the whole item if the
+// wrapped persister cannot patch.
+func (k *KeyCodecPersistence) Patch(key string, offset int64, data []byte, item *kvstore.ValueItem) error {
+	if p, ok := k.persistence.(kvstore.Patcher); ok {
+		return p.Patch(k.codec.Encode(key), offset, data, item)
+	}
+	return k.Write(key, item)
+}
+
+// Read reads the item stored under the key's encoded name.
+func (k *KeyCodecPersistence) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	return k.persistence.Read(k.codec.Encode(key), readValue)
+}
+
+// ReadMulti reads several keys, as a batch if the wrapped persister supports it.
+func (k *KeyCodecPersistence) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	items := make(map[string]*kvstore.ValueItem, len(keys))
+	br, ok := k.persistence.(kvstore.BatchReader)
+	if !ok {
+		for _, key := range keys {
+			if item, err := k.Read(key, readValue); err == nil {
+				items[key] = item
+			}
+		}
+		return items, nil
+	}
+
+	names := make(map[string]string, len(keys))
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		name := k.codec.Encode(key)
+		names[name] = key
+		encoded = append(encoded, name)
+	}
+	read, err := br.ReadMulti(encoded, readValue)
+	if err != nil {
+		return nil, errors.Wrap(err, "KeyCodecPersistence.ReadMulti")
+	}
+	for name, item := range read {
+		items[names[name]] = item
+	}
+	return items, nil
+}
+
+// Delete removes the item stored under the key's encoded name.
+func (k *KeyCodecPersistence) Delete(key string) error {
+	return k.persistence.Delete(k.codec.Encode(key))
+}
+
+// DeleteMulti removes several keys, as a batch if the wrapped persister supports it.
+func (k *KeyCodecPersistence) DeleteMulti(keys []string) error {
+	encoded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		encoded = append(encoded, k.codec.Encode(key))
+	}
+	if bd, ok := k.persistence.(kvstore.BatchDeleter); ok {
+		return bd.DeleteMulti(encoded)
+	}
+	for _, name := range encoded {
+		if err := k.persistence.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the decoded keys held by the wrapped persister.
+func (k *KeyCodecPersistence) Keys() ([]string, error) {
+	names, err := k.persistence.Keys()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, err := k.codec.Decode(name)
+		if err != nil {
+			log.Warn().Msgf("KeyCodecPersistence.Keys skipping %s", err.Error())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
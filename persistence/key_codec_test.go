@@ -0,0 +1,61 @@
+package persistence_test
+
+import (
+	"os"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyCodecPersistence(t *testing.T) {
+	const folder = "TestKeyCodecPersistence"
+	defer os.RemoveAll(folder)
+	codec := persistence.Base32KeyCodec{}
+	newStore := func() *kvstore.Store {
+		s, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewKeyCodecPersistence(persistence.NewFsPersistence(folder), codec)))
+		require.NoError(t, err)
+		return s
+	}
+
+	s := newStore()
+	require.NoError(t, s.Set("tenant1:café", []byte("1")))
+	require.NoError(t, s.Set("Tenant1:café", []byte("2")))
+
+	// Keys differing only in case are stored under distinct encoded names.
+	_, err := os.Stat(path.Join(folder, codec.Encode("tenant1:café")))
+	require.NoError(t, err)
+	_, err = os.Stat(path.Join(folder, codec.Encode("Tenant1:café")))
+	require.NoError(t, err)
+
+	// A restarted store lists and reads the decoded keys.
+	s = newStore()
+	keys, err := s.Keys()
+	require.NoError(t, err)
+	sort.Strings(keys)
+	require.Equal(t, []string{"Tenant1:café", "tenant1:café"}, keys)
+	v, err := s.Get("tenant1:café")
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+}
+
+func TestKeyCodecs(t *testing.T) {
+	for _, codec := range []persistence.KeyCodec{persistence.Base32KeyCodec{}, persistence.EscapedKeyCodec{}} {
+		for _, key := range []string{"", "plain", "tenant1:orders/42", "café 数据", "100%"} {
+			name := codec.Encode(key)
+			require.Regexp(t, `^[A-Za-z0-9_%-]*$`, name)
+			decoded, err := codec.Decode(name)
+			require.NoError(t, err)
+			require.Equal(t, key, decoded)
+		}
+	}
+	require.Equal(t, "tenant1%3Acaf%C3%A9", persistence.EscapedKeyCodec{}.Encode("tenant1:café"))
+
+	_, err := persistence.Base32KeyCodec{}.Decode("not base32!")
+	require.Error(t, err)
+	_, err = persistence.EscapedKeyCodec{}.Decode("bad%zz")
+	require.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package persistence
+
+import "github.com/jrsteele09/go-kvstore/kvstore"
+
+// Router is a DataPersister that sends each key to one of several persisters, so one store can keep
+// different classes of data in different backends, such as images in object storage and everything
+// else on local disk. It is the router stores use for namespaces with their own persister; see
+// kvstore.Router.
+type Router = kvstore.Router
+
+// RouterOption configures a Router.
+type RouterOption = kvstore.RouterOption
+
+// WithPrefixRouterOption returns a RouterOption that sends keys starting with prefix to persister.
+// When several prefixes match a key the longest wins.
+//
+// Example:
+//
+//	NewRouter(local, WithPrefixRouterOption("images:", s3))
+func WithPrefixRouterOption(prefix string, persister kvstore.DataPersister) RouterOption {
+	return kvstore.WithPrefixRouterOption(prefix, persister)
+}
+
+// WithTagRouterOption returns a RouterOption that sends values whose metadata entry name equals value
+// to persister, as set with kvstore.WithMetaSetOption. Tag routes are checked before prefix routes,
+// in the order they were added.
+//
+// Example:
+//
+//	NewRouter(local, WithTagRouterOption("class", "archive", coldStorage))
+func WithTagRouterOption(name, value string, persister kvstore.DataPersister) RouterOption {
+	return kvstore.WithTagRouterOption(name, value, persister)
+}
+
+// NewRouter creates a Router that sends keys matching no route to fallback.
+func NewRouter(fallback kvstore.DataPersister, options ...RouterOption) *Router {
+	return kvstore.NewRouter(fallback, options...)
+}
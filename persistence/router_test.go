@@ -0,0 +1,59 @@
+package persistence_test
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouter(t *testing.T) {
+	const defaultFolder, imagesFolder, archiveFolder = "TestRouterDefault", "TestRouterImages", "TestRouterArchive"
+	defer func() {
+		os.RemoveAll(defaultFolder)
+		os.RemoveAll(imagesFolder)
+		os.RemoveAll(archiveFolder)
+	}()
+	local := persistence.NewFsPersistence(defaultFolder)
+	images := persistence.NewFsPersistence(imagesFolder)
+	archive := persistence.NewFsPersistence(archiveFolder)
+
+	router := persistence.NewRouter(local,
+		persistence.WithPrefixRouterOption("images:", images),
+		persistence.WithTagRouterOption("class", "archive", archive),
+	)
+	s, err := kvstore.New(kvstore.WithPersistenceOption(router))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("images:logo", []byte("png")))
+	require.NoError(t, s.Set("user:1", []byte("alice")))
+	require.NoError(t, s.Set("report:2023", []byte("old"), kvstore.WithMetaSetOption(map[string]string{"class": "archive"})))
+
+	keysOf := func(p kvstore.DataPersister) []string {
+		keys, err := p.Keys()
+		require.NoError(t, err)
+		sort.Strings(keys)
+		return keys
+	}
+	require.Equal(t, []string{"user:1"}, keysOf(local))
+	require.Equal(t, []string{"images:logo"}, keysOf(images))
+	require.Equal(t, []string{"report:2023"}, keysOf(archive))
+	require.Equal(t, []string{"images:logo", "report:2023", "user:1"}, keysOf(router))
+
+	reopened := persistence.NewRouter(local,
+		persistence.WithPrefixRouterOption("images:", images),
+		persistence.WithTagRouterOption("class", "archive", archive),
+	)
+	item, err := reopened.Read("report:2023", true)
+	require.NoError(t, err)
+	require.Equal(t, "old", string(item.Data))
+
+	require.NoError(t, s.Set("report:2023", []byte("current"), kvstore.WithMetaSetOption(map[string]string{"class": "hot"})))
+	require.Equal(t, []string{"report:2023", "user:1"}, keysOf(local))
+	require.Empty(t, keysOf(archive))
+
+	require.NoError(t, s.Delete("images:logo"))
+	require.Empty(t, keysOf(images))
+}
@@ -0,0 +1,172 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// MetadataSchemaVersion is the layout version of the metadata files written by Filesystem.
+// Files written before the version was recorded are version 1.
+//
+// Version history:
+//
+//	1: the original layout, where a TTL expires TTL seconds after the timestamp.
+//	2: the expiry deadline is recorded in expiresAt.
+const MetadataSchemaVersion = 2
+
+// schemaFilename records the schema version every metadata file in a folder was last migrated to,
+// so Migrate can skip scanning folders that are already current.
+const schemaFilename = ".schema"
+
+// ErrUnsupportedSchema returned when a metadata file was written by a newer version of the package
+// than this one, so it cannot be read without risking losing fields. The file is not corrupt, so it
+// does not wrap kvstore.ErrCorrupted.
+var ErrUnsupportedSchema error = errors.New("unsupported metadata schema version")
+
+// metadataMigration upgrades the fields of a metadata file by one schema version.
+type metadataMigration func(fields map[string]any) error
+
+// metadataMigrations upgrade metadata one version at a time: metadataMigrations[i] upgrades
+// version i+1 to version i+2. A format change adds a migration and increments MetadataSchemaVersion.
+var metadataMigrations = []metadataMigration{
+	migrateAbsoluteExpiry,
+}
+
+// decodeMetadata decodes a metadata file, upgrading it to the current schema version first if it is
+// older, and reports whether it was upgraded.
+func decodeMetadata(data []byte) (fsMetadata, bool, error) {
+	metadata := fsMetadata{ValueItem: &kvstore.ValueItem{}}
+
+	var header struct {
+		SchemaVersion int `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return metadata, false, errors.Wrapf(kvstore.ErrCorrupted, "Unmarshal metadata: %s", err.Error())
+	}
+	version := max(header.SchemaVersion, 1)
+	if version > MetadataSchemaVersion {
+		return metadata, false, errors.Wrapf(ErrUnsupportedSchema, "version %d, supported up to %d", version, MetadataSchemaVersion)
+	}
+
+	migrated := version < MetadataSchemaVersion
+	if migrated {
+		upgraded, err := migrateMetadata(data, version)
+		if err != nil {
+			return metadata, false, err
+		}
+		data = upgraded
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return metadata, false, errors.Wrapf(kvstore.ErrCorrupted, "Unmarshal metadata: %s", err.Error())
+	}
+	return metadata, migrated, nil
+}
+
+// migrateMetadata runs the migrations from version up to the current schema version over a metadata file.
+func migrateMetadata(data []byte, version int) ([]byte, error) {
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "Unmarshal metadata: %s", err.Error())
+	}
+
+	for v := version; v < MetadataSchemaVersion; v++ {
+		if err := metadataMigrations[v-1](fields); err != nil {
+			return nil, errors.Wrapf(kvstore.ErrCorrupted, "migrate metadata from version %d: %s", v, err.Error())
+		}
+	}
+	fields["schemaVersion"] = MetadataSchemaVersion
+
+	upgraded, err := json.Marshal(fields)
+	if err != nil {
+		return nil, errors.Wrap(err, "Marshal migrated metadata")
+	}
+	return upgraded, nil
+}
+
+// migrateAbsoluteExpiry records the expiry deadline of version 1 metadata, which expires TTL seconds after its timestamp.
+func migrateAbsoluteExpiry(fields map[string]any) error {
+	ttl, ok := fields["ttl"].(json.Number)
+	if !ok {
+		return nil
+	}
+	seconds, err := strconv.ParseInt(ttl.String(), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "ttl")
+	}
+	if expiresAt, ok := fields["expiresAt"].(string); seconds <= 0 || (ok && expiresAt != "") {
+		return nil
+	}
+
+	timestamp, _ := fields["timestamp"].(string)
+	ts, err := time.Parse(time.RFC3339Nano, timestamp)
+	if err != nil {
+		return errors.Wrap(err, "timestamp")
+	}
+	fields["expiresAt"] = ts.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano)
+	return nil
+}
+
+// Migrate rewrites every metadata file written with an older schema version in the current layout.
+// Files are otherwise upgraded as they are read and rewritten on the key's next write, so migrating
+// is only needed before the folder is read by tools that expect the current layout. The store calls
+// Migrate on startup unless it is read-only. Once a folder is migrated the version is recorded in it
+// and later calls return without scanning it; files copied in from older versions are still
+// upgraded as they are read.
+func (fs Filesystem) Migrate() error {
+	if err := fs.lock.checkWritable(); err != nil {
+		return errors.Wrap(err, "Migrate")
+	}
+	if fs.schemaCurrent() {
+		return nil
+	}
+	keys, err := fs.Keys()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Migrate: Keys")
+	}
+	if err := fs.lock.lockWrite(); err != nil {
+		return errors.Wrap(err, "Migrate")
+	}
+	defer fs.lock.unlockWrite()
+
+	for _, k := range keys {
+		metaFile := path.Join(fs.folder, k, metaDataFilename)
+		data, err := os.ReadFile(metaFile)
+		if err != nil {
+			continue
+		}
+		metadata, migrated, err := decodeMetadata(data)
+		if err != nil || !migrated {
+			// Unreadable metadata is left for Check.
+			continue
+		}
+		if err := fs.putMetadata(k, metadata.ValueItem, metadata.Checksum); err != nil {
+			return errors.Wrapf(err, "Migrate: key %s", k)
+		}
+	}
+	marker := []byte(strconv.Itoa(MetadataSchemaVersion))
+	if err := os.WriteFile(path.Join(fs.folder, schemaFilename), marker, fileMode); err != nil {
+		return errors.Wrap(err, "Migrate: WriteFile schema")
+	}
+	return nil
+}
+
+// schemaCurrent reports whether the folder was last migrated to the current schema version.
+func (fs Filesystem) schemaCurrent() bool {
+	data, err := os.ReadFile(path.Join(fs.folder, schemaFilename))
+	if err != nil {
+		return false
+	}
+	version, err := strconv.Atoi(string(data))
+	return err == nil && version >= MetadataSchemaVersion
+}
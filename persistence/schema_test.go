@@ -0,0 +1,71 @@
+package persistence_test
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadataMigration(t *testing.T) {
+	const folder = "TestMetadataMigration"
+	defer os.RemoveAll(folder)
+
+	fs := persistence.NewFsPersistence(folder)
+	require.NoError(t, fs.Write("legacy", kvstore.NewValueItem([]byte("value"), time.Now())))
+	require.NoError(t, fs.Write("future", kvstore.NewValueItem([]byte("value"), time.Now())))
+
+	// A version 1 file records a TTL relative to its timestamp, and no schema version.
+	ts := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	legacy := `{"version":18446744073709551615,"timestamp":"2023-06-01T12:00:00Z","ttl":3153600000}`
+	require.NoError(t, os.WriteFile(path.Join(folder, "legacy", "metadata.json"), []byte(legacy), 0700))
+	require.NoError(t, os.WriteFile(path.Join(folder, "future", "metadata.json"), []byte(`{"schemaVersion":99}`), 0700))
+
+	item, err := fs.Read("legacy", true)
+	require.NoError(t, err)
+	expiresAt := ts.Add(3153600000 * time.Second)
+	require.Equal(t, expiresAt, item.ExpiresAt.UTC())
+	require.Equal(t, uint64(18446744073709551615), item.Version)
+	require.Equal(t, []byte("value"), item.Data)
+
+	_, err = fs.Read("future", false)
+	require.True(t, errors.Is(err, persistence.ErrUnsupportedSchema))
+	require.False(t, errors.Is(err, kvstore.ErrCorrupted))
+
+	// Check leaves metadata from a newer version alone.
+	report, err := persistence.Check(folder, persistence.CheckOptions{Fix: true})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+
+	// The store upgrades files on startup.
+	store, err := kvstore.New(kvstore.WithPersistenceOption(fs))
+	require.NoError(t, err)
+	store.Close()
+
+	data, err := os.ReadFile(path.Join(folder, "legacy", "metadata.json"))
+	require.NoError(t, err)
+	var fields map[string]any
+	require.NoError(t, json.Unmarshal(data, &fields))
+	require.Equal(t, float64(persistence.MetadataSchemaVersion), fields["schemaVersion"])
+	require.Equal(t, expiresAt.Format(time.RFC3339Nano), fields["expiresAt"])
+
+	data, err = os.ReadFile(path.Join(folder, "future", "metadata.json"))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"schemaVersion":99}`, string(data))
+
+	// Once migrated, the folder is not scanned again; older files are still upgraded when read.
+	require.NoError(t, os.WriteFile(path.Join(folder, "legacy", "metadata.json"), []byte(legacy), 0700))
+	require.NoError(t, fs.Migrate())
+	data, err = os.ReadFile(path.Join(folder, "legacy", "metadata.json"))
+	require.NoError(t, err)
+	require.Equal(t, legacy, string(data))
+	item, err = fs.Read("legacy", false)
+	require.NoError(t, err)
+	require.Equal(t, expiresAt, item.ExpiresAt.UTC())
+}
@@ -0,0 +1,256 @@
+package persistence
+
+import (
+	"strings"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// TransformEnvelope is the kvstore.ValueItem Envelope entry recording the transforms applied to a
+// value, in the order they were applied, as in "zstd,aes-gcm:v1,crc32c:8a9136aa".
+// It is only held by the wrapped persister and is removed from items returned by Read.
+const TransformEnvelope = "transforms"
+
+// Transformer is a stage of the pipeline run by Transformed, changing values on their way to the
+// wrapped persister and reversing the change when they are read back.
+type Transformer interface {
+
+	// Name identifies the transformer in the envelope of the values it transformed, so it must be
+	// unique within a pipeline, must not change once values are written and must not hold ',' or ':'.
+	Name() string
+
+	// Encode transforms data, the value of item as output by the previous stage, before it is written.
+	// It returns the transformed data and a parameter to record with it, such as the ID of the key
+	// that encrypted it, or ok false to leave the value as it is. The parameter must not hold ','.
+	Encode(key string, item *kvstore.ValueItem, data []byte) (encoded []byte, param string, ok bool, err error)
+
+	// Decode reverses Encode, given the parameter it recorded.
+	Decode(key, param string, data []byte) ([]byte, error)
+}
+
+// Transformed wraps another DataPersister, passing values through an ordered pipeline of
+// Transformers before they are written and through the same stages in reverse when they are read,
+// so that concerns such as compression, encryption and checksums compose without being built into
+// each backend. The stages applied to each value are recorded with it, so values written before a
+// stage was added are still read, though a stage cannot be removed while values hold it.
+type Transformed struct {
+	wrapped
+	transformers []Transformer
+	byName       map[string]Transformer
+}
+
+// NewTransformedPersistence creates a wrapper around persister that applies transformers in order
+// when writing. Stages that change the size of a value, such as compression, go before stages that
+// make it incompressible, such as encryption, and a checksum goes last to cover the stored bytes.
+//
+// Example:
+//
+//	compression, _ := NewCompressionTransformer(DefaultCompressionThreshold)
+//	encryption, _ := NewEncryptionTransformer(map[string][]byte{"v1": key}, "v1")
+//	p := NewTransformedPersistence(NewFsPersistence("./data"), compression, encryption, ChecksumTransformer{})
+func NewTransformedPersistence(persister kvstore.DataPersister, transformers ...Transformer) *Transformed {
+	t := &Transformed{
+		wrapped:      wrapped{persister},
+		transformers: transformers,
+		byName:       make(map[string]Transformer, len(transformers)),
+	}
+	for _, tr := range transformers {
+		t.byName[tr.Name()] = tr
+	}
+	return t
+}
+
+// Write transforms the item's data and writes it to the wrapped persister.
+func (t *Transformed) Write(key string, data *kvstore.ValueItem) error {
+	encoded, err := t.encode(key, data)
+	if err != nil {
+		return err
+	}
+	if err := t.persistence.Write(key, encoded); err != nil {
+		return errors.Wrap(err, "Transformed.Write")
+	}
+	return nil
+}
+
+// WriteMulti transforms every item and writes them as a batch if the wrapped persister supports it.
+func (t *Transformed) WriteMulti(items map[string]*kvstore.ValueItem) error {
+	bw, ok := t.persistence.(kvstore.BatchWriter)
+	if !ok {
+		for k, item := range items {
+			if err := t.Write(k, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	encoded := make(map[string]*kvstore.ValueItem, len(items))
+	for k, item := range items {
+		e, err := t.encode(k, item)
+		if err != nil {
+			return err
+		}
+		encoded[k] = e
+	}
+	if err := bw.WriteMulti(encoded); err != nil {
+		return errors.Wrap(err, "Transformed.WriteMulti")
+	}
+	return nil
+}
+
+// encode returns a copy of the item with its data passed through each stage and the stages applied
+// recorded in its envelope. Metadata-only writes keep the stages of the value already stored, as
+// that value is not rewritten.
+func (t *Transformed) encode(key string, data *kvstore.ValueItem) (*kvstore.ValueItem, error) {
+	encoded := withEnvelope(data)
+	if data.Data == nil {
+		if stored, err := t.persistence.Read(key, false); err == nil && stored.Envelope[TransformEnvelope] != "" {
+			encoded.Envelope[TransformEnvelope] = stored.Envelope[TransformEnvelope]
+		}
+		return encoded, nil
+	}
+
+	value := data.Data
+	applied := make([]string, 0, len(t.transformers))
+	for _, tr := range t.transformers {
+		out, param, ok, err := tr.Encode(key, data, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Transformed.Write key %s %s", key, tr.Name())
+		}
+		if !ok {
+			continue
+		}
+		value = out
+		stage := tr.Name()
+		if param != "" {
+			stage += ":" + param
+		}
+		applied = append(applied, stage)
+	}
+	encoded.Data = value
+	if len(applied) > 0 {
+		encoded.Envelope[TransformEnvelope] = strings.Join(applied, ",")
+	}
+	return encoded, nil
+}
+
+// Read reads an item from the wrapped persister, reversing its transforms if its data is requested.
+func (t *Transformed) Read(key string, readValue bool) (*kvstore.ValueItem, error) {
+	item, err := t.persistence.Read(key, readValue)
+	if err != nil {
+		return nil, err
+	}
+	return t.decode(key, item, readValue)
+}
+
+// ReadMulti reads several items from the wrapped persister, as a batch if it supports batch reads.
+// Items whose transforms cannot be reversed are omitted, as with items that cannot be read.
+func (t *Transformed) ReadMulti(keys []string, readValue bool) (map[string]*kvstore.ValueItem, error) {
+	br, ok := t.persistence.(kvstore.BatchReader)
+	if !ok {
+		items := make(map[string]*kvstore.ValueItem, len(keys))
+		for _, k := range keys {
+			if item, err := t.Read(k, readValue); err == nil {
+				items[k] = item
+			}
+		}
+		return items, nil
+	}
+
+	encoded, err := br.ReadMulti(keys, readValue)
+	if err != nil {
+		return nil, errors.Wrap(err, "Transformed.ReadMulti")
+	}
+	items := make(map[string]*kvstore.ValueItem, len(encoded))
+	for k, item := range encoded {
+		if decoded, err := t.decode(k, item, readValue); err == nil {
+			items[k] = decoded
+		}
+	}
+	return items, nil
+}
+
+// decode removes the stages from an item read from the wrapped persister and, if its data was read,
+// reverses them from last to first.
+func (t *Transformed) decode(key string, item *kvstore.ValueItem, readValue bool) (*kvstore.ValueItem, error) {
+	stages := takeEnvelope(item, TransformEnvelope)
+	if !readValue || stages == "" {
+		return item, nil
+	}
+
+	applied := strings.Split(stages, ",")
+	value := item.Data
+	for i := len(applied) - 1; i >= 0; i-- {
+		name, param, _ := strings.Cut(applied[i], ":")
+		tr, ok := t.byName[name]
+		if !ok {
+			return nil, errors.Wrapf(kvstore.ErrCorrupted, "Transformed.Read key %s: unknown transform %q", key, name)
+		}
+		var err error
+		if value, err = tr.Decode(key, param, value); err != nil {
+			return nil, errors.Wrap(err, "Transformed.Read")
+		}
+	}
+	if err := item.SetData(value); err != nil {
+		return nil, errors.Wrap(err, "Transformed.Read SetData")
+	}
+	return item, nil
+}
+
+// Delete removes the key from the wrapped persister.
+func (t *Transformed) Delete(key string) error {
+	return t.persistence.Delete(key)
+}
+
+// DeleteMulti removes several keys, as a batch if the wrapped persister supports it.
+func (t *Transformed) DeleteMulti(keys []string) error {
+	if bd, ok := t.persistence.(kvstore.BatchDeleter); ok {
+		return bd.DeleteMulti(keys)
+	}
+	for _, k := range keys {
+		if err := t.persistence.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys held by the wrapped persister.
+func (t *Transformed) Keys() ([]string, error) {
+	return t.persistence.Keys()
+}
+
+// Close closes the wrapped persister and the transformers that hold resources, such as a
+// CompressionTransformer.
+func (t *Transformed) Close() {
+	t.wrapped.Close()
+	for _, tr := range t.transformers {
+		if cl, ok := tr.(interface{ Close() }); ok {
+			cl.Close()
+		}
+	}
+}
+
+// ChecksumTransformer is a Transformer that records the CRC-32C of each value and fails reads of
+// values that no longer match it with kvstore.ErrCorrupted. Filesystem already checks its data
+// files, so it is for backends that do not, and goes last in a pipeline to cover the stored bytes.
+type ChecksumTransformer struct{}
+
+// Name returns "crc32c".
+func (ChecksumTransformer) Name() string {
+	return "crc32c"
+}
+
+// Encode returns data unchanged with its checksum as the parameter to record.
+func (ChecksumTransformer) Encode(_ string, _ *kvstore.ValueItem, data []byte) ([]byte, string, bool, error) {
+	return data, checksum(data), true, nil
+}
+
+// Decode returns data if it matches the recorded checksum.
+func (ChecksumTransformer) Decode(key, sum string, data []byte) ([]byte, error) {
+	if checksum(data) != sum {
+		return nil, errors.Wrapf(kvstore.ErrCorrupted, "ChecksumTransformer.Decode key %s: checksum mismatch", key)
+	}
+	return data, nil
+}
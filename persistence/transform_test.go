@@ -0,0 +1,75 @@
+package persistence_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransformedPipeline(t *testing.T) {
+	const folder = "TestTransformedPipeline"
+	defer os.RemoveAll(folder)
+	large := bytes.Repeat([]byte("compressible "), 100)
+
+	fs := persistence.NewFsPersistence(folder)
+	compression, err := persistence.NewCompressionTransformer(64)
+	require.NoError(t, err)
+	encryption, err := persistence.NewEncryptionTransformer(map[string][]byte{"v1": bytes.Repeat([]byte{1}, 32)}, "v1")
+	require.NoError(t, err)
+	p := persistence.NewTransformedPersistence(fs, compression, encryption, persistence.ChecksumTransformer{})
+	defer p.Close()
+	s, err := kvstore.New(kvstore.WithPersistenceOption(p))
+	require.NoError(t, err)
+	require.NoError(t, s.Set("large", large, kvstore.WithMetaSetOption(map[string]string{"owner": "a", "transforms": "user"})))
+	require.NoError(t, s.Set("small", []byte("tiny")))
+
+	// Stages that leave a value as it is are not recorded.
+	stored, err := fs.Read("large", true)
+	require.NoError(t, err)
+	require.Less(t, len(stored.Data), len(large))
+	stages := strings.Split(stored.Envelope[persistence.TransformEnvelope], ",")
+	require.Len(t, stages, 3)
+	require.Equal(t, "zstd", stages[0])
+	require.Equal(t, "aes-gcm:v1", stages[1])
+	require.True(t, strings.HasPrefix(stages[2], "crc32c:"))
+	stored, err = fs.Read("small", true)
+	require.NoError(t, err)
+	require.NotContains(t, string(stored.Data), "tiny")
+	require.False(t, strings.HasPrefix(stored.Envelope[persistence.TransformEnvelope], "zstd"))
+
+	item, err := p.Read("large", true)
+	require.NoError(t, err)
+	require.Equal(t, large, item.Data)
+	require.Equal(t, map[string]string{"owner": "a", "transforms": "user"}, item.Meta)
+
+	// Metadata-only writes keep the stages of the stored value.
+	require.NoError(t, p.Write("large", &kvstore.ValueItem{Ts: time.Now(), Meta: item.Meta}))
+	item, err = p.Read("large", true)
+	require.NoError(t, err)
+	require.Equal(t, large, item.Data)
+
+	// Values holding a stage the pipeline does not have cannot be read.
+	_, err = persistence.NewTransformedPersistence(fs, compression).Read("large", true)
+	require.True(t, errors.Is(err, kvstore.ErrCorrupted))
+}
+
+func TestChecksumTransformer(t *testing.T) {
+	var c persistence.ChecksumTransformer
+	data, sum, ok, err := c.Encode("key", nil, []byte("value"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "value", string(data))
+
+	data, err = c.Decode("key", sum, data)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(data))
+	_, err = c.Decode("key", sum, []byte("valve"))
+	require.True(t, errors.Is(err, kvstore.ErrCorrupted))
+}
@@ -0,0 +1,46 @@
+package persistence
+
+import "github.com/jrsteele09/go-kvstore/kvstore"
+
+// wrapped is embedded by persisters that wrap another, forwarding to it the optional operations
+// that pass straight through: Usage, Flush, Compact, Migrate and Close. Each is a no-op, or returns
+// kvstore.ErrUsageNotSupported, when the wrapped persister does not implement it.
+type wrapped struct {
+	persistence kvstore.DataPersister
+}
+
+// Usage returns the usage of the wrapped persister if it reports usage.
+func (w wrapped) Usage() (kvstore.Usage, error) {
+	return kvstore.UsageOf(w.persistence)
+}
+
+// Flush waits for the wrapped persister's queued writes if it queues them.
+func (w wrapped) Flush() error {
+	if f, ok := w.persistence.(kvstore.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Compact compacts the wrapped persister if it supports compaction.
+func (w wrapped) Compact() error {
+	if c, ok := w.persistence.(kvstore.Compactor); ok {
+		return c.Compact()
+	}
+	return nil
+}
+
+// Migrate upgrades the layout of the wrapped persister if it is versioned.
+func (w wrapped) Migrate() error {
+	if m, ok := w.persistence.(kvstore.Migrator); ok {
+		return m.Migrate()
+	}
+	return nil
+}
+
+// Close closes the wrapped persister if it holds resources.
+func (w wrapped) Close() {
+	if c, ok := w.persistence.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,298 @@
+// Package persistencetest provides a conformance suite for kvstore.DataPersister implementations,
+// so that third-party backends can check they behave like the persisters in the persistence package.
+package persistencetest
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/stretchr/testify/require"
+)
+
+// LargeValueSize is the size, in bytes, of the value written by the large value test.
+const LargeValueSize = 4 << 20
+
+// concurrentWorkers and concurrentKeys size the concurrent operations test.
+const (
+	concurrentWorkers = 8
+	concurrentKeys    = 25
+)
+
+// Run exercises a DataPersister with writes, reads, deletes and key listings, including edge cases
+// such as empty and large values, metadata-only writes and concurrent operations. The optional
+// BatchWriter, BatchReader and BatchDeleter interfaces are tested when implemented.
+// newPersister is called for each subtest and must return an empty persister; persisters that
+// implement Close are closed when the subtest ends. Persisters that queue writes are flushed before
+// their keys are listed.
+//
+// Example:
+//
+//	func TestConformance(t *testing.T) {
+//		persistencetest.Run(t, func() kvstore.DataPersister {
+//			return persistence.NewFsPersistence(t.TempDir())
+//		})
+//	}
+func Run(t *testing.T, newPersister func() kvstore.DataPersister) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, p kvstore.DataPersister)
+	}{
+		{"WriteRead", testWriteRead},
+		{"ReadMetadata", testReadMetadata},
+		{"ReadMissing", testReadMissing},
+		{"Overwrite", testOverwrite},
+		{"MetadataOnlyWrite", testMetadataOnlyWrite},
+		{"EmptyValue", testEmptyValue},
+		{"LargeValue", testLargeValue},
+		{"KeyCharacters", testKeyCharacters},
+		{"Delete", testDelete},
+		{"Keys", testKeys},
+		{"ConcurrentOperations", testConcurrentOperations},
+		{"BatchWriter", testBatchWriter},
+		{"BatchReader", testBatchReader},
+		{"BatchDeleter", testBatchDeleter},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPersister()
+			if c, ok := p.(interface{ Close() }); ok {
+				defer c.Close()
+			}
+			tt.test(t, p)
+		})
+	}
+}
+
+// newItem returns a ValueItem holding value with metadata set, as the store writes it.
+func newItem(value []byte) *kvstore.ValueItem {
+	item := kvstore.NewValueItem(value, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+	item.ContentType = "text/plain"
+	item.Meta = map[string]string{"owner": "conformance"}
+	item.Version = 7
+	item.TTL = 3600
+	item.ExpiresAt = item.Ts.Add(time.Hour)
+	return item
+}
+
+// requireMetadata checks that the metadata written with item was read back.
+func requireMetadata(t *testing.T, want, got *kvstore.ValueItem) {
+	t.Helper()
+	require.Equal(t, want.ContentType, got.ContentType)
+	require.Equal(t, want.Meta, got.Meta)
+	require.Equal(t, want.Version, got.Version)
+	require.Equal(t, want.TTL, got.TTL)
+	require.Equal(t, want.Size, got.Size)
+	require.True(t, want.Ts.Equal(got.Ts), "timestamp %s, want %s", got.Ts, want.Ts)
+	require.True(t, want.ExpiresAt.Equal(got.ExpiresAt), "expiry %s, want %s", got.ExpiresAt, want.ExpiresAt)
+}
+
+// listKeys flushes p if it queues writes and returns its keys in order.
+func listKeys(t *testing.T, p kvstore.DataPersister) []string {
+	t.Helper()
+	if f, ok := p.(kvstore.Flusher); ok {
+		require.NoError(t, f.Flush())
+	}
+	keys, err := p.Keys()
+	require.NoError(t, err)
+	sort.Strings(keys)
+	return keys
+}
+
+func testWriteRead(t *testing.T, p kvstore.DataPersister) {
+	item := newItem([]byte("value"))
+	require.NoError(t, p.Write("key", item))
+
+	got, err := p.Read("key", true)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(got.Data))
+	requireMetadata(t, item, got)
+}
+
+func testReadMetadata(t *testing.T, p kvstore.DataPersister) {
+	item := newItem([]byte("value"))
+	require.NoError(t, p.Write("key", item))
+
+	got, err := p.Read("key", false)
+	require.NoError(t, err)
+	requireMetadata(t, item, got)
+}
+
+func testReadMissing(t *testing.T, p kvstore.DataPersister) {
+	_, err := p.Read("missing", true)
+	require.Error(t, err)
+	_, err = p.Read("missing", false)
+	require.Error(t, err)
+}
+
+func testOverwrite(t *testing.T, p kvstore.DataPersister) {
+	require.NoError(t, p.Write("key", newItem([]byte("a longer first value"))))
+	item := newItem([]byte("second"))
+	item.Version = 8
+	require.NoError(t, p.Write("key", item))
+
+	got, err := p.Read("key", true)
+	require.NoError(t, err)
+	require.Equal(t, "second", string(got.Data))
+	requireMetadata(t, item, got)
+}
+
+// testMetadataOnlyWrite checks that writing an item without data, as the store does when the TTL of
+// an unloaded value changes, updates the metadata and keeps the stored value.
+func testMetadataOnlyWrite(t *testing.T, p kvstore.DataPersister) {
+	require.NoError(t, p.Write("key", newItem([]byte("value"))))
+	item := newItem(nil)
+	item.Data = nil
+	item.Size = int64(len("value"))
+	item.TTL = 60
+	require.NoError(t, p.Write("key", item))
+
+	got, err := p.Read("key", true)
+	require.NoError(t, err)
+	require.Equal(t, "value", string(got.Data))
+	require.Equal(t, kvstore.TTLType(60), got.TTL)
+}
+
+func testEmptyValue(t *testing.T, p kvstore.DataPersister) {
+	require.NoError(t, p.Write("key", newItem([]byte{})))
+
+	got, err := p.Read("key", true)
+	require.NoError(t, err)
+	require.Empty(t, got.Data)
+	require.Equal(t, int64(0), got.Size)
+}
+
+func testLargeValue(t *testing.T, p kvstore.DataPersister) {
+	value := bytes.Repeat([]byte("0123456789abcdef"), LargeValueSize/16)
+	require.NoError(t, p.Write("key", newItem(value)))
+
+	got, err := p.Read("key", true)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(value, got.Data), "large value was not read back intact")
+}
+
+// testKeyCharacters checks keys with the characters the store allows, such as namespace separators
+// and non-ASCII letters.
+func testKeyCharacters(t *testing.T, p kvstore.DataPersister) {
+	keys := []string{"tenant1:orders:42", "user.name-1_2", "café", "数据"}
+	for _, k := range keys {
+		require.NoError(t, p.Write(k, newItem([]byte(k))))
+	}
+	for _, k := range keys {
+		got, err := p.Read(k, true)
+		require.NoError(t, err, k)
+		require.Equal(t, k, string(got.Data))
+	}
+	sort.Strings(keys)
+	require.Equal(t, keys, listKeys(t, p))
+}
+
+func testDelete(t *testing.T, p kvstore.DataPersister) {
+	require.NoError(t, p.Write("key", newItem([]byte("value"))))
+	require.NoError(t, p.Delete("key"))
+	_, err := p.Read("key", true)
+	require.Error(t, err)
+	require.Empty(t, listKeys(t, p))
+
+	// Deleting a key that does not exist is not an error.
+	require.NoError(t, p.Delete("missing"))
+}
+
+func testKeys(t *testing.T, p kvstore.DataPersister) {
+	require.Empty(t, listKeys(t, p))
+	for _, k := range []string{"c", "a", "b"} {
+		require.NoError(t, p.Write(k, newItem([]byte(k))))
+	}
+	require.NoError(t, p.Delete("b"))
+	require.Equal(t, []string{"a", "c"}, listKeys(t, p))
+}
+
+func testConcurrentOperations(t *testing.T, p kvstore.DataPersister) {
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrentWorkers)
+	for w := 0; w < concurrentWorkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < concurrentKeys; i++ {
+				key := fmt.Sprintf("worker%d:%d", w, i)
+				if err := p.Write(key, newItem([]byte(key))); err != nil {
+					errs <- err
+					return
+				}
+				got, err := p.Read(key, true)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if string(got.Data) != key {
+					errs <- fmt.Errorf("read %q for key %s", got.Data, key)
+					return
+				}
+				if i%2 == 1 {
+					if err := p.Delete(key); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Len(t, listKeys(t, p), concurrentWorkers*(concurrentKeys+1)/2)
+}
+
+func testBatchWriter(t *testing.T, p kvstore.DataPersister) {
+	bw, ok := p.(kvstore.BatchWriter)
+	if !ok {
+		t.Skip("persister does not implement kvstore.BatchWriter")
+	}
+	items := map[string]*kvstore.ValueItem{"a": newItem([]byte("1")), "b": newItem([]byte("2"))}
+	require.NoError(t, bw.WriteMulti(items))
+	for k, item := range items {
+		got, err := p.Read(k, true)
+		require.NoError(t, err)
+		require.Equal(t, string(item.Data), string(got.Data))
+	}
+}
+
+func testBatchReader(t *testing.T, p kvstore.DataPersister) {
+	br, ok := p.(kvstore.BatchReader)
+	if !ok {
+		t.Skip("persister does not implement kvstore.BatchReader")
+	}
+	require.NoError(t, p.Write("a", newItem([]byte("1"))))
+	require.NoError(t, p.Write("b", newItem([]byte("2"))))
+
+	// Keys that cannot be read are omitted.
+	items, err := br.ReadMulti([]string{"a", "b", "missing"}, true)
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+	require.Equal(t, "1", string(items["a"].Data))
+	require.Equal(t, "2", string(items["b"].Data))
+
+	items, err = br.ReadMulti([]string{"a"}, false)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	requireMetadata(t, newItem([]byte("1")), items["a"])
+}
+
+func testBatchDeleter(t *testing.T, p kvstore.DataPersister) {
+	bd, ok := p.(kvstore.BatchDeleter)
+	if !ok {
+		t.Skip("persister does not implement kvstore.BatchDeleter")
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		require.NoError(t, p.Write(k, newItem([]byte(k))))
+	}
+	require.NoError(t, bd.DeleteMulti([]string{"a", "c", "missing"}))
+	require.Equal(t, []string{"b"}, listKeys(t, p))
+}
@@ -0,0 +1,88 @@
+package persistencetest_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/jrsteele09/go-kvstore/persistencetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesystem(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewFsPersistence(t.TempDir())
+	})
+}
+
+func TestFilesystemWithIndex(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewFsPersistence(t.TempDir(), persistence.WithIndexFsOption())
+	})
+}
+
+func TestBuffer(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewPersistenceBuffer(persistence.NewFsPersistence(t.TempDir()), 100, persistence.WithWorkersOption(4))
+	})
+}
+
+func TestCompressed(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		c, err := persistence.NewCompressedPersistence(persistence.NewFsPersistence(t.TempDir()))
+		require.NoError(t, err)
+		return c
+	})
+}
+
+func TestEncrypted(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		keys := map[string][]byte{"v1": bytes.Repeat([]byte{1}, 32)}
+		e, err := persistence.NewEncryptedPersistence(persistence.NewFsPersistence(t.TempDir()), keys, "v1")
+		require.NoError(t, err)
+		return e
+	})
+}
+
+func TestBase32KeyCodec(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewKeyCodecPersistence(persistence.NewFsPersistence(t.TempDir()), persistence.Base32KeyCodec{})
+	})
+}
+
+func TestEscapedKeyCodec(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewKeyCodecPersistence(persistence.NewFsPersistence(t.TempDir()), persistence.EscapedKeyCodec{})
+	})
+}
+
+func TestTransformed(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		compression, err := persistence.NewCompressionTransformer(0)
+		require.NoError(t, err)
+		encryption, err := persistence.NewEncryptionTransformer(map[string][]byte{"v1": bytes.Repeat([]byte{1}, 32)}, "v1")
+		require.NoError(t, err)
+		return persistence.NewTransformedPersistence(persistence.NewFsPersistence(t.TempDir()), compression, encryption, persistence.ChecksumTransformer{})
+	})
+}
+
+func TestDeduplicated(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewDeduplicatedPersistence(persistence.NewFsPersistence(t.TempDir()))
+	})
+}
+
+func TestDiskCache(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		c, err := persistence.NewDiskCache(persistence.NewFsPersistence(t.TempDir()), persistence.NewFsPersistence(t.TempDir()), 1<<20)
+		require.NoError(t, err)
+		return c
+	})
+}
+
+func TestDelta(t *testing.T) {
+	persistencetest.Run(t, func() kvstore.DataPersister {
+		return persistence.NewDeltaPersistence(persistence.NewFsPersistence(t.TempDir()), persistence.WithThresholdDeltaOption(1))
+	})
+}
@@ -0,0 +1,46 @@
+package respserver
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+)
+
+// WithTokenOption returns a ServerOption that accepts an API token, sent with "AUTH <token>" or
+// "AUTH <username> <token>", and serves the connection's commands as identity. Scope the identity to
+// namespaces by granting it permissions on the store's ACL. Once any authentication is configured,
+// commands other than AUTH, PING and QUIT are rejected until the client authenticates.
+//
+// Example:
+//
+//	respserver.New(store, respserver.WithTokenOption(os.Getenv("BILLING_TOKEN"), "billing-service"))
+func WithTokenOption(token, identity string) ServerOption {
+	return func(s *Server) {
+		s.tokens[sha256.Sum256([]byte(token))] = identity
+	}
+}
+
+// WithClientCertAuthOption returns a ServerOption that accepts verified TLS client certificates,
+// serving the connection's commands as the certificate's subject common name. The TLS configuration
+// must request and verify client certificates for mutual TLS.
+//
+// Example:
+//
+//	respserver.New(store, respserver.WithTLSOption(config), respserver.WithClientCertAuthOption())
+func WithClientCertAuthOption() ServerOption {
+	return func(s *Server) {
+		s.clientCertAuth = true
+	}
+}
+
+// WithTLSOption returns a ServerOption that serves connections over TLS with config, such as the
+// configuration returned by httpserver.Server.TLSConfig, which reloads renewed certificates.
+//
+// Example:
+//
+//	config, _ := httpserver.New(store, httpserver.WithTLSOption(cert, key)).TLSConfig()
+//	respserver.New(store, respserver.WithTLSOption(config))
+func WithTLSOption(config *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
@@ -0,0 +1,227 @@
+package respserver
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// execute runs a command and writes its reply, returning true if the client asked to quit.
+func (s *Server) execute(sess *session, args []string) bool {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			writeBulk(sess.w, []byte(args[1]))
+		} else {
+			writeSimple(sess.w, "PONG")
+		}
+		return false
+	case "QUIT":
+		writeSimple(sess.w, "OK")
+		return true
+	case "AUTH":
+		s.auth(sess, args)
+		return false
+	}
+
+	if sess.caller == nil {
+		writeError(sess.w, "NOAUTH Authentication required.")
+		return false
+	}
+	if !s.allow(sess) {
+		return false
+	}
+	handler, ok := commands[name]
+	if !ok {
+		writeError(sess.w, "ERR unknown command '"+args[0]+"'")
+		return false
+	}
+	if len(args) < handler.minArgs {
+		writeError(sess.w, "ERR wrong number of arguments for '"+strings.ToLower(name)+"' command")
+		return false
+	}
+	handler.run(sess, args[1:])
+	return false
+}
+
+// auth authenticates the connection with an API token, taken from the last argument so that both
+// "AUTH <token>" and "AUTH <username> <token>" are accepted.
+func (s *Server) auth(sess *session, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		writeError(sess.w, "ERR wrong number of arguments for 'auth' command")
+		return
+	}
+	if len(s.tokens) == 0 {
+		writeError(sess.w, "ERR AUTH called without any password configured")
+		return
+	}
+	identity, ok := s.authenticate(args[len(args)-1])
+	if !ok {
+		writeError(sess.w, "WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	sess.identity = identity
+	sess.caller = s.store.As(identity)
+	writeSimple(sess.w, "OK")
+}
+
+// command is a command run on behalf of an authenticated caller, with its arguments after the name.
+type command struct {
+	minArgs int // Including the command name.
+	run     func(sess *session, args []string)
+}
+
+var commands = map[string]command{
+	"GET":    {2, get},
+	"SET":    {3, set},
+	"DEL":    {2, del},
+	"EXISTS": {2, exists},
+	"EXPIRE": {3, expire},
+	"TTL":    {2, ttl},
+	"KEYS":   {2, keys},
+}
+
+// get replies with a key's value, or null if it does not exist.
+func get(sess *session, args []string) {
+	value, err := sess.caller.Get(args[0])
+	if errors.Is(err, kvstore.ErrNotFound) {
+		writeNull(sess.w)
+		return
+	} else if err != nil {
+		writeStoreError(sess, err)
+		return
+	}
+	writeBulk(sess.w, value)
+}
+
+// set stores a value, with a time-to-live if EX seconds or PX milliseconds follow it.
+func set(sess *session, args []string) {
+	var options []kvstore.SetOption
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			writeError(sess.w, "ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			writeError(sess.w, "ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "EX":
+			options = append(options, kvstore.WithTTLSetOption(time.Duration(n)*time.Second))
+		case "PX":
+			options = append(options, kvstore.WithTTLSetOption(time.Duration(n)*time.Millisecond))
+		default:
+			writeError(sess.w, "ERR syntax error")
+			return
+		}
+	}
+	if err := sess.caller.Set(args[0], []byte(args[1]), options...); err != nil {
+		writeStoreError(sess, err)
+		return
+	}
+	writeSimple(sess.w, "OK")
+}
+
+// del deletes keys, replying with the number that existed.
+func del(sess *session, args []string) {
+	deleted := int64(0)
+	for _, k := range args {
+		err := sess.caller.Delete(k)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			continue
+		} else if err != nil {
+			writeStoreError(sess, err)
+			return
+		}
+		deleted++
+	}
+	writeInt(sess.w, deleted)
+}
+
+// exists replies with the number of the keys that exist.
+func exists(sess *session, args []string) {
+	found := int64(0)
+	for _, k := range args {
+		_, err := sess.caller.GetMetadata(k)
+		if errors.Is(err, kvstore.ErrNotFound) {
+			continue
+		} else if err != nil {
+			writeStoreError(sess, err)
+			return
+		}
+		found++
+	}
+	writeInt(sess.w, found)
+}
+
+// expire sets a key's time-to-live in seconds, replying 1, or 0 if the key does not exist.
+func expire(sess *session, args []string) {
+	seconds, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		writeError(sess.w, "ERR value is not an integer or out of range")
+		return
+	}
+	err = sess.caller.SetTTL(args[0], seconds)
+	if errors.Is(err, kvstore.ErrNotFound) {
+		writeInt(sess.w, 0)
+		return
+	} else if err != nil {
+		writeStoreError(sess, err)
+		return
+	}
+	writeInt(sess.w, 1)
+}
+
+// ttl replies with a key's remaining time-to-live in seconds, -1 if it has none or -2 if it does not exist.
+func ttl(sess *session, args []string) {
+	remaining, err := sess.caller.TTL(args[0])
+	if err != nil {
+		writeStoreError(sess, err)
+		return
+	}
+	writeInt(sess.w, int64(remaining))
+}
+
+// keys replies with the keys the caller may read that match a glob pattern, as matched by path.Match.
+func keys(sess *session, args []string) {
+	all, err := sess.caller.Keys()
+	if err != nil {
+		writeStoreError(sess, err)
+		return
+	}
+	matched := make([]string, 0, len(all))
+	for _, k := range all {
+		if ok, err := path.Match(args[0], k); err != nil {
+			writeError(sess.w, "ERR invalid pattern")
+			return
+		} else if ok {
+			matched = append(matched, k)
+		}
+	}
+	writeArray(sess.w, matched)
+}
+
+// writeStoreError maps store errors to RESP error codes.
+func writeStoreError(sess *session, err error) {
+	switch {
+	case errors.Is(err, kvstore.ErrPermissionDenied):
+		writeError(sess.w, "NOPERM "+err.Error())
+	case errors.Is(err, kvstore.ErrReadOnly):
+		writeError(sess.w, "READONLY You can't write against a read only store.")
+	case errors.Is(err, kvstore.ErrWrongType):
+		writeError(sess.w, "WRONGTYPE Operation against a key holding the wrong kind of value")
+	case errors.Is(err, kvstore.ErrKeyInvalid):
+		writeError(sess.w, "ERR "+err.Error())
+	default:
+		log.Error().Msgf("[kvstore respserver] error: %s", err.Error())
+		writeError(sess.w, "ERR internal error")
+	}
+}
@@ -0,0 +1,55 @@
+package respserver
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/limits"
+	"github.com/rs/zerolog/log"
+)
+
+// WithRateLimitOption returns a ServerOption that allows each client at most limit commands per window,
+// rejecting further commands with an error until the window ends. Commands are counted once the client
+// has authenticated, so AUTH, PING and QUIT never use a client's quota. Clients are identified by their
+// caller identity, or by IP address when no authentication is configured. Commands are counted with
+// window counters in counters, as described by limits.NewRateLimiter.
+//
+// Example:
+//
+//	counters, _ := kvstore.New()
+//	respserver.New(store, respserver.WithRateLimitOption(counters, 100, time.Second))
+func WithRateLimitOption(counters *kvstore.Store, limit int64, window time.Duration) ServerOption {
+	return func(s *Server) {
+		s.rateLimiter = limits.NewRateLimiter(counters, limit, window)
+	}
+}
+
+// WithMaxConnectionsOption returns a ServerOption that limits the number of simultaneous connections
+// served. Further connections wait until an existing one is closed, or until the server is closed.
+//
+// Example:
+//
+//	respserver.New(store, respserver.WithMaxConnectionsOption(1000))
+func WithMaxConnectionsOption(n int) ServerOption {
+	return func(s *Server) {
+		s.maxConnections = n
+	}
+}
+
+// allow counts a command from an authenticated client and reports whether it is within the rate
+// limit, writing the error reply if it is not.
+func (s *Server) allow(sess *session) bool {
+	client := sess.identity
+	if client == "" {
+		client = limits.RemoteIP(sess.remoteAddr)
+	}
+	allowed, retryAfter, err := s.rateLimiter.Allow(client)
+	if err != nil {
+		log.Error().Msgf("[kvstore respserver] error counting commands for %s error: %s", client, err.Error())
+	}
+	if !allowed {
+		writeError(sess.w, "ERR rate limit exceeded, retry in "+strconv.FormatInt(retryAfter, 10)+" seconds")
+	}
+	return allowed
+}
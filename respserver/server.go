@@ -0,0 +1,200 @@
+// Package respserver exposes a kvstore.Store over the Redis serialization protocol (RESP), so Redis
+// clients and redis-cli can read and write it.
+//
+// The server supports PING, AUTH, QUIT, GET, SET (with EX or PX), DEL, EXISTS, EXPIRE, TTL and KEYS.
+// Callers are identified by the authenticators configured on the Server and their commands are checked
+// against the store's ACL.
+package respserver
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/limits"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Server serves the RESP protocol for a store.
+type Server struct {
+	store          *kvstore.Store
+	tokens         map[[32]byte]string
+	clientCertAuth bool
+	tlsConfig      *tls.Config
+	rateLimiter    *limits.RateLimiter
+	maxConnections int
+	lock           sync.Mutex
+	listener       net.Listener
+	conns          map[net.Conn]struct{}
+	closed         bool
+	wg             sync.WaitGroup
+}
+
+// ServerOption is a type for functions that configure a Server.
+type ServerOption func(s *Server)
+
+// New creates a Server for store.
+func New(store *kvstore.Store, options ...ServerOption) *Server {
+	s := &Server{
+		store:  store,
+		tokens: make(map[[32]byte]string),
+		conns:  make(map[net.Conn]struct{}),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// ListenAndServe listens on addr and serves connections until Close is called, using TLS if configured.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Server.ListenAndServe Listen")
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln and serves each on its own goroutine until Close is called, waiting
+// for a connection to close before accepting another when the maximum number of connections is open.
+func (s *Server) Serve(ln net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		ln.Close()
+		return nil
+	}
+	if s.maxConnections > 0 {
+		ln = limits.NewListener(ln, s.maxConnections)
+	}
+	s.listener = ln
+	s.lock.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return errors.Wrap(err, "Server.Serve Accept")
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return nil
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops accepting connections, closes those open and waits for their commands to finish.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// track records an open connection, returning false if the server is closed.
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// session is the state of a client connection.
+type session struct {
+	r          *bufio.Reader
+	w          *bufio.Writer
+	remoteAddr string
+	identity   string
+	caller     *kvstore.ScopedStore // nil until the client authenticates.
+}
+
+// serveConn reads commands from a connection and writes their replies until the client quits or
+// the connection is closed.
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	sess := &session{r: bufio.NewReader(conn), w: bufio.NewWriter(conn), remoteAddr: conn.RemoteAddr().String()}
+	if identity, ok := s.identify(conn); ok {
+		sess.identity = identity
+		sess.caller = s.store.As(identity)
+	}
+	for {
+		args, err := readCommand(sess.r)
+		if err != nil {
+			var perr protocolError
+			if errors.As(err, &perr) {
+				writeError(sess.w, "ERR "+perr.Error())
+				_ = sess.w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.execute(sess, args)
+		if err := sess.w.Flush(); err != nil {
+			log.Debug().Msgf("[kvstore respserver] error writing reply: %s", err.Error())
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// identify returns the identity of a connection authenticated without AUTH: anonymous when no
+// authentication is configured, or the common name of a verified client certificate.
+func (s *Server) identify(conn net.Conn) (string, bool) {
+	if len(s.tokens) == 0 && !s.clientCertAuth {
+		return "", true
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !s.clientCertAuth || !ok {
+		return "", false
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", false
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) > 0 && len(state.VerifiedChains[0]) > 0 {
+		return state.VerifiedChains[0][0].Subject.CommonName, true
+	}
+	return "", false
+}
+
+// authenticate returns the identity of an API token sent with AUTH.
+func (s *Server) authenticate(token string) (string, bool) {
+	identity, ok := s.tokens[sha256.Sum256([]byte(token))]
+	return identity, ok
+}
@@ -0,0 +1,212 @@
+package respserver_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/respserver"
+	"github.com/stretchr/testify/require"
+)
+
+// client sends commands as RESP arrays and reads their replies, as Redis clients do.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func serve(t *testing.T, store *kvstore.Store, options ...respserver.ServerOption) *client {
+	return dial(t, listen(t, store, options...))
+}
+
+// listen serves store on a local port until the test ends, returning its address.
+func listen(t *testing.T, store *kvstore.Store, options ...respserver.ServerOption) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := respserver.New(store, options...)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		require.NoError(t, srv.Close())
+		require.NoError(t, <-done)
+	})
+	return ln.Addr().String()
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply, with bulk strings and arrays flattened to their contents.
+func (c *client) do(args ...string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	require.NoError(c.t, err)
+	return c.reply()
+}
+
+func (c *client) reply() string {
+	line, err := c.r.ReadString('\n')
+	require.NoError(c.t, err)
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		require.NoError(c.t, err)
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		_, err = io.ReadFull(c.r, buf)
+		require.NoError(c.t, err)
+		return string(buf[:n])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		require.NoError(c.t, err)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.reply()
+		}
+		return strings.Join(items, ",")
+	default:
+		return line
+	}
+}
+
+func TestCommands(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	c := serve(t, store)
+
+	require.Equal(t, "+PONG", c.do("PING"))
+	require.Equal(t, "+OK", c.do("SET", "greeting", "hello world"))
+	require.Equal(t, "hello world", c.do("GET", "greeting"))
+	require.Equal(t, "(nil)", c.do("GET", "missing"))
+	require.Equal(t, ":-1", c.do("TTL", "greeting"))
+	require.Equal(t, ":1", c.do("EXPIRE", "greeting", "60"))
+	require.Equal(t, ":60", c.do("TTL", "greeting"))
+	require.Equal(t, "+OK", c.do("set", "session", "x", "EX", "30"))
+	require.Equal(t, ":30", c.do("TTL", "session"))
+	require.Equal(t, ":2", c.do("EXISTS", "greeting", "session", "missing"))
+	require.Equal(t, "session", c.do("KEYS", "sess*"))
+	require.Equal(t, ":1", c.do("DEL", "greeting", "missing"))
+	require.Equal(t, ":-2", c.do("TTL", "greeting"))
+	require.Equal(t, "-ERR unknown command 'FLUSHALL'", c.do("FLUSHALL"))
+	require.Equal(t, "-ERR wrong number of arguments for 'get' command", c.do("GET"))
+
+	_, err = c.conn.Write([]byte("PING\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "+PONG", c.reply())
+	require.Equal(t, "+OK", c.do("QUIT"))
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	acl := kvstore.NewACL()
+	acl.Grant("tenant1-app", "tenant1", kvstore.PermWrite)
+	store, err := kvstore.New(kvstore.WithACLOption(acl))
+	require.NoError(t, err)
+	require.NoError(t, store.Set("tenant2:doc", []byte("other")))
+	c := serve(t, store, respserver.WithTokenOption("secret1", "tenant1-app"))
+
+	require.Equal(t, "+PONG", c.do("PING"))
+	require.Equal(t, "-NOAUTH Authentication required.", c.do("GET", "tenant1:doc"))
+	require.True(t, strings.HasPrefix(c.do("AUTH", "wrong"), "-WRONGPASS"))
+	require.Equal(t, "-NOAUTH Authentication required.", c.do("SET", "tenant1:doc", "value"))
+
+	require.Equal(t, "+OK", c.do("AUTH", "default", "secret1"))
+	require.Equal(t, "+OK", c.do("SET", "tenant1:doc", "value"))
+	require.Equal(t, "value", c.do("GET", "tenant1:doc"))
+	require.True(t, strings.HasPrefix(c.do("GET", "tenant2:doc"), "-NOPERM"))
+	require.True(t, strings.HasPrefix(c.do("SET", "tenant2:doc", "mine"), "-NOPERM"))
+	require.Equal(t, "tenant1:doc", c.do("KEYS", "*"))
+}
+
+func TestRateLimit(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	now := time.Date(2023, 1, 1, 10, 0, 0, 0, time.UTC)
+	var lock sync.Mutex
+	counters, err := kvstore.New(kvstore.WithNowFuncOption(func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}))
+	require.NoError(t, err)
+	addr := listen(t, store,
+		respserver.WithTokenOption("a", "client-a"),
+		respserver.WithTokenOption("b", "client-b"),
+		respserver.WithRateLimitOption(counters, 2, time.Minute),
+	)
+	a, b := dial(t, addr), dial(t, addr)
+
+	// Commands are counted once authenticated, so AUTH and rejected commands never use the quota.
+	require.True(t, strings.HasPrefix(a.do("AUTH", "wrong"), "-WRONGPASS"))
+	require.Equal(t, "-NOAUTH Authentication required.", a.do("GET", "k"))
+	require.Equal(t, "+OK", a.do("AUTH", "a"))
+	require.Equal(t, "+OK", b.do("AUTH", "b"))
+
+	require.Equal(t, "(nil)", a.do("GET", "k"))
+	require.Equal(t, "(nil)", a.do("GET", "k"))
+	require.Equal(t, "-ERR rate limit exceeded, retry in 60 seconds", a.do("GET", "k"))
+	require.Equal(t, "+PONG", a.do("PING"))
+	require.Equal(t, "(nil)", b.do("GET", "k"))
+
+	lock.Lock()
+	now = now.Add(time.Minute)
+	lock.Unlock()
+	require.Equal(t, "(nil)", a.do("GET", "k"))
+}
+
+func TestRateLimitExpiresIdleClients(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	counters, err := kvstore.New()
+	require.NoError(t, err)
+	defer counters.Close()
+	c := serve(t, store, respserver.WithRateLimitOption(counters, 10, 50*time.Millisecond))
+
+	require.Equal(t, "(nil)", c.do("GET", "k"))
+	require.Equal(t, 1, counters.Stats().Keys)
+	require.Eventually(t, func() bool {
+		return counters.Stats().Keys == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMaxConnections(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	addr := listen(t, store, respserver.WithMaxConnectionsOption(1))
+
+	// The first connection holds the only slot, so the second is served once it closes.
+	first := dial(t, addr)
+	require.Equal(t, "+PONG", first.do("PING"))
+	second := dial(t, addr)
+	require.NoError(t, second.conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = second.conn.Write([]byte("PING\r\n"))
+	require.NoError(t, err)
+	_, err = second.r.ReadString('\n')
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+
+	require.Equal(t, "+OK", first.do("QUIT"))
+	require.NoError(t, second.conn.SetReadDeadline(time.Time{}))
+	require.Equal(t, "+PONG", second.reply())
+
+	// The second connection now holds the slot, so closing the server in the cleanup must release
+	// the Accept waiting for another.
+}
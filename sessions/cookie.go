@@ -0,0 +1,163 @@
+package sessions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// CookieSessions stores one opaque value per session for plain net/http applications. The session is
+// identified by a random ID in a cookie, which is unguessable and so needs no signing, and the value
+// expires from the store ttl after it was last saved.
+type CookieSessions struct {
+	store  *kvstore.Store
+	name   string
+	ttl    time.Duration
+	prefix string
+	secure bool
+}
+
+// CookieOption is a type for functions that configure CookieSessions.
+type CookieOption func(c *CookieSessions)
+
+// WithSecureCookieOption returns a CookieOption that only sends the session cookie over HTTPS.
+//
+// Example:
+//
+//	NewCookieSessions(store, "sid", time.Hour, WithSecureCookieOption())
+func WithSecureCookieOption() CookieOption {
+	return func(c *CookieSessions) {
+		c.secure = true
+	}
+}
+
+// WithKeyPrefixCookieOption returns a CookieOption that changes the prefix prepended to session IDs
+// to form their store keys, which is DefaultKeyPrefix by default.
+//
+// Example:
+//
+//	NewCookieSessions(store, "sid", time.Hour, WithKeyPrefixCookieOption("admin-session:"))
+func WithKeyPrefixCookieOption(prefix string) CookieOption {
+	return func(c *CookieSessions) {
+		c.prefix = prefix
+	}
+}
+
+// NewCookieSessions creates a session helper that uses the cookie called name and keeps sessions for ttl.
+func NewCookieSessions(store *kvstore.Store, name string, ttl time.Duration, options ...CookieOption) *CookieSessions {
+	c := &CookieSessions{
+		store:  store,
+		name:   name,
+		ttl:    ttl,
+		prefix: DefaultKeyPrefix,
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	return c
+}
+
+// Load returns the value of the request's session, or kvstore.ErrNotFound if it has none or it has expired.
+func (c *CookieSessions) Load(r *http.Request) ([]byte, error) {
+	id, ok := c.id(r)
+	if !ok {
+		return nil, kvstore.ErrNotFound
+	}
+	return c.store.Get(c.prefix + id)
+}
+
+// Save stores the value of the request's session and sets the session cookie so that its lifetime is
+// extended. A new session, under a freshly generated ID, is started if the request has no session
+// cookie or its session does not exist in the store, so an ID chosen by someone else, such as one
+// planted in the browser by an attacker, is never adopted.
+func (c *CookieSessions) Save(w http.ResponseWriter, r *http.Request, value []byte) error {
+	id, ok := c.id(r)
+	if ok {
+		if _, err := c.store.GetMetadata(c.prefix + id); errors.Is(err, kvstore.ErrNotFound) {
+			ok = false
+		} else if err != nil {
+			return errors.Wrap(err, "CookieSessions.Save GetMetadata")
+		}
+	}
+	if !ok {
+		return c.start(w, value)
+	}
+	if err := c.store.Set(c.prefix+id, value, kvstore.WithTTLSetOption(c.ttl)); err != nil {
+		return errors.Wrap(err, "CookieSessions.Save Set")
+	}
+	http.SetCookie(w, c.cookie(id, int(c.ttl.Seconds())))
+	return nil
+}
+
+// Rotate moves the request's session to a freshly generated ID, storing value under it and deleting
+// the old ID. Call it whenever the session's privileges change, such as on login or logout, so an
+// ID observed before the change cannot be used after it.
+//
+// Example:
+//
+//	err := cs.Rotate(w, r, []byte("user=alice"))
+func (c *CookieSessions) Rotate(w http.ResponseWriter, r *http.Request, value []byte) error {
+	if err := c.start(w, value); err != nil {
+		return errors.Wrap(err, "CookieSessions.Rotate")
+	}
+	if id, ok := c.id(r); ok {
+		if err := c.store.Delete(c.prefix + id); err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+			return errors.Wrap(err, "CookieSessions.Rotate Delete")
+		}
+	}
+	return nil
+}
+
+// start stores value under a new random session ID and sets the cookie carrying it.
+func (c *CookieSessions) start(w http.ResponseWriter, value []byte) error {
+	for {
+		id := base32RawStdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		created, err := c.store.SetNX(c.prefix+id, value, kvstore.WithTTLSetOption(c.ttl))
+		if err != nil {
+			return errors.Wrap(err, "CookieSessions.Save SetNX")
+		}
+		if created {
+			http.SetCookie(w, c.cookie(id, int(c.ttl.Seconds())))
+			return nil
+		}
+	}
+}
+
+// Destroy deletes the request's session and clears its cookie.
+func (c *CookieSessions) Destroy(w http.ResponseWriter, r *http.Request) error {
+	if id, ok := c.id(r); ok {
+		if err := c.store.Delete(c.prefix + id); err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+			return errors.Wrap(err, "CookieSessions.Destroy Delete")
+		}
+	}
+	http.SetCookie(w, c.cookie("", -1))
+	return nil
+}
+
+// id returns the session ID from the request's cookie.
+func (c *CookieSessions) id(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(c.name)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	if _, err := base32RawStdEncoding.DecodeString(cookie.Value); err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// cookie returns the session cookie carrying id.
+func (c *CookieSessions) cookie(id string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     c.name,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   c.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,108 @@
+package sessions_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/sessions"
+	"github.com/stretchr/testify/require"
+)
+
+// withCookies returns a request carrying the cookies set on a response.
+func withCookies(rec *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestGorillaStore(t *testing.T) {
+	kv, err := kvstore.New()
+	require.NoError(t, err)
+	defer kv.Close()
+	store := sessions.NewStore(kv, []byte("0123456789abcdef0123456789abcdef"))
+	store.MaxAge(60)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.Get(r, "app")
+	require.NoError(t, err)
+	require.True(t, session.IsNew)
+	session.Values["user"] = "alice"
+	rec := httptest.NewRecorder()
+	require.NoError(t, session.Save(r, rec))
+
+	keys, err := kv.QueryKeys(time.Time{}, time.Now(), kvstore.WithPrefixQueryOption(sessions.DefaultKeyPrefix))
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, kvstore.TTLType(60), kv.TTL(keys[0]))
+
+	loaded, err := store.New(withCookies(rec), "app")
+	require.NoError(t, err)
+	require.False(t, loaded.IsNew)
+	require.Equal(t, "alice", loaded.Values["user"])
+
+	loaded.Options.MaxAge = -1
+	require.NoError(t, store.Save(r, httptest.NewRecorder(), loaded))
+	_, err = kv.Get(keys[0])
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	expired, err := store.New(withCookies(rec), "app")
+	require.NoError(t, err)
+	require.True(t, expired.IsNew)
+}
+
+func TestCookieSessions(t *testing.T) {
+	kv, err := kvstore.New()
+	require.NoError(t, err)
+	defer kv.Close()
+	cs := sessions.NewCookieSessions(kv, "sid", time.Hour)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err = cs.Load(r)
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+
+	rec := httptest.NewRecorder()
+	require.NoError(t, cs.Save(rec, r, []byte("cart=3")))
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	require.True(t, cookies[0].HttpOnly)
+	require.Equal(t, 3600, cookies[0].MaxAge)
+
+	value, err := cs.Load(withCookies(rec))
+	require.NoError(t, err)
+	require.Equal(t, "cart=3", string(value))
+
+	rotated := httptest.NewRecorder()
+	require.NoError(t, cs.Rotate(rotated, withCookies(rec), []byte("cart=3;user=alice")))
+	require.NotEqual(t, cookies[0].Value, rotated.Result().Cookies()[0].Value)
+	_, err = cs.Load(withCookies(rec))
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+	value, err = cs.Load(withCookies(rotated))
+	require.NoError(t, err)
+	require.Equal(t, "cart=3;user=alice", string(value))
+
+	destroyed := httptest.NewRecorder()
+	require.NoError(t, cs.Destroy(destroyed, withCookies(rotated)))
+	_, err = cs.Load(withCookies(rotated))
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
+
+func TestCookieSessionsRejectUnknownID(t *testing.T) {
+	kv, err := kvstore.New()
+	require.NoError(t, err)
+	defer kv.Close()
+	cs := sessions.NewCookieSessions(kv, "sid", time.Hour)
+
+	planted := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "sid", Value: planted})
+	rec := httptest.NewRecorder()
+	require.NoError(t, cs.Save(rec, r, []byte("user=alice")))
+	require.NotEqual(t, planted, rec.Result().Cookies()[0].Value)
+	_, err = kv.Get(sessions.DefaultKeyPrefix + planted)
+	require.ErrorIs(t, err, kvstore.ErrNotFound)
+}
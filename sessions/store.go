@@ -0,0 +1,146 @@
+// Package sessions stores HTTP session data in a kvstore.Store, expiring it with the store's TTLs.
+// Store implements the gorilla/sessions Store interface, and CookieSessions is a plain net/http
+// helper for applications that don't use gorilla.
+package sessions
+
+import (
+	"encoding/base32"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+)
+
+// DefaultKeyPrefix is prepended to session IDs to form their store keys, placing them in the "session" namespace.
+const DefaultKeyPrefix = "session:"
+
+// defaultMaxAge is the lifetime of a session in seconds, matching gorilla/sessions.
+const defaultMaxAge = 86400 * 30
+
+var base32RawStdEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Store is a gorilla/sessions Store that keeps session values in a kvstore.Store. The cookie only
+// holds the signed session ID, and the values expire from the store when the session's MaxAge passes.
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // Default configuration for new sessions.
+	store   *kvstore.Store
+	prefix  string
+}
+
+// NewStore creates a session store backed by store. The key pairs sign, and optionally encrypt,
+// the session ID cookie, as described for gorilla/sessions.NewCookieStore.
+func NewStore(store *kvstore.Store, keyPairs ...[]byte) *Store {
+	s := &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:     "/",
+			MaxAge:   defaultMaxAge,
+			HttpOnly: true,
+		},
+		store:  store,
+		prefix: DefaultKeyPrefix,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// SetKeyPrefix changes the prefix prepended to session IDs to form their store keys.
+func (s *Store) SetKeyPrefix(prefix string) {
+	s.prefix = prefix
+}
+
+// MaxAge sets the lifetime in seconds of new sessions and of the signed ID cookies.
+func (s *Store) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// Get returns a session for the given name after adding it to the request's registry.
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry. The session is
+// loaded from the store if the request has a valid ID cookie for it, and is otherwise new.
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	if err := s.load(session); errors.Is(err, kvstore.ErrNotFound) {
+		session.ID = ""
+		return session, nil
+	} else if err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save writes the session's values to the store and sets its ID cookie. A session with a MaxAge of
+// zero or less is deleted from the store and its cookie is cleared.
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.store.Delete(s.prefix + session.ID); err != nil && !errors.Is(err, kvstore.ErrNotFound) {
+				return errors.Wrap(err, "sessions.Store.Save Delete")
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = base32RawStdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return errors.Wrap(err, "sessions.Store.Save EncodeMulti")
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// save writes the session's values to the store with a TTL of the session's MaxAge.
+func (s *Store) save(session *sessions.Session) error {
+	data, err := securecookie.GobEncoder{}.Serialize(session.Values)
+	if err != nil {
+		return errors.Wrap(err, "sessions.Store.save Serialize")
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err := s.store.Set(s.prefix+session.ID, data, kvstore.WithTTLSetOption(ttl)); err != nil {
+		return errors.Wrap(err, "sessions.Store.save Set")
+	}
+	return nil
+}
+
+// load reads the session's values from the store.
+func (s *Store) load(session *sessions.Session) error {
+	data, err := s.store.Get(s.prefix + session.ID)
+	if err != nil {
+		return err
+	}
+	if err := (securecookie.GobEncoder{}).Deserialize(data, &session.Values); err != nil {
+		return errors.Wrapf(kvstore.ErrCorrupted, "sessions.Store.load %s", err.Error())
+	}
+	return nil
+}
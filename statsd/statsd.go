@@ -0,0 +1,280 @@
+// Package statsd pushes a store's statistics to a StatsD agent, such as the Datadog agent, at a fixed
+// interval. Tags are sent with the DogStatsD extension, which plain StatsD servers ignore or reject,
+// so they are only sent when set, and only set them when the agent supports them:
+//
+//	sink, err := statsd.New(store, "127.0.0.1:8125", statsd.WithTagsOption("service:cache", "env:prod"))
+//	defer sink.Close()
+package statsd
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultInterval is how often statistics are pushed by default.
+const DefaultInterval = 10 * time.Second
+
+// DefaultPrefix is prepended to every metric name by default.
+const DefaultPrefix = "kvstore."
+
+// maxPacketSize keeps each datagram below a typical MTU so it is not fragmented.
+const maxPacketSize = 1432
+
+// Sink periodically pushes the statistics of a store to a StatsD agent over UDP.
+// Gauges, such as the number of keys, are always sent. Counters, such as hits, are sent as the change
+// since the last push and are subject to the sample rate. Per-persister metrics are tagged with the
+// persister's index when tags are set, and otherwise carry it in their name, as in
+// "kvstore.persister.0.writes".
+type Sink struct {
+	store      *kvstore.Store
+	conn       net.Conn
+	prefix     string
+	tags       []string
+	sampleRate float64
+	interval   time.Duration
+
+	lock     sync.Mutex
+	previous kvstore.Stats
+	random   *rand.Rand
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Option configures a Sink.
+type Option func(*Sink)
+
+// WithPrefixOption returns an Option that prepends prefix to every metric name instead of DefaultPrefix.
+//
+// Example:
+//
+//	statsd.New(store, addr, statsd.WithPrefixOption("sessions."))
+func WithPrefixOption(prefix string) Option {
+	return func(s *Sink) {
+		s.prefix = prefix
+	}
+}
+
+// WithTagsOption returns an Option that adds DogStatsD tags, such as "env:prod", to every metric.
+//
+// Example:
+//
+//	statsd.New(store, addr, statsd.WithTagsOption("service:cache", "env:prod"))
+func WithTagsOption(tags ...string) Option {
+	return func(s *Sink) {
+		s.tags = append(s.tags, tags...)
+	}
+}
+
+// WithSampleRateOption returns an Option that sends counters on only a fraction of pushes, between 0 and 1.
+// The agent scales sampled counters back up, trading accuracy for fewer packets.
+//
+// Example:
+//
+//	statsd.New(store, addr, statsd.WithSampleRateOption(0.1))
+func WithSampleRateOption(rate float64) Option {
+	return func(s *Sink) {
+		s.sampleRate = rate
+	}
+}
+
+// WithIntervalOption returns an Option that sets how often statistics are pushed.
+//
+// Example:
+//
+//	statsd.New(store, addr, statsd.WithIntervalOption(time.Minute))
+func WithIntervalOption(interval time.Duration) Option {
+	return func(s *Sink) {
+		s.interval = interval
+	}
+}
+
+// New creates a Sink that pushes the statistics of store to the StatsD agent listening on addr until it is closed.
+func New(store *kvstore.Store, addr string, options ...Option) (*Sink, error) {
+	s := &Sink{
+		store:      store,
+		prefix:     DefaultPrefix,
+		sampleRate: 1,
+		interval:   DefaultInterval,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	if s.sampleRate <= 0 || s.sampleRate > 1 {
+		return nil, errors.Errorf("statsd.New: sample rate %v must be greater than 0 and at most 1", s.sampleRate)
+	}
+	if s.interval <= 0 {
+		return nil, errors.Errorf("statsd.New: interval %v must be positive", s.interval)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "statsd.New: Dial")
+	}
+	s.conn = conn
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// run pushes statistics every interval until the sink is closed.
+func (s *Sink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(); err != nil {
+				log.Error().Msgf("[kvstore statsd] push error: %s", err.Error())
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Flush pushes the store's current statistics immediately.
+func (s *Sink) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	stats := s.store.Stats()
+	sampled := s.sampleRate >= 1 || s.random.Float64() < s.sampleRate
+
+	var lines []string
+	lines = append(lines,
+		s.gauge("keys", int64(stats.Keys)),
+		s.gauge("loaded_keys", int64(stats.LoadedKeys)),
+		s.gauge("loaded_bytes", stats.LoadedBytes),
+		s.gauge("total_bytes", stats.TotalBytes),
+	)
+	if sampled {
+		lines = append(lines,
+			s.count("hits", delta(stats.Hits, s.previous.Hits)),
+			s.count("misses", delta(stats.Misses, s.previous.Misses)),
+		)
+	}
+	for i, p := range stats.Persisters {
+		name, tags := s.persister(i)
+		var prev kvstore.PersisterStats
+		if i < len(s.previous.Persisters) {
+			prev = s.previous.Persisters[i]
+		}
+		lines = append(lines,
+			s.gauge(name+"queue_depth", int64(p.QueueDepth), tags...),
+			s.timing(name+"latency", p.AverageLatency, tags...),
+		)
+		if p.Usage != nil {
+			lines = append(lines,
+				s.gauge(name+"usage_bytes", p.Usage.Bytes, tags...),
+				s.gauge(name+"usage_keys", int64(p.Usage.Keys), tags...),
+			)
+		}
+		if sampled {
+			lines = append(lines,
+				s.count(name+"writes", delta(p.Writes, prev.Writes), tags...),
+				s.count(name+"reads", delta(p.Reads, prev.Reads), tags...),
+				s.count(name+"deletes", delta(p.Deletes, prev.Deletes), tags...),
+				s.count(name+"errors", delta(p.Errors, prev.Errors), tags...),
+			)
+		}
+	}
+
+	// Every push moves the baseline on, sampled or not, so the agent's scaling of sampled counts by
+	// the sample rate estimates the counts that were not sent rather than counting them again.
+	s.previous = stats
+	if err := s.send(lines); err != nil {
+		return errors.Wrap(err, "Sink.Flush")
+	}
+	return nil
+}
+
+// persister returns the prefix of the metric names of the ith persister and the tags to send with
+// them. Without tags, which plain StatsD does not support, the index goes in the name.
+func (s *Sink) persister(i int) (string, []string) {
+	if len(s.tags) == 0 {
+		return "persister." + strconv.Itoa(i) + ".", nil
+	}
+	return "persister.", []string{"persister:" + strconv.Itoa(i)}
+}
+
+// Close stops pushing statistics and closes the connection to the agent. Closing a closed sink does nothing.
+func (s *Sink) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+		_ = s.conn.Close()
+	})
+}
+
+// send writes lines to the agent, packing as many into each datagram as fit.
+func (s *Sink) send(lines []string) error {
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if _, err := s.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(packet.Bytes())
+	return err
+}
+
+// gauge formats a gauge metric.
+func (s *Sink) gauge(name string, value int64, tags ...string) string {
+	return s.format(name, strconv.FormatInt(value, 10), "g", 1, tags)
+}
+
+// count formats a counter metric at the sink's sample rate.
+func (s *Sink) count(name string, value int64, tags ...string) string {
+	return s.format(name, strconv.FormatInt(value, 10), "c", s.sampleRate, tags)
+}
+
+// timing formats a timing metric in milliseconds.
+func (s *Sink) timing(name string, d time.Duration, tags ...string) string {
+	return s.format(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", 1, tags)
+}
+
+// format returns a metric line in the StatsD protocol, with DogStatsD tags if there are any.
+func (s *Sink) format(name, value, kind string, rate float64, tags []string) string {
+	line := fmt.Sprintf("%s%s:%s|%s", s.prefix, name, value, kind)
+	if rate < 1 {
+		line += "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+	if all := append(append([]string{}, s.tags...), tags...); len(all) > 0 {
+		line += "|#" + strings.Join(all, ",")
+	}
+	return line
+}
+
+// delta returns the change in a cumulative counter, treating a decrease as a reset.
+func delta(current, previous uint64) int64 {
+	if current < previous {
+		return int64(current)
+	}
+	return int64(current - previous)
+}
@@ -0,0 +1,116 @@
+package statsd_test
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jrsteele09/go-kvstore/kvstore"
+	"github.com/jrsteele09/go-kvstore/persistence"
+	"github.com/jrsteele09/go-kvstore/statsd"
+	"github.com/stretchr/testify/require"
+)
+
+// receive reads one datagram from conn and returns its metric lines.
+func receive(t *testing.T, conn net.PacketConn) []string {
+	buf := make([]byte, 65536)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	return strings.Split(string(buf[:n]), "\n")
+}
+
+func TestSink(t *testing.T) {
+	folder := "./TestStatsdSink"
+	defer os.RemoveAll(folder)
+
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	store, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer store.Close()
+
+	sink, err := statsd.New(store, agent.LocalAddr().String(),
+		statsd.WithIntervalOption(time.Hour),
+		statsd.WithPrefixOption("cache."),
+		statsd.WithTagsOption("env:test"),
+	)
+	require.NoError(t, err)
+	defer sink.Close()
+
+	require.NoError(t, store.Set("a", []byte("one")))
+	_, err = store.Get("a")
+	require.NoError(t, err)
+	_, _ = store.Get("missing")
+
+	require.NoError(t, sink.Flush())
+	lines := receive(t, agent)
+	require.Contains(t, lines, "cache.keys:1|g|#env:test")
+	require.Contains(t, lines, "cache.hits:1|c|#env:test")
+	require.Contains(t, lines, "cache.persister.writes:1|c|#env:test,persister:0")
+
+	// Counters report the change since the previous push.
+	_, err = store.Get("a")
+	require.NoError(t, err)
+	require.NoError(t, sink.Flush())
+	lines = receive(t, agent)
+	require.Contains(t, lines, "cache.hits:1|c|#env:test")
+	require.Contains(t, lines, "cache.persister.writes:0|c|#env:test,persister:0")
+}
+
+func TestSinkSampleRate(t *testing.T) {
+	store, err := kvstore.New()
+	require.NoError(t, err)
+	defer store.Close()
+
+	_, err = statsd.New(store, "127.0.0.1:8125", statsd.WithSampleRateOption(0))
+	require.Error(t, err)
+
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	sink, err := statsd.New(store, agent.LocalAddr().String(), statsd.WithIntervalOption(time.Hour), statsd.WithSampleRateOption(0.999999))
+	require.NoError(t, err)
+	defer sink.Close()
+
+	require.NoError(t, sink.Flush())
+	lines := receive(t, agent)
+	require.Contains(t, lines, "kvstore.keys:0|g")
+	for _, line := range lines {
+		if strings.Contains(line, "|c") {
+			require.True(t, strings.HasSuffix(line, "|@0.999999"), line)
+		}
+	}
+
+	sink.Close()
+	sink.Close()
+}
+
+func TestSinkWithoutTags(t *testing.T) {
+	folder := "./TestStatsdSinkWithoutTags"
+	defer os.RemoveAll(folder)
+
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	store, err := kvstore.New(kvstore.WithPersistenceOption(persistence.NewFsPersistence(folder)))
+	require.NoError(t, err)
+	defer store.Close()
+	sink, err := statsd.New(store, agent.LocalAddr().String(), statsd.WithIntervalOption(time.Hour))
+	require.NoError(t, err)
+	defer sink.Close()
+
+	require.NoError(t, store.Set("a", []byte("one")))
+	require.NoError(t, sink.Flush())
+	lines := receive(t, agent)
+	require.Contains(t, lines, "kvstore.persister.0.writes:1|c")
+	for _, line := range lines {
+		require.NotContains(t, line, "|#")
+	}
+}